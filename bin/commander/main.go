@@ -29,6 +29,7 @@ var (
 func main() {
 	var (
 		svr    httpdown.Server
+		cmdr   *commander.Commander
 		db     gorm.DB
 		err    error
 		logger distillog.Logger
@@ -75,6 +76,11 @@ func main() {
 		logger.Infoln("Initializing commander server database")
 		reconnectDB()
 
+		cmdr = commander.New(&db, logger)
+		cmdr.SetCommanderPort(int(*ListenPort))
+		cmdr.ResumePendingChanges()
+		cmdr.Start()
+
 		// Start an http server with this radio app
 		logger.Infoln("Starting commander server on port", *ListenPort)
 		var err error
@@ -83,17 +89,24 @@ func main() {
 			KillTimeout: 5 * time.Second,
 		}.ListenAndServe(&http.Server{
 			Addr:    fmt.Sprintf("%s:%d", *ListenAddr, *ListenPort),
-			Handler: commander.New(&db, logger),
+			Handler: cmdr,
 		})
 		if err != nil {
 			die(fmt.Errorf("Failed to start http server: %s", err))
 		}
 	}
 
-	restartCommander := func() {
+	stopCommander := func() {
 		if svr != nil {
 			svr.Stop()
 		}
+		if cmdr != nil {
+			cmdr.Stop()
+		}
+	}
+
+	restartCommander := func() {
+		stopCommander()
 		startCommander()
 	}
 
@@ -109,7 +122,7 @@ func main() {
 				restartCommander()
 			case syscall.SIGINT, syscall.SIGTERM:
 				logger.Infoln("Received sig:", sig, "- terminating")
-				svr.Stop()
+				stopCommander()
 				return
 			}
 		}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"rocketship/commander"
+	"rocketship/commander/modules/provision"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/amoghe/distillog"
@@ -17,6 +19,8 @@ var (
 	DbDSN    = kingpin.Flag("db-dsn", "DB DSN to connect").Default("/tmp/commander").String()
 	SeedOnly = kingpin.Flag("seed-only", "Only migrate+seed the database, do not rewrite files").Default("false").Bool()
 	LogTo    = kingpin.Flag("log-to", "Log output").Default("stdout").Enum("syslog", "stdout", "stderr")
+	CmdrPort = kingpin.Flag("commander-port", "Port on which commander listens (0 to not report crashes to it)").Uint64()
+	SeedFile = kingpin.Flag("seed-file", "Provisioning seed to apply (instead of searching for one)").String()
 )
 
 func main() {
@@ -48,6 +52,8 @@ func main() {
 	}
 
 	cmdr := commander.New(&db, logger)
+	cmdr.SetCommanderPort(int(*CmdrPort))
+	defer cmdr.Stop()
 
 	logger.Infoln("<1> Migrating database")
 	cmdr.MigrateDB()
@@ -55,6 +61,24 @@ func main() {
 	logger.Infoln("<2> Seeding database")
 	cmdr.SeedDB()
 
+	if provision.IsProvisioned() {
+		logger.Infoln("<2a> System already provisioned, skipping provisioning seed")
+	} else {
+		logger.Infoln("<2a> Looking for provisioning seed")
+		// Failing to provision is not fatal, we carry on with the seeded (default) config so that
+		// the system remains reachable.
+		seed, err := findSeed(logger)
+		if err != nil {
+			logger.Errorln("Unable to read provisioning seed:", err)
+		} else if seed != nil {
+			if err := cmdr.Provision(*seed); err != nil {
+				logger.Errorln("Failed to apply provisioning seed:", err)
+			} else if err := provision.MarkProvisioned(); err != nil {
+				logger.Errorln("Failed to mark system as provisioned:", err)
+			}
+		}
+	}
+
 	if *SeedOnly == true {
 		logger.Infoln("Exiting early due to seed-only")
 		return
@@ -65,3 +89,19 @@ func main() {
 
 	logger.Infoln("Preflight finished")
 }
+
+func findSeed(logger distillog.Logger) (*provision.Seed, error) {
+	if len(*SeedFile) <= 0 {
+		return provision.Find(logger)
+	}
+
+	contents, err := ioutil.ReadFile(*SeedFile)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := provision.Parse(contents)
+	if err != nil {
+		return nil, err
+	}
+	return &seed, nil
+}
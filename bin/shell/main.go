@@ -1,12 +1,29 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
 
+	"rocketship/commander/modules/host"
 	"rocketship/shell"
+
+	"github.com/parnurzeal/gorequest"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	CommanderURL = "http://localhost:8888"
 )
 
 func main() {
+	if err := ensureLoginAllowed(os.Getenv("USER")); err != nil {
+		fmt.Println("%", err)
+		os.Exit(1)
+	}
+
 	shell := shell.New()
 	defer shell.Close()
 
@@ -15,3 +32,87 @@ func main() {
 
 	shell.Run()
 }
+
+// ensureLoginAllowed refuses locked out users, and forces the user to change their password (before
+// they can do anything else) if they have been flagged as needing to do so.
+func ensureLoginAllowed(username string) error {
+	req := gorequest.New()
+
+	res, body, errs := req.Get(CommanderURL + host.EUsers).End()
+	if errs != nil {
+		// Without the status we cannot tell a locked (or unchanged) account from a good one.
+		return fmt.Errorf("Unable to determine password status: %s", errs)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to determine password status: %s", body)
+	}
+
+	users := []host.UserResource{}
+	if err := json.Unmarshal([]byte(body), &users); err != nil {
+		return fmt.Errorf("Unable to determine password status: %s", err)
+	}
+
+	for _, user := range users {
+		if user.Name != username {
+			continue
+		}
+		if user.Locked {
+			return fmt.Errorf("Account is locked due to repeated login failures")
+		}
+		if !user.MustChangePassword {
+			continue
+		}
+
+		fmt.Println("You are required to change your password before proceeding.")
+		for {
+			current, err := promptPassword("Enter current password:")
+			if err != nil {
+				return err
+			}
+			pass1, err := promptPassword("Enter new password:")
+			if err != nil {
+				return err
+			}
+			pass2, err := promptPassword("Re-enter new password:")
+			if err != nil {
+				return err
+			}
+			if pass1 != pass2 {
+				fmt.Println("Passwords do not match")
+				continue
+			}
+
+			endpoint := strings.Replace(host.EUsersPassword, ":id", fmt.Sprintf("%d", user.ID), 1)
+			res, body, errs := req.
+				Put(CommanderURL + endpoint).
+				Send(host.PasswordChangeResource{OldPassword: current, NewPassword: pass1}).
+				End()
+			if errs != nil {
+				return fmt.Errorf("Failed to change password: %s", errs)
+			}
+			if res.StatusCode == http.StatusForbidden {
+				return fmt.Errorf("Failed to change password: %s", body)
+			}
+			if res.StatusCode != http.StatusOK {
+				fmt.Println("Failed to change password:", body)
+				continue
+			}
+
+			fmt.Println("Password changed succesfully")
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func promptPassword(prompt string) (string, error) {
+	fmt.Printf(prompt)
+	defer fmt.Println("")
+
+	pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read password: %s", err)
+	}
+	return string(pass), nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"rocketship/commander/modules/host"
@@ -19,10 +20,12 @@ var (
 	listCmdStr = "list"
 	showCmdStr = "show"
 	editCmdStr = "edit"
+	confCmdStr = "confirm"
 
 	listCmd = kingpin.Command(listCmdStr, "List interfaces")
 	editCmd = kingpin.Command(editCmdStr, "Edit an interface")
 	showCmd = kingpin.Command(showCmdStr, "Show details for an interface")
+	confCmd = kingpin.Command(confCmdStr, "Confirm a change to an interface (so that it is not reverted)")
 
 	// show opts
 	showname = showCmd.Flag("name", "Name of interface to display").String()
@@ -33,6 +36,13 @@ var (
 	address = editCmd.Flag("address", "Interface address. Only for "+host.ModeStatic).IP()
 	gateway = editCmd.Flag("address", "Default gateway. Only for "+host.ModeStatic).IP()
 	netmask = editCmd.Flag("address", "Netmask. Only for "+host.ModeStatic).Default("255.255.255.0").IP()
+	enabled = editCmd.Flag("enabled", "Whether the interface is up").Default("true").Bool()
+	mtu     = editCmd.Flag("mtu", "MTU (0 for the default of the link)").Default("0").Int()
+	mac     = editCmd.Flag("mac", "MAC address override").String()
+	timeout = editCmd.Flag("confirm-timeout", "Revert the change unless confirmed within these many seconds").Int()
+
+	// confirm opts
+	confname = confCmd.Flag("name", "Name of interface to confirm the change to").String()
 )
 
 func main() {
@@ -46,6 +56,8 @@ func main() {
 		doShowInterface()
 	case editCmdStr:
 		doEditInterface()
+	case confCmdStr:
+		doConfirmInterface()
 	default:
 		fmt.Println("Unknown subcommand:", mode)
 		os.Exit(1)
@@ -102,6 +114,7 @@ func doShowInterface() {
 
 	fmt.Println("Interface details:")
 	fmt.Println("\tName\t\t:", iface.Name)
+	fmt.Println("\tEnabled\t\t:", iface.Enabled)
 	fmt.Println("\tMode\t\t:", iface.Mode)
 	if *mode == host.ModeStatic {
 		fmt.Println("\tAddress\t\t:", iface.Address)
@@ -110,12 +123,45 @@ func doShowInterface() {
 	} else {
 		fmt.Println("\tDHCP Profile ID\t:", iface.DHCPProfileID)
 	}
+	fmt.Println("\tIPv6 Mode\t:", iface.IPv6Mode)
+	if iface.IPv6Mode == host.ModeStatic {
+		fmt.Printf("\tIPv6 Address\t: %s/%d\n", iface.IPv6Address, iface.IPv6PrefixLen)
+		fmt.Println("\tIPv6 Gateway\t:", iface.IPv6Gateway)
+	}
+	if iface.MTU > 0 {
+		fmt.Println("\tMTU (override)\t:", iface.MTU)
+	}
+	if len(iface.MACAddress) > 0 {
+		fmt.Println("\tMAC (override)\t:", iface.MACAddress)
+	}
+	if iface.RevertIn > 0 {
+		fmt.Printf("\tUnconfirmed\t: change will be reverted in %d seconds\n", iface.RevertIn)
+	}
 
-	fmt.Printf("\tInterface status:\n\n")
-	for _, line := range strings.Split(iface.InterfaceStatus, "\n") {
-		fmt.Println("\t\t", line)
+	status := iface.InterfaceStatus
+	if !status.Present {
+		fmt.Println("\tStatus\t\t: not present")
+		return
 	}
 
+	link := "down"
+	if status.LinkUp {
+		link = "up"
+	}
+	speed := "unknown"
+	if status.Speed > 0 {
+		speed = fmt.Sprintf("%d Mbps", status.Speed)
+	}
+
+	fmt.Printf("\tLink\t\t: %s (%s)\n", link, status.OperState)
+	fmt.Printf("\tSpeed\t\t: %s, %s duplex\n", speed, status.Duplex)
+	fmt.Println("\tMAC\t\t:", status.MAC)
+	fmt.Println("\tMTU\t\t:", status.MTU)
+	fmt.Println("\tAddresses\t:", strings.Join(status.Addresses, ", "))
+	fmt.Printf("\tRX\t\t: %d bytes, %d packets, %d errors, %d dropped\n",
+		status.RxBytes, status.RxPackets, status.RxErrors, status.RxDropped)
+	fmt.Printf("\tTX\t\t: %d bytes, %d packets, %d errors, %d dropped\n",
+		status.TxBytes, status.TxPackets, status.TxErrors, status.TxDropped)
 }
 
 func doEditInterface() {
@@ -127,9 +173,11 @@ func doEditInterface() {
 
 	iface := host.InterfaceConfigResource{
 		InterfaceConfig: host.InterfaceConfig{
-			Name:    *name,
-			Mode:    *mode,
-			Enabled: true, // TODO: server doesn't support this yet?
+			Name:       *name,
+			Mode:       *mode,
+			Enabled:    *enabled,
+			MTU:        *mtu,
+			MACAddress: *mac,
 		},
 	}
 
@@ -142,6 +190,9 @@ func doEditInterface() {
 	}
 
 	endpoint := strings.Replace(host.EInterfacesID, ":id", *name, 1)
+	if *timeout > 0 {
+		endpoint += fmt.Sprintf("?%s=%d", host.ConfirmTimeoutParam, *timeout)
+	}
 
 	res, body, errs := req.
 		Put("http://localhost:8888" + endpoint).
@@ -158,5 +209,57 @@ func doEditInterface() {
 		os.Exit(1)
 	}
 
+	if *timeout > 0 {
+		fmt.Printf("Interface updated, confirm the change within %d seconds or it will be reverted\n", *timeout)
+		return
+	}
 	fmt.Println("Hostname updated succesfully")
 }
+
+func doConfirmInterface() {
+
+	if len(*confname) <= 0 {
+		fmt.Println("Interface name not specified")
+		os.Exit(1)
+	}
+
+	if err := confirmInterface("http://localhost:8888", *confname, os.Getenv("SSH_CONNECTION")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Interface change confirmed")
+}
+
+// confirmInterface confirms the pending change to the named interface. Commander only accepts the
+// confirmation if the (ssh) session it comes from is connected over the new address of the interface.
+func confirmInterface(commanderURL, name, sshConnection string) error {
+	addr, err := sessionAddress(sshConnection)
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.Replace(host.EInterfacesConfirm, ":id", name, 1)
+
+	res, body, errs := req.
+		Put(commanderURL + endpoint).
+		Send(host.InterfaceConfirmResource{SessionAddress: addr}).
+		End()
+	if errs != nil {
+		return fmt.Errorf("%s", errs)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error response from server:\n\tCode:\t %d\n\tBody:\t %s", res.StatusCode, body)
+	}
+	return nil
+}
+
+// sessionAddress returns the address (of this host) that the ssh session is connected to, as per
+// the SSH_CONNECTION ("<client ip> <client port> <server ip> <server port>") set by sshd.
+func sessionAddress(sshConnection string) (string, error) {
+	fields := strings.Fields(sshConnection)
+	if len(fields) != 4 || net.ParseIP(fields[2]) == nil {
+		return "", fmt.Errorf("Interface changes must be confirmed from an ssh session (over the new address)")
+	}
+	return fields[2], nil
+}
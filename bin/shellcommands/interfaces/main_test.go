@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rocketship/commander/modules/host"
+
+	"github.com/amoghe/distillog"
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	// Don't let the addresses of the NICs of the test machine leak into the tests
+	host.SysClassNetPath = "/nonexistent"
+	TestingT(t)
+}
+
+func init() {
+	Suite(&ConfirmTestSuite{})
+}
+
+// ConfirmTestSuite runs the confirm command against a commander (host controller) that does not
+// apply its config to the system.
+type ConfirmTestSuite struct {
+	db         gorm.DB
+	controller *host.Controller
+	server     *httptest.Server
+}
+
+func (ts *ConfirmTestSuite) SetUpTest(c *C) {
+	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
+	c.Assert(err, IsNil)
+
+	// Comment this to enable db logs during tests
+	db.SetLogger(log.New(ioutil.Discard, "", 0))
+	ts.db = db
+
+	ts.controller = host.NewController(&ts.db, distillog.NewNullLogger("test"))
+	ts.controller.MigrateDB()
+	ts.controller.SeedDB()
+
+	env := map[interface{}]interface{}{host.NoApplyEnvKey: true}
+	ts.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.controller.ServeHTTPC(web.C{Env: env}, w, r)
+	}))
+}
+
+func (ts *ConfirmTestSuite) TearDownTest(c *C) {
+	ts.server.Close()
+	ts.controller.Stop()
+	ts.db.Close()
+}
+
+func (ts *ConfirmTestSuite) TestSessionAddress(c *C) {
+	addr, err := sessionAddress("10.9.9.9 50000 192.168.168.8 22")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "192.168.168.8")
+
+	addr, err = sessionAddress("2001:db8::9 50000 2001:db8::8 22")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "2001:db8::8")
+
+	for _, conn := range []string{"", "10.9.9.9 50000", "10.9.9.9 50000 bogus 22"} {
+		_, err = sessionAddress(conn)
+		c.Assert(err, NotNil, Commentf("SSH_CONNECTION: %s", conn))
+	}
+}
+
+func (ts *ConfirmTestSuite) TestConfirmInterface(c *C) {
+	// Nothing to confirm
+	c.Assert(confirmInterface(ts.server.URL, "eth0", "10.9.9.9 50000 192.168.168.8 22"), NotNil)
+
+	endpoint := strings.Replace(host.EInterfacesID, ":id", "eth0", 1) + "?" + host.ConfirmTimeoutParam + "=600"
+	req, err := http.NewRequest("PUT", ts.server.URL+endpoint, bytes.NewBufferString(
+		`{"Enabled": true, "Mode": "static", "Address": "192.168.168.8", "Netmask": "255.255.255.0",
+		"Gateway": "192.168.168.1"}`))
+	c.Assert(err, IsNil)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	// Not from an ssh session, or from one over the old address
+	c.Assert(confirmInterface(ts.server.URL, "eth0", ""), NotNil)
+	c.Assert(confirmInterface(ts.server.URL, "eth0", "10.9.9.9 50000 10.0.0.1 22"), NotNil)
+	c.Assert(ts.revertIn(c), Not(Equals), 0)
+
+	// From a session over the new address
+	c.Assert(confirmInterface(ts.server.URL, "eth0", "10.9.9.9 50000 192.168.168.8 22"), IsNil)
+	c.Assert(ts.revertIn(c), Equals, 0)
+}
+
+// revertIn returns the seconds until the change to eth0 is reverted (0 if none is pending).
+func (ts *ConfirmTestSuite) revertIn(c *C) int {
+	endpoint := strings.Replace(host.EInterfacesID, ":id", "eth0", 1)
+	res, err := http.Get(ts.server.URL + endpoint)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+
+	iface := host.InterfaceConfigResource{}
+	c.Assert(json.NewDecoder(res.Body).Decode(&iface), IsNil)
+	return iface.RevertIn
+}
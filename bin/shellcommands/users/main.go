@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"rocketship/commander/modules/host"
@@ -20,17 +21,46 @@ var (
 	listCmdStr   = "list"
 	createCmdStr = "create"
 	deleteCmdStr = "delete"
+	passwdCmdStr = "passwd"
+	unlockCmdStr = "unlock"
+
+	keysCmdStr       = "keys"
+	keysListCmdStr   = "list"
+	keysAddCmdStr    = "add"
+	keysDeleteCmdStr = "delete"
 
 	getCmd    = kingpin.Command(listCmdStr, "List users")
 	createCmd = kingpin.Command(createCmdStr, "Create a user")
 	deleteCmd = kingpin.Command(deleteCmdStr, "Delete a user")
+	passwdCmd = kingpin.Command(passwdCmdStr, "Change a user's password")
+	unlockCmd = kingpin.Command(unlockCmdStr, "Unlock a user locked out due to failed logins")
+	keysCmd   = kingpin.Command(keysCmdStr, "Manage a user's SSH keys")
+
+	keysListCmd   = keysCmd.Command(keysListCmdStr, "List SSH keys of a user")
+	keysAddCmd    = keysCmd.Command(keysAddCmdStr, "Add an SSH key for a user")
+	keysDeleteCmd = keysCmd.Command(keysDeleteCmdStr, "Delete an SSH key of a user")
 
 	// create opts
 	name    = createCmd.Flag("name", "Name of user to be created").String()
 	comment = createCmd.Flag("comment", "Comment string (admin purpose)").String()
+	shell   = createCmd.Flag("shell", "Login shell of the user").
+		Default(host.DefaultShell).
+		Enum(host.ShellCLI, host.ShellBash, host.ShellNologin)
 
 	// delete opts
 	id = deleteCmd.Flag("id", "ID of user to be deleted").Default("0").Int()
+
+	// passwd opts
+	passwdName = passwdCmd.Flag("name", "Name of user whose password is to be changed").Default(os.Getenv("USER")).String()
+
+	// unlock opts
+	unlockId = unlockCmd.Flag("id", "ID of user to be unlocked").Default("0").Int()
+
+	// keys opts
+	keysName    = keysCmd.Flag("name", "Name of user whose keys are to be managed").Default(os.Getenv("USER")).String()
+	keysFile    = keysAddCmd.Flag("file", "File containing the public key (e.g. id_rsa.pub)").Required().String()
+	keysComment = keysAddCmd.Flag("comment", "Comment for the key (defaults to the one in the file)").String()
+	keysId      = keysDeleteCmd.Flag("id", "ID of key to be deleted").Default("0").Int()
 )
 
 func main() {
@@ -44,6 +74,16 @@ func main() {
 		doCreateUser()
 	case deleteCmdStr:
 		doDeleteUser()
+	case passwdCmdStr:
+		doChangePassword()
+	case unlockCmdStr:
+		doUnlockUser()
+	case keysCmdStr + " " + keysListCmdStr:
+		doListKeys()
+	case keysCmdStr + " " + keysAddCmdStr:
+		doAddKey()
+	case keysCmdStr + " " + keysDeleteCmdStr:
+		doDeleteKey()
 	default:
 		fmt.Println("Unknown subcommand:", mode)
 		os.Exit(1)
@@ -64,29 +104,14 @@ func doListUsers() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("ID\tName\tComment\n")
-	fmt.Printf("--\t----\t-------\n")
+	fmt.Printf("ID\tName\tShell\tComment\n")
+	fmt.Printf("--\t----\t-----\t-------\n")
 	for _, user := range users {
-		fmt.Printf("%2d\t%s\t%s\n", user.ID, user.Name, user.Comment)
+		fmt.Printf("%2d\t%s\t%s\t%s\n", user.ID, user.Name, user.Shell, user.Comment)
 	}
 }
 
 func doCreateUser() {
-	var ()
-
-	promptPassword := func(prompt string) string {
-		fmt.Printf(prompt)
-		defer fmt.Println("")
-
-		pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-		if err != nil {
-			fmt.Println("Failed to read password:", err)
-			os.Exit(1)
-		}
-
-		return string(pass)
-	}
-
 	if len(*name) <= 0 {
 		fmt.Println("Cannot have empty user name")
 		os.Exit(1)
@@ -103,6 +128,7 @@ func doCreateUser() {
 	user := host.UserResource{
 		Name:     *name,
 		Comment:  *comment,
+		Shell:    *shell,
 		Password: pass1,
 	}
 
@@ -159,3 +185,183 @@ func doDeleteUser() {
 	fmt.Println("\tName\t:", user.Name)
 	fmt.Println("\tComment\t:", user.Comment)
 }
+
+func doChangePassword() {
+	user := findUser(*passwdName)
+
+	current := promptPassword("Enter current password:")
+	pass1 := promptPassword("Enter new password:")
+	pass2 := promptPassword("Re-enter new password:")
+
+	if len(pass1) <= 0 {
+		fmt.Println("Cannot have empty password")
+		os.Exit(1)
+	}
+	if pass1 != pass2 {
+		fmt.Println("Passwords do not match")
+		os.Exit(1)
+	}
+
+	endpoint := strings.Replace(host.EUsersPassword, ":id", fmt.Sprintf("%d", user.ID), 1)
+
+	res, body, errs := req.
+		Put("http://localhost:8888" + endpoint).
+		Send(host.PasswordChangeResource{OldPassword: current, NewPassword: pass1}).
+		End()
+	if errs != nil {
+		fmt.Println(errs)
+		os.Exit(1)
+	}
+	if res.StatusCode != http.StatusOK {
+		fmt.Println("Error response from server:")
+		fmt.Println("\tCode:\t", res.StatusCode)
+		fmt.Println("\tBody:\t", body)
+		os.Exit(1)
+	}
+
+	fmt.Println("Password changed succesfully")
+}
+
+func doUnlockUser() {
+	if *unlockId <= 0 {
+		fmt.Println("Must specify user ID to unlock")
+		os.Exit(1)
+	}
+
+	endpoint := strings.Replace(host.EUsersUnlock, ":id", fmt.Sprintf("%d", *unlockId), 1)
+
+	res, body, errs := req.
+		Put("http://localhost:8888" + endpoint).
+		End()
+	if errs != nil {
+		fmt.Println(errs)
+		os.Exit(1)
+	}
+	if res.StatusCode != http.StatusOK {
+		fmt.Println("Error response from server:")
+		fmt.Println("\tCode:\t", res.StatusCode)
+		fmt.Println("\tBody:\t", body)
+		os.Exit(1)
+	}
+
+	fmt.Println("User unlocked succesfully")
+}
+
+func doListKeys() {
+	endpoint := strings.Replace(host.EUsersKeys, ":id", fmt.Sprintf("%d", findUser(*keysName).ID), 1)
+
+	_, body, errs := req.Get("http://localhost:8888" + endpoint).End()
+	if errs != nil {
+		fmt.Println(errs)
+		os.Exit(1)
+	}
+
+	keys := []host.SSHKeyResource{}
+	if err := json.Unmarshal([]byte(body), &keys); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("ID\tFingerprint\t\t\t\t\t\tComment\n")
+	fmt.Printf("--\t-----------\t\t\t\t\t\t-------\n")
+	for _, key := range keys {
+		fmt.Printf("%2d\t%s\t%s\n", key.ID, key.Fingerprint, key.Comment)
+	}
+}
+
+func doAddKey() {
+	contents, err := ioutil.ReadFile(*keysFile)
+	if err != nil {
+		fmt.Println("Unable to read key:", err)
+		os.Exit(1)
+	}
+
+	endpoint := strings.Replace(host.EUsersKeys, ":id", fmt.Sprintf("%d", findUser(*keysName).ID), 1)
+
+	res, body, errs := req.
+		Post("http://localhost:8888" + endpoint).
+		Send(host.SSHKeyResource{Key: strings.TrimSpace(string(contents)), Comment: *keysComment}).
+		End()
+	if errs != nil {
+		fmt.Println(errs)
+		os.Exit(1)
+	}
+	if res.StatusCode != http.StatusOK {
+		fmt.Println("Error response from server:")
+		fmt.Println("\tCode:\t", res.StatusCode)
+		fmt.Println("\tBody:\t", body)
+		os.Exit(1)
+	}
+
+	key := host.SSHKeyResource{}
+	if err := json.Unmarshal([]byte(body), &key); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Added key:", key.Fingerprint)
+}
+
+func doDeleteKey() {
+	if *keysId <= 0 {
+		fmt.Println("Must specify key ID to delete")
+		os.Exit(1)
+	}
+
+	endpoint := strings.Replace(host.EUsersKeysID, ":id", fmt.Sprintf("%d", findUser(*keysName).ID), 1)
+	endpoint = strings.Replace(endpoint, ":keyid", fmt.Sprintf("%d", *keysId), 1)
+
+	res, body, errs := req.
+		Delete("http://localhost:8888" + endpoint).
+		End()
+	if errs != nil {
+		fmt.Println(errs)
+		os.Exit(1)
+	}
+	if res.StatusCode != http.StatusOK {
+		fmt.Println("Error response from server:")
+		fmt.Println("\tCode:\t", res.StatusCode)
+		fmt.Println("\tBody:\t", body)
+		os.Exit(1)
+	}
+
+	fmt.Println("Key deleted succesfully")
+}
+
+// findUser looks up the user with the specified name (exiting if there is no such user).
+func findUser(name string) host.UserResource {
+	_, body, errs := req.Get("http://localhost:8888" + host.EUsers).End()
+	if errs != nil {
+		fmt.Println(errs)
+		os.Exit(1)
+	}
+
+	users := []host.UserResource{}
+	if err := json.Unmarshal([]byte(body), &users); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, user := range users {
+		if user.Name == name {
+			return user
+		}
+	}
+
+	fmt.Println("No such user:", name)
+	os.Exit(1)
+	return host.UserResource{}
+}
+
+func promptPassword(prompt string) string {
+	fmt.Printf(prompt)
+	defer fmt.Println("")
+
+	pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Println("Failed to read password:", err)
+		os.Exit(1)
+	}
+
+	return string(pass)
+}
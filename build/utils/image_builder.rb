@@ -13,7 +13,15 @@ class ImageBuilder < BaseBuilder
 
 	# These are packages that are installed when transforming a basic rootfs into a rocketship rootfs.
 	ADDITIONAL_PACKAGES = [
+		"bridge-utils",       # bridge interfaces
 		"ca-certificates",
+		"ifenslave",          # bond interfaces
+		"libnss-ldapd",       # remote auth (LDAP)
+		"libpam-ldapd",       # remote auth (LDAP)
+		"libpam-radius-auth", # remote auth (RADIUS)
+		"libpam-tacplus",     # remote auth (TACACS+)
+		"nslcd",              # remote auth (LDAP)
+		"vlan",               # VLAN interfaces
 	]
 
 	# These are packages installed when we detect a developer build.
@@ -1,9 +1,18 @@
 package commander
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 
 	"rocketship/commander/modules"
+	"rocketship/commander/modules/auth"
+	"rocketship/commander/modules/crashcorder"
+	"rocketship/commander/modules/events/eventtypes"
+	"rocketship/commander/modules/host"
+	"rocketship/commander/modules/powerstate"
+	"rocketship/commander/modules/provision"
 
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
@@ -25,6 +34,8 @@ func New(db *gorm.DB, log distillog.Logger) *Commander {
 		log:         log,
 	}
 
+	c.mux.Use(c.requirePasswordChange)
+
 	routes := map[string]modules.Controller{}
 	for _, ctrl := range c.controllers {
 		if c, there := routes[ctrl.RoutePrefix()]; there {
@@ -36,9 +47,51 @@ func New(db *gorm.DB, log distillog.Logger) *Commander {
 		c.mux.Handle(ctrl.RoutePrefix()+"/*", ctrl)
 	}
 
+	for _, ctrl := range c.controllers {
+		if ps, ok := ctrl.(*powerstate.Controller); ok {
+			ps.SetFactoryResetter(&c)
+		}
+		if ac, ok := ctrl.(*auth.Controller); ok {
+			if hostCtrl := c.hostController(); hostCtrl != nil {
+				hostCtrl.SetRemoteAuthenticator(ac)
+				ac.SetPamRewriter(hostCtrl.RewritePamFiles)
+			}
+		}
+	}
+
 	return &c
 }
 
+// requirePasswordChange is a middleware that refuses all requests (except the ones needed to change
+// the password) while the default admin is still using its seeded password.
+func (c *Commander) requirePasswordChange(h http.Handler) http.Handler {
+	allowed := func(r *http.Request) bool {
+		switch {
+		case r.Method == "GET" && r.URL.Path == host.EUsers:
+			return true // needed to look up the user whose password is to be changed
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, host.EUsers+"/") &&
+			strings.HasSuffix(r.URL.Path, "/password"):
+			return true
+		case r.Method == "POST" && r.URL.Path == host.ELogin:
+			return true // needed to verify the current password
+		case r.Method == "POST" && r.URL.Path == eventtypes.PublishPath:
+			return true // crash reports must not be lost while the password is pending
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostCtrl := c.hostController()
+		if hostCtrl != nil && hostCtrl.AdminPasswordChangeRequired() && !allowed(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(fmt.Sprintf("{\"error\": \"password for %s must be changed\"}", host.AdminUsername)))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 // ServeHTTP makes Commander adhere to the http.Handler interface so it can act as a http application.
 func (c *Commander) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.mux.ServeHTTP(w, r)
@@ -69,3 +122,126 @@ func (c *Commander) RewriteFiles() error {
 	}
 	return nil
 }
+
+// Provision applies the first boot provisioning seed via the controllers that consume it. The seed
+// is validated by all of them before any of them applies it, so that an invalid seed isn't
+// partially applied.
+func (c *Commander) Provision(seed provision.Seed) error {
+	c.log.Infoln("Validating provisioning seed")
+	for _, ctrl := range c.controllers {
+		if p, ok := ctrl.(modules.Provisioner); ok {
+			if err := p.ValidateSeed(seed); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.log.Infoln("Applying provisioning seed")
+	for _, ctrl := range c.controllers {
+		if p, ok := ctrl.(modules.Provisioner); ok {
+			if err := p.Provision(seed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FactoryReset wipes all user data and returns the DB to its seeded state, then rewrites all the
+// config files. If preserveNetwork is set, the network settings are carried across the reset.
+func (c *Commander) FactoryReset(preserveNetwork bool) error {
+	c.log.Warningln("Resetting to factory state")
+
+	var (
+		hostCtrl = c.hostController()
+		netCfg   host.NetworkConfig
+	)
+
+	// Requests to the controllers would race the reset of their tables. The powerstate controller
+	// isn't locked (it doesn't implement Lock), as the reset is requested through it.
+	for _, ctrl := range c.controllers {
+		if l, ok := ctrl.(sync.Locker); ok {
+			l.Lock()
+			defer l.Unlock()
+		}
+	}
+
+	if preserveNetwork && hostCtrl != nil {
+		snap, err := hostCtrl.SnapshotNetworkConfig()
+		if err != nil {
+			return err
+		}
+		netCfg = snap
+	}
+
+	// Files first, since some controllers consult the DB to find their files.
+	for _, ctrl := range c.controllers {
+		if err := ctrl.WipeFiles(); err != nil {
+			c.log.Warningf("Error: %s. Continuing...", err)
+		}
+	}
+
+	c.log.Infoln("Dropping database")
+	for _, ctrl := range c.controllers {
+		ctrl.DropDB()
+	}
+
+	c.MigrateDB()
+	c.SeedDB()
+
+	if preserveNetwork && hostCtrl != nil {
+		if err := hostCtrl.RestoreNetworkConfig(netCfg); err != nil {
+			return err
+		}
+	}
+
+	return c.RewriteFiles()
+}
+
+// Start starts the background work of the controllers. It is only done by the commander that
+// serves requests (and not when it is used to prepare the system, e.g. at boot).
+func (c *Commander) Start() {
+	for _, ctrl := range c.controllers {
+		if s, ok := ctrl.(modules.Starter); ok {
+			s.Start()
+		}
+	}
+}
+
+// Stop stops the controllers that run in the background. The commander must not be used after it
+// is stopped.
+func (c *Commander) Stop() {
+	for _, ctrl := range c.controllers {
+		if s, ok := ctrl.(modules.Stopper); ok {
+			s.Stop()
+		}
+	}
+}
+
+// ResumePendingChanges picks up the changes that were pending confirmation when commander last
+// stopped, so that they are still reverted unless confirmed.
+func (c *Commander) ResumePendingChanges() {
+	if hostCtrl := c.hostController(); hostCtrl != nil {
+		hostCtrl.ResumePendingChange()
+	}
+}
+
+// SetCommanderPort tells the controllers the port on which commander listens (for the local daemons
+// that report into it).
+func (c *Commander) SetCommanderPort(port int) {
+	for _, ctrl := range c.controllers {
+		if cc, ok := ctrl.(*crashcorder.Controller); ok {
+			cc.SetCommanderPort(port)
+		}
+	}
+}
+
+// hostController returns the host controller (if loaded).
+func (c *Commander) hostController() *host.Controller {
+	for _, ctrl := range c.controllers {
+		if h, ok := ctrl.(*host.Controller); ok {
+			return h
+		}
+	}
+	return nil
+}
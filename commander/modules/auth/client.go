@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"fmt"
+)
+
+var (
+	// Returned by clients when the server rejects the credentials
+	errRejected = fmt.Errorf("credentials rejected by server")
+	// Returned by clients when the server does not know the user
+	errUnknownUser = fmt.Errorf("user unknown to server")
+)
+
+// authClient verifies credentials against a remote server. Errors other than errRejected and
+// errUnknownUser indicate that the server could not be consulted (and that the next one should be).
+type authClient interface {
+	// authenticate returns the groups the user is a member of (as reported by the server).
+	authenticate(addr, secret, name, password string) ([]string, error)
+}
+
+func newAuthClient(cfg AuthConfig) authClient {
+	switch cfg.Protocol {
+	case ProtocolLDAP:
+		return &ldapClient{cfg: cfg}
+	case ProtocolRADIUS:
+		return &radiusClient{timeout: cfg.timeout()}
+	case ProtocolTACACS:
+		return &tacacsClient{timeout: cfg.timeout()}
+	}
+	return &nullClient{}
+}
+
+// nullClient is used when the protocol is unknown (which the model validation prevents).
+type nullClient struct{}
+
+func (n *nullClient) authenticate(addr, secret, name, password string) ([]string, error) {
+	return nil, fmt.Errorf("unsupported protocol")
+}
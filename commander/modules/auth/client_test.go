@@ -0,0 +1,428 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testSecret   = "shared-secret"
+	testBaseDN   = "dc=enterprise,dc=com"
+	testBindDN   = "cn=commander,dc=enterprise,dc=com"
+	testBindPass = "bindpass"
+	testTimeout  = time.Second
+)
+
+// testUser is a user known to the stand-in servers.
+type testUser struct {
+	password string
+	groups   []string
+}
+
+var testUsers = map[string]testUser{
+	"picard": {"engage", []string{"captains", "starfleet"}},
+	"wesley": {"shutup", []string{}},
+}
+
+type ClientsTestSuite struct{}
+
+func (ts *ClientsTestSuite) TestRadiusHidePassword(c *C) {
+	authenticator := bytes.Repeat([]byte{0x42}, radiusAuthLen)
+
+	for _, password := range []string{"", "engage", "0123456789abcdef", "make it so, number one"} {
+		hidden := radiusHidePassword(testSecret, authenticator, password)
+		c.Assert(len(hidden)%radiusAuthLen, Equals, 0)
+		c.Assert(len(hidden) >= radiusAuthLen, Equals, true)
+		c.Assert(revealRadiusPassword(testSecret, authenticator, hidden), Equals, password)
+	}
+}
+
+func (ts *ClientsTestSuite) TestRadiusClient(c *C) {
+	server := newStandInRadiusServer(c, testSecret)
+	defer server.close()
+
+	client := &radiusClient{timeout: testTimeout}
+
+	groups, err := client.authenticate(server.addr(), testSecret, "picard", "engage")
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{"captains", "starfleet"})
+
+	_, err = client.authenticate(server.addr(), testSecret, "picard", "disengage")
+	c.Assert(err, Equals, errRejected)
+
+	_, err = client.authenticate(server.addr(), testSecret, "q", "omnipotent")
+	c.Assert(err, Equals, errRejected)
+
+	// Responses that cannot be authenticated (wrong secret) are dropped, so we time out.
+	_, err = client.authenticate(server.addr(), "not-the-secret", "picard", "engage")
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(Equals), errRejected)
+}
+
+func (ts *ClientsTestSuite) TestLDAPClient(c *C) {
+	server := newStandInLDAPServer(c)
+	defer server.close()
+
+	client := &ldapClient{cfg: AuthConfig{
+		Protocol:     ProtocolLDAP,
+		TimeoutSecs:  1,
+		BaseDN:       testBaseDN,
+		BindDN:       testBindDN,
+		BindPassword: testBindPass,
+	}}
+
+	groups, err := client.authenticate(server.addr(), "", "picard", "engage")
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{"captains", "starfleet"})
+
+	groups, err = client.authenticate(server.addr(), "", "wesley", "shutup")
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 0)
+
+	_, err = client.authenticate(server.addr(), "", "picard", "disengage")
+	c.Assert(err, Equals, errRejected)
+
+	// An empty password must never result in an (unauthenticated) bind
+	_, err = client.authenticate(server.addr(), "", "picard", "")
+	c.Assert(err, Equals, errRejected)
+
+	_, err = client.authenticate(server.addr(), "", "q", "omnipotent")
+	c.Assert(err, Equals, errUnknownUser)
+
+	// If we can't look users up, the server is of no use to us
+	client.cfg.BindPassword = "wrong"
+	_, err = client.authenticate(server.addr(), "", "picard", "engage")
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(Equals), errRejected)
+}
+
+func (ts *ClientsTestSuite) TestTacacsClient(c *C) {
+	server := newStandInTacacsServer(c, testSecret)
+	defer server.close()
+
+	client := &tacacsClient{timeout: testTimeout}
+
+	groups, err := client.authenticate(server.addr(), testSecret, "picard", "engage")
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{"captains", "starfleet"})
+
+	_, err = client.authenticate(server.addr(), testSecret, "picard", "disengage")
+	c.Assert(err, Equals, errRejected)
+
+	// With the wrong secret the server can't make sense of our request
+	_, err = client.authenticate(server.addr(), "not-the-secret", "picard", "engage")
+	c.Assert(err, NotNil)
+}
+
+func (ts *ClientsTestSuite) TestLDAPFirstRDNValue(c *C) {
+	c.Assert(ldapFirstRDNValue("cn=captains,ou=groups,dc=enterprise,dc=com"), Equals, "captains")
+	c.Assert(ldapFirstRDNValue("CN = captains"), Equals, "captains")
+	c.Assert(ldapFirstRDNValue("captains"), Equals, "captains")
+}
+
+//
+// Stand-in servers
+//
+
+func revealRadiusPassword(secret string, authenticator, hidden []byte) string {
+	password := make([]byte, len(hidden))
+
+	prev := authenticator
+	for i := 0; i < len(hidden); i += radiusAuthLen {
+		hash := md5.New()
+		hash.Write([]byte(secret))
+		hash.Write(prev)
+		for j, b := range hash.Sum(nil) {
+			password[i+j] = hidden[i+j] ^ b
+		}
+		prev = hidden[i : i+radiusAuthLen]
+	}
+	return string(bytes.TrimRight(password, "\x00"))
+}
+
+// standInRadiusServer answers the Access-Requests for the test users.
+type standInRadiusServer struct {
+	conn   *net.UDPConn
+	secret string
+}
+
+func newStandInRadiusServer(c *C, secret string) *standInRadiusServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+
+	s := &standInRadiusServer{conn: conn, secret: secret}
+	go s.serve()
+	return s
+}
+
+func (s *standInRadiusServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *standInRadiusServer) close() {
+	s.conn.Close()
+}
+
+func (s *standInRadiusServer) serve() {
+	buf := make([]byte, radiusMaxPacketLen)
+	for {
+		n, peer, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request := append([]byte{}, buf[:n]...)
+		if len(request) < radiusHeaderLen || request[0] != radiusAccessRequest {
+			continue
+		}
+
+		attrs, err := parseRadiusAttrs(request[radiusHeaderLen:])
+		if err != nil {
+			continue
+		}
+
+		name, password, authenticated := "", "", false
+		for _, attr := range attrs {
+			switch attr.typ {
+			case radiusAttrUserName:
+				name = string(attr.value)
+			case radiusAttrUserPassword:
+				password = revealRadiusPassword(s.secret, request[4:radiusHeaderLen], attr.value)
+			case radiusAttrMessageAuthenticator:
+				unsigned := append([]byte{}, request...)
+				copy(unsigned[len(unsigned)-radiusAuthLen:], make([]byte, radiusAuthLen))
+				mac := hmac.New(md5.New, []byte(s.secret))
+				mac.Write(unsigned)
+				authenticated = hmac.Equal(mac.Sum(nil), attr.value)
+			}
+		}
+		if !authenticated {
+			continue // as required of servers since BlastRADIUS
+		}
+
+		code, replyAttrs := byte(radiusAccessReject), []radiusAttr{}
+		if user, there := testUsers[name]; there && user.password == password {
+			code = radiusAccessAccept
+			for _, g := range user.groups {
+				replyAttrs = append(replyAttrs, radiusAttr{radiusAttrClass, []byte(g)})
+			}
+		}
+
+		// The response authenticator is computed with the request authenticator in its place
+		reply := radiusPacket(code, request[1], request[4:radiusHeaderLen], replyAttrs)
+		hash := md5.New()
+		hash.Write(reply)
+		hash.Write([]byte(s.secret))
+		copy(reply[4:radiusHeaderLen], hash.Sum(nil))
+
+		s.conn.WriteToUDP(reply, peer)
+	}
+}
+
+// standInLDAPServer serves the test users (under the test base DN) to clients bound as the test
+// bind DN.
+type standInLDAPServer struct {
+	listener net.Listener
+}
+
+func newStandInLDAPServer(c *C) *standInLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	s := &standInLDAPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standInLDAPServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *standInLDAPServer) close() {
+	s.listener.Close()
+}
+
+func (s *standInLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		reader  = bufio.NewReader(conn)
+		boundAs = ""
+	)
+
+	respond := func(id int, ops ...[]byte) {
+		for _, op := range ops {
+			conn.Write(berTLV(berTagSequence, berInt(berTagInteger, id), op))
+		}
+	}
+	result := func(tag byte, code int) []byte {
+		return berTLV(tag, berInt(berTagEnumerated, code), berString(berTagOctetString, ""),
+			berString(berTagOctetString, ""))
+	}
+
+	for {
+		msg, err := readBER(reader)
+		if err != nil {
+			return
+		}
+		elems, err := msg.children()
+		if err != nil || len(elems) < 2 {
+			return
+		}
+		id, op := elems[0].intValue(), elems[1]
+		parts, _ := op.children()
+
+		switch op.tag {
+		case ldapOpBindRequest:
+			dn, password := string(parts[1].content), string(parts[2].content)
+			code := ldapResultBadCreds
+			if dn == testBindDN && password == testBindPass {
+				code = ldapResultSuccess
+			}
+			for uid, user := range testUsers {
+				if dn == "uid="+uid+",ou=people,"+testBaseDN && password == user.password {
+					code = ldapResultSuccess
+				}
+			}
+			if code == ldapResultSuccess {
+				boundAs = dn
+			}
+			respond(id, result(ldapOpBindResponse, code))
+
+		case ldapOpSearchRequest:
+			if boundAs != testBindDN {
+				respond(id, result(ldapOpSearchDone, 50)) // insufficientAccessRights
+				continue
+			}
+
+			filter, _ := parts[6].children()
+			uid := string(filter[1].content)
+
+			ops := [][]byte{}
+			if user, there := testUsers[uid]; there {
+				values := [][]byte{}
+				for _, g := range user.groups {
+					values = append(values, berString(berTagOctetString, "cn="+g+",ou=groups,"+testBaseDN))
+				}
+				ops = append(ops, berTLV(ldapOpSearchEntry,
+					berString(berTagOctetString, "uid="+uid+",ou=people,"+testBaseDN),
+					berTLV(berTagSequence,
+						berTLV(berTagSequence,
+							berString(berTagOctetString, ldapMemberOfAttribute),
+							berTLV(berTagSet, values...)))))
+			}
+			respond(id, append(ops, result(ldapOpSearchDone, ldapResultSuccess))...)
+
+		case ldapOpUnbindRequest:
+			return
+		}
+	}
+}
+
+// standInTacacsServer authenticates (and authorizes) the test users.
+type standInTacacsServer struct {
+	listener net.Listener
+	secret   string
+}
+
+func newStandInTacacsServer(c *C, secret string) *standInTacacsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	s := &standInTacacsServer{listener: listener, secret: secret}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standInTacacsServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *standInTacacsServer) close() {
+	s.listener.Close()
+}
+
+func (s *standInTacacsServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, tacacsHeaderLen)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return
+	}
+	body = tacacsObfuscate(body, header, s.secret)
+	if len(body) < 8 {
+		return
+	}
+
+	// The user (and port, rem_addr) fields follow the fixed fields (and arg lengths)
+	fixedLen := 8
+	if header[1] == tacacsTypeAuthor {
+		fixedLen += int(body[7])
+	}
+	if len(body) < fixedLen+int(body[4])+int(body[5])+int(body[6]) {
+		return
+	}
+	name := string(body[fixedLen : fixedLen+int(body[4])])
+	user, known := testUsers[name]
+
+	reply := []byte{}
+	switch header[1] {
+	case tacacsTypeAuthen:
+		password := string(body[fixedLen+int(body[4])+int(body[5])+int(body[6]):])
+		status := byte(tacacsAuthenStatusFail)
+		if known && user.password == password {
+			status = tacacsAuthenStatusPass
+		}
+		reply = []byte{status, 0, 0, 0, 0, 0}
+
+	case tacacsTypeAuthor:
+		if !known {
+			reply = []byte{tacacsAuthorStatusFail, 0, 0, 0, 0, 0}
+			break
+		}
+		args := []string{}
+		for _, g := range user.groups {
+			args = append(args, "group="+g)
+		}
+		reply = []byte{tacacsAuthorStatusAdd, byte(len(args)), 0, 0, 0, 0}
+		for _, arg := range args {
+			reply = append(reply, byte(len(arg)))
+		}
+		for _, arg := range args {
+			reply = append(reply, arg...)
+		}
+	}
+
+	replyHeader := append([]byte{header[0], header[1], tacacsReplySeqNo, 0}, header[4:8]...)
+	replyHeader = append(replyHeader, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(replyHeader[8:], uint32(len(reply)))
+
+	conn.Write(append(replyHeader, tacacsObfuscate(reply, replyHeader, s.secret)...))
+}
@@ -0,0 +1,719 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"rocketship/commander/modules/events"
+	"rocketship/commander/modules/host"
+
+	"github.com/amoghe/distillog"
+	"github.com/amoghe/go-upstart"
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Indicates that we should'nt apply db settings to the system
+	NoApplyEnvKey = "noapply"
+
+	// Prefix under which this controller registers endpoints
+	URLPrefix = "/auth"
+
+	// Endpoint at which remote authentication is configured
+	EConfig = URLPrefix + "/config"
+	// Endpoint at which the remote auth servers are configured
+	EServers   = URLPrefix + "/servers"
+	EServersID = EServers + "/:id"
+	// Endpoint at which remote groups are mapped to local groups
+	EGroupMappings   = URLPrefix + "/group-mappings"
+	EGroupMappingsID = EGroupMappings + "/:id"
+
+	// Protocols that may be used to talk to the remote auth servers
+	ProtocolLDAP   = "ldap"
+	ProtocolRADIUS = "radius"
+	ProtocolTACACS = "tacacs+"
+
+	// How long to wait for a server before moving on to the next one
+	DefaultTimeoutSecs = 5
+	MaxTimeoutSecs     = 60
+
+	// Max number of servers that may be configured
+	MaxServers = 8
+)
+
+var (
+	// Ports the servers are assumed to listen on (unless specified otherwise)
+	defaultPorts = map[string]int{
+		ProtocolLDAP:   389,
+		ProtocolRADIUS: 1812,
+		ProtocolTACACS: 49,
+	}
+
+	// Port LDAP servers are assumed to listen on when TLS is in use
+	defaultLDAPSPort = 636
+
+	hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9\-\.]*[a-zA-Z0-9])?$`)
+)
+
+type Controller struct {
+	db   *gorm.DB
+	mux  *web.Mux
+	log  distillog.Logger
+	lock sync.Mutex
+
+	rewritePam func() error
+}
+
+func NewController(db *gorm.DB, logger distillog.Logger) *Controller {
+	ctrl := &Controller{db: db, mux: web.New(), log: logger}
+
+	ctrl.mux.Get(EConfig, ctrl.GetConfig)
+	ctrl.mux.Put(EConfig, ctrl.PutConfig)
+	ctrl.mux.Get(EServers, ctrl.GetServers)
+	ctrl.mux.Post(EServers, ctrl.CreateServer)
+	ctrl.mux.Put(EServersID, ctrl.UpdateServer)
+	ctrl.mux.Delete(EServersID, ctrl.DeleteServer)
+	ctrl.mux.Get(EGroupMappings, ctrl.GetGroupMappings)
+	ctrl.mux.Post(EGroupMappings, ctrl.CreateGroupMapping)
+	ctrl.mux.Delete(EGroupMappingsID, ctrl.DeleteGroupMapping)
+
+	return ctrl
+}
+
+// ServeHTTP satisfies the http.Handler interface (net/http as well as goji)
+func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	c.mux.ServeHTTPC(ctx, w, r)
+	c.lock.Unlock()
+	return
+}
+
+// Lock holds off the requests to the controller until Unlock is called.
+func (c *Controller) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock undoes Lock.
+func (c *Controller) Unlock() {
+	c.lock.Unlock()
+}
+
+// RoutePrefix returns the URL prefix under which this controller serves its routes
+func (c *Controller) RoutePrefix() string {
+	return URLPrefix
+}
+
+// SetPamRewriter sets the func invoked to rewrite the PAM config (owned by the host module) when
+// the remote auth config changes.
+func (c *Controller) SetPamRewriter(f func() error) {
+	c.rewritePam = f
+}
+
+// The config files are regenerated from the DB.
+func (c *Controller) WipeFiles() error { return nil }
+
+//
+// HTTP Handlers
+//
+
+func (c *Controller) GetConfig(_ web.C, w http.ResponseWriter, r *http.Request) {
+	cfg := AuthConfig{}
+	if err := c.db.First(&cfg).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := AuthConfigResource{}
+	resource.FromAuthConfigModel(cfg)
+	c.writeResource(resource, w)
+}
+
+func (c *Controller) PutConfig(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := AuthConfigResource{}
+	if err = json.Unmarshal(reqBody, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	existing := AuthConfig{}
+	if err = c.db.First(&existing).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	cfg := resource.ToAuthConfigModel()
+	if len(cfg.BindPassword) <= 0 {
+		cfg.BindPassword = existing.BindPassword // password is only updated when specified
+	}
+
+	if err = c.db.Save(&cfg).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.AuthConfigChanged, map[string]string{"Enabled": fmt.Sprint(cfg.Enabled), "Protocol": cfg.Protocol})
+	c.apply(ctx)
+
+	resource.FromAuthConfigModel(cfg)
+	c.writeResource(resource, w)
+}
+
+func (c *Controller) GetServers(_ web.C, w http.ResponseWriter, r *http.Request) {
+	servers := []AuthServer{}
+	if err := c.db.Order("priority, id").Find(&servers).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resources := make([]AuthServerResource, len(servers))
+	for i := range servers {
+		resources[i].FromAuthServerModel(servers[i])
+	}
+
+	c.writeResource(resources, w)
+}
+
+func (c *Controller) CreateServer(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := AuthServerResource{}
+	if err = json.Unmarshal(reqBody, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	server := resource.ToAuthServerModel()
+	server.ID = 0
+
+	if err = c.db.Create(&server).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.AuthConfigChanged, map[string]string{"Server": server.Host})
+	c.apply(ctx)
+
+	c.writeServerResource(server, w)
+}
+
+func (c *Controller) UpdateServer(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	existing := AuthServer{}
+	if err := c.db.Find(&existing, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := AuthServerResource{}
+	if err = json.Unmarshal(reqBody, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	server := resource.ToAuthServerModel()
+	server.ID = existing.ID
+	if len(server.Secret) <= 0 {
+		server.Secret = existing.Secret // secret is only updated when specified
+	}
+
+	if err = c.db.Save(&server).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.AuthConfigChanged, map[string]string{"Server": server.Host})
+	c.apply(ctx)
+
+	c.writeServerResource(server, w)
+}
+
+func (c *Controller) DeleteServer(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	server := AuthServer{}
+	if err := c.db.Find(&server, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := c.db.Delete(&server).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.AuthConfigChanged, map[string]string{"Server": server.Host})
+	c.apply(ctx)
+
+	c.writeServerResource(server, w)
+}
+
+func (c *Controller) GetGroupMappings(_ web.C, w http.ResponseWriter, r *http.Request) {
+	mappings := []GroupMapping{}
+	if err := c.db.Find(&mappings).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.writeResource(mappings, w)
+}
+
+func (c *Controller) CreateGroupMapping(_ web.C, w http.ResponseWriter, r *http.Request) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	mapping := GroupMapping{}
+	if err = json.Unmarshal(reqBody, &mapping); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	mapping.ID = 0
+
+	if err = c.db.Create(&mapping).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.AuthConfigChanged, map[string]string{"RemoteGroup": mapping.RemoteGroup})
+	c.writeResource(mapping, w)
+}
+
+func (c *Controller) DeleteGroupMapping(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	mapping := GroupMapping{}
+	if err := c.db.Find(&mapping, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := c.db.Delete(&mapping).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.AuthConfigChanged, map[string]string{"RemoteGroup": mapping.RemoteGroup})
+	c.writeResource(mapping, w)
+}
+
+//
+// Authentication
+//
+
+// Authenticate verifies the credentials against the configured servers (in order of priority),
+// and returns the local groups that the remote groups of the user are mapped to. It satisfies the
+// host.RemoteAuthenticator interface.
+func (c *Controller) Authenticate(name, password string) ([]string, error) {
+	cfg, servers, err := c.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled || len(servers) <= 0 {
+		return nil, host.ErrRemoteAuthUnavailable
+	}
+	if len(password) <= 0 {
+		return nil, host.ErrBadCredentials
+	}
+
+	client := newAuthClient(cfg)
+	for _, server := range servers {
+		addr := server.Address(cfg)
+
+		remoteGroups, err := client.authenticate(addr, server.Secret, name, password)
+		switch err {
+		case nil:
+			c.log.Infof("User %s authenticated by %s server %s", name, cfg.Protocol, addr)
+			return c.localGroups(remoteGroups)
+		case errRejected:
+			return nil, host.ErrBadCredentials
+		case errUnknownUser:
+			c.log.Infof("User %s unknown to %s server %s", name, cfg.Protocol, addr)
+			return nil, host.ErrRemoteAuthUnavailable
+		default:
+			c.log.Warningf("Unable to reach %s server %s: %s", cfg.Protocol, addr, err)
+			events.Publish(events.AuthServerUnreachable, map[string]string{"Server": addr, "Error": err.Error()})
+		}
+	}
+
+	c.log.Warningln("No remote auth servers reachable, falling back to local users")
+	return nil, host.ErrRemoteAuthUnavailable
+}
+
+// localGroups returns the (names of the) local groups that the remote groups map to.
+func (c *Controller) localGroups(remoteGroups []string) ([]string, error) {
+	mappings := []GroupMapping{}
+	if err := c.db.Find(&mappings).Error; err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for _, m := range mappings {
+		for _, g := range remoteGroups {
+			if strings.EqualFold(g, m.RemoteGroup) {
+				found[m.LocalGroup] = true
+			}
+		}
+	}
+
+	groups := []string{}
+	for g := range found {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+//
+// Helpers
+//
+
+// apply rewrites the config files (and restarts the services) affected by the remote auth config.
+func (c *Controller) apply(ctx web.C) {
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply auth config to system (\"noapply\" present in env)")
+		return
+	}
+
+	if err := c.RewriteFiles(); err != nil {
+		c.log.Errorln("Failed to apply auth config:", err)
+		return
+	}
+	if c.rewritePam != nil {
+		if err := c.rewritePam(); err != nil {
+			c.log.Errorln("Failed to apply auth config to PAM:", err)
+			return
+		}
+	}
+
+	cfg := AuthConfig{}
+	if err := c.db.First(&cfg).Error; err != nil {
+		c.log.Errorln("Failed to load auth config:", err)
+		return
+	}
+
+	// nslcd only runs while LDAP is in use
+	upstart.StopJob("nslcd")
+	if cfg.Enabled && cfg.Protocol == ProtocolLDAP {
+		if err := upstart.StartJob("nslcd"); err != nil {
+			c.log.Errorln("Failed to start nslcd:", err)
+		}
+	}
+}
+
+// loadConfig loads the config and the servers (in the order they should be tried).
+func (c *Controller) loadConfig() (AuthConfig, []AuthServer, error) {
+	cfg := AuthConfig{}
+	if err := c.db.First(&cfg).Error; err != nil {
+		return cfg, nil, err
+	}
+
+	servers := []AuthServer{}
+	if err := c.db.Order("priority, id").Find(&servers).Error; err != nil {
+		return cfg, nil, err
+	}
+
+	return cfg, servers, nil
+}
+
+func (c *Controller) writeServerResource(server AuthServer, w http.ResponseWriter) {
+	resource := AuthServerResource{}
+	resource.FromAuthServerModel(server)
+	c.writeResource(resource, w)
+}
+
+func (c *Controller) writeResource(resource interface{}, w http.ResponseWriter) {
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) jsonError(err error, w http.ResponseWriter) {
+	// TODO: switch on err type
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+}
+
+// validateConfigString ensures the string can be safely placed in the generated config files, and
+// as an argument in the PAM config (where whitespace would split it).
+func validateConfigString(what, s string) error {
+	if strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("%s cannot contain whitespace or control chars", what)
+	}
+	return nil
+}
+
+//
+// DB Models
+//
+
+// AuthConfig is the (singleton) remote authentication config.
+type AuthConfig struct {
+	ID          int
+	Enabled     bool
+	Protocol    string // One of Protocol[LDAP|RADIUS|TACACS]
+	TimeoutSecs int
+
+	// LDAP only
+	UseTLS       bool
+	BaseDN       string // Under which users are looked up (by uid)
+	BindDN       string // Used to look users up (anonymous if unspecified)
+	BindPassword string
+}
+
+func (a *AuthConfig) BeforeSave(txn *gorm.DB) error {
+	if _, ok := defaultPorts[a.Protocol]; !ok {
+		return fmt.Errorf("Invalid protocol (%s), must be one of: %s, %s, %s",
+			a.Protocol, ProtocolLDAP, ProtocolRADIUS, ProtocolTACACS)
+	}
+	if a.TimeoutSecs <= 0 {
+		a.TimeoutSecs = DefaultTimeoutSecs
+	}
+	if a.TimeoutSecs > MaxTimeoutSecs {
+		return fmt.Errorf("Timeout cannot exceed %d seconds", MaxTimeoutSecs)
+	}
+
+	for what, s := range map[string]string{
+		"Base DN":       a.BaseDN,
+		"Bind DN":       a.BindDN,
+		"Bind password": a.BindPassword,
+	} {
+		if err := validateConfigString(what, s); err != nil {
+			return err
+		}
+	}
+
+	if !a.Enabled {
+		return nil
+	}
+
+	servers := []AuthServer{}
+	if err := txn.Find(&servers).Error; err != nil {
+		return err
+	}
+	if len(servers) <= 0 {
+		return fmt.Errorf("At least one server must be configured to enable remote authentication")
+	}
+
+	switch a.Protocol {
+	case ProtocolLDAP:
+		if len(a.BaseDN) <= 0 {
+			return fmt.Errorf("Base DN must be specified for LDAP")
+		}
+	case ProtocolRADIUS, ProtocolTACACS:
+		for _, s := range servers {
+			if len(s.Secret) <= 0 {
+				return fmt.Errorf("Server %s has no shared secret (needed for %s)", s.Host, a.Protocol)
+			}
+		}
+	}
+	return nil
+}
+
+// timeout returns how long to wait for a server.
+func (a AuthConfig) timeout() time.Duration {
+	return time.Duration(a.TimeoutSecs) * time.Second
+}
+
+// AuthServer is a remote server against which credentials are verified.
+type AuthServer struct {
+	ID       int64
+	Host     string
+	Port     int    // Defaults to the well known port of the protocol
+	Secret   string // Shared secret (RADIUS and TACACS+ only)
+	Priority int    // Servers are tried in ascending order of priority
+}
+
+func (s *AuthServer) BeforeSave(txn *gorm.DB) error {
+	if err := validateConfigString("Server host", s.Host); err != nil {
+		return err
+	}
+	if net.ParseIP(s.Host) == nil && !hostnameRegexp.MatchString(s.Host) {
+		return fmt.Errorf("Invalid server host (%s)", s.Host)
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("Invalid server port (%d)", s.Port)
+	}
+	if err := validateConfigString("Shared secret", s.Secret); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *AuthServer) BeforeCreate(txn *gorm.DB) error {
+	count := 0
+	if err := txn.Model(AuthServer{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count >= MaxServers {
+		return fmt.Errorf("Cannot configure more than %d servers", MaxServers)
+	}
+	return nil
+}
+
+func (s *AuthServer) BeforeDelete(txn *gorm.DB) error {
+	cfg := AuthConfig{}
+	if err := txn.First(&cfg).Error; err != nil {
+		return err
+	}
+
+	count := 0
+	if err := txn.Model(AuthServer{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if cfg.Enabled && count <= 1 {
+		return fmt.Errorf("Cannot delete the last server while remote authentication is enabled")
+	}
+	return nil
+}
+
+// Address returns the address (host:port) at which the server is reached.
+func (s AuthServer) Address(cfg AuthConfig) string {
+	port := s.Port
+	if port == 0 {
+		port = defaultPorts[cfg.Protocol]
+		if cfg.Protocol == ProtocolLDAP && cfg.UseTLS {
+			port = defaultLDAPSPort
+		}
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+// GroupMapping grants members of the remote group membership of the local group.
+type GroupMapping struct {
+	ID          int64
+	RemoteGroup string // As reported by the server (the CN of groups in LDAP)
+	LocalGroup  string // Name of a host group
+}
+
+func (m *GroupMapping) BeforeSave(txn *gorm.DB) error {
+	if len(m.RemoteGroup) <= 0 {
+		return fmt.Errorf("Remote group must be specified")
+	}
+	if err := txn.Where(host.Group{Name: m.LocalGroup}).First(&host.Group{}).Error; err != nil {
+		return fmt.Errorf("No such local group: %s", m.LocalGroup)
+	}
+
+	existing := GroupMapping{}
+	err := txn.Where(GroupMapping{RemoteGroup: m.RemoteGroup, LocalGroup: m.LocalGroup}).First(&existing).Error
+	if err == nil && existing.ID != m.ID {
+		return fmt.Errorf("%s is already mapped to %s", m.RemoteGroup, m.LocalGroup)
+	}
+	return nil
+}
+
+//
+// Resources
+//
+
+type AuthConfigResource struct {
+	Enabled      bool
+	Protocol     string
+	TimeoutSecs  int
+	UseTLS       bool
+	BaseDN       string
+	BindDN       string
+	BindPassword string // WRITE ONLY
+}
+
+func (r AuthConfigResource) ToAuthConfigModel() AuthConfig {
+	return AuthConfig{
+		ID:           1,
+		Enabled:      r.Enabled,
+		Protocol:     r.Protocol,
+		TimeoutSecs:  r.TimeoutSecs,
+		UseTLS:       r.UseTLS,
+		BaseDN:       r.BaseDN,
+		BindDN:       r.BindDN,
+		BindPassword: r.BindPassword,
+	}
+}
+
+func (r *AuthConfigResource) FromAuthConfigModel(m AuthConfig) {
+	r.Enabled = m.Enabled
+	r.Protocol = m.Protocol
+	r.TimeoutSecs = m.TimeoutSecs
+	r.UseTLS = m.UseTLS
+	r.BaseDN = m.BaseDN
+	r.BindDN = m.BindDN
+
+	// NEVER return the password
+	// r.BindPassword = m.BindPassword
+}
+
+type AuthServerResource struct {
+	ID       int64
+	Host     string
+	Port     int
+	Secret   string // WRITE ONLY
+	Priority int
+}
+
+func (r AuthServerResource) ToAuthServerModel() AuthServer {
+	return AuthServer{
+		ID:       r.ID,
+		Host:     r.Host,
+		Port:     r.Port,
+		Secret:   r.Secret,
+		Priority: r.Priority,
+	}
+}
+
+func (r *AuthServerResource) FromAuthServerModel(m AuthServer) {
+	r.ID = m.ID
+	r.Host = m.Host
+	r.Port = m.Port
+	r.Priority = m.Priority
+
+	// NEVER return the secret
+	// r.Secret = m.Secret
+}
+
+//
+// DB
+//
+
+func (c *Controller) MigrateDB() {
+	c.log.Infoln("Migrating auth tables")
+	c.db.AutoMigrate(&AuthConfig{})
+	c.db.AutoMigrate(&AuthServer{})
+	c.db.AutoMigrate(&GroupMapping{})
+}
+
+func (c *Controller) SeedDB() {
+	c.log.Infoln("Seeding auth tables")
+	cfg := AuthConfig{ID: 1}
+	c.db.Where(cfg).Attrs(AuthConfig{Protocol: ProtocolLDAP, TimeoutSecs: DefaultTimeoutSecs}).FirstOrCreate(&cfg)
+}
+
+func (c *Controller) DropDB() {
+	c.log.Infoln("Dropping auth tables")
+	c.db.DropTable(&AuthConfig{})
+	c.db.DropTable(&AuthServer{})
+	c.db.DropTable(&GroupMapping{})
+}
@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rocketship/commander/modules/host"
+
+	"github.com/amoghe/distillog"
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "gopkg.in/check.v1"
+)
+
+type AuthTestSuite struct {
+	db         gorm.DB
+	controller *Controller
+	host       *host.Controller
+}
+
+// Register the test suites with gocheck.
+func init() {
+	Suite(&AuthTestSuite{})
+	Suite(&ClientsTestSuite{})
+}
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (ts *AuthTestSuite) SetUpTest(c *C) {
+	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
+	c.Assert(err, IsNil)
+
+	// Comment this for db logs during tests
+	db.SetLogger(log.New(ioutil.Discard, "", 0))
+	ts.db = db
+
+	// Group mappings refer to host groups
+	ts.host = host.NewController(&ts.db, distillog.NewNullLogger(""))
+	ts.host.MigrateDB()
+	ts.host.SeedDB()
+
+	ts.controller = NewController(&ts.db, distillog.NewNullLogger(""))
+	ts.controller.MigrateDB()
+	ts.controller.SeedDB()
+
+	ts.host.SetRemoteAuthenticator(ts.controller)
+}
+
+func (ts *AuthTestSuite) TearDownTest(c *C) {
+	ts.db.Close()
+}
+
+func (ts *AuthTestSuite) TestConfigValidation(c *C) {
+	cfg := AuthConfig{ID: 1, Protocol: ProtocolRADIUS}
+	c.Assert(ts.db.Save(&cfg).Error, IsNil)
+	c.Assert(cfg.TimeoutSecs, Equals, DefaultTimeoutSecs)
+
+	for _, invalid := range []AuthConfig{
+		{ID: 1, Protocol: "kerberos"},
+		{ID: 1, Protocol: ProtocolLDAP, TimeoutSecs: MaxTimeoutSecs + 1},
+		{ID: 1, Protocol: ProtocolLDAP, BaseDN: "dc=enterprise\nuri ldap://evil"},
+		{ID: 1, Protocol: ProtocolLDAP, BaseDN: "dc=enterprise", BindPassword: "two words"},
+		{ID: 1, Protocol: ProtocolRADIUS, Enabled: true}, // no servers
+	} {
+		c.Assert(ts.db.Save(&invalid).Error, NotNil, Commentf("config: %+v", invalid))
+	}
+
+	for _, invalid := range []AuthServer{
+		{Host: ""},
+		{Host: "bad host"},
+		{Host: "10.0.0.1", Port: 65536},
+		{Host: "10.0.0.1", Secret: "has spaces"},
+		{Host: "10.0.0.1", Secret: "tab\tsecret"},
+		{Host: "radius.enterprise.com\t"},
+	} {
+		c.Assert(ts.db.Create(&invalid).Error, NotNil, Commentf("server: %+v", invalid))
+	}
+
+	server := AuthServer{Host: "radius.enterprise.com"}
+	c.Assert(ts.db.Create(&server).Error, IsNil)
+
+	// RADIUS needs shared secrets, LDAP a base DN
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Protocol: ProtocolRADIUS, Enabled: true}).Error, NotNil)
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Protocol: ProtocolLDAP, Enabled: true}).Error, NotNil)
+
+	server.Secret = testSecret
+	c.Assert(ts.db.Save(&server).Error, IsNil)
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Protocol: ProtocolRADIUS, Enabled: true}).Error, IsNil)
+
+	// The last server can't go while it is in use
+	c.Assert(ts.db.Delete(&server).Error, NotNil)
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Protocol: ProtocolRADIUS}).Error, IsNil)
+	c.Assert(ts.db.Delete(&server).Error, IsNil)
+}
+
+func (ts *AuthTestSuite) TestGroupMappingValidation(c *C) {
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "captains", LocalGroup: "nosuchgroup"}).Error, NotNil)
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "", LocalGroup: host.SudoGroupName}).Error, NotNil)
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "captains", LocalGroup: host.SudoGroupName}).Error, IsNil)
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "captains", LocalGroup: host.SudoGroupName}).Error, NotNil)
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "captains", LocalGroup: "adm"}).Error, IsNil)
+}
+
+func (ts *AuthTestSuite) TestEndpointHandlers(c *C) {
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+
+	rec := do(ts.controller.CreateServer, nil, `{"Host": "10.0.0.1", "Secret": "s3cr3t"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(rec.Body.String(), "s3cr3t"), Equals, false)
+
+	server := AuthServerResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &server), IsNil)
+	params := map[string]string{"id": fmt.Sprint(server.ID)}
+
+	// The secret is retained unless specified
+	rec = do(ts.controller.UpdateServer, params, `{"Host": "10.0.0.2", "Priority": 1}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	model := AuthServer{}
+	c.Assert(ts.db.First(&model, server.ID).Error, IsNil)
+	c.Assert(model.Host, Equals, "10.0.0.2")
+	c.Assert(model.Secret, Equals, "s3cr3t")
+
+	rec = do(ts.controller.PutConfig, nil, `{"Enabled": true, "Protocol": "radius"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.GetConfig, nil, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	cfg := AuthConfigResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &cfg), IsNil)
+	c.Assert(cfg.Enabled, Equals, true)
+	c.Assert(cfg.TimeoutSecs, Equals, DefaultTimeoutSecs)
+
+	rec = do(ts.controller.DeleteServer, params, "")
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.CreateGroupMapping, nil, `{"RemoteGroup": "captains", "LocalGroup": "sudo"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	rec = do(ts.controller.GetGroupMappings, nil, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	mappings := []GroupMapping{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &mappings), IsNil)
+	c.Assert(mappings, HasLen, 1)
+
+	rec = do(ts.controller.DeleteGroupMapping, map[string]string{"id": fmt.Sprint(mappings[0].ID)}, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+}
+
+func (ts *AuthTestSuite) TestFileContents(c *C) {
+	c.Assert(ts.db.Create(&AuthServer{Host: "10.0.0.1", Secret: testSecret}).Error, IsNil)
+	c.Assert(ts.db.Create(&AuthServer{Host: "10.0.0.2", Port: 1645, Secret: testSecret}).Error, IsNil)
+
+	// Nothing remote while disabled
+	cfg, servers, err := ts.controller.loadConfig()
+	c.Assert(err, IsNil)
+	contents, err := nsswitchFileContents(cfg, servers)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, "(?ms).*^passwd: +compat$.*")
+	lines, err := ts.controller.PamAuthLines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, HasLen, 0)
+
+	// LDAP
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Enabled: true, Protocol: ProtocolLDAP, BaseDN: testBaseDN,
+		BindDN: testBindDN, BindPassword: testBindPass}).Error, IsNil)
+	cfg, servers, err = ts.controller.loadConfig()
+	c.Assert(err, IsNil)
+
+	contents, err = nsswitchFileContents(cfg, servers)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, "(?ms).*^passwd: +compat ldap$.*")
+	c.Assert(string(contents), Matches, "(?ms).*^group: +compat ldap$.*")
+
+	contents, err = nslcdConfFileContents(cfg, servers)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, "(?ms).*^uri ldap://10.0.0.1:389/\nuri ldap://10.0.0.2:1645/$.*")
+	c.Assert(string(contents), Matches, "(?ms).*^base "+testBaseDN+"$.*")
+	c.Assert(string(contents), Matches, "(?ms).*^bindpw "+testBindPass+"$.*")
+	c.Assert(string(contents), Matches, `(?ms).*^map passwd loginShell "/bin/shell"$.*`)
+
+	lines, err = ts.controller.PamAuthLines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, DeepEquals, []string{"auth\t" + pamRemoteAuthControl + "\tpam_ldap.so"})
+
+	// RADIUS
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Enabled: true, Protocol: ProtocolRADIUS}).Error, IsNil)
+	cfg, servers, err = ts.controller.loadConfig()
+	c.Assert(err, IsNil)
+
+	contents, err = pamRadiusConfFileContents(cfg, servers)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, "(?ms).*^10.0.0.1:1812\t"+testSecret+"\t5\n10.0.0.2:1645\t"+testSecret+"\t5\n")
+
+	contents, err = nslcdConfFileContents(cfg, servers)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "uri"), Equals, false)
+
+	// TACACS+ (the servers go in the PAM config)
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Enabled: true, Protocol: ProtocolTACACS}).Error, IsNil)
+	lines, err = ts.controller.PamAuthLines()
+	c.Assert(err, IsNil)
+	c.Assert(lines, HasLen, 1)
+	c.Assert(lines[0], Matches, ".*pam_tacplus.so server=10.0.0.1:49 secret="+testSecret+
+		" server=10.0.0.2:1645 secret="+testSecret+" timeout=5 login=pap")
+}
+
+func (ts *AuthTestSuite) TestAuthenticate(c *C) {
+	server := newStandInRadiusServer(c, testSecret)
+	defer server.close()
+	ts.useRadiusServers(c, server.addr())
+
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "Captains", LocalGroup: host.SudoGroupName}).Error, IsNil)
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "starfleet", LocalGroup: "adm"}).Error, IsNil)
+
+	groups, err := ts.controller.Authenticate("picard", "engage")
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{"adm", host.SudoGroupName})
+
+	groups, err = ts.controller.Authenticate("wesley", "shutup")
+	c.Assert(err, IsNil)
+	c.Assert(groups, HasLen, 0)
+
+	_, err = ts.controller.Authenticate("picard", "disengage")
+	c.Assert(err, Equals, host.ErrBadCredentials)
+	_, err = ts.controller.Authenticate("picard", "")
+	c.Assert(err, Equals, host.ErrBadCredentials)
+
+	// Disabled
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Protocol: ProtocolRADIUS}).Error, IsNil)
+	_, err = ts.controller.Authenticate("picard", "engage")
+	c.Assert(err, Equals, host.ErrRemoteAuthUnavailable)
+}
+
+func (ts *AuthTestSuite) TestFailoverAndFallback(c *C) {
+	server := newStandInRadiusServer(c, testSecret)
+	defer server.close()
+
+	// The first server is unreachable, so the second one is consulted
+	ts.useRadiusServers(c, unreachableAddr(c), server.addr())
+	_, err := ts.controller.Authenticate("picard", "engage")
+	c.Assert(err, IsNil)
+
+	// Neither is reachable, so the local users are consulted
+	ts.useRadiusServers(c, unreachableAddr(c), unreachableAddr(c))
+	_, err = ts.controller.Authenticate("picard", "engage")
+	c.Assert(err, Equals, host.ErrRemoteAuthUnavailable)
+}
+
+func (ts *AuthTestSuite) TestHostLogin(c *C) {
+	c.Assert(ts.db.Create(&host.User{Name: "jdoe", Password: "somepass"}).Error, IsNil)
+	c.Assert(ts.db.Create(&GroupMapping{RemoteGroup: "captains", LocalGroup: host.SudoGroupName}).Error, IsNil)
+
+	login := func(name, password string) (int, host.UserResource) {
+		jsonStr := fmt.Sprintf(`{"Name": "%s", "Password": "%s"}`, name, password)
+		req, err := http.NewRequest("POST", "/dont/care", bytes.NewBufferString(jsonStr))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		ts.host.Login(web.C{Env: map[interface{}]interface{}{NoApplyEnvKey: true}}, rec, req)
+
+		user := host.UserResource{}
+		if rec.Code == http.StatusOK {
+			c.Assert(json.Unmarshal(rec.Body.Bytes(), &user), IsNil)
+		}
+		return rec.Code, user
+	}
+
+	server := newStandInRadiusServer(c, testSecret)
+	defer server.close()
+	ts.useRadiusServers(c, server.addr())
+
+	code, user := login("picard", "engage")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(user.Remote, Equals, true)
+	c.Assert(user.Groups, DeepEquals, []string{host.SudoGroupName})
+
+	// The servers have the final say (while reachable)
+	code, _ = login("jdoe", "somepass")
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	// ... but local users can log in when they aren't
+	ts.useRadiusServers(c, unreachableAddr(c))
+	code, user = login("jdoe", "somepass")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(user.Remote, Equals, false)
+	code, _ = login("picard", "engage")
+	c.Assert(code, Equals, http.StatusUnauthorized)
+}
+
+// useRadiusServers replaces the configured servers, and enables RADIUS authentication.
+func (ts *AuthTestSuite) useRadiusServers(c *C, addrs ...string) {
+	c.Assert(ts.db.Save(&AuthConfig{ID: 1, Protocol: ProtocolRADIUS}).Error, IsNil)
+	c.Assert(ts.db.Exec("DELETE FROM auth_servers").Error, IsNil)
+
+	for i, addr := range addrs {
+		h, p, err := net.SplitHostPort(addr)
+		c.Assert(err, IsNil)
+		port, err := net.LookupPort("udp", p)
+		c.Assert(err, IsNil)
+
+		server := AuthServer{Host: h, Port: port, Secret: testSecret, Priority: i}
+		c.Assert(ts.db.Create(&server).Error, IsNil)
+	}
+
+	cfg := AuthConfig{ID: 1, Enabled: true, Protocol: ProtocolRADIUS, TimeoutSecs: 1}
+	c.Assert(ts.db.Save(&cfg).Error, IsNil)
+}
+
+// unreachableAddr returns an address at which nothing is listening.
+func unreachableAddr(c *C) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
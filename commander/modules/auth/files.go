@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	NsswitchFilePath      = "/etc/nsswitch.conf"
+	NslcdConfFilePath     = "/etc/nslcd.conf"
+	PamRadiusConfFilePath = "/etc/pam_radius_auth.conf"
+
+	// Login shell of users that are only known to the LDAP servers (the rocketship CLI)
+	RemoteUserShell = "/bin/shell"
+
+	// PAM control flags for the remote auth modules: a verdict from the servers is final, but if
+	// they can't be reached (or don't know the user) the local users are consulted.
+	pamRemoteAuthControl = "[success=done new_authtok_reqd=done authinfo_unavail=ignore user_unknown=ignore default=die]"
+)
+
+// RewriteFiles rewrites the name service and PAM module config files for remote authentication.
+// The PAM stack itself is owned by the host module (see PamAuthLines).
+func (c *Controller) RewriteFiles() error {
+	c.log.Infoln("Rewriting auth configuration files")
+
+	cfg, servers, err := c.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	for path, file := range map[string]struct {
+		contents func(AuthConfig, []AuthServer) ([]byte, error)
+		mode     os.FileMode
+	}{
+		NsswitchFilePath:      {nsswitchFileContents, 0644},
+		NslcdConfFilePath:     {nslcdConfFileContents, 0600},     // has the bind password
+		PamRadiusConfFilePath: {pamRadiusConfFileContents, 0600}, // has the shared secrets
+	} {
+		contents, err := file.contents(cfg, servers)
+		if err != nil {
+			return err
+		}
+
+		// WriteFile does not change the mode of existing files
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = ioutil.WriteFile(path, contents, file.mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PamAuthLines returns the lines that hand off authentication to the configured servers. It
+// satisfies the host.RemoteAuthenticator interface.
+func (c *Controller) PamAuthLines() ([]string, error) {
+	cfg, servers, err := c.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Enabled || len(servers) <= 0 {
+		return []string{}, nil
+	}
+
+	module := ""
+	switch cfg.Protocol {
+	case ProtocolLDAP:
+		module = "pam_ldap.so"
+	case ProtocolRADIUS:
+		module = "pam_radius_auth.so" // servers are in PamRadiusConfFilePath
+	case ProtocolTACACS:
+		args := []string{"pam_tacplus.so"}
+		for _, s := range servers {
+			args = append(args, "server="+s.Address(cfg), "secret="+s.Secret)
+		}
+		args = append(args, fmt.Sprintf("timeout=%d", cfg.TimeoutSecs), "login=pap")
+		module = strings.Join(args, " ")
+	default:
+		return nil, fmt.Errorf("Unknown protocol: %s", cfg.Protocol)
+	}
+
+	return []string{fmt.Sprintf("auth\t%s\t%s", pamRemoteAuthControl, module)}, nil
+}
+
+func nsswitchFileContents(cfg AuthConfig, _ []AuthServer) ([]byte, error) {
+	return executeTemplate(nsswitchTemplate, struct {
+		GenTime string
+		LDAP    bool
+	}{
+		time.Now().String(),
+		cfg.Enabled && cfg.Protocol == ProtocolLDAP,
+	})
+}
+
+func nslcdConfFileContents(cfg AuthConfig, servers []AuthServer) ([]byte, error) {
+	uris := []string{}
+	if cfg.Enabled && cfg.Protocol == ProtocolLDAP {
+		scheme := "ldap"
+		if cfg.UseTLS {
+			scheme = "ldaps"
+		}
+		for _, s := range servers {
+			uris = append(uris, fmt.Sprintf("%s://%s/", scheme, s.Address(cfg)))
+		}
+	}
+
+	return executeTemplate(nslcdConfTemplate, struct {
+		GenTime      string
+		URIs         []string
+		BaseDN       string
+		BindDN       string
+		BindPassword string
+		TimeoutSecs  int
+		UseTLS       bool
+		LoginShell   string
+	}{
+		time.Now().String(),
+		uris,
+		cfg.BaseDN,
+		cfg.BindDN,
+		cfg.BindPassword,
+		cfg.TimeoutSecs,
+		cfg.UseTLS,
+		RemoteUserShell,
+	})
+}
+
+func pamRadiusConfFileContents(cfg AuthConfig, servers []AuthServer) ([]byte, error) {
+	type radiusServer struct {
+		Address string
+		Secret  string
+	}
+
+	radiusServers := []radiusServer{}
+	if cfg.Enabled && cfg.Protocol == ProtocolRADIUS {
+		for _, s := range servers {
+			radiusServers = append(radiusServers, radiusServer{s.Address(cfg), s.Secret})
+		}
+	}
+
+	return executeTemplate(pamRadiusConfTemplate, struct {
+		GenTime     string
+		Servers     []radiusServer
+		TimeoutSecs int
+	}{
+		time.Now().String(),
+		radiusServers,
+		cfg.TimeoutSecs,
+	})
+}
+
+func executeTemplate(tmplStr string, data interface{}) ([]byte, error) {
+	tmpl, err := template.New("auth").Parse(tmplStr)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	retbuf := &bytes.Buffer{}
+	if err = tmpl.Execute(retbuf, data); err != nil {
+		return []byte{}, err
+	}
+
+	return retbuf.Bytes(), nil
+}
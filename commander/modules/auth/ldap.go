@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// LDAP (RFC 4511) protocol ops, result codes and BER tags of interest to us.
+const (
+	ldapOpBindRequest     = 0x60
+	ldapOpBindResponse    = 0x61
+	ldapOpUnbindRequest   = 0x42
+	ldapOpSearchRequest   = 0x63
+	ldapOpSearchEntry     = 0x64
+	ldapOpSearchDone      = 0x65
+	ldapOpSearchRef       = 0x73
+	ldapFilterEquality    = 0xa3
+	ldapAuthSimple        = 0x80
+	ldapResultSuccess     = 0
+	ldapResultBadCreds    = 49
+	ldapScopeSubtree      = 2
+	ldapNeverDerefAlias   = 0
+	ldapProtocolVersion   = 3
+	ldapMaxMessageLen     = 1 << 20
+	ldapUserAttribute     = "uid"
+	ldapMemberOfAttribute = "memberOf"
+
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	berTagSet         = 0x31
+)
+
+// ldapClient looks the user up (by uid) under the base DN, and then verifies the password by
+// binding as the user. The groups of the user are the CNs of the groups in its memberOf attribute.
+type ldapClient struct {
+	cfg AuthConfig
+}
+
+func (l *ldapClient) authenticate(addr, _, name, password string) ([]string, error) {
+	// An empty password would make for an (always successful) unauthenticated bind.
+	if len(password) <= 0 {
+		return nil, errRejected
+	}
+
+	conn, err := l.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(l.cfg.timeout())); err != nil {
+		return nil, err
+	}
+
+	session := &ldapSession{conn: conn, reader: bufio.NewReader(conn)}
+	defer session.unbind()
+
+	if len(l.cfg.BindDN) > 0 {
+		if err = session.bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("unable to bind as %s: %s", l.cfg.BindDN, err)
+		}
+	}
+
+	dn, memberOf, err := session.findUser(l.cfg.BaseDN, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = session.bind(dn, password); err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	for _, groupDN := range memberOf {
+		groups = append(groups, ldapFirstRDNValue(groupDN))
+	}
+	return groups, nil
+}
+
+func (l *ldapClient) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: l.cfg.timeout()}
+	if !l.cfg.UseTLS {
+		return dialer.Dial("tcp", addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+}
+
+// ldapSession is a connection to an LDAP server on which requests are made one at a time.
+type ldapSession struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+// bind binds as the specified DN, returning errRejected if the credentials are incorrect.
+func (s *ldapSession) bind(dn, password string) error {
+	err := s.send(berTLV(ldapOpBindRequest,
+		berInt(berTagInteger, ldapProtocolVersion),
+		berString(berTagOctetString, dn),
+		berString(ldapAuthSimple, password)))
+	if err != nil {
+		return err
+	}
+
+	op, err := s.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapOpBindResponse {
+		return fmt.Errorf("unexpected response (tag: %#x) to bind", op.tag)
+	}
+
+	return ldapResultError(op)
+}
+
+// findUser returns the DN and groups (memberOf) of the named user.
+func (s *ldapSession) findUser(baseDN, name string) (string, []string, error) {
+	err := s.send(berTLV(ldapOpSearchRequest,
+		berString(berTagOctetString, baseDN),
+		berInt(berTagEnumerated, ldapScopeSubtree),
+		berInt(berTagEnumerated, ldapNeverDerefAlias),
+		berInt(berTagInteger, 2), // more than one match is an error anyway
+		berInt(berTagInteger, 0),
+		berTLV(berTagBoolean, []byte{0}),
+		berTLV(ldapFilterEquality,
+			berString(berTagOctetString, ldapUserAttribute),
+			berString(berTagOctetString, name)),
+		berTLV(berTagSequence, berString(berTagOctetString, ldapMemberOfAttribute))))
+	if err != nil {
+		return "", nil, err
+	}
+
+	dns, memberOf := []string{}, []string{}
+	for {
+		op, err := s.receive()
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch op.tag {
+		case ldapOpSearchEntry:
+			dn, values, err := parseLDAPSearchEntry(op, ldapMemberOfAttribute)
+			if err != nil {
+				return "", nil, err
+			}
+			dns = append(dns, dn)
+			memberOf = append(memberOf, values...)
+		case ldapOpSearchRef:
+			// we don't chase referrals
+		case ldapOpSearchDone:
+			if len(dns) > 1 {
+				return "", nil, fmt.Errorf("multiple entries match %s=%s", ldapUserAttribute, name)
+			}
+			if err = ldapResultError(op); err != nil {
+				return "", nil, err
+			}
+			if len(dns) <= 0 {
+				return "", nil, errUnknownUser
+			}
+			return dns[0], memberOf, nil
+		default:
+			return "", nil, fmt.Errorf("unexpected response (tag: %#x) to search", op.tag)
+		}
+	}
+}
+
+func (s *ldapSession) unbind() {
+	s.send(berTLV(ldapOpUnbindRequest))
+}
+
+func (s *ldapSession) send(op []byte) error {
+	s.messageID++
+	_, err := s.conn.Write(berTLV(berTagSequence, berInt(berTagInteger, s.messageID), op))
+	return err
+}
+
+// receive returns the protocol op of the next message (for the outstanding request).
+func (s *ldapSession) receive() (berElement, error) {
+	msg, err := readBER(s.reader)
+	if err != nil {
+		return berElement{}, err
+	}
+	if msg.tag != berTagSequence {
+		return berElement{}, fmt.Errorf("malformed message")
+	}
+
+	elems, err := msg.children()
+	if err != nil {
+		return berElement{}, err
+	}
+	if len(elems) < 2 || elems[0].tag != berTagInteger || elems[0].intValue() != s.messageID {
+		return berElement{}, fmt.Errorf("malformed message (or response to another request)")
+	}
+	return elems[1], nil
+}
+
+// ldapResultError returns the error indicated by the (LDAPResult of the) response.
+func ldapResultError(op berElement) error {
+	elems, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(elems) < 3 || elems[0].tag != berTagEnumerated {
+		return fmt.Errorf("malformed result")
+	}
+
+	switch code := elems[0].intValue(); code {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultBadCreds:
+		return errRejected
+	default:
+		return fmt.Errorf("ldap error %d: %s", code, elems[2].content)
+	}
+}
+
+// parseLDAPSearchEntry returns the DN of the entry and the values of the specified attribute.
+func parseLDAPSearchEntry(op berElement, attr string) (string, []string, error) {
+	elems, err := op.children()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(elems) < 2 {
+		return "", nil, fmt.Errorf("malformed search entry")
+	}
+
+	attrs, err := elems[1].children()
+	if err != nil {
+		return "", nil, err
+	}
+
+	values := []string{}
+	for _, a := range attrs {
+		parts, err := a.children()
+		if err != nil {
+			return "", nil, err
+		}
+		if len(parts) < 2 || !strings.EqualFold(string(parts[0].content), attr) {
+			continue
+		}
+
+		vals, err := parts[1].children()
+		if err != nil {
+			return "", nil, err
+		}
+		for _, v := range vals {
+			values = append(values, string(v.content))
+		}
+	}
+
+	return string(elems[0].content), values, nil
+}
+
+// ldapFirstRDNValue returns the value of the first RDN of the DN (e.g. "admins" for
+// "cn=admins,ou=groups,dc=example,dc=com").
+func ldapFirstRDNValue(dn string) string {
+	rdn := strings.SplitN(dn, ",", 2)[0]
+	if i := strings.Index(rdn, "="); i >= 0 {
+		return strings.TrimSpace(rdn[i+1:])
+	}
+	return dn
+}
+
+//
+// BER (the subset of it that LDAP uses)
+//
+
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// children parses the content of a constructed element.
+func (e berElement) children() ([]berElement, error) {
+	elems := []berElement{}
+	reader := bufio.NewReader(bytes.NewReader(e.content))
+	for {
+		elem, err := readBER(reader)
+		if err == io.EOF {
+			return elems, nil
+		} else if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+}
+
+func (e berElement) intValue() int {
+	v := 0
+	for _, b := range e.content {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+func readBER(r *bufio.Reader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+
+	length, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, io.ErrUnexpectedEOF
+	}
+
+	contentLen := int(length)
+	if length&0x80 != 0 {
+		numBytes := int(length & 0x7f)
+		if numBytes <= 0 || numBytes > 4 {
+			return berElement{}, fmt.Errorf("unsupported BER length")
+		}
+		contentLen = 0
+		for i := 0; i < numBytes; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, io.ErrUnexpectedEOF
+			}
+			contentLen = contentLen<<8 | int(b)
+		}
+	}
+	if contentLen > ldapMaxMessageLen {
+		return berElement{}, fmt.Errorf("BER element too long")
+	}
+
+	content := make([]byte, contentLen)
+	if _, err = io.ReadFull(r, content); err != nil {
+		return berElement{}, io.ErrUnexpectedEOF
+	}
+	return berElement{tag, content}, nil
+}
+
+func berTLV(tag byte, contents ...[]byte) []byte {
+	content := []byte{}
+	for _, c := range contents {
+		content = append(content, c...)
+	}
+
+	ret := []byte{tag}
+	if len(content) < 0x80 {
+		ret = append(ret, byte(len(content)))
+	} else {
+		lenBytes := []byte{}
+		for n := len(content); n > 0; n >>= 8 {
+			lenBytes = append([]byte{byte(n)}, lenBytes...)
+		}
+		ret = append(ret, 0x80|byte(len(lenBytes)))
+		ret = append(ret, lenBytes...)
+	}
+	return append(ret, content...)
+}
+
+// berInt encodes a (small, non negative) integer.
+func berInt(tag byte, v int) []byte {
+	content := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		content = append([]byte{byte(v)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...) // keep it positive
+	}
+	return berTLV(tag, content)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
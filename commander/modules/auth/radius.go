@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RADIUS (RFC 2865) packet codes and attribute types of interest to us.
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	radiusAttrUserName             = 1
+	radiusAttrUserPassword         = 2
+	radiusAttrFilterID             = 11
+	radiusAttrClass                = 25
+	radiusAttrNASIdentifier        = 32
+	radiusAttrMessageAuthenticator = 80 // RFC 3579
+
+	radiusHeaderLen      = 20
+	radiusAuthLen        = 16
+	radiusMaxPacketLen   = 4096
+	radiusMaxAttrLen     = 253
+	radiusMaxPasswordLen = 128
+
+	// Identifies us to the RADIUS servers
+	radiusNASIdentifier = "rocketship"
+)
+
+// radiusClient verifies credentials using (PAP) Access-Requests. The groups of the user are taken
+// from the Class and Filter-Id attributes of the Access-Accept.
+type radiusClient struct {
+	timeout time.Duration
+}
+
+func (r *radiusClient) authenticate(addr, secret, name, password string) ([]string, error) {
+	if len(password) > radiusMaxPasswordLen {
+		return nil, errRejected
+	}
+
+	request, err := radiusAccessRequestPacket(secret, name, password)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", addr, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(r.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, radiusMaxPacketLen)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Packets that don't answer our request (or can't be authenticated) are silently dropped.
+		code, attrs, err := parseRadiusResponse(buf[:n], request, secret)
+		if err != nil {
+			continue
+		}
+
+		switch code {
+		case radiusAccessAccept:
+			groups := []string{}
+			for _, attr := range attrs {
+				if attr.typ == radiusAttrClass || attr.typ == radiusAttrFilterID {
+					groups = append(groups, string(attr.value))
+				}
+			}
+			return groups, nil
+		case radiusAccessReject, radiusAccessChallenge:
+			// we have no way to answer challenges
+			return nil, errRejected
+		}
+	}
+}
+
+type radiusAttr struct {
+	typ   byte
+	value []byte
+}
+
+// radiusAccessRequestPacket returns an Access-Request for the credentials.
+func radiusAccessRequestPacket(secret, name, password string) ([]byte, error) {
+	if len(name) <= 0 || len(name) > radiusMaxAttrLen {
+		return nil, fmt.Errorf("invalid user name length")
+	}
+
+	// The first byte is used as the id, the rest as the request authenticator
+	random := make([]byte, 1+radiusAuthLen)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	id, authenticator := random[0], random[1:]
+
+	attrs := []radiusAttr{
+		{radiusAttrUserName, []byte(name)},
+		{radiusAttrUserPassword, radiusHidePassword(secret, authenticator, password)},
+		{radiusAttrNASIdentifier, []byte(radiusNASIdentifier)},
+		{radiusAttrMessageAuthenticator, make([]byte, radiusAuthLen)}, // computed below
+	}
+
+	packet := radiusPacket(radiusAccessRequest, id, authenticator, attrs)
+
+	// The message authenticator is the last attribute, computed over the whole packet
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(packet)
+	copy(packet[len(packet)-radiusAuthLen:], mac.Sum(nil))
+
+	return packet, nil
+}
+
+// parseRadiusResponse verifies that the packet is a response to the request, and returns its code
+// and attributes.
+func parseRadiusResponse(packet, request []byte, secret string) (byte, []radiusAttr, error) {
+	if len(packet) < radiusHeaderLen {
+		return 0, nil, fmt.Errorf("short packet")
+	}
+
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if length < radiusHeaderLen || length > len(packet) {
+		return 0, nil, fmt.Errorf("invalid packet length")
+	}
+	packet = packet[:length]
+
+	if packet[1] != request[1] {
+		return 0, nil, fmt.Errorf("response to some other request")
+	}
+
+	// ResponseAuth = MD5(Code+ID+Length+RequestAuth+Attributes+Secret)
+	hash := md5.New()
+	hash.Write(packet[:4])
+	hash.Write(request[4:radiusHeaderLen])
+	hash.Write(packet[radiusHeaderLen:])
+	hash.Write([]byte(secret))
+	if !hmac.Equal(hash.Sum(nil), packet[4:radiusHeaderLen]) {
+		return 0, nil, fmt.Errorf("invalid response authenticator")
+	}
+
+	attrs, err := parseRadiusAttrs(packet[radiusHeaderLen:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// If present, the message authenticator is computed with the request authenticator in place.
+	offset := radiusHeaderLen
+	for _, attr := range attrs {
+		offset += 2 + len(attr.value)
+		if attr.typ != radiusAttrMessageAuthenticator {
+			continue
+		}
+
+		unsigned := append([]byte{}, packet...)
+		copy(unsigned[4:radiusHeaderLen], request[4:radiusHeaderLen])
+		copy(unsigned[offset-radiusAuthLen:offset], make([]byte, radiusAuthLen))
+
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(unsigned)
+		if !hmac.Equal(mac.Sum(nil), attr.value) {
+			return 0, nil, fmt.Errorf("invalid message authenticator")
+		}
+	}
+
+	return packet[0], attrs, nil
+}
+
+func parseRadiusAttrs(b []byte) ([]radiusAttr, error) {
+	attrs := []radiusAttr{}
+	for len(b) > 0 {
+		if len(b) < 2 || int(b[1]) < 2 || int(b[1]) > len(b) {
+			return nil, fmt.Errorf("malformed attribute")
+		}
+		attrs = append(attrs, radiusAttr{b[0], b[2:b[1]]})
+		b = b[b[1]:]
+	}
+	return attrs, nil
+}
+
+func radiusPacket(code, id byte, authenticator []byte, attrs []radiusAttr) []byte {
+	packet := &bytes.Buffer{}
+	packet.Write([]byte{code, id, 0, 0}) // length is filled in below
+	packet.Write(authenticator)
+	for _, attr := range attrs {
+		packet.Write([]byte{attr.typ, byte(2 + len(attr.value))})
+		packet.Write(attr.value)
+	}
+
+	ret := packet.Bytes()
+	binary.BigEndian.PutUint16(ret[2:4], uint16(len(ret)))
+	return ret
+}
+
+// radiusHidePassword obfuscates the password as described in RFC 2865 (section 5.2).
+func radiusHidePassword(secret string, authenticator []byte, password string) []byte {
+	padded := make([]byte, ((len(password)+radiusAuthLen-1)/radiusAuthLen)*radiusAuthLen)
+	if len(padded) <= 0 {
+		padded = make([]byte, radiusAuthLen)
+	}
+	copy(padded, password)
+
+	prev := authenticator
+	for i := 0; i < len(padded); i += radiusAuthLen {
+		hash := md5.New()
+		hash.Write([]byte(secret))
+		hash.Write(prev)
+		for j, b := range hash.Sum(nil) {
+			padded[i+j] ^= b
+		}
+		prev = padded[i : i+radiusAuthLen]
+	}
+	return padded
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// TACACS+ (RFC 8907) packet fields of interest to us.
+const (
+	tacacsVersionDefault = 0xc0
+	tacacsVersionPAP     = 0xc1
+
+	tacacsTypeAuthen = 1
+	tacacsTypeAuthor = 2
+
+	tacacsAuthenActionLogin  = 1
+	tacacsAuthenTypePAP      = 2
+	tacacsAuthenServiceLogin = 1
+	tacacsAuthenMethodTacacs = 6
+	tacacsPrivLevelUser      = 1
+
+	tacacsAuthenStatusPass = 1
+	tacacsAuthenStatusFail = 2
+	tacacsAuthorStatusAdd  = 1
+	tacacsAuthorStatusRepl = 2
+	tacacsAuthorStatusFail = 0x10
+	tacacsHeaderLen        = 12
+	tacacsMaxBodyLen       = 1 << 16
+	tacacsMaxFieldLen      = 255
+	tacacsPortName         = "commander"
+	tacacsGroupArgument    = "group"
+	tacacsServiceArgument  = "service=shell"
+	tacacsShellCmdArgument = "cmd="
+	tacacsSessionIDLen     = 4
+	tacacsReplySeqNo       = 2
+	tacacsRequestSeqNo     = 1
+)
+
+// tacacsClient verifies credentials with a (PAP) authentication request, and then asks for the
+// authorization of the shell service. The groups of the user are the values of the "group"
+// arguments of the authorization.
+type tacacsClient struct {
+	timeout time.Duration
+}
+
+func (t *tacacsClient) authenticate(addr, secret, name, password string) ([]string, error) {
+	if len(name) <= 0 || len(name) > tacacsMaxFieldLen || len(password) > tacacsMaxFieldLen {
+		return nil, errRejected
+	}
+
+	// START: action, priv_lvl, authen_type, authen_service, user_len, port_len, rem_addr_len,
+	// data_len, followed by the fields.
+	start := &bytes.Buffer{}
+	start.Write([]byte{tacacsAuthenActionLogin, tacacsPrivLevelUser, tacacsAuthenTypePAP,
+		tacacsAuthenServiceLogin, byte(len(name)), byte(len(tacacsPortName)), 0, byte(len(password))})
+	start.WriteString(name)
+	start.WriteString(tacacsPortName)
+	start.WriteString(password)
+
+	reply, err := t.exchange(addr, secret, tacacsVersionPAP, tacacsTypeAuthen, start.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	switch reply[0] {
+	case tacacsAuthenStatusPass:
+	case tacacsAuthenStatusFail:
+		return nil, errRejected
+	default:
+		return nil, fmt.Errorf("unexpected authentication status %d", reply[0])
+	}
+
+	return t.authorize(addr, secret, name)
+}
+
+// authorize asks for the authorization of the shell service, and returns the groups of the user.
+func (t *tacacsClient) authorize(addr, secret, name string) ([]string, error) {
+	args := []string{tacacsServiceArgument, tacacsShellCmdArgument}
+
+	// REQUEST: authen_method, priv_lvl, authen_type, authen_service, user_len, port_len,
+	// rem_addr_len, arg_cnt, arg_N_len..., followed by the fields.
+	request := &bytes.Buffer{}
+	request.Write([]byte{tacacsAuthenMethodTacacs, tacacsPrivLevelUser, tacacsAuthenTypePAP,
+		tacacsAuthenServiceLogin, byte(len(name)), byte(len(tacacsPortName)), 0, byte(len(args))})
+	for _, arg := range args {
+		request.WriteByte(byte(len(arg)))
+	}
+	request.WriteString(name)
+	request.WriteString(tacacsPortName)
+	for _, arg := range args {
+		request.WriteString(arg)
+	}
+
+	reply, err := t.exchange(addr, secret, tacacsVersionDefault, tacacsTypeAuthor, request.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	switch reply[0] {
+	case tacacsAuthorStatusAdd, tacacsAuthorStatusRepl:
+	case tacacsAuthorStatusFail:
+		return nil, errRejected
+	default:
+		return nil, fmt.Errorf("unexpected authorization status %d", reply[0])
+	}
+
+	// REPLY: status, arg_cnt, server_msg_len (2), data_len (2), arg_N_len..., followed by the
+	// fields.
+	if len(reply) < 6 {
+		return nil, fmt.Errorf("short authorization reply")
+	}
+	argCount := int(reply[1])
+	offset := 6 + argCount + int(binary.BigEndian.Uint16(reply[2:4])) + int(binary.BigEndian.Uint16(reply[4:6]))
+	if len(reply) < 6+argCount {
+		return nil, fmt.Errorf("short authorization reply")
+	}
+
+	groups := []string{}
+	for _, argLen := range reply[6 : 6+argCount] {
+		if offset+int(argLen) > len(reply) {
+			return nil, fmt.Errorf("short authorization reply")
+		}
+		arg := string(reply[offset : offset+int(argLen)])
+		offset += int(argLen)
+
+		// Arguments are "name=value" (mandatory) or "name*value" (optional)
+		if i := strings.IndexAny(arg, "=*"); i > 0 && arg[:i] == tacacsGroupArgument {
+			groups = append(groups, arg[i+1:])
+		}
+	}
+	return groups, nil
+}
+
+// exchange sends the request body (as the start of a new session), and returns the body of the
+// reply.
+func (t *tacacsClient) exchange(addr, secret string, version, typ byte, body []byte) ([]byte, error) {
+	sessionID := make([]byte, tacacsSessionIDLen)
+	if _, err := rand.Read(sessionID); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+		return nil, err
+	}
+
+	header := []byte{version, typ, tacacsRequestSeqNo, 0}
+	header = append(header, sessionID...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(body)))
+
+	packet := append(header, tacacsObfuscate(body, header, secret)...)
+	if _, err = conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	replyHeader := make([]byte, tacacsHeaderLen)
+	if _, err = io.ReadFull(conn, replyHeader); err != nil {
+		return nil, err
+	}
+	if replyHeader[0]>>4 != version>>4 || replyHeader[1] != typ ||
+		replyHeader[2] != tacacsReplySeqNo || !bytes.Equal(replyHeader[4:8], sessionID) {
+		return nil, fmt.Errorf("unexpected reply")
+	}
+
+	replyLen := binary.BigEndian.Uint32(replyHeader[8:])
+	if replyLen <= 0 || replyLen > tacacsMaxBodyLen {
+		return nil, fmt.Errorf("invalid reply length %d", replyLen)
+	}
+
+	reply := make([]byte, replyLen)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return tacacsObfuscate(reply, replyHeader, secret), nil
+}
+
+// tacacsObfuscate (un)obfuscates the body of the packet with the specified header, by XOR'ing it
+// with a pseudo pad derived from the header and secret (RFC 8907, section 4.5).
+func tacacsObfuscate(body, header []byte, secret string) []byte {
+	ret := make([]byte, len(body))
+
+	var prev []byte
+	for i := 0; i < len(body); i += md5.Size {
+		hash := md5.New()
+		hash.Write(header[4:8]) // session id
+		hash.Write([]byte(secret))
+		hash.Write(header[0:1]) // version
+		hash.Write(header[2:3]) // sequence number
+		hash.Write(prev)
+		prev = hash.Sum(nil)
+
+		for j := 0; j < md5.Size && i+j < len(body); j++ {
+			ret[i+j] = body[i+j] ^ prev[j]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,64 @@
+package auth
+
+var (
+	nsswitchTemplate = `#
+# THIS FILE IS AUTOGENERATED. MODIFICATiONS WiLL NOT BE PERSISTENT.
+# Generated at  {{ .GenTime }} by Commander
+#
+# See the nsswitch.conf(5) manpage for details
+
+passwd:         compat{{ if .LDAP }} ldap{{ end }}
+group:          compat{{ if .LDAP }} ldap{{ end }}
+shadow:         compat{{ if .LDAP }} ldap{{ end }}
+gshadow:        files
+
+hosts:          files dns
+networks:       files
+
+protocols:      db files
+services:       db files
+ethers:         db files
+rpc:            db files
+
+netgroup:       nis
+`
+
+	nslcdConfTemplate = `#
+# THIS FILE IS AUTOGENERATED. MODIFICATiONS WiLL NOT BE PERSISTENT.
+# Generated at  {{ .GenTime }} by Commander
+#
+# See the nslcd.conf(5) manpage for details
+
+# The user and group nslcd should run as
+uid nslcd
+gid nslcd
+
+# The LDAP servers (tried in order)
+{{ range .URIs }}uri {{ . }}
+{{ end }}
+base {{ .BaseDN }}
+{{ if .BindDN }}
+# The DN (and credentials) to bind with when looking up users
+binddn {{ .BindDN }}
+bindpw {{ .BindPassword }}
+{{ end }}
+# How long to wait for the servers
+timelimit {{ .TimeoutSecs }}
+bind_timelimit {{ .TimeoutSecs }}
+{{ if .UseTLS }}
+# Insist on verifying the certificates of the servers
+tls_reqcert demand
+tls_cacertfile /etc/ssl/certs/ca-certificates.crt
+{{ end }}
+# Remote users land in the CLI (regardless of what the directory says)
+map passwd loginShell "{{ .LoginShell }}"
+`
+
+	pamRadiusConfTemplate = `#
+# THIS FILE IS AUTOGENERATED. MODIFICATiONS WiLL NOT BE PERSISTENT.
+# Generated at  {{ .GenTime }} by Commander
+#
+# server[:port]	shared_secret	timeout (s)
+{{ range .Servers }}{{ .Address }}	{{ .Secret }}	{{ $.TimeoutSecs }}
+{{ end }}`
+)
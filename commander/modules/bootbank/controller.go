@@ -15,6 +15,8 @@ import (
 	"syscall"
 	"time"
 
+	"rocketship/commander/modules/events"
+
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
 	"github.com/juju/deputy"
@@ -63,6 +65,16 @@ func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Reques
 	return
 }
 
+// Lock holds off the requests to the controller until Unlock is called.
+func (c *Controller) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock undoes Lock.
+func (c *Controller) Unlock() {
+	c.lock.Unlock()
+}
+
 // RoutePrefix returns the URL prefix under which this controller serves its routes
 func (c *Controller) RoutePrefix() string {
 	return URLPrefix
@@ -70,8 +82,37 @@ func (c *Controller) RoutePrefix() string {
 
 // These satisfy the controller interface.
 func (c *Controller) SeedDB()             {}
-func (c *Controller) MigrateDB()          {}
 func (c *Controller) RewriteFiles() error { return nil }
+func (c *Controller) WipeFiles() error    { return nil }
+
+func (c *Controller) MigrateDB() {
+	c.log.Infoln("Migrating booted version table")
+	c.db.AutoMigrate(&BootedVersion{})
+}
+
+func (c *Controller) DropDB() {
+	c.log.Infoln("Dropping booted version table")
+	c.db.DropTable(&BootedVersion{})
+}
+
+// Start publishes an event if the image that was booted differs from the one that was booted
+// previously, i.e. an upgrade was completed.
+func (c *Controller) Start() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.checkBootedVersion(ImageVersionFile)
+}
+
+//
+// DB Models
+//
+
+// BootedVersion is the version of the image that was last booted.
+type BootedVersion struct {
+	ID      int64
+	Version string
+}
 
 //
 // Response Entities
@@ -160,6 +201,8 @@ func (c *Controller) UploadImageFile(ctx web.C, w http.ResponseWriter, r *http.R
 		return
 	}
 
+	events.Publish(events.BootbankImageInstalled, map[string]string{"Bootbank": c.otherBootbankLabel()})
+
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -177,6 +220,8 @@ func (c *Controller) MarkBootable(ctx web.C, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	events.Publish(events.BootbankMarkedBootable, map[string]string{"Bootbank": bbLabel})
+
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -389,6 +434,38 @@ func withMountedPartition(partitionLabel string, readonly bool, log distillog.Lo
 	return f(tempDir)
 }
 
+// checkBootedVersion compares the version of the running image (read from the specified file) to
+// the one last booted, and publishes an event if they differ.
+func (c *Controller) checkBootedVersion(versionFile string) {
+	vbytes, err := ioutil.ReadFile(versionFile)
+	if err != nil {
+		c.log.Warningln("Failed to read version of the running image:", err)
+		return
+	}
+	version := strings.TrimSpace(string(vbytes))
+
+	booted := BootedVersion{}
+	if err := c.db.FirstOrInit(&booted, BootedVersion{ID: 1}).Error; err != nil {
+		c.log.Errorln("Failed to load the version last booted:", err)
+		return
+	}
+	if booted.Version == version {
+		return
+	}
+
+	// Nothing was booted before (e.g. first boot, or after a factory reset)
+	if len(booted.Version) > 0 {
+		c.log.Infoln("Upgrade from", booted.Version, "to", version, "completed")
+		events.Publish(events.UpgradeCompleted,
+			map[string]string{"PreviousVersion": booted.Version, "Version": version})
+	}
+
+	booted.Version = version
+	if err := c.db.Save(&booted).Error; err != nil {
+		c.log.Errorln("Failed to save the version booted:", err)
+	}
+}
+
 func jsonError(err error, w http.ResponseWriter) {
 	// TODO: switch on err type
 	w.WriteHeader(http.StatusInternalServerError)
@@ -1,9 +1,13 @@
 package bootbank
 
 import (
+	"io/ioutil"
+	"path"
 	"strings"
 	"testing"
 
+	"rocketship/commander/modules/events"
+
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
 
@@ -47,3 +51,24 @@ func (ts *BootbankTestSuite) TestGrubConfFileContents(c *C) {
 	c.Assert(strings.Contains(string(f), "set default=\"Rocketship1\""), Equals, true)
 	c.Assert(strings.Count(string(f), "menuentry"), Equals, 2)
 }
+
+func (ts *BootbankTestSuite) TestCheckBootedVersion(c *C) {
+	sub := events.Subscribe(events.UpgradeCompleted)
+	defer events.Unsubscribe(sub)
+
+	versionFile := path.Join(c.MkDir(), "rocketship_version")
+	boot := func(version string) {
+		c.Assert(ioutil.WriteFile(versionFile, []byte(version+"\n"), 0644), IsNil)
+		ts.controller.checkBootedVersion(versionFile)
+	}
+
+	// Neither the first boot, nor rebooting the same image, is an upgrade
+	boot("1.0")
+	boot("1.0")
+	c.Assert(sub.Events, HasLen, 0)
+
+	boot("1.1")
+	c.Assert(sub.Events, HasLen, 1)
+	evt := <-sub.Events
+	c.Assert(evt.Data, DeepEquals, map[string]string{"PreviousVersion": "1.0", "Version": "1.1"})
+}
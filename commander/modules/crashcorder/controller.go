@@ -30,7 +30,8 @@ const (
 )
 
 type Controller struct {
-	log distillog.Logger
+	log           distillog.Logger
+	commanderPort int // crashcorder publishes crash events to commander on this port (if set)
 }
 
 func NewController(_ *gorm.DB, log distillog.Logger) *Controller {
@@ -43,6 +44,12 @@ func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Reques
 	return
 }
 
+// SetCommanderPort sets the port on which commander listens, so that crashcorder can publish crash
+// events to it. Crash events are not published unless this is set.
+func (c *Controller) SetCommanderPort(port int) {
+	c.commanderPort = port
+}
+
 // RoutePrefix returns the prefix under which this router handles endpoints
 func (c *Controller) RoutePrefix() string {
 	return URLPrefix
@@ -92,6 +99,9 @@ func (c *Controller) crashcorderConfigFileContents() ([]byte, error) {
 		CoresDirectory:    CoresDirPath,
 		RadioConnectAddr:  net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: radio.RadioPort},
 	}
+	if c.commanderPort > 0 {
+		cfg.CommanderConnectAddr = net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: c.commanderPort}
+	}
 
 	b, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
@@ -117,3 +127,24 @@ func (c *Controller) configureKernelCorePattern() error {
 
 func (c *Controller) MigrateDB() {}
 func (c *Controller) SeedDB()    {}
+func (c *Controller) DropDB()    {}
+
+// WipeFiles deletes all the cores collected in the cores dir.
+func (c *Controller) WipeFiles() error {
+	c.log.Infoln("Wiping cores dir")
+
+	cores, err := ioutil.ReadDir(CoresDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, core := range cores {
+		if err := os.RemoveAll(CoresDirPath + "/" + core.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
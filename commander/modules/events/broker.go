@@ -0,0 +1,182 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"rocketship/commander/modules/events/eventtypes"
+)
+
+const (
+	// Number of events buffered per subscriber before we start dropping events for it.
+	SubscriberBufferLen = 32
+)
+
+// Types of events published by the various commander modules (and daemons that report into it).
+const (
+	HostnameChanged        = "host.hostname.changed"
+	DomainChanged          = "host.domain.changed"
+	InterfaceCreated       = "host.interface.created"
+	InterfaceReconfigured  = "host.interface.reconfigured"
+	InterfaceDeleted       = "host.interface.deleted"
+	InterfaceConfirmed     = "host.interface.confirmed"
+	InterfaceReverted      = "host.interface.reverted"
+	InterfaceLinkDown      = "host.interface.link.down"
+	InterfaceLinkUp        = "host.interface.link.up"
+	DHCPProfileChanged     = "host.dhcp.profile.changed"
+	ResolversChanged       = "host.resolvers.changed"
+	RoutesChanged          = "host.routes.changed"
+	HostsEntriesChanged    = "host.hosts.entries.changed"
+	UserCreated            = "host.user.created"
+	UserUpdated            = "host.user.updated"
+	UserDeleted            = "host.user.deleted"
+	UserPasswordChanged    = "host.user.password.changed"
+	UserLoginFailed        = "host.user.login.failed"
+	UserLocked             = "host.user.locked"
+	UserUnlocked           = "host.user.unlocked"
+	UserKeyAdded           = "host.user.key.added"
+	UserKeyRemoved         = "host.user.key.removed"
+	GroupCreated           = "host.group.created"
+	GroupUpdated           = "host.group.updated"
+	GroupDeleted           = "host.group.deleted"
+	SudoRulesChanged       = "host.sudo.rules.changed"
+	AuthConfigChanged      = "auth.config.changed"
+	AuthServerUnreachable  = "auth.server.unreachable"
+	BootbankImageInstalled = "bootbank.image.installed"
+	BootbankMarkedBootable = "bootbank.marked.bootable"
+	UpgradeCompleted       = "bootbank.upgrade.completed"
+	RebootRequested        = "powerstate.reboot.requested"
+	ShutdownRequested      = "powerstate.shutdown.requested"
+	FactoryResetRequested  = "powerstate.factoryreset.requested"
+	CrashDetected          = eventtypes.CrashDetected
+)
+
+var (
+	// All the types of events that are published (and so may be subscribed to)
+	Types = []string{
+		HostnameChanged, DomainChanged,
+		InterfaceCreated, InterfaceReconfigured, InterfaceDeleted, InterfaceConfirmed, InterfaceReverted,
+		InterfaceLinkDown, InterfaceLinkUp,
+		DHCPProfileChanged, ResolversChanged, RoutesChanged, HostsEntriesChanged,
+		UserCreated, UserUpdated, UserDeleted, UserPasswordChanged, UserLoginFailed, UserLocked,
+		UserUnlocked, UserKeyAdded, UserKeyRemoved,
+		GroupCreated, GroupUpdated, GroupDeleted, SudoRulesChanged,
+		AuthConfigChanged, AuthServerUnreachable,
+		BootbankImageInstalled, BootbankMarkedBootable, UpgradeCompleted,
+		RebootRequested, ShutdownRequested, FactoryResetRequested,
+		CrashDetected,
+	}
+)
+
+// IsKnownType returns whether events of the specified type are published.
+func IsKnownType(eventType string) bool {
+	for _, t := range Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event describes a configuration or system change that subscribers may be interested in.
+type Event struct {
+	ID   uint64
+	Type string
+	Time time.Time
+	Data map[string]string
+}
+
+// Broker fans out published events to all of its subscribers.
+type Broker struct {
+	lock   sync.Mutex
+	lastID uint64
+	subs   map[*Subscription]bool
+}
+
+// Subscription receives events from a Broker (on its Events chan) till it is unsubscribed.
+type Subscription struct {
+	Events chan Event
+	types  map[string]bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*Subscription]bool)}
+}
+
+// Subscribe returns a new subscription that receives events of the specified types. If no types
+// are specified, the subscription receives all events.
+func (b *Broker) Subscribe(types ...string) *Subscription {
+	sub := &Subscription{
+		Events: make(chan Event, SubscriberBufferLen),
+		types:  make(map[string]bool),
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.lock.Lock()
+	b.subs[sub] = true
+	b.lock.Unlock()
+
+	return sub
+}
+
+// Unsubscribe stops delivery of events to the subscription and closes its Events chan.
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, there := b.subs[sub]; there {
+		delete(b.subs, sub)
+		close(sub.Events)
+	}
+}
+
+// Publish sends an event of the specified type to all interested subscribers. Publish never
+// blocks, subscribers that aren't keeping up will miss events.
+func (b *Broker) Publish(eventType string, data map[string]string) Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastID++
+	evt := Event{
+		ID:   b.lastID,
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+
+	for sub := range b.subs {
+		if len(sub.types) > 0 && !sub.types[eventType] {
+			continue
+		}
+		select {
+		case sub.Events <- evt:
+		default:
+			// subscriber is too slow, drop it on the floor
+		}
+	}
+
+	return evt
+}
+
+//
+// Default broker (shared by all the commander modules)
+//
+
+var defaultBroker = NewBroker()
+
+// Publish publishes an event on the default broker.
+func Publish(eventType string, data map[string]string) Event {
+	return defaultBroker.Publish(eventType, data)
+}
+
+// Subscribe subscribes to events on the default broker.
+func Subscribe(types ...string) *Subscription {
+	return defaultBroker.Subscribe(types...)
+}
+
+// Unsubscribe unsubscribes from events on the default broker.
+func Unsubscribe(sub *Subscription) {
+	defaultBroker.Unsubscribe(sub)
+}
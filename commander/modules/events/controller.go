@@ -0,0 +1,174 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"rocketship/commander/modules/events/eventtypes"
+
+	"github.com/amoghe/distillog"
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Prefix under which all the endpoints reside
+	URLPrefix = "/events"
+	// Endpoint at which clients can subscribe to a stream of events (server sent events)
+	EStream = URLPrefix + "/stream"
+	// Endpoint at which local daemons (e.g. crashcorder) can publish events
+	EPublish = eventtypes.PublishPath
+
+	// How often we write a comment line to idle streams to keep proxies from timing them out.
+	KeepaliveInterval = 30 * time.Second
+)
+
+type Controller struct {
+	mux    *web.Mux
+	log    distillog.Logger
+	broker *Broker
+}
+
+func NewController(_ *gorm.DB, logger distillog.Logger) *Controller {
+	ctrl := &Controller{mux: web.New(), log: logger, broker: defaultBroker}
+
+	ctrl.mux.Get(EStream, ctrl.StreamEvents)
+	ctrl.mux.Post(EPublish, ctrl.PublishEvent)
+
+	return ctrl
+}
+
+// ServeHTTP satisfies the http.Handler interface (net/http as well as goji)
+func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	// Unlike other controllers we do not serialize requests, streams are long lived.
+	c.mux.ServeHTTPC(ctx, w, r)
+}
+
+// RoutePrefix returns the URL prefix under which this controller serves its routes
+func (c *Controller) RoutePrefix() string {
+	return URLPrefix
+}
+
+// These satisfy the controller interface.
+func (c *Controller) SeedDB()             {}
+func (c *Controller) MigrateDB()          {}
+func (c *Controller) DropDB()             {}
+func (c *Controller) RewriteFiles() error { return nil }
+func (c *Controller) WipeFiles() error    { return nil }
+
+//
+// Handlers
+//
+
+// StreamEvents streams events to the client as server sent events. Clients may restrict the
+// events they receive by specifying one or more 'type' query params.
+func (c *Controller) StreamEvents(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(fmt.Errorf("Streaming is not supported"), w)
+		return
+	}
+
+	sub := c.broker.Subscribe(r.URL.Query()["type"]...)
+	defer c.broker.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(KeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case evt := <-sub.Events:
+			data, err := json.Marshal(evt)
+			if err != nil {
+				c.log.Warningln("Failed to serialize event:", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", evt.ID, evt.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			c.log.Debugln("Event stream client went away")
+			return
+		}
+	}
+}
+
+// PublishEvent publishes the event in the request body to all subscribers. Only local daemons may
+// publish events, and only of the types that they report (see eventtypes.Publishable).
+func (c *Controller) PublishEvent(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r.RemoteAddr) {
+		c.log.Warningln("Refusing to publish event from", r.RemoteAddr)
+		forbiddenError(fmt.Errorf("Events may only be published by local daemons"), w)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	resource := eventtypes.EventResource{}
+	if err = json.Unmarshal(reqBody, &resource); err != nil {
+		jsonError(err, w)
+		return
+	}
+	if len(resource.Type) <= 0 {
+		jsonError(fmt.Errorf("Missing event type"), w)
+		return
+	}
+	if !eventtypes.IsPublishable(resource.Type) {
+		forbiddenError(fmt.Errorf("Events of type %s cannot be published", resource.Type), w)
+		return
+	}
+
+	evt := c.broker.Publish(resource.Type, resource.Data)
+
+	if err := json.NewEncoder(w).Encode(evt); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+//
+// Helpers
+//
+
+func jsonError(err error, w http.ResponseWriter) {
+	// TODO: switch on err type
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+}
+
+func forbiddenError(err error, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+}
+
+// isLoopback returns whether the (host:port) address is on the loopback network.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
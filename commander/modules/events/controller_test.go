@@ -0,0 +1,186 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amoghe/distillog"
+	"github.com/zenazn/goji/web"
+
+	. "gopkg.in/check.v1"
+)
+
+type EventsTestSuite struct {
+	controller *Controller
+}
+
+// Register the test suite with gocheck.
+func init() {
+	Suite(&EventsTestSuite{})
+}
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (ts *EventsTestSuite) SetUpTest(c *C) {
+	ts.controller = NewController(nil, distillog.NewNullLogger("test"))
+	ts.controller.broker = NewBroker() // don't pollute the default broker
+}
+
+//
+// Broker tests
+//
+
+func (ts *EventsTestSuite) TestBrokerFanout(c *C) {
+	b := NewBroker()
+
+	all := b.Subscribe()
+	some := b.Subscribe(UserCreated)
+
+	b.Publish(HostnameChanged, map[string]string{"Hostname": "foo"})
+	b.Publish(UserCreated, map[string]string{"Name": "bar"})
+
+	c.Assert(all.Events, HasLen, 2)
+	c.Assert(some.Events, HasLen, 1)
+
+	evt := <-some.Events
+	c.Assert(evt.Type, Equals, UserCreated)
+	c.Assert(evt.Data["Name"], Equals, "bar")
+	c.Assert(evt.ID, Equals, uint64(2))
+}
+
+func (ts *EventsTestSuite) TestBrokerDoesNotBlockOnSlowSubscriber(c *C) {
+	b := NewBroker()
+	sub := b.Subscribe()
+
+	for i := 0; i < SubscriberBufferLen*2; i++ {
+		b.Publish(RebootRequested, nil)
+	}
+
+	c.Assert(sub.Events, HasLen, SubscriberBufferLen)
+}
+
+func (ts *EventsTestSuite) TestBrokerUnsubscribe(c *C) {
+	b := NewBroker()
+	sub := b.Subscribe()
+	b.Unsubscribe(sub)
+
+	b.Publish(RebootRequested, nil)
+
+	_, open := <-sub.Events
+	c.Assert(open, Equals, false)
+}
+
+//
+// Handler tests
+//
+
+func (ts *EventsTestSuite) TestPublishEventHandler(c *C) {
+	sub := ts.controller.broker.Subscribe()
+
+	body := `{"Type": "crashcorder.crash.detected", "Data": {"Executable": "foo"}}`
+	req, err := http.NewRequest("POST", "/dont/care", bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "127.0.0.1:34567"
+
+	rec := httptest.NewRecorder()
+	ts.controller.PublishEvent(web.C{}, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	evt := Event{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &evt), IsNil)
+	c.Assert(evt.Type, Equals, CrashDetected)
+
+	c.Assert(sub.Events, HasLen, 1)
+	c.Assert((<-sub.Events).Data["Executable"], Equals, "foo")
+}
+
+func (ts *EventsTestSuite) TestPublishEventHandlerRequiresType(c *C) {
+	req, err := http.NewRequest("POST", "/dont/care", bytes.NewBufferString(`{"Data": {}}`))
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "127.0.0.1:34567"
+
+	rec := httptest.NewRecorder()
+	ts.controller.PublishEvent(web.C{}, rec, req)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+}
+
+func (ts *EventsTestSuite) TestPublishEventHandlerRestrictions(c *C) {
+	sub := ts.controller.broker.Subscribe()
+
+	for _, d := range []struct {
+		remoteAddr string
+		body       string
+	}{
+		// Only local daemons may publish
+		{"192.168.1.8:34567", `{"Type": "crashcorder.crash.detected", "Data": {}}`},
+		{"[2001:db8::8]:34567", `{"Type": "crashcorder.crash.detected", "Data": {}}`},
+		// Only the events that daemons report may be published
+		{"127.0.0.1:34567", `{"Type": "host.user.deleted", "Data": {"Name": "admin"}}`},
+		{"[::1]:34567", `{"Type": "powerstate.reboot.requested", "Data": {}}`},
+	} {
+		req, err := http.NewRequest("POST", "/dont/care", bytes.NewBufferString(d.body))
+		c.Assert(err, IsNil)
+		req.RemoteAddr = d.remoteAddr
+
+		rec := httptest.NewRecorder()
+		ts.controller.PublishEvent(web.C{}, rec, req)
+		c.Check(rec.Code, Equals, http.StatusForbidden, Commentf("from %s: %s", d.remoteAddr, d.body))
+	}
+
+	c.Assert(sub.Events, HasLen, 0)
+}
+
+func (ts *EventsTestSuite) TestStreamEventsHandler(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", "/dont/care?type="+HostnameChanged, nil)
+	c.Assert(err, IsNil)
+	req = req.WithContext(ctx)
+
+	rec := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		ts.controller.StreamEvents(web.C{}, rec, req)
+		done <- true
+	}()
+
+	// wait for the handler to subscribe
+	for i := 0; i < 100 && ts.numSubscribers() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(ts.numSubscribers(), Equals, 1)
+
+	ts.controller.broker.Publish(UserDeleted, map[string]string{"Name": "ignored"})
+	ts.controller.broker.Publish(HostnameChanged, map[string]string{"Hostname": "foobar"})
+
+	// give the handler a chance to write the events out, then hang up
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	body := rec.Body.String()
+	c.Log(body)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "text/event-stream")
+	c.Assert(strings.Contains(body, "event: "+HostnameChanged+"\n"), Equals, true)
+	c.Assert(strings.Contains(body, "foobar"), Equals, true)
+	c.Assert(strings.Contains(body, "ignored"), Equals, false)
+	c.Assert(ts.numSubscribers(), Equals, 0)
+}
+
+//
+// Helpers
+//
+
+func (ts *EventsTestSuite) numSubscribers() int {
+	ts.controller.broker.lock.Lock()
+	defer ts.controller.broker.lock.Unlock()
+	return len(ts.controller.broker.subs)
+}
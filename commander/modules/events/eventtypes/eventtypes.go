@@ -0,0 +1,33 @@
+// Package eventtypes holds what the daemons that report into commander need in order to publish
+// events, without the dependencies (db, http router) of the events module itself.
+package eventtypes
+
+const (
+	// Path (on commander) at which local daemons publish events
+	PublishPath = "/events/publish"
+
+	// Types of events published by the daemons
+	CrashDetected = "crashcorder.crash.detected"
+)
+
+var (
+	// Types of events that may be published via PublishPath. Events of all other types originate
+	// in commander itself and cannot be published by its clients.
+	Publishable = []string{CrashDetected}
+)
+
+// EventResource is what daemons send (to PublishPath) when publishing an event.
+type EventResource struct {
+	Type string
+	Data map[string]string
+}
+
+// IsPublishable returns whether events of the specified type may be published via PublishPath.
+func IsPublishable(eventType string) bool {
+	for _, t := range Publishable {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
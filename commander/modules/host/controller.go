@@ -3,6 +3,7 @@ package host
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
 
 	"github.com/amoghe/distillog"
@@ -21,12 +22,43 @@ const (
 	EHostname = URLPrefix + "/hostname"
 	// Endpoint at which domain can be configured
 	EDomain = URLPrefix + "/domain"
+	// Endpoint at which the FQDN (hostname and domain) can be read
+	EFQDN = URLPrefix + "/fqdn"
 	// Endpoint at which users can be configured
-	EUsers   = URLPrefix + "/users"
-	EUsersID = EUsers + "/:id"
+	EUsers         = URLPrefix + "/users"
+	EUsersID       = EUsers + "/:id"
+	EUsersPassword = EUsersID + "/password"
+	EUsersUnlock   = EUsersID + "/unlock"
+	EUsersKeys     = EUsersID + "/keys"
+	EUsersKeysID   = EUsersKeys + "/:keyid"
+	// Endpoint at which user credentials can be verified
+	ELogin = URLPrefix + "/login"
+	// Endpoint at which groups (and their members) can be configured
+	EGroups          = URLPrefix + "/groups"
+	EGroupsID        = EGroups + "/:id"
+	EGroupsMembers   = EGroupsID + "/members"
+	EGroupsMembersID = EGroupsMembers + "/:userid"
+	// Endpoint at which sudo rules (for groups) can be configured
+	ESudoRules   = URLPrefix + "/sudo-rules"
+	ESudoRulesID = ESudoRules + "/:id"
+	// Endpoint at which the password policy can be configured
+	EPasswordPolicy = URLPrefix + "/password-policy"
 	// Endpoint for interface configur
 	EInterfaces   = URLPrefix + "/interfaces"
 	EInterfacesID = EInterfaces + "/:id"
+	// Endpoint at which a change to an interface (made with a confirmation timeout) is confirmed
+	EInterfacesConfirm = EInterfacesID + "/confirm"
+	// Endpoint at which DHCP profiles (used by interfaces in DHCP mode) can be configured
+	EDHCPProfiles   = URLPrefix + "/dhcp-profiles"
+	EDHCPProfilesID = EDHCPProfiles + "/:id"
+	// Endpoint at which static routes can be configured
+	ERoutes   = URLPrefix + "/routes"
+	ERoutesID = ERoutes + "/:id"
+	// Endpoint at which the DNS servers can be configured
+	EResolvers = URLPrefix + "/resolvers"
+	// Endpoint at which static name mappings (in /etc/hosts) can be configured
+	EHostsEntries   = URLPrefix + "/hosts-entries"
+	EHostsEntriesID = EHostsEntries + "/:id"
 )
 
 type Controller struct {
@@ -34,6 +66,14 @@ type Controller struct {
 	mux  *web.Mux
 	log  distillog.Logger
 	lock sync.Mutex
+
+	remoteAuth RemoteAuthenticator
+
+	// Interface change that is reverted unless confirmed in time (if any)
+	pending *pendingChange
+
+	// Closed to stop monitoring the links of the interfaces (see Start)
+	stopLinks chan struct{}
 }
 
 func NewController(db *gorm.DB, logger distillog.Logger) *Controller {
@@ -50,24 +90,109 @@ func NewController(db *gorm.DB, logger distillog.Logger) *Controller {
 	// Domain endpoints
 	c.mux.Get(EDomain, c.GetDomain)
 	c.mux.Put(EDomain, c.PutDomain)
+	// FQDN endpoints
+	c.mux.Get(EFQDN, c.GetFQDN)
 	// User endpoints
 	c.mux.Get(EUsers, c.GetUsers)
 	c.mux.Post(EUsers, c.CreateUser)
+	c.mux.Put(EUsersID, c.UpdateUser)
 	c.mux.Delete(EUsersID, c.DeleteUser)
+	c.mux.Put(EUsersPassword, c.ChangePassword)
+	c.mux.Put(EUsersUnlock, c.UnlockUser)
+	c.mux.Get(EUsersKeys, c.GetUserKeys)
+	c.mux.Post(EUsersKeys, c.CreateUserKey)
+	c.mux.Put(EUsersKeysID, c.UpdateUserKey)
+	c.mux.Delete(EUsersKeysID, c.DeleteUserKey)
+	c.mux.Post(ELogin, c.Login)
+	// Group endpoints
+	c.mux.Get(EGroups, c.GetGroups)
+	c.mux.Post(EGroups, c.CreateGroup)
+	c.mux.Put(EGroupsID, c.UpdateGroup)
+	c.mux.Delete(EGroupsID, c.DeleteGroup)
+	c.mux.Post(EGroupsMembers, c.AddGroupMember)
+	c.mux.Delete(EGroupsMembersID, c.RemoveGroupMember)
+	// Sudo rule endpoints
+	c.mux.Get(ESudoRules, c.GetSudoRules)
+	c.mux.Post(ESudoRules, c.CreateSudoRule)
+	c.mux.Put(ESudoRulesID, c.UpdateSudoRule)
+	c.mux.Delete(ESudoRulesID, c.DeleteSudoRule)
+	// Password policy endpoints
+	c.mux.Get(EPasswordPolicy, c.GetPasswordPolicy)
+	c.mux.Put(EPasswordPolicy, c.PutPasswordPolicy)
 	// Interfaces endpoints
 	c.mux.Get(EInterfaces, c.GetInterfaceNames)
+	c.mux.Post(EInterfaces, c.CreateInterface)
 	c.mux.Get(EInterfacesID, c.GetInterface)
 	c.mux.Put(EInterfacesID, c.EditInterface)
+	c.mux.Delete(EInterfacesID, c.DeleteInterface)
+	c.mux.Put(EInterfacesConfirm, c.ConfirmInterface)
+	// DHCP profile endpoints
+	c.mux.Get(EDHCPProfiles, c.GetDHCPProfiles)
+	c.mux.Post(EDHCPProfiles, c.CreateDHCPProfile)
+	c.mux.Put(EDHCPProfilesID, c.UpdateDHCPProfile)
+	c.mux.Delete(EDHCPProfilesID, c.DeleteDHCPProfile)
+	// Static route endpoints
+	c.mux.Get(ERoutes, c.GetRoutes)
+	c.mux.Post(ERoutes, c.CreateRoute)
+	c.mux.Put(ERoutesID, c.UpdateRoute)
+	c.mux.Delete(ERoutesID, c.DeleteRoute)
+	// Resolvers endpoints
+	c.mux.Get(EResolvers, c.GetResolvers)
+	c.mux.Put(EResolvers, c.SetResolvers)
+	// Hosts entries endpoints
+	c.mux.Get(EHostsEntries, c.GetHostsEntries)
+	c.mux.Post(EHostsEntries, c.CreateHostsEntry)
+	c.mux.Put(EHostsEntriesID, c.UpdateHostsEntry)
+	c.mux.Delete(EHostsEntriesID, c.DeleteHostsEntry)
 	return &c
 }
 
 // ServeHTTP satisfies the http.Handler interface (net/http as well as goji)
 func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	// Logins may wait on the remote auth servers, so they take the lock themselves (only for as
+	// long as they need it) rather than blocking every other request meanwhile.
+	if r.Method == "POST" && r.URL.Path == ELogin {
+		c.Login(ctx, w, r)
+		return
+	}
+
 	c.lock.Lock()
 	c.mux.ServeHTTPC(ctx, w, r)
 	c.lock.Unlock()
 }
 
+// Start starts monitoring the links of the interfaces, so that an event is published whenever one
+// of them goes down (or comes back up).
+func (c *Controller) Start() {
+	c.stopLinks = make(chan struct{})
+	go c.monitorLinks(c.stopLinks)
+}
+
+// Stop stops monitoring the links, and waiting for the pending interface change (if any) to be
+// confirmed. The change remains stored in the db, and so is picked up again by ResumePendingChange.
+// The controller must not be used after it is stopped.
+func (c *Controller) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stopLinks != nil {
+		close(c.stopLinks)
+		c.stopLinks = nil
+	}
+	c.stopPendingChange()
+}
+
+// Lock blocks the requests (and background work) of the controller until Unlock is called, e.g.
+// so that the DB can be reset without a request racing it.
+func (c *Controller) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock undoes Lock.
+func (c *Controller) Unlock() {
+	c.lock.Unlock()
+}
+
 // RoutePrefix returns the prefix under which this router handles endpoints
 func (c *Controller) RoutePrefix() string {
 	return URLPrefix
@@ -81,37 +206,87 @@ func (c *Controller) MigrateDB() {
 
 	c.log.Infoln("Migrating DHCP profiles table")
 	c.db.AutoMigrate(&DHCPProfile{})
+	c.migrateDHCPProfiles()
 	c.log.Infoln("Migrating interfaces table")
 	c.db.AutoMigrate(&InterfaceConfig{})
+	c.migrateInterfaces()
+	c.db.AutoMigrate(&PendingInterfaceChange{})
+	c.log.Infoln("Migrating static routes table")
+	c.db.AutoMigrate(&StaticRoute{})
 
 	c.log.Infoln("Migrating users table")
 	c.db.AutoMigrate(&User{})
+	c.migrateUserIds()
+	c.migrateUserShells()
+	c.migrateDefaultAdminPassword()
+	c.log.Infoln("Migrating ssh keys table")
+	c.db.AutoMigrate(&SSHKey{})
+
+	c.log.Infoln("Migrating groups tables")
+	c.db.AutoMigrate(&Group{})
+	c.db.AutoMigrate(&GroupMember{})
+	c.db.AutoMigrate(&SudoRule{})
+
+	c.log.Infoln("Migrating password policy tables")
+	c.db.AutoMigrate(&PasswordPolicy{})
+	c.db.AutoMigrate(&PasswordHistory{})
 
 	c.log.Infoln("Migrating resolvers table")
 	c.db.AutoMigrate(&ResolversConfig{})
+	c.migrateResolvers()
+	c.log.Infoln("Migrating hosts entries table")
+	c.db.AutoMigrate(&HostsEntry{})
 }
 
 func (c *Controller) SeedDB() {
 	c.seedHostname()
 	c.seedDomain()
 	c.seedInterface()
+	c.seedPasswordPolicy()
 	c.seedUsers()
+	c.seedGroups()
 	c.seedResolvers()
 }
 
+func (c *Controller) DropDB() {
+	// A change pending confirmation does not survive the reset
+	c.stopPendingChange()
+
+	c.log.Infoln("Dropping host tables")
+	c.db.DropTable(&Hostname{})
+	c.db.DropTable(&Domain{})
+	c.db.DropTable(&InterfaceConfig{})
+	c.db.DropTable(&PendingInterfaceChange{})
+	c.db.DropTable(&DHCPProfile{})
+	c.db.DropTable(&StaticRoute{})
+	c.db.DropTable(&User{})
+	c.db.DropTable(&SSHKey{})
+	c.db.DropTable(&Group{})
+	c.db.DropTable(&GroupMember{})
+	c.db.DropTable(&SudoRule{})
+	c.db.DropTable(&PasswordPolicy{})
+	c.db.DropTable(&PasswordHistory{})
+	c.db.DropTable(&ResolversConfig{})
+	c.db.DropTable(&HostsEntry{})
+}
+
 func (c *Controller) RewriteFiles() error {
 	for _, f := range []func() error{
 		c.RewriteHostnameFile,
 		c.RewriteEtcHostsFile,
 		c.RewritePasswdFile,
 		c.RewriteShadowFile,
+		c.RewritePamFiles,
+		c.RewriteShellsFile,
 		c.RewriteGroupsFile,
+		c.RewriteGShadowFile,
 		c.RewriteInterfacesFile,
 		c.RewriteDhclientConfFile,
 		c.RewriteSudoersFile,
 		c.RewriteResolvConf,
 
 		c.EnsureHomedirs,
+		c.RewriteAuthorizedKeysFiles,
 	} {
 		if err := f(); err != nil {
 			return err
@@ -120,6 +295,23 @@ func (c *Controller) RewriteFiles() error {
 	return nil
 }
 
+// WipeFiles deletes the homedirs of all the users in the db (including the default admin).
+func (c *Controller) WipeFiles() error {
+	c.log.Infoln("Wiping user homedirs")
+
+	users := []User{}
+	if err := c.db.Find(&users).Error; err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := os.RemoveAll(fmt.Sprintf("/home/%s", user.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //
 // AfterCommit
 //
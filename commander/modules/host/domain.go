@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+
+	"rocketship/commander/modules/events"
 
 	"github.com/jinzhu/gorm"
 	"github.com/zenazn/goji/web"
@@ -15,8 +18,9 @@ var (
 )
 
 const (
-	// MaxDomainLen is the maximum character length of domain name
-	MaxDomainLen = 32
+	// MaxDomainLen is the maximum character length of domain name (so that an FQDN with it, and a
+	// single char hostname, is within limits)
+	MaxDomainLen = MaxFQDNLen - 2
 )
 
 func (c *Controller) GetDomain(ctx web.C, w http.ResponseWriter, r *http.Request) {
@@ -65,7 +69,37 @@ func (c *Controller) PutDomain(ctx web.C, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	w.Write(bodybytes)
+	events.Publish(events.DomainChanged, map[string]string{"Domain": domain.Domain})
+
+	// The domain is part of the FQDN (in /etc/hosts), the search domains and the DHCP overrides
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply domain to system (\"noapply\" present in env)")
+	} else {
+		c.log.Infoln("Applying domain to system")
+		if err := c.RewriteEtcHostsFile(); err != nil {
+			c.log.Warningln("failed to apply domain to system: ", err)
+		}
+		c.rewriteNetworkFiles(ctx)
+		if err := c.RewriteResolvConf(); err != nil {
+			c.log.Warningln("failed to apply domain to system: ", err)
+		}
+	}
+
+	// The response has the name as saved (i.e. in its ASCII form)
+	resource := DomainResource{}
+	resource.FromDomainModel(domain)
+
+	bytes, err := json.Marshal(&resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
 }
 
 //
@@ -78,10 +112,24 @@ type Domain struct {
 }
 
 func (d *Domain) BeforeSave(txn *gorm.DB) error {
-	if len(d.Domain) > MaxDomainLen {
+	// No domain at all is fine, the FQDN is just the hostname then
+	if len(d.Domain) <= 0 {
+		return nil
+	}
+
+	name, err := normalizeDNSName(strings.TrimSuffix(d.Domain, "."))
+	if err != nil {
+		return err
+	}
+	if len(name) > MaxDomainLen {
 		return fmt.Errorf("domain cannot be more than %d chars", MaxDomainLen)
 	}
-	// TODO: validate all the chars
+	d.Domain = name
+
+	host := Hostname{}
+	if txn.First(&host, 1).Error == nil && len(host.Hostname)+1+len(name) > MaxFQDNLen {
+		return fmt.Errorf("FQDN (%s.%s) cannot be longer than %d chars", host.Hostname, name, MaxFQDNLen)
+	}
 	return nil
 }
 
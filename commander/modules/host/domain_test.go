@@ -64,7 +64,7 @@ func (ts *DomainTestSuite) TestPutDomain(c *C) {
 	req, err := http.NewRequest("PUT", "/dont/care", bytes.NewBufferString(jsonbody))
 	rec := httptest.NewRecorder()
 
-	ts.controller.PutDomain(web.C{}, rec, req)
+	ts.controller.PutDomain(web.C{Env: nullEnv}, rec, req)
 	c.Assert(rec.Code, Equals, http.StatusOK)
 
 	resbody, err := ioutil.ReadAll(rec.Body)
@@ -0,0 +1,134 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+	"golang.org/x/net/idna"
+)
+
+const (
+	// Limits on DNS names (RFC 1035), in their ASCII form
+	MaxLabelLen = 63
+	MaxFQDNLen  = 253
+)
+
+var (
+	// Labels of host and domain names (RFC 1123): letters, digits and hyphens, with a letter or
+	// digit at either end.
+	dnsLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+)
+
+//
+// Endpoint handlers
+//
+
+// GetFQDN returns the fully qualified domain name of the host (as computed from the hostname and
+// the domain).
+func (c *Controller) GetFQDN(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	resource := FQDNResource{}
+	resource.Hostname, resource.Domain, resource.FQDN = hostNames(c.db)
+
+	bytes, err := json.Marshal(&resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+//
+// Helpers
+//
+
+// hostNames returns the hostname, domain and FQDN of the host. The FQDN is just the hostname if
+// no domain is configured.
+func hostNames(db *gorm.DB) (hostname, domain, fqdn string) {
+	host := Hostname{}
+	db.First(&host, 1)
+	hostname = host.Hostname
+	if len(hostname) <= 0 {
+		hostname = DefaultHostname
+	}
+
+	dom := Domain{}
+	db.First(&dom, 1)
+	domain = dom.Domain
+
+	fqdn = hostname
+	if len(domain) > 0 {
+		fqdn = hostname + "." + domain
+	}
+	return
+}
+
+// toASCIIName returns the ASCII form of the (host or domain) name, in which internationalized
+// labels are punycode, e.g. bücher.example => xn--bcher-kva.example. ASCII names are returned as is.
+func toASCIIName(name string) (string, error) {
+	isASCII := true
+	for _, r := range name {
+		if r > 127 {
+			isASCII = false
+			break
+		}
+	}
+	if isASCII {
+		return name, nil
+	}
+
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a valid internationalized name (%s)", name, err)
+	}
+	return ascii, nil
+}
+
+// validateDNSName ensures that the (ASCII) name is a valid host or domain name.
+func validateDNSName(name string) error {
+	if len(name) <= 0 {
+		return fmt.Errorf("Name cannot be empty")
+	}
+	if len(name) > MaxFQDNLen {
+		return fmt.Errorf("%s is longer than %d chars", name, MaxFQDNLen)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > MaxLabelLen {
+			return fmt.Errorf("Label %s (of %s) is longer than %d chars", label, name, MaxLabelLen)
+		}
+		if !dnsLabelRegexp.MatchString(label) {
+			return fmt.Errorf("%s is not a valid name (labels may only contain letters, digits and "+
+				"hyphens, and cannot begin or end with a hyphen)", name)
+		}
+	}
+	return nil
+}
+
+// normalizeDNSName converts the name to its ASCII form and validates it.
+func normalizeDNSName(name string) (string, error) {
+	ascii, err := toASCIIName(name)
+	if err != nil {
+		return "", err
+	}
+	return ascii, validateDNSName(ascii)
+}
+
+//
+// Resources
+//
+
+type FQDNResource struct {
+	Hostname string // READ ONLY
+	Domain   string // READ ONLY
+	FQDN     string // READ ONLY
+}
@@ -0,0 +1,120 @@
+package host
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zenazn/goji/web"
+)
+
+type FQDNTestSuite struct {
+	hostTestSuite
+}
+
+//
+// Tests
+//
+
+func (ts *FQDNTestSuite) TestLabelValidation(c *C) {
+	for _, name := range []string{
+		"a",
+		"ncc-1701",
+		"1701",
+		"a.b.c",
+		strings.Repeat("a", MaxLabelLen),
+		strings.Repeat(strings.Repeat("a", MaxLabelLen)+".", 3) + strings.Repeat("a", 61),
+	} {
+		c.Check(validateDNSName(name), IsNil, Commentf("name: %s", name))
+	}
+
+	for _, name := range []string{
+		"",
+		".",
+		"-ncc1701",
+		"ncc1701-",
+		"ncc_1701",
+		"ncc 1701",
+		"a..b",
+		".a",
+		"a.",
+		strings.Repeat("a", MaxLabelLen+1),
+		strings.Repeat(strings.Repeat("a", MaxLabelLen)+".", 3) + strings.Repeat("a", 62),
+	} {
+		c.Check(validateDNSName(name), NotNil, Commentf("name: %s", name))
+	}
+}
+
+func (ts *FQDNTestSuite) TestInternationalizedNames(c *C) {
+	name, err := normalizeDNSName("bücher.example")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "xn--bcher-kva.example")
+
+	// ASCII names are left as is
+	name, err = normalizeDNSName("Starfleet.org")
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "Starfleet.org")
+
+	// Saved (and so rendered) in the ASCII form
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "bücher.example"}).Error, IsNil)
+	dom := Domain{}
+	c.Assert(ts.db.First(&dom, 1).Error, IsNil)
+	c.Assert(dom.Domain, Equals, "xn--bcher-kva.example")
+}
+
+func (ts *FQDNTestSuite) TestHostnameAndDomainValidation(c *C) {
+	c.Check(ts.db.Save(&Hostname{ID: 1, Hostname: "-ncc1701"}).Error, NotNil)
+	c.Check(ts.db.Save(&Hostname{ID: 1, Hostname: strings.Repeat("a", MaxLabelLen+1)}).Error, NotNil)
+	c.Check(ts.db.Save(&Domain{ID: 1, Domain: "starfleet-.org"}).Error, NotNil)
+	c.Check(ts.db.Save(&Domain{ID: 1, Domain: "starfleet..org"}).Error, NotNil)
+
+	// The trailing dot (of an absolute domain) is dropped
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "starfleet.org."}).Error, IsNil)
+	dom := Domain{}
+	c.Assert(ts.db.First(&dom, 1).Error, IsNil)
+	c.Assert(dom.Domain, Equals, "starfleet.org")
+
+	// The FQDN cannot exceed the max length, whichever of the two is changed
+	longDomain := strings.Repeat(strings.Repeat("a", 49)+".", 4) + strings.Repeat("a", 49) // 249 chars
+	c.Check(ts.db.Save(&Domain{ID: 1, Domain: longDomain}).Error, NotNil)
+	c.Assert(ts.db.Save(&Hostname{ID: 1, Hostname: "a"}).Error, IsNil)
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: longDomain}).Error, IsNil)
+	c.Check(ts.db.Save(&Hostname{ID: 1, Hostname: "ncc1701"}).Error, NotNil)
+	c.Check(ts.db.Save(&Domain{ID: 1, Domain: longDomain + ".aa"}).Error, NotNil)
+}
+
+func (ts *FQDNTestSuite) TestGetFQDN(c *C) {
+	// No domain is seeded, so the FQDN is just the hostname
+	fqdn := ts.getFQDN(c)
+	c.Assert(fqdn.Hostname, Equals, DefaultHostname)
+	c.Assert(fqdn.Domain, Equals, "")
+	c.Assert(fqdn.FQDN, Equals, DefaultHostname)
+
+	c.Assert(ts.db.Save(&Hostname{ID: 1, Hostname: "enterprise"}).Error, IsNil)
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "starfleet.org"}).Error, IsNil)
+
+	fqdn = ts.getFQDN(c)
+	c.Assert(fqdn.Hostname, Equals, "enterprise")
+	c.Assert(fqdn.Domain, Equals, "starfleet.org")
+	c.Assert(fqdn.FQDN, Equals, "enterprise.starfleet.org")
+}
+
+//
+// Helpers
+//
+
+func (ts *FQDNTestSuite) getFQDN(c *C) FQDNResource {
+	req, err := http.NewRequest("GET", "/dont/care", nil)
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ts.controller.GetFQDN(web.C{}, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	fqdn := FQDNResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &fqdn), IsNil)
+	return fqdn
+}
@@ -1,8 +1,13 @@
 package host
 
 import (
+	"io/ioutil"
+	"log"
 	"testing"
 
+	"github.com/amoghe/distillog"
+	"github.com/jinzhu/gorm"
+	_ "github.com/mattn/go-sqlite3"
 	. "gopkg.in/check.v1"
 )
 
@@ -10,13 +15,56 @@ import (
 func init() {
 	Suite(&HostnameTestSuite{})
 	Suite(&DomainTestSuite{})
+	Suite(&FQDNTestSuite{})
 	Suite(&InterfacesTestSuite{})
+	Suite(&VirtualInterfacesTestSuite{})
+	Suite(&NICsTestSuite{})
 	Suite(&UsersTestSuite{})
 	Suite(&SudoersTestSuite{})
 	Suite(&ResolversTestSuite{})
+	Suite(&RoutesTestSuite{})
+	Suite(&HostsEntriesTestSuite{})
+	Suite(&ProvisionTestSuite{})
+	Suite(&PasswordPolicyTestSuite{})
+	Suite(&LockoutTestSuite{})
+	Suite(&SSHKeysTestSuite{})
+	Suite(&GroupsTestSuite{})
 }
 
 // Hook up gocheck into the "go test" runner.
 func Test(t *testing.T) {
+	// Don't seed configs for the NICs of the machine running the tests
+	SysClassNetPath = "/nonexistent"
 	TestingT(t)
 }
+
+// hostTestSuite holds the (in memory) db and the controller that the test suites run against. Suites
+// embed it, those that need more setup call its SetUpTest/TearDownTest from their own.
+type hostTestSuite struct {
+	db         gorm.DB
+	controller *Controller
+}
+
+func (ts *hostTestSuite) SetUpTest(c *C) {
+	ts.openDB(c)
+	ts.controller.SeedDB()
+}
+
+func (ts *hostTestSuite) TearDownTest(c *C) {
+	// The (shared cache) memory db lives for as long as a connection to it is open, so this must
+	// always be done to prevent a test from seeing the rows left behind by an earlier one.
+	ts.db.Close()
+}
+
+// openDB opens the db and sets up a controller with it, without seeding it.
+func (ts *hostTestSuite) openDB(c *C) {
+	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
+	c.Assert(err, IsNil)
+
+	// Comment this to enable db logs during tests
+	db.SetLogger(log.New(ioutil.Discard, "", 0))
+	ts.db = db
+
+	ts.controller = NewController(&ts.db, distillog.NewNullLogger("test"))
+	ts.controller.MigrateDB()
+}
@@ -2,16 +2,33 @@ package host
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"sort"
 	"strings"
+	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
 )
 
 const (
-	GroupsFilePath = "/etc/group"
+	GroupsFilePath  = "/etc/group"
+	GShadowFilePath = "/etc/gshadow"
 
 	// Datum from which we start computing gid's for configured users.
 	GIDDatum = 2000
+
+	// Name of the (seeded) group whose members have admin rights
+	SudoGroupName = "sudo"
+)
+
+var (
+	ErrLastSudoMember = fmt.Errorf("The %s group must have at least one member", SudoGroupName)
 )
 
 var (
@@ -49,8 +66,371 @@ var (
 
 		"nogroup": 65534,
 	}
+
+	// Default groups that users may be made members of (the rest are reserved for the system).
+	memberGroups = []string{
+		"adm", // to read logs
+		SudoGroupName,
+	}
 )
 
+//
+// Endpoint handlers
+//
+
+func (c *Controller) GetGroups(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	groups := []Group{}
+	if err := c.db.Find(&groups).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	ret := make([]GroupResource, len(groups))
+	for i := range groups {
+		if err := c.groupResource(groups[i], &ret[i]); err != nil {
+			c.jsonError(err, w)
+			return
+		}
+	}
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) CreateGroup(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := GroupResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	group := resource.ToGroupModel()
+
+	txn := c.db.Begin()
+	if err = txn.Create(&group).Error; err != nil {
+		txn.Rollback()
+		c.jsonError(err, w)
+		return
+	}
+	if err = setGroupMembers(txn, group, resource.Members); err != nil {
+		txn.Rollback()
+		c.jsonError(err, w)
+		return
+	}
+	if err = txn.Commit().Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.GroupCreated, map[string]string{"ID": fmt.Sprint(group.ID), "Name": group.Name})
+	c.writeGroupResponse(ctx, group, w)
+}
+
+// UpdateGroup updates the comment, sudo flag and members of a group. Groups cannot be renamed (or
+// have their gid changed). Fields that are omitted from the request retain their values.
+func (c *Controller) UpdateGroup(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	group := Group{}
+	if err = c.db.Find(&group, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// The request is applied over the existing settings (and members)
+	resource := GroupResource{}
+	if err = c.groupResource(group, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if len(resource.Name) > 0 && resource.Name != group.Name {
+		c.jsonError(fmt.Errorf("Groups cannot be renamed"), w)
+		return
+	}
+	if resource.GID != 0 && resource.GID != group.GID {
+		c.jsonError(fmt.Errorf("The gid of a group cannot be changed"), w)
+		return
+	}
+
+	if group.Name == SudoGroupName && len(resource.Members) <= 0 {
+		c.jsonError(ErrLastSudoMember, w)
+		return
+	}
+
+	group.Comment = resource.Comment
+	group.Sudo = resource.Sudo
+
+	txn := c.db.Begin()
+	if err = txn.Save(&group).Error; err != nil {
+		txn.Rollback()
+		c.jsonError(err, w)
+		return
+	}
+	if err = setGroupMembers(txn, group, resource.Members); err != nil {
+		txn.Rollback()
+		c.jsonError(err, w)
+		return
+	}
+	if err = txn.Commit().Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.GroupUpdated, map[string]string{"ID": fmt.Sprint(group.ID), "Name": group.Name})
+	c.writeGroupResponse(ctx, group, w)
+}
+
+func (c *Controller) DeleteGroup(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	group := Group{}
+	if err := c.db.Find(&group, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// Load the members before they're gone, so that we can report them.
+	resource := GroupResource{}
+	if err := c.groupResource(group, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := c.db.Delete(&group).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.GroupDeleted, map[string]string{"ID": fmt.Sprint(group.ID), "Name": group.Name})
+	c.applyGroups(ctx)
+
+	bytes, err := json.Marshal(resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// AddGroupMember adds the user (specified by name) to the group.
+func (c *Controller) AddGroupMember(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := GroupMemberResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	group := Group{}
+	if err = c.db.Find(&group, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	user := User{}
+	if err = c.db.Where(User{Name: resource.Name}).First(&user).Error; err != nil {
+		c.jsonError(fmt.Errorf("No such user: %s", resource.Name), w)
+		return
+	}
+
+	member := GroupMember{GroupID: group.ID, UserID: user.ID}
+	if err = c.db.Where(member).FirstOrCreate(&member).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.GroupUpdated, map[string]string{"ID": fmt.Sprint(group.ID), "Name": group.Name})
+	c.writeGroupResponse(ctx, group, w)
+}
+
+// RemoveGroupMember removes the user (specified by id) from the group.
+func (c *Controller) RemoveGroupMember(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	group := Group{}
+	if err := c.db.Find(&group, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	member := GroupMember{}
+	err := c.db.Where("group_id = ? AND user_id = ?", group.ID, ctx.URLParams["userid"]).First(&member).Error
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if group.Name == SudoGroupName {
+		members, err := groupMembers(c.db, group.ID)
+		if err != nil {
+			c.jsonError(err, w)
+			return
+		}
+		if len(members) <= 1 {
+			c.jsonError(ErrLastSudoMember, w)
+			return
+		}
+	}
+
+	if err = c.db.Delete(&member).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.GroupUpdated, map[string]string{"ID": fmt.Sprint(group.ID), "Name": group.Name})
+	c.writeGroupResponse(ctx, group, w)
+}
+
+//
+// Helpers
+//
+
+// writeGroupResponse applies the group config to the system and writes the group to the response.
+func (c *Controller) writeGroupResponse(ctx web.C, group Group, w http.ResponseWriter) {
+	c.applyGroups(ctx)
+
+	ret := GroupResource{}
+	if err := c.groupResource(group, &ret); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) applyGroups(ctx web.C) {
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply groups to system (\"noapply\" present in env)")
+		return
+	}
+
+	for _, f := range []func() error{
+		c.RewriteGroupsFile,
+		c.RewriteGShadowFile,
+		c.RewriteSudoersFile,
+	} {
+		if err := f(); err != nil {
+			c.log.Warningln("failed to apply groups to system:", err)
+		}
+	}
+}
+
+// groupResource fills in the resource from the group (and its members).
+func (c *Controller) groupResource(group Group, res *GroupResource) error {
+	members, err := groupMembers(c.db, group.ID)
+	if err != nil {
+		return err
+	}
+
+	res.FromGroupModel(group)
+	res.Members = []string{}
+	for _, user := range members {
+		res.Members = append(res.Members, user.Name)
+	}
+	return nil
+}
+
+// groupMembers returns the users that are members of the specified group.
+func groupMembers(txn *gorm.DB, groupID int64) ([]User, error) {
+	members := []GroupMember{}
+	if err := txn.Where(GroupMember{GroupID: groupID}).Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for _, m := range members {
+		user := User{}
+		if err := txn.Find(&user, m.UserID).Error; err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// userGroups returns the names of the (supplementary) groups the user is a member of.
+func userGroups(txn *gorm.DB, userID int64) ([]string, error) {
+	members := []GroupMember{}
+	if err := txn.Where(GroupMember{UserID: userID}).Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, m := range members {
+		group := Group{}
+		if err := txn.Find(&group, m.GroupID).Error; err != nil {
+			return nil, err
+		}
+		names = append(names, group.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// setGroupMembers replaces the members of the group with the (named) users.
+func setGroupMembers(txn *gorm.DB, group Group, names []string) error {
+	if err := txn.Where(GroupMember{GroupID: group.ID}).Delete(GroupMember{}).Error; err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		user := User{}
+		if err := txn.Where(User{Name: name}).First(&user).Error; err != nil {
+			return fmt.Errorf("No such user: %s", name)
+		}
+		if err := txn.Create(&GroupMember{GroupID: group.ID, UserID: user.ID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Controller) RewriteGroupsFile() error {
 	c.log.Infoln("Rewriting groups file")
 
@@ -67,27 +447,102 @@ func (c *Controller) RewriteGroupsFile() error {
 	return nil
 }
 
+func (c *Controller) RewriteGShadowFile() error {
+	c.log.Infoln("Rewriting gshadow file")
+
+	contents, err := c.gshadowFileContents()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(GShadowFilePath, contents, 0640)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (c *Controller) groupsFileContents() ([]byte, error) {
+	entries, err := c.groupEntries()
+	if err != nil {
+		return []byte{}, err
+	}
+
 	contents := bytes.Buffer{}
-	for group, id := range defaultGroups {
-		contents.WriteString(groupFileEntry(group, id, []User{}))
+	for _, e := range entries {
+		contents.WriteString(groupFileEntry(e.name, e.gid, e.members))
 		contents.WriteString("\n")
 	}
+	return contents.Bytes(), nil
+}
 
-	users := []User{}
-	err := c.db.Find(&users).Error
+func (c *Controller) gshadowFileContents() ([]byte, error) {
+	entries, err := c.groupEntries()
 	if err != nil {
 		return []byte{}, err
 	}
 
-	for _, user := range users {
-		contents.WriteString(groupFileEntry(user.Name, user.Gid(), []User{user}))
+	contents := bytes.Buffer{}
+	for _, e := range entries {
+		contents.WriteString(gshadowFileEntry(e.name, e.members))
 		contents.WriteString("\n")
 	}
-
 	return contents.Bytes(), nil
 }
 
+type groupEntry struct {
+	name    string
+	gid     int
+	members []User
+}
+
+// groupEntries returns all the groups on the system (default groups, a personal group for each
+// user, and the configured groups) along with their members.
+func (c *Controller) groupEntries() ([]groupEntry, error) {
+	var (
+		entries = []groupEntry{}
+		users   = []User{}
+		groups  = []Group{}
+	)
+
+	if err := c.db.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if err := c.db.Find(&groups).Error; err != nil {
+		return nil, err
+	}
+
+	members := map[string][]User{}
+	for _, group := range groups {
+		m, err := groupMembers(c.db, group.ID)
+		if err != nil {
+			return nil, err
+		}
+		members[group.Name] = m
+	}
+
+	for group, id := range defaultGroups {
+		entries = append(entries, groupEntry{group, id, members[group]})
+	}
+	for _, user := range users {
+		if err := user.checkIds(); err != nil {
+			return nil, err
+		}
+		entries = append(entries, groupEntry{user.Name, user.Gid(), []User{user}})
+	}
+	for _, group := range groups {
+		if group.System {
+			continue
+		}
+		if group.GID <= 0 {
+			return nil, fmt.Errorf("Group %s has no gid allocated, refusing to render it", group.Name)
+		}
+		entries = append(entries, groupEntry{group.Name, group.GID, members[group.Name]})
+	}
+	return entries, nil
+}
+
 func groupFileEntry(name string, id int, users []User) string {
 	var usersList []string
 	for _, u := range users {
@@ -106,3 +561,180 @@ func groupFileEntry(name string, id int, users []User) string {
 		userNames,
 	)
 }
+
+func gshadowFileEntry(name string, users []User) string {
+	var usersList []string
+	for _, u := range users {
+		usersList = append(usersList, u.Name)
+	}
+
+	return fmt.Sprintf("%s:%s:%s:%s",
+		name,
+		"!", // no group password
+		"",  // no group administrators
+		strings.Join(usersList, ","),
+	)
+}
+
+//
+// DB Models
+//
+
+type Group struct {
+	ID      int64
+	Name    string
+	GID     int
+	Comment string
+
+	// Whether this is one of the default groups (only its members can be changed)
+	System bool
+	// Whether members of this group may run any command as root
+	Sudo bool
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GroupMember records the (supplementary) membership of a user in a group.
+type GroupMember struct {
+	ID      int64
+	GroupID int64
+	UserID  int64
+}
+
+func (g *Group) BeforeCreate(txn *gorm.DB) error {
+	if g.System {
+		for _, name := range memberGroups {
+			if name == g.Name {
+				g.GID = defaultGroups[name]
+				return nil
+			}
+		}
+		return fmt.Errorf("Group %s is reserved for the system", g.Name)
+	}
+
+	if len(g.Name) < MinUsernameLen || len(g.Name) > MaxUsernameLen {
+		return fmt.Errorf("Group name must be between %d and %d chars", MinUsernameLen, MaxUsernameLen)
+	}
+	for _, char := range []byte(g.Name) {
+		if !strings.Contains(ValidUsernameChars, string(char)) {
+			return fmt.Errorf("Group name can only contain upper/lower case alphabets and numbers.")
+		}
+	}
+	if _, reserved := defaultGroups[g.Name]; reserved {
+		return fmt.Errorf("Group %s is reserved for the system", g.Name)
+	}
+
+	users := []User{}
+	if err := txn.Find(&users).Error; err != nil {
+		return err
+	}
+	groups := []Group{}
+	if err := txn.Find(&groups).Error; err != nil {
+		return err
+	}
+
+	usedGids := map[int]bool{}
+	for _, gid := range defaultGroups {
+		usedGids[gid] = true
+	}
+	for _, user := range users {
+		if user.Name == g.Name {
+			return fmt.Errorf("Group %s conflicts with the personal group of user %s", g.Name, user.Name)
+		}
+		usedGids[user.GID] = true
+	}
+	for _, group := range groups {
+		if group.Name == g.Name {
+			return fmt.Errorf("Group %s already exists", g.Name)
+		}
+		usedGids[group.GID] = true
+	}
+
+	gid, err := pickId("gid", g.GID, GIDDatum, usedGids)
+	if err != nil {
+		return err
+	}
+	g.GID = gid
+	return nil
+}
+
+func (g *Group) BeforeDelete() error {
+	if g.System {
+		return fmt.Errorf("Group %s is reserved for the system", g.Name)
+	}
+	return nil
+}
+
+func (g *Group) AfterDelete(txn *gorm.DB) error {
+	if err := txn.Where(SudoRule{GroupID: g.ID}).Delete(SudoRule{}).Error; err != nil {
+		return err
+	}
+	return txn.Where(GroupMember{GroupID: g.ID}).Delete(GroupMember{}).Error
+}
+
+//
+// Resources
+//
+
+type GroupResource struct {
+	ID      int64
+	Name    string
+	GID     int // Allocated if unspecified, cannot be changed once created
+	Comment string
+	Sudo    bool     // Set to allow members to run any command as root
+	System  bool     // READ ONLY
+	Members []string // Names of the users in the group
+}
+
+type GroupMemberResource struct {
+	Name string // Name of the user
+}
+
+func (g GroupResource) ToGroupModel() Group {
+	return Group{
+		ID:      g.ID,
+		Name:    g.Name,
+		GID:     g.GID,
+		Comment: g.Comment,
+		Sudo:    g.Sudo,
+	}
+}
+
+func (g *GroupResource) FromGroupModel(m Group) {
+	g.ID = m.ID
+	g.Name = m.Name
+	g.GID = m.GID
+	g.Comment = m.Comment
+	g.Sudo = m.Sudo
+	g.System = m.System
+}
+
+//
+// DB Seed
+//
+
+func (c *Controller) seedGroups() {
+	c.log.Infoln("Seeding groups")
+
+	for _, name := range memberGroups {
+		group := Group{}
+		if !c.db.Where(Group{Name: name}).First(&group).RecordNotFound() {
+			continue
+		}
+
+		group = Group{Name: name, System: true, Sudo: name == SudoGroupName}
+		if err := c.db.Create(&group).Error; err != nil {
+			c.log.Errorln("Failed to seed group", name, ":", err)
+			continue
+		}
+
+		// The admin has always had admin rights.
+		if name == SudoGroupName {
+			admin := User{}
+			if err := c.db.Where(User{Name: AdminUsername}).First(&admin).Error; err == nil {
+				c.db.Create(&GroupMember{GroupID: group.ID, UserID: admin.ID})
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package host
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zenazn/goji/web"
+)
+
+type GroupsTestSuite struct {
+	hostTestSuite
+}
+
+func (ts *GroupsTestSuite) TestSeededGroups(c *C) {
+	groups := []Group{}
+	c.Assert(ts.db.Find(&groups).Error, IsNil)
+	c.Assert(groups, HasLen, len(memberGroups))
+
+	sudo := Group{}
+	c.Assert(ts.db.Where(Group{Name: SudoGroupName}).First(&sudo).Error, IsNil)
+	c.Assert(sudo.System, Equals, true)
+	c.Assert(sudo.Sudo, Equals, true)
+	c.Assert(sudo.GID, Equals, defaultGroups[SudoGroupName])
+
+	members, err := groupMembers(&ts.db, sudo.ID)
+	c.Assert(err, IsNil)
+	c.Assert(members, HasLen, 1)
+	c.Assert(members[0].Name, Equals, AdminUsername)
+
+	// Reseeding does not put back members that were removed
+	c.Assert(ts.db.Where(GroupMember{GroupID: sudo.ID}).Delete(GroupMember{}).Error, IsNil)
+	ts.controller.SeedDB()
+	members, err = groupMembers(&ts.db, sudo.ID)
+	c.Assert(err, IsNil)
+	c.Assert(members, HasLen, 0)
+}
+
+func (ts *GroupsTestSuite) TestGroupValidation(c *C) {
+	c.Assert(ts.db.Create(&User{Name: "jdoe", Password: "somepass"}).Error, IsNil)
+
+	for _, group := range []Group{
+		{Name: "x"},                               // too short
+		{Name: "bad name"},                        // invalid chars
+		{Name: "shadow"},                          // reserved
+		{Name: "syslog", System: true},            // reserved (and not one users may join)
+		{Name: "jdoe"},                            // personal group of a user
+		{Name: "ops", GID: 27},                    // reserved gid
+		{Name: "ops", GID: 100},                   // gid out of range
+		{Name: "ops", GID: ts.userGid(c, "jdoe")}, // gid of a user
+	} {
+		c.Assert(ts.db.Create(&group).Error, NotNil, Commentf("group: %+v", group))
+	}
+
+	ops := Group{Name: "ops"}
+	c.Assert(ts.db.Create(&ops).Error, IsNil)
+	c.Assert(ops.GID >= GIDDatum, Equals, true)
+	c.Assert(ops.GID, Not(Equals), ts.userGid(c, "jdoe"))
+
+	// Names and gids cannot be reused
+	c.Assert(ts.db.Create(&Group{Name: "ops"}).Error, NotNil)
+	c.Assert(ts.db.Create(&Group{Name: "ops2", GID: ops.GID}).Error, NotNil)
+
+	// ... not even by the personal group of a user
+	c.Assert(ts.db.Create(&User{Name: "ops", Password: "somepass"}).Error, NotNil)
+	c.Assert(ts.db.Create(&User{Name: "adm", Password: "somepass"}).Error, NotNil)
+	u := User{Name: "jane", Password: "somepass"}
+	c.Assert(ts.db.Create(&u).Error, IsNil)
+	c.Assert(u.Gid(), Not(Equals), ops.GID)
+}
+
+func (ts *GroupsTestSuite) TestSystemGroupsCannotBeDeleted(c *C) {
+	sudo := Group{}
+	c.Assert(ts.db.Where(Group{Name: SudoGroupName}).First(&sudo).Error, IsNil)
+	c.Assert(ts.db.Delete(&sudo).Error, NotNil)
+	c.Assert(ts.db.First(&Group{}, sudo.ID).Error, IsNil)
+}
+
+func (ts *GroupsTestSuite) TestGroupEndpointHandlers(c *C) {
+	c.Assert(ts.db.Create(&User{Name: "jdoe", Password: "somepass"}).Error, IsNil)
+	c.Assert(ts.db.Create(&User{Name: "jane", Password: "somepass"}).Error, IsNil)
+
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+
+	// Create with a nonexistent member fails (and leaves no trace)
+	rec := do(ts.controller.CreateGroup, nil, `{"Name": "ops", "Members": ["nobody"]}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+	c.Assert(ts.db.Where(Group{Name: "ops"}).First(&Group{}).RecordNotFound(), Equals, true)
+
+	rec = do(ts.controller.CreateGroup, nil, `{"Name": "ops", "Comment": "operators", "Members": ["jdoe"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	ops := GroupResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &ops), IsNil)
+	c.Assert(ops.Members, DeepEquals, []string{"jdoe"})
+
+	params := map[string]string{"id": fmt.Sprintf("%d", ops.ID)}
+
+	// Add a member
+	rec = do(ts.controller.AddGroupMember, params, `{"Name": "jane"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &ops), IsNil)
+	c.Assert(ops.Members, HasLen, 2)
+
+	// Adding again is a no-op
+	rec = do(ts.controller.AddGroupMember, params, `{"Name": "jane"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &ops), IsNil)
+	c.Assert(ops.Members, HasLen, 2)
+
+	// Remove a member
+	jdoe := User{}
+	c.Assert(ts.db.Where(User{Name: "jdoe"}).First(&jdoe).Error, IsNil)
+	rec = do(ts.controller.RemoveGroupMember,
+		map[string]string{"id": params["id"], "userid": fmt.Sprintf("%d", jdoe.ID)}, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &ops), IsNil)
+	c.Assert(ops.Members, DeepEquals, []string{"jane"})
+
+	// Update replaces the members, but cannot rename
+	rec = do(ts.controller.UpdateGroup, params, `{"Name": "ops2", "Members": ["jdoe"]}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+	rec = do(ts.controller.UpdateGroup, params, `{"Comment": "ops", "Sudo": true, "Members": ["jdoe"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &ops), IsNil)
+	c.Assert(ops.Members, DeepEquals, []string{"jdoe"})
+	c.Assert(ops.Sudo, Equals, true)
+
+	// Omitted fields retain their values
+	rec = do(ts.controller.UpdateGroup, params, `{"Comment": "operators"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &ops), IsNil)
+	c.Assert(ops.Comment, Equals, "operators")
+	c.Assert(ops.Members, DeepEquals, []string{"jdoe"})
+	c.Assert(ops.Sudo, Equals, true)
+
+	// List
+	rec = do(ts.controller.GetGroups, nil, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	groups := []GroupResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &groups), IsNil)
+	c.Assert(groups, HasLen, len(memberGroups)+1)
+
+	// Delete
+	rec = do(ts.controller.DeleteGroup, params, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.First(&Group{}, ops.ID).RecordNotFound(), Equals, true)
+	c.Assert(ts.db.Where(GroupMember{GroupID: ops.ID}).First(&GroupMember{}).RecordNotFound(), Equals, true)
+}
+
+func (ts *GroupsTestSuite) TestSudoGroupKeepsAMember(c *C) {
+	sudo := Group{}
+	c.Assert(ts.db.Where(Group{Name: SudoGroupName}).First(&sudo).Error, IsNil)
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	params := map[string]string{"id": fmt.Sprintf("%d", sudo.ID)}
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+	members := func() []string {
+		res := GroupResource{}
+		c.Assert(ts.controller.groupResource(sudo, &res), IsNil)
+		return res.Members
+	}
+
+	// Updating just the comment leaves the admin in the group
+	c.Assert(do(ts.controller.UpdateGroup, params, `{"Comment": "admins"}`).Code, Equals, http.StatusOK)
+	c.Assert(members(), DeepEquals, []string{AdminUsername})
+
+	contents, err := ts.controller.sudoersFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "%sudo ALL=(ALL:ALL) ALL"), Equals, true)
+
+	// The last member cannot be removed
+	c.Assert(do(ts.controller.UpdateGroup, params, `{"Members": []}`).Code, Not(Equals), http.StatusOK)
+	c.Assert(do(ts.controller.RemoveGroupMember,
+		map[string]string{"id": params["id"], "userid": fmt.Sprintf("%d", admin.ID)}, "").Code,
+		Not(Equals), http.StatusOK)
+	c.Assert(members(), DeepEquals, []string{AdminUsername})
+
+	// ... unless there is another
+	c.Assert(ts.db.Create(&User{Name: "jdoe", Password: "somepass"}).Error, IsNil)
+	c.Assert(do(ts.controller.UpdateGroup, params, `{"Members": ["jdoe"]}`).Code, Equals, http.StatusOK)
+	c.Assert(members(), DeepEquals, []string{"jdoe"})
+}
+
+func (ts *GroupsTestSuite) TestGroupFilesContents(c *C) {
+	jdoe := User{Name: "jdoe", Password: "somepass"}
+	c.Assert(ts.db.Create(&jdoe).Error, IsNil)
+
+	ops := Group{Name: "ops"}
+	c.Assert(ts.db.Create(&ops).Error, IsNil)
+	c.Assert(ts.db.Create(&GroupMember{GroupID: ops.ID, UserID: jdoe.ID}).Error, IsNil)
+
+	adm := Group{}
+	c.Assert(ts.db.Where(Group{Name: "adm"}).First(&adm).Error, IsNil)
+	c.Assert(ts.db.Create(&GroupMember{GroupID: adm.ID, UserID: jdoe.ID}).Error, IsNil)
+
+	contents, err := ts.controller.groupsFileContents()
+	c.Assert(err, IsNil)
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	// default groups, personal groups of the seeded admin and jdoe, and ops
+	c.Assert(lines, HasLen, len(defaultGroups)+2+1)
+	c.Assert(string(contents), Matches, "(?ms).*^adm:x:4:jdoe$.*")
+	c.Assert(string(contents), Matches, fmt.Sprintf("(?ms).*^ops:x:%d:jdoe$.*", ops.GID))
+	c.Assert(string(contents), Matches, fmt.Sprintf("(?ms).*^jdoe:x:%d:jdoe$.*", jdoe.Gid()))
+
+	contents, err = ts.controller.gshadowFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Split(strings.TrimSpace(string(contents)), "\n"), HasLen, len(lines))
+	c.Assert(string(contents), Matches, "(?ms).*^adm:!::jdoe$.*")
+	c.Assert(string(contents), Matches, "(?ms).*^ops:!::jdoe$.*")
+
+	// Memberships go away with the user
+	c.Assert(ts.db.Delete(&jdoe).Error, IsNil)
+	contents, err = ts.controller.groupsFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, "(?ms).*^adm:x:4:$.*")
+}
+
+func (ts *GroupsTestSuite) userGid(c *C, name string) int {
+	user := User{}
+	c.Assert(ts.db.Where(User{Name: name}).First(&user).Error, IsNil)
+	return user.Gid()
+}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"strings"
 
+	"rocketship/commander/modules/events"
+
 	"github.com/amoghe/go-upstart"
 	"github.com/jinzhu/gorm"
 	"github.com/zenazn/goji/web"
@@ -71,6 +73,8 @@ func (c *Controller) PutHostname(ctx web.C, w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	events.Publish(events.HostnameChanged, map[string]string{"Hostname": host.Hostname})
+
 	applicator := func() error {
 		if err := c.RewriteHostnameFile(); err != nil {
 			return err
@@ -78,6 +82,10 @@ func (c *Controller) PutHostname(ctx web.C, w http.ResponseWriter, r *http.Reque
 		if err := c.RewriteEtcHostsFile(); err != nil {
 			return err
 		}
+		// DHCP profiles may override the hostname (from the server) with ours
+		if err := c.RewriteDhclientConfFile(); err != nil {
+			return err
+		}
 		if err := upstart.StartJob("hostname"); err != nil {
 			return err
 		}
@@ -93,7 +101,21 @@ func (c *Controller) PutHostname(ctx web.C, w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	w.Write(bodybytes)
+	// The response has the name as saved (i.e. in its ASCII form)
+	resource := HostnameResource{}
+	resource.FromHostnameModel(host)
+
+	bytes, err := json.Marshal(&resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
 }
 
 //
@@ -146,29 +168,20 @@ func (c *Controller) hostnameFileContents() ([]byte, error) {
 }
 
 func (c *Controller) etcHostsFileContents() ([]byte, error) {
-	var (
-		ret      = bytes.Buffer{}
-		host     = Hostname{}
-		dom      = Domain{}
-		hostname = DefaultHostname
-		fqdn     = ""
-	)
+	ret := bytes.Buffer{}
 
-	c.db.First(&host, 1)
-	if len(host.Hostname) > 0 {
-		hostname = host.Hostname
-	}
-
-	c.db.First(&dom, 1)
-	if len(dom.Domain) > 0 {
-		fqdn = hostname + dom.Domain
+	// The FQDN goes first, so that it is the canonical name (e.g. for `hostname -f`)
+	hostname, _, fqdn := hostNames(c.db)
+	names := hostname
+	if fqdn != hostname {
+		names = fqdn + " " + hostname
 	}
 
 	lines := []string{
 		"# This file is autogenerated. Do not edit this file.",
 		"# Your changes will be overwritten.",
 		"127.0.0.1 localhost",
-		fmt.Sprintf("127.0.1.1 %s %s", hostname, fqdn),
+		"127.0.1.1 " + names,
 		"",
 		"# IPv6",
 		"::1     ip6-localhost ip6-loopback",
@@ -178,6 +191,16 @@ func (c *Controller) etcHostsFileContents() ([]byte, error) {
 		"ff02::2 ip6-allrouters",
 	}
 
+	// Static entries (if any) follow the defaults
+	entries, err := c.etcHostsEntryLines()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		lines = append(lines, "", "# Static entries")
+		lines = append(lines, entries...)
+	}
+
 	// Add header lines
 	for _, h := range lines {
 		ret.WriteString(h)
@@ -201,11 +224,20 @@ func (h *Hostname) BeforeSave(txn *gorm.DB) error {
 	if len(h.Hostname) < MinHostnameLength {
 		return fmt.Errorf("Hostname cannot be shorter than %d chars", MinHostnameLength)
 	}
-	// Invalid chars check
-	for _, char := range []string{" ", ".", "/"} {
-		if strings.Contains(h.Hostname, char) {
-			return fmt.Errorf("Hostname cannot contain %s", char)
-		}
+
+	name, err := normalizeDNSName(h.Hostname)
+	if err != nil {
+		return err
+	}
+	// The hostname is a single label, the domain makes up the rest of the FQDN
+	if strings.Contains(name, ".") {
+		return fmt.Errorf("Hostname cannot contain .")
+	}
+	h.Hostname = name
+
+	dom := Domain{}
+	if txn.First(&dom, 1).Error == nil && len(dom.Domain) > 0 && len(name)+1+len(dom.Domain) > MaxFQDNLen {
+		return fmt.Errorf("FQDN (%s.%s) cannot be longer than %d chars", name, dom.Domain, MaxFQDNLen)
 	}
 	return nil
 }
@@ -75,6 +75,14 @@ func (ts *HostnameTestSuite) TestEtcHostsFileContents(c *C) {
 	c.Log(string(contents))
 	c.Assert(err, IsNil)
 	c.Assert(strings.Contains(string(contents), "127.0.0.1 localhost"), Equals, true)
+	c.Assert(strings.Contains(string(contents), "127.0.1.1 "+DefaultHostname+"\n"), Equals, true)
+
+	// The FQDN (hostname and domain, separated by a dot) is the canonical name
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "starfleet.org"}).Error, IsNil)
+	contents, err = ts.controller.etcHostsFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents),
+		"127.0.1.1 "+DefaultHostname+".starfleet.org "+DefaultHostname+"\n"), Equals, true)
 }
 
 func (ts *HostnameTestSuite) TestGetHostname(c *C) {
@@ -0,0 +1,279 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Max number of names that map to an IP (in a single hosts entry)
+	MaxHostsEntryNames = 8
+)
+
+var (
+	// Names that the default entries of /etc/hosts map
+	reservedHostsNames = []string{"localhost", "ip6-localhost", "ip6-loopback", "ip6-localnet",
+		"ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters"}
+)
+
+//
+// Endpoint handlers
+//
+
+func (c *Controller) GetHostsEntries(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	entries := []HostsEntry{}
+	if err := c.db.Find(&entries).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resources := make([]HostsEntryResource, len(entries))
+	for i, entry := range entries {
+		resources[i].FromHostsEntryModel(entry)
+	}
+
+	bytes, err := json.Marshal(resources)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) CreateHostsEntry(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := HostsEntryResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	entry := resource.ToHostsEntryModel()
+	entry.ID = 0
+
+	c.log.Infoln("Creating hosts entry for", entry.IP)
+	if err = c.db.Create(&entry).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.applyHostsEntries(ctx, entry)
+	c.writeHostsEntryResponse(entry, w)
+}
+
+func (c *Controller) UpdateHostsEntry(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := HostsEntryResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	entry := resource.ToHostsEntryModel()
+
+	existing := HostsEntry{}
+	if err = c.db.Find(&existing, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	entry.ID = existing.ID
+
+	c.log.Infoln("Updating hosts entry for", entry.IP)
+	if err = c.db.Save(&entry).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.applyHostsEntries(ctx, entry)
+	c.writeHostsEntryResponse(entry, w)
+}
+
+func (c *Controller) DeleteHostsEntry(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	entry := HostsEntry{}
+	if err := c.db.Find(&entry, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.log.Infoln("Deleting hosts entry for", entry.IP)
+	if err := c.db.Delete(&entry).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.applyHostsEntries(ctx, entry)
+	c.writeHostsEntryResponse(entry, w)
+}
+
+//
+// Helpers
+//
+
+func (c *Controller) writeHostsEntryResponse(entry HostsEntry, w http.ResponseWriter) {
+	resource := HostsEntryResource{}
+	resource.FromHostsEntryModel(entry)
+
+	bytes, err := json.Marshal(resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// applyHostsEntries rewrites /etc/hosts following a change to the (specified) entry.
+func (c *Controller) applyHostsEntries(ctx web.C, entry HostsEntry) {
+	defer events.Publish(events.HostsEntriesChanged,
+		map[string]string{"ID": fmt.Sprint(entry.ID), "IP": entry.IP})
+
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping rewrite of etc/hosts file (\"noapply\" present in env)")
+		return
+	}
+
+	if err := c.RewriteEtcHostsFile(); err != nil {
+		c.log.Warningln("failed to rewrite etc/hosts file:", err)
+	}
+}
+
+// etcHostsEntryLines returns the lines (for /etc/hosts) of the configured entries.
+func (c *Controller) etcHostsEntryLines() ([]string, error) {
+	entries := []HostsEntry{}
+	if err := c.db.Order("id").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, entry := range entries {
+		lines = append(lines, entry.IP+" "+strings.Join(entry.nameList(), " "))
+	}
+	return lines, nil
+}
+
+//
+// DB Models
+//
+
+// HostsEntry is a static mapping (in /etc/hosts) of names to an IP, for names that can't (or
+// shouldn't) be resolved via DNS.
+type HostsEntry struct {
+	ID    int64
+	IP    string
+	Names string // Comma separated, the first is the canonical name
+}
+
+func (h *HostsEntry) BeforeSave(txn *gorm.DB) error {
+	ip := net.ParseIP(h.IP)
+	if ip == nil {
+		return fmt.Errorf("Invalid IP (%s)", h.IP)
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("IP %s cannot be mapped to names", h.IP)
+	}
+	h.IP = ip.String() // canonical form, e.g. 2001:DB8:0::1 => 2001:db8::1
+
+	names := h.nameList()
+	if len(names) <= 0 || len(names) > MaxHostsEntryNames {
+		return fmt.Errorf("Between 1 and %d names must map to %s", MaxHostsEntryNames, h.IP)
+	}
+	for i, name := range names {
+		var err error
+		if names[i], err = normalizeDNSName(name); err != nil {
+			return err
+		}
+	}
+	h.Names = strings.Join(names, ",")
+
+	// Names of the host itself, and those of the default entries, are taken
+	taken := map[string]bool{}
+	for _, name := range reservedHostsNames {
+		taken[name] = true
+	}
+	hostname, _, fqdn := hostNames(txn)
+	taken[strings.ToLower(hostname)] = true
+	taken[strings.ToLower(fqdn)] = true
+
+	others := []HostsEntry{}
+	if err := txn.Where("id <> ?", h.ID).Find(&others).Error; err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.IP == h.IP {
+			return fmt.Errorf("An entry for %s already exists", h.IP)
+		}
+		for _, name := range other.nameList() {
+			taken[strings.ToLower(name)] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if taken[strings.ToLower(name)] {
+			return fmt.Errorf("Name %s is already in use", name)
+		}
+		if seen[strings.ToLower(name)] {
+			return fmt.Errorf("Name %s is specified more than once", name)
+		}
+		seen[strings.ToLower(name)] = true
+	}
+
+	return nil
+}
+
+// nameList returns the names (in order) that map to the IP.
+func (h HostsEntry) nameList() []string {
+	names := []string{}
+	for _, name := range strings.Split(h.Names, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//
+// Resources
+//
+
+type HostsEntryResource struct {
+	ID    int64 // READ ONLY
+	IP    string
+	Names []string // The first is the canonical name
+}
+
+func (r *HostsEntryResource) FromHostsEntryModel(m HostsEntry) {
+	r.ID = m.ID
+	r.IP = m.IP
+	r.Names = m.nameList()
+}
+
+func (r HostsEntryResource) ToHostsEntryModel() HostsEntry {
+	return HostsEntry{ID: r.ID, IP: r.IP, Names: strings.Join(r.Names, ",")}
+}
@@ -0,0 +1,113 @@
+package host
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+
+	. "gopkg.in/check.v1"
+)
+
+type HostsEntriesTestSuite struct {
+	hostTestSuite
+}
+
+func (ts *HostsEntriesTestSuite) SetUpTest(c *C) {
+	ts.hostTestSuite.SetUpTest(c)
+
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "starfleet.org"}).Error, IsNil)
+}
+
+//
+// tests
+//
+
+func (ts *HostsEntriesTestSuite) TestHostsEntryValidation(c *C) {
+	c.Assert(ts.db.Create(&HostsEntry{IP: "10.0.0.10", Names: "license.corp,license"}).Error, IsNil)
+
+	for _, entry := range []HostsEntry{
+		{IP: "10.0.0.300", Names: "syslog"},                          // bad IP
+		{IP: "127.0.0.5", Names: "syslog"},                           // loopback
+		{IP: "::", Names: "syslog"},                                  // unspecified
+		{IP: "10.0.0.11", Names: ""},                                 // no names
+		{IP: "10.0.0.11", Names: "a,b,c,d,e,f,g,h,i"},                // too many names
+		{IP: "10.0.0.11", Names: "syslog,-syslog"},                   // bad name
+		{IP: "10.0.0.11", Names: "syslog,SYSLOG"},                    // twice
+		{IP: "10.0.0.11", Names: "localhost"},                        // reserved
+		{IP: "10.0.0.11", Names: DefaultHostname},                    // the host itself
+		{IP: "10.0.0.11", Names: DefaultHostname + ".starfleet.org"}, // ... by its FQDN
+		{IP: "10.0.0.11", Names: "License"},                          // another entry has it
+		{IP: "10.0.0.10", Names: "syslog"},                           // another entry for the IP
+	} {
+		c.Assert(ts.db.Create(&entry).Error, NotNil, Commentf("entry: %+v", entry))
+	}
+
+	entry := HostsEntry{IP: "2001:DB8:0::514", Names: " syslog.corp , syslog "}
+	c.Assert(ts.db.Create(&entry).Error, IsNil)
+	c.Assert(entry.IP, Equals, "2001:db8::514")
+	c.Assert(entry.Names, Equals, "syslog.corp,syslog")
+
+	// An entry doesn't conflict with itself
+	entry.Names = "syslog,syslog.corp"
+	c.Assert(ts.db.Save(&entry).Error, IsNil)
+}
+
+func (ts *HostsEntriesTestSuite) TestHostsEntriesEndpointHandlers(c *C) {
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: map[interface{}]interface{}{NoApplyEnvKey: true}}, rec, req)
+		return rec
+	}
+
+	rec := do(ts.controller.CreateHostsEntry, nil, `{"IP": "10.0.0.10", "Names": []}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.CreateHostsEntry, nil, `{"ID": 42, "IP": "10.0.0.10", "Names": ["license.corp", "license"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	entry := HostsEntryResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &entry), IsNil)
+	c.Assert(entry.ID, Not(Equals), int64(42))
+	c.Assert(entry.Names, DeepEquals, []string{"license.corp", "license"})
+
+	params := map[string]string{"id": fmt.Sprint(entry.ID)}
+	rec = do(ts.controller.UpdateHostsEntry, params, `{"IP": "10.0.0.12", "Names": ["license.corp", "license", "lic"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.UpdateHostsEntry, map[string]string{"id": "42"}, `{"IP": "10.0.0.13", "Names": ["x"]}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.CreateHostsEntry, nil, `{"IP": "10.0.0.14", "Names": ["syslog"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.GetHostsEntries, nil, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	entries := []HostsEntryResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &entries), IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[0].IP, Equals, "10.0.0.12")
+
+	// They follow the default entries in /etc/hosts
+	contents, err := ts.controller.etcHostsFileContents()
+	c.Assert(err, IsNil)
+	c.Log(string(contents))
+	c.Assert(strings.HasSuffix(string(contents),
+		"ff02::2 ip6-allrouters\n\n# Static entries\n10.0.0.12 license.corp license lic\n10.0.0.14 syslog\n"),
+		Equals, true)
+
+	rec = do(ts.controller.DeleteHostsEntry, params, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	contents, err = ts.controller.etcHostsFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "license"), Equals, false)
+}
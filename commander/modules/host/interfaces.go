@@ -8,7 +8,12 @@ import (
 	"net"
 	"net/http"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"rocketship/commander/modules/events"
 
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
@@ -18,6 +23,17 @@ import (
 const (
 	ModeDHCP   = "dhcp"
 	ModeStatic = "static"
+	ModeSLAAC  = "auto" // IPv6 only, stateless address autoconfiguration
+	ModeNone   = "none" // address family is not configured on the interface
+
+	// Bounds on the prefix length of static IPv6 addresses
+	MinIPv6PrefixLen = 1
+	MaxIPv6PrefixLen = 128
+
+	// Bounds on the MTU of interfaces (an MTU of 0 leaves the link at its default)
+	MinMTU     = 68   // the minimum for IPv4 (RFC 791)
+	MaxMTU     = 9000 // jumbo frames
+	MinIPv6MTU = 1280 // the minimum for IPv6 (RFC 8200)
 
 	InterfacesFilePath   = "/etc/network/interfaces"
 	DhclientConfFilePath = "/etc/dhcp/dhclient.conf"
@@ -37,9 +53,24 @@ const (
 		"\"rfc3442-classless-static-routes\", \"ntp-servers\", \"dhcp6.domain-search\", " +
 		"\"dhcp6.fqdn\", \"dhcp6.name-servers\", \"dhcp6.sntp-servers\"]"
 
-	IfupBinPath     = "/sbin/ifup"
-	IfdownBinPath   = "/sbin/ifdown"
-	IfconfigBinPath = "/sbin/ifconfig"
+	// DHCP options that are configured by way of other settings (rather than the option maps)
+	dhcpOptionDNSServers  = "domain-name-servers"
+	dhcpOptionDNSServers6 = "dhcp6.name-servers"
+	dhcpOptionHostname    = "host-name"
+	dhcpOptionDomainName  = "domain-name"
+
+	IfupBinPath   = "/sbin/ifup"
+	IfdownBinPath = "/sbin/ifdown"
+)
+
+var (
+	// DHCP option names, optionally qualified by their space (e.g. "dhcp6.name-servers"), see
+	// dhcp-options(5).
+	dhcpOptionNameRegexp = regexp.MustCompile(`^([a-z][a-z0-9-]*\.)?[a-z][a-z0-9-]*$`)
+	// DHCP option values are (comma separated lists of) quoted strings or simple tokens (numbers,
+	// addresses, names), so that they cannot terminate the statement they are in.
+	dhcpOptionValueRegexp = regexp.MustCompile(`^("[^"\\\n]*"|[A-Za-z0-9.:_/-]+)` +
+		`(\s*,\s*("[^"\\\n]*"|[A-Za-z0-9.:_/-]+))*$`)
 )
 
 //
@@ -84,13 +115,14 @@ func (c *Controller) GetInterface(ctx web.C, w http.ResponseWriter, r *http.Requ
 	}
 
 	resource := &InterfaceConfigResource{}
-	output, err := (ifaceCtrl{Name: ifaceName, Log: c.log}).Ifconfig()
+	status, err := (ifaceCtrl{Name: ifaceName, Log: c.log}).Status()
 	if err != nil {
-		c.log.Warningln("Failed to get ifconfig info for ", ifaceName)
+		c.log.Warningln("Failed to get status of", ifaceName, ":", err)
 	}
 
-	resource.InterfaceConfig = iface
-	resource.InterfaceStatus = output
+	resource.FromInterfaceConfigModel(iface)
+	resource.InterfaceStatus = status
+	resource.RevertIn = c.revertIn(ifaceName)
 
 	bytes, err := json.MarshalIndent(resource, "", "  ")
 	if err != nil {
@@ -128,12 +160,47 @@ func (c *Controller) EditInterface(ctx web.C, w http.ResponseWriter, r *http.Req
 	}
 
 	// only the InterfaceConfig from the request is useful to us.
-	iface := resource.InterfaceConfig
+	iface := resource.ToInterfaceConfigModel()
 	iface.Name = ifaceName
 
-	// save to db
+	// The change may have to be confirmed (else it is reverted)
+	timeout, err := confirmTimeout(r)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	if err = c.checkPendingChange(iface.Name, timeout); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	previous := InterfaceConfig{Name: ifaceName}
+	if err := c.db.First(&previous).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, noapply := ctx.Env[NoApplyEnvKey]
+
+	var pending *pendingChange
+	if timeout > 0 {
+		pending = &pendingChange{previous: previous, deadline: time.Now().Add(timeout), noapply: noapply}
+	}
+
+	// save to db (along with the change that is pending confirmation, so that it survives restarts)
 	c.log.Infoln("Saving configuration for interface", iface.Name)
-	if err := c.db.Save(&iface).Error; err != nil {
+	txn := c.db.Begin()
+	if err := txn.Save(&iface).Error; err != nil {
+		txn.Rollback()
+		c.jsonError(err, w)
+		return
+	}
+	if err := savePendingChange(txn, pending); err != nil {
+		txn.Rollback()
+		c.jsonError(err, w)
+		return
+	}
+	if err := txn.Commit().Error; err != nil {
 		c.jsonError(err, w)
 		return
 	}
@@ -144,35 +211,30 @@ func (c *Controller) EditInterface(ctx web.C, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	applicator := func() error {
-		c.log.Infoln("Applying interface configuration to system")
-		if err := c.RewriteInterfacesFile(); err != nil {
-			return err
-		}
-		if iface.Mode == ModeDHCP {
-			if err := c.RewriteDhclientConfFile(); err != nil {
-				return err
-			}
-		}
-		return nil
-	}
-
-	if _, there := ctx.Env[NoApplyEnvKey]; there {
+	if noapply {
 		c.log.Infoln("Skipping apply interface config to system (\"noapply\" present in env)")
 	} else {
-		if err := applicator(); err != nil {
+		if err := c.applyInterface(iface); err != nil {
 			c.log.Warningln("failed to apply interface settings to system:", err)
 		}
 	}
 
-	// get the latest ifconfig output (for the response)
-	output, err := (ifaceCtrl{Name: iface.Name, Log: c.log}).Ifconfig()
+	if pending != nil {
+		c.startPendingChange(pending)
+	}
+
+	events.Publish(events.InterfaceReconfigured,
+		map[string]string{"Name": iface.Name, "Mode": iface.Mode, "IPv6Mode": iface.IPv6Mode,
+			"Enabled": fmt.Sprint(iface.Enabled)})
+
+	// get the latest status (for the response)
+	status, err := (ifaceCtrl{Name: iface.Name, Log: c.log}).Status()
 	if err != nil {
-		output = fmt.Sprintf("Failed to get ifconfig info for %s", iface.Name)
-		c.log.Errorln(output)
+		c.log.Errorln("Failed to get status of", iface.Name, ":", err)
 	}
-	resource.InterfaceStatus = output
-	resource.InterfaceConfig = iface
+	resource.InterfaceStatus = status
+	resource.FromInterfaceConfigModel(iface)
+	resource.RevertIn = c.revertIn(iface.Name)
 
 	bytes, err := json.Marshal(resource)
 	if err != nil {
@@ -197,9 +259,11 @@ func (c *Controller) GetDHCPProfiles(ctx web.C, w http.ResponseWriter, r *http.R
 	}
 
 	resources := make([]DHCPProfileResource, len(profiles))
-	for i, r := range resources {
-		ptr := &r
-		ptr.FromDHCPProfileModel(profiles[i])
+	for i := range profiles {
+		if err := resources[i].FromDHCPProfileModel(profiles[i]); err != nil {
+			c.jsonError(err, w)
+			return
+		}
 	}
 
 	bytes, err := json.Marshal(resources)
@@ -218,43 +282,89 @@ func (c *Controller) GetDHCPProfiles(ctx web.C, w http.ResponseWriter, r *http.R
 }
 
 func (c *Controller) CreateDHCPProfile(ctx web.C, w http.ResponseWriter, r *http.Request) {
-	profile := DHCPProfile{}
-
 	bodybytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		c.jsonError(err, w)
 		return
 	}
 
-	err = json.Unmarshal(bodybytes, &profile)
+	resource := DHCPProfileResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	profile, err := resource.ToDHCPProfileModel()
 	if err != nil {
 		c.jsonError(err, w)
 		return
 	}
 
 	c.log.Infoln("Creating DHCP profile")
-	err = c.db.Create(&profile).Error
-	if err != nil {
+	if err = c.db.Create(&profile).Error; err != nil {
 		c.jsonError(err, w)
 		return
 	}
 
-	resource := &DHCPProfileResource{}
-	resource.FromDHCPProfileModel(profile)
+	events.Publish(events.DHCPProfileChanged, map[string]string{"ID": fmt.Sprint(profile.ID)})
+	c.writeDHCPProfileResponse(profile, w)
+}
 
-	bytes, err := json.Marshal(resource)
+func (c *Controller) UpdateDHCPProfile(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		c.jsonError(err, w)
 		return
 	}
 
-	_, err = w.Write(bytes)
+	resource := DHCPProfileResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	existing := DHCPProfile{}
+	if err = c.db.Find(&existing, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	profile, err := resource.ToDHCPProfileModel()
 	if err != nil {
 		c.jsonError(err, w)
 		return
 	}
+	profile.ID = existing.ID
 
-	return
+	c.log.Infoln("Updating DHCP profile", profile.ID)
+	if err = c.db.Save(&profile).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// Interfaces using the profile pick up the changes the next time they are brought up.
+	c.rewriteNetworkFiles(ctx)
+
+	events.Publish(events.DHCPProfileChanged, map[string]string{"ID": fmt.Sprint(profile.ID)})
+	c.writeDHCPProfileResponse(profile, w)
+}
+
+func (c *Controller) DeleteDHCPProfile(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	profile := DHCPProfile{}
+	if err := c.db.Find(&profile, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// Fails if any interface is still using the profile (see BeforeDelete).
+	c.log.Infoln("Deleting DHCP profile", profile.ID)
+	if err := c.db.Delete(&profile).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.DHCPProfileChanged, map[string]string{"ID": fmt.Sprint(profile.ID)})
+	c.writeDHCPProfileResponse(profile, w)
 }
 
 //
@@ -299,6 +409,60 @@ func (c *Controller) RewriteDhclientConfFile() error {
 // Helpers
 //
 
+func (c *Controller) writeDHCPProfileResponse(profile DHCPProfile, w http.ResponseWriter) {
+	resource := DHCPProfileResource{}
+	if err := resource.FromDHCPProfileModel(profile); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bytes, err := json.Marshal(resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// applyInterface rewrites the config files and brings the interface up (or down, if it is disabled)
+// with its new configuration. Only this interface is bounced, so as to not disturb the others.
+func (c *Controller) applyInterface(iface InterfaceConfig) error {
+	c.log.Infoln("Applying interface configuration to system")
+	if err := c.RewriteInterfacesFile(); err != nil {
+		return err
+	}
+	if err := c.RewriteDhclientConfFile(); err != nil {
+		return err
+	}
+
+	ctrl := ifaceCtrl{Name: iface.Name, Log: c.log}
+	if !iface.Enabled {
+		return ctrl.Down()
+	}
+	return ctrl.Flap()
+}
+
+// rewriteNetworkFiles rewrites the interfaces and dhclient.conf files (unless "noapply" is present
+// in the env), so that settings that feed into them (profiles, resolvers) take effect.
+func (c *Controller) rewriteNetworkFiles(ctx web.C) {
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping rewrite of network files (\"noapply\" present in env)")
+		return
+	}
+
+	for _, f := range []func() error{c.RewriteInterfacesFile, c.RewriteDhclientConfFile} {
+		if err := f(); err != nil {
+			c.log.Warningln("failed to rewrite network files:", err)
+			return
+		}
+	}
+}
+
 // returns the contents of the interfaces file
 func (c *Controller) interfacesConfigFileContents() ([]byte, error) {
 	contents := bytes.Buffer{}
@@ -308,6 +472,7 @@ func (c *Controller) interfacesConfigFileContents() ([]byte, error) {
 	if err != nil {
 		return contents.Bytes(), err
 	}
+	sort.Stable(byBringUpOrder(ifaces))
 
 	// Banner
 	contents.WriteString("# This file is AUTOGENERATED.\n")
@@ -328,38 +493,69 @@ func (c *Controller) interfacesConfigFileContents() ([]byte, error) {
 func (c *Controller) interfacesConfigFileSection(iface InterfaceConfig) string {
 	contents := bytes.Buffer{}
 
-	getDomain := func() string {
-		dom := Domain{}
-		c.db.First(&dom, 1)
-		return dom.Domain
+	// The resolvers are configured with the first static stanza of every interface that has one
+	// (resolvconf merges the copies registered for each interface)
+	dnsLines := func() {
+		for _, line := range c.resolverLines() {
+			contents.WriteString(line + "\n")
+		}
+	}
+
+	// The options that set up the link go in the first stanza for the interface
+	linkLines := c.linkOptionLines(iface)
+	stanza := func(family, mode string) {
+		contents.WriteString("iface " + iface.Name + " " + family + " " + mode + "\n")
+		for _, line := range linkLines {
+			contents.WriteString(line + "\n")
+		}
+		linkLines = nil
 	}
 
-	getResolvers := func() string {
-		res := ResolversConfig{}
-		c.db.First(&res, 1)
+	// Disabled interfaces are configured, but not brought up (at boot)
+	if iface.Enabled {
+		contents.WriteString("auto " + iface.Name + "\n")
+	}
 
-		resolvers := []string{}
-		for _, res := range []string{res.DNSServerIP1, res.DNSServerIP2, res.DNSServerIP3} {
-			if len(res) > 0 {
-				resolvers = append(resolvers, res)
-			}
+	if !iface.hasAddressing() {
+		// Brought up without any addresses (e.g. members of bonds and bridges)
+		stanza("inet", "manual")
+	}
+
+	if iface.Mode != ModeNone {
+		stanza("inet", iface.Mode)
+		if iface.Mode == ModeStatic {
+			contents.WriteString("address " + iface.Address + "\n")
+			contents.WriteString("netmask " + iface.Netmask + "\n")
+			contents.WriteString("gateway " + iface.Gateway + "\n")
+			dnsLines()
 		}
 
-		return strings.Join(resolvers, " ")
+		routes, err := c.routesForInterface(iface.Name)
+		if err != nil {
+			c.log.Warningln("Failed to fetch routes for", iface.Name, ":", err)
+		}
+		for _, route := range routes {
+			for _, line := range route.upDownLines() {
+				contents.WriteString(line + "\n")
+			}
+		}
 	}
 
-	// per the docs, err is always nil
-	contents.WriteString("auto " + iface.Name + "\n")
-	contents.WriteString("iface " + iface.Name + " inet " + iface.Mode + "\n")
-	if iface.Mode == ModeStatic {
-		contents.WriteString("address " + iface.Address + "\n")
-		contents.WriteString("netmask " + iface.Netmask + "\n")
-		contents.WriteString("gateway " + iface.Gateway + "\n")
-		if domain := getDomain(); len(domain) > 0 {
-			contents.WriteString("dns-search " + domain + "\n")
+	switch iface.IPv6Mode {
+	case ModeSLAAC:
+		stanza("inet6", "auto")
+		contents.WriteString("dhcp 1\n") // stateless DHCPv6, for the resolvers
+	case ModeDHCP:
+		stanza("inet6", "dhcp")
+	case ModeStatic:
+		stanza("inet6", "static")
+		contents.WriteString("address " + iface.IPv6Address + "\n")
+		contents.WriteString(fmt.Sprintf("netmask %d\n", iface.IPv6PrefixLen))
+		if len(iface.IPv6Gateway) > 0 {
+			contents.WriteString("gateway " + iface.IPv6Gateway + "\n")
 		}
-		if resolvers := getResolvers(); len(resolvers) > 0 {
-			contents.WriteString("dns-nameservers " + resolvers + "\n")
+		if iface.Mode != ModeStatic {
+			dnsLines()
 		}
 	}
 
@@ -402,10 +598,13 @@ func (c *Controller) dhclientConfFileContents() ([]byte, error) {
 		ret.WriteString("\n")
 	}
 
-	// Add interface specific options
+	// Add interface specific options (dhclient -6 uses the same sections)
 	ifaces := []InterfaceConfig{}
-	c.db.Where(InterfaceConfig{Mode: ModeDHCP}).Find(&ifaces)
+	c.db.Find(&ifaces)
 	for _, iface := range ifaces {
+		if !iface.usesDHCP() {
+			continue
+		}
 		if str, err := c.dhconfFileSection(iface); err != nil {
 			fmt.Errorf("ERROR: %s", err)
 			// TODO: LOG
@@ -454,6 +653,10 @@ func (c *Controller) dhconfFileSection(iface InterfaceConfig) (string, error) {
 	}
 
 	sectionForSlice := func(indent int, clause string, elems []string) string {
+		if len(elems) <= 0 {
+			return ""
+		}
+
 		var (
 			lines     = []string{}
 			indentStr = strings.Repeat(" ", indent)
@@ -470,9 +673,17 @@ func (c *Controller) dhconfFileSection(iface InterfaceConfig) (string, error) {
 		var (
 			retbuf    = bytes.Buffer{}
 			indentStr = strings.Repeat(" ", indent)
+			keys      = []string{}
 		)
 
-		for k, v := range elems {
+		// sorted, so that the file doesn't change unless the options do
+		for k := range elems {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := elems[k]
 			if len(clause) > 0 {
 				retbuf.WriteString(fmt.Sprintf("%s%s %s%s%s;\n", indentStr, clause, k, sep, v))
 			} else {
@@ -483,27 +694,17 @@ func (c *Controller) dhconfFileSection(iface InterfaceConfig) (string, error) {
 	}
 
 	decodeMap := func(ser string) map[string]string {
-		retmap := make(map[string]string)
-		if len(ser) <= 0 {
-			return retmap
-		}
-		err := json.Unmarshal([]byte(ser), &retmap)
+		retmap, err := decodeDHCPOptionMap(ser)
 		if err != nil {
-			// TODO: log
-			fmt.Println("ERROR (", ser, "):", err)
+			c.log.Warningln("Ignoring malformed DHCP options (", ser, "):", err)
 		}
 		return retmap
 	}
 
 	decodeSlice := func(ser string) []string {
-		ret := []string{}
-		if len(ser) <= 0 {
-			return ret
-		}
-		err := json.Unmarshal([]byte(ser), &ret)
+		ret, err := decodeDHCPOptionList(ser)
 		if err != nil {
-			// TODO: log
-			fmt.Println("ERROR (", ser, "):", err)
+			c.log.Warningln("Ignoring malformed DHCP options (", ser, "):", err)
 		}
 		return ret
 	}
@@ -518,30 +719,43 @@ func (c *Controller) dhconfFileSection(iface InterfaceConfig) (string, error) {
 	// Next, handle the 'special' HostNameMode and DomainNameMode flags which allow the user to
 	// easily specify whether to override the hostname and domain name returned by the server.
 
+	hostname, domain, _ := hostNames(c.db)
+
 	if dhcpProfile.OverrideHostname {
-		hostname := Hostname{}
-		if err = c.db.First(&hostname).Error; err != nil {
-			return "", fmt.Errorf("failed to get hostname from db (for dhclient.conf): %s", err)
-		}
-		supersedeMap := map[string]string{"host-name": fmt.Sprintf("\"%s\"", hostname.Hostname)}
+		supersedeMap := map[string]string{dhcpOptionHostname: fmt.Sprintf("\"%s\"", hostname)}
 		ret.WriteString(sectionForMap(2, "supersede", supersedeMap, " "))
 	}
 
-	if dhcpProfile.OverrideDomainName {
-		domain := Domain{}
-		if err = c.db.First(&domain).Error; err != nil {
-			return "", fmt.Errorf("failed to get domain from db (for dhclient.conf): %s", err)
+	if dhcpProfile.OverrideDomainName && len(domain) > 0 {
+		overrideMap := map[string]string{dhcpOptionDomainName: fmt.Sprintf("\"%s\"", domain)}
+		ret.WriteString(sectionForMap(2, "supersede", overrideMap, " "))
+	}
+
+	// The DNSMode determines how the configured resolvers combine with those from the server
+	// (DHCPv6 servers hand out IPv6 resolvers in an option of their own).
+	for _, dns := range []struct {
+		option    string
+		resolvers []string
+	}{
+		{dhcpOptionDNSServers, c.resolverIPsOfFamily(true)},
+		{dhcpOptionDNSServers6, c.resolverIPsOfFamily(false)},
+	} {
+		if len(dns.resolvers) <= 0 {
+			continue
 		}
-		if len(domain.Domain) > 0 {
-			overrideMap := map[string]string{"domain-name": fmt.Sprintf("\"%s\"", domain.Domain)}
-			ret.WriteString(sectionForMap(2, "supersede", overrideMap, " "))
+		switch dhcpProfile.DNSMode {
+		case ModeAppend:
+			ret.WriteString(sectionForSlice(2, "append "+dns.option, dns.resolvers))
+		case ModePrepend:
+			ret.WriteString(sectionForSlice(2, "prepend "+dns.option, dns.resolvers))
+		case ModeOverride:
+			ret.WriteString(sectionForSlice(2, "supersede "+dns.option, dns.resolvers))
 		}
 	}
 
-	// Not configurable yet (see models.go)
-	//ret.WriteString(sectionForMap(2, "append", decodeMap(dhcpProfile.AppendOptions)))
-	//ret.WriteString(sectionForMap(2, "prepend", decodeMap(dhcpProfile.PrependOptions)))
-	//ret.WriteString(sectionForMap(2, "supersede", decodeMap(dhcpProfile.SupersedeOptions)))
+	ret.WriteString(sectionForMap(2, "append", decodeMap(dhcpProfile.AppendOptions), " "))
+	ret.WriteString(sectionForMap(2, "prepend", decodeMap(dhcpProfile.PrependOptions), " "))
+	ret.WriteString(sectionForMap(2, "supersede", decodeMap(dhcpProfile.SupersedeOptions), " "))
 
 	ret.WriteString("}\n")
 
@@ -557,10 +771,9 @@ type DHCPProfile struct {
 	TimingOptions string // Serialized json map[string]string
 	SendOptions   string // Serialized json map[string]string
 
-	// Not yet supported
-	// AppendOptions    string // Serialized json map[string]string
-	// PrependOptions   string // Serialized json map[string]string
-	// SupersedeOptions string // Serialized json map[string]string
+	AppendOptions    string // Serialized json map[string]string
+	PrependOptions   string // Serialized json map[string]string
+	SupersedeOptions string // Serialized json map[string]string
 
 	DNSMode            string // One of Mode[Append|Prepend|Supercede]
 	OverrideHostname   bool   // Whether to supercede the name returned by the dhcp server
@@ -573,28 +786,84 @@ type DHCPProfile struct {
 type InterfaceConfig struct {
 	Name    string `gorm:"primary_key"`
 	Enabled bool
-	Mode    string
+	Type    string // One of Type[Ethernet|VLAN|Bond|Bridge]
+	Mode    string // One of Mode[DHCP|Static|None]
 
 	Address string
 	Gateway string
 	Netmask string
 
+	IPv6Mode      string // One of Mode[SLAAC|DHCP|Static|None]
+	IPv6Address   string
+	IPv6PrefixLen int
+	IPv6Gateway   string // Optional, may be link local
+
+	VLANParent string // VLANs only
+	VLANID     int    // VLANs only
+	BondMode   string // Bonds only, one of BondMode[ActiveBackup|LACP]
+	Members    string // Bonds and bridges only, comma separated names of the member interfaces
+
+	MTU        int    // 0 for the default of the link
+	MACAddress string // Overrides the (burnt in) address of the link, if set
+
 	DHCPProfileID int64
 }
 
 func (i *InterfaceConfig) BeforeSave(txn *gorm.DB) error {
+	if err := i.validateLink(txn); err != nil {
+		return err
+	}
+
 	switch i.Mode {
 	case ModeStatic:
-		return i.validateIPs()
-	case ModeDHCP:
-		// In DHCP mode, these cannot be set by the user
+		if err := i.validateIPs(); err != nil {
+			return err
+		}
+	case ModeDHCP, ModeNone:
+		// In these modes, these cannot be set by the user
 		i.Address = ""
 		i.Gateway = ""
 		i.Netmask = ""
-		return i.validateDHCPProfile(txn)
 	default:
 		return fmt.Errorf("Invalid mode (%s) set for interface %s", i.Mode, i.Name)
 	}
+
+	// Interfaces that predate IPv6 support have no IPv6 mode
+	if len(i.IPv6Mode) <= 0 {
+		i.IPv6Mode = ModeNone
+	}
+
+	switch i.IPv6Mode {
+	case ModeStatic:
+		if err := i.validateIPv6s(); err != nil {
+			return err
+		}
+	case ModeSLAAC, ModeDHCP, ModeNone:
+		i.IPv6Address = ""
+		i.IPv6PrefixLen = 0
+		i.IPv6Gateway = ""
+	default:
+		return fmt.Errorf("Invalid IPv6 mode (%s) set for interface %s", i.IPv6Mode, i.Name)
+	}
+
+	if err := i.validateMTU(); err != nil {
+		return err
+	}
+	if err := i.validateMACAddress(); err != nil {
+		return err
+	}
+	if err := i.validateEnslaved(txn); err != nil {
+		return err
+	}
+	if err := i.validateRoutes(txn); err != nil {
+		return err
+	}
+	return i.validateDHCPProfile(txn)
+}
+
+// usesDHCP returns whether dhclient (-4 or -6) runs on the interface.
+func (i InterfaceConfig) usesDHCP() bool {
+	return i.Mode == ModeDHCP || i.IPv6Mode == ModeDHCP || i.IPv6Mode == ModeSLAAC
 }
 
 func (i *InterfaceConfig) BeforeUpdate(txn *gorm.DB) error {
@@ -602,18 +871,80 @@ func (i *InterfaceConfig) BeforeUpdate(txn *gorm.DB) error {
 	if txn.First(&temp).Error != nil {
 		return fmt.Errorf("Unknown interface: %s", i.Name)
 	}
+	if interfaceType(temp.Type) != interfaceType(i.Type) {
+		return fmt.Errorf("Type of interface %s cannot be changed", i.Name)
+	}
 	return nil
 }
 
-func (d *DHCPProfile) BeforeCreate(txn *gorm.DB) error {
-	if len(d.RequestOptions) <= 0 {
-		txn.Model(d).Update(DHCPProfile{
-			TimingOptions:  DefaultTimingOptionsJSON,
-			SendOptions:    DefaultSendOptionsJSON,
-			RequestOptions: DefaultRequestOptionsJSON,
-			RequireOptions: DefaultRequireOptionsJSON,
-		})
+func (i *InterfaceConfig) BeforeDelete(txn *gorm.DB) error {
+	return i.validateUnused(txn)
+}
+
+// BeforeSave validates the profile, and fills in the defaults for the options that are not
+// specified.
+func (d *DHCPProfile) BeforeSave() error {
+	if len(d.DNSMode) <= 0 {
+		d.DNSMode = ModeAppend
+	}
+	if d.DNSMode != ModeAppend && d.DNSMode != ModePrepend && d.DNSMode != ModeOverride {
+		return fmt.Errorf("Invalid DNSMode (%s)", d.DNSMode)
+	}
+
+	for _, opt := range []struct {
+		field *string
+		value string
+	}{
+		{&d.TimingOptions, DefaultTimingOptionsJSON},
+		{&d.SendOptions, DefaultSendOptionsJSON},
+		{&d.RequestOptions, DefaultRequestOptionsJSON},
+		{&d.RequireOptions, DefaultRequireOptionsJSON},
+	} {
+		if len(*opt.field) <= 0 {
+			*opt.field = opt.value
+		}
+	}
+
+	for _, ser := range []string{d.RequestOptions, d.RequireOptions} {
+		opts, err := decodeDHCPOptionList(ser)
+		if err != nil {
+			return err
+		}
+		for _, opt := range opts {
+			if !dhcpOptionNameRegexp.MatchString(opt) {
+				return fmt.Errorf("Invalid DHCP option name (%s)", opt)
+			}
+		}
+	}
+
+	for _, opt := range []struct {
+		clause string
+		ser    string
+	}{
+		{"append", d.AppendOptions},
+		{"prepend", d.PrependOptions},
+		{"supersede", d.SupersedeOptions},
+	} {
+		opts, err := decodeDHCPOptionMap(opt.ser)
+		if err != nil {
+			return err
+		}
+		for name, value := range opts {
+			if !dhcpOptionNameRegexp.MatchString(name) {
+				return fmt.Errorf("Invalid DHCP option name (%s)", name)
+			}
+			if !dhcpOptionValueRegexp.MatchString(value) {
+				return fmt.Errorf("Invalid value (%s) for DHCP option %s", value, name)
+			}
+			// These are configured by the DNSMode and the override flags
+			if name == dhcpOptionDNSServers || name == dhcpOptionDNSServers6 ||
+				(name == dhcpOptionHostname && d.OverrideHostname) ||
+				(name == dhcpOptionDomainName && d.OverrideDomainName) {
+				return fmt.Errorf("Cannot %s DHCP option %s, it is set by the profile", opt.clause, name)
+			}
+		}
 	}
+
 	return nil
 }
 
@@ -631,8 +962,32 @@ func (d *DHCPProfile) BeforeDelete(txn *gorm.DB) error {
 	return nil
 }
 
+// decodeDHCPOptionMap deserializes the json map of DHCP options (name to value).
+func decodeDHCPOptionMap(ser string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if len(ser) <= 0 {
+		return ret, nil
+	}
+	if err := json.Unmarshal([]byte(ser), &ret); err != nil {
+		return make(map[string]string), fmt.Errorf("Malformed DHCP options: %s", err)
+	}
+	return ret, nil
+}
+
+// decodeDHCPOptionList deserializes the json list of DHCP option names.
+func decodeDHCPOptionList(ser string) ([]string, error) {
+	ret := []string{}
+	if len(ser) <= 0 {
+		return ret, nil
+	}
+	if err := json.Unmarshal([]byte(ser), &ret); err != nil {
+		return []string{}, fmt.Errorf("Malformed DHCP options: %s", err)
+	}
+	return ret, nil
+}
+
 func (i *InterfaceConfig) validateDHCPProfile(txn *gorm.DB) error {
-	if i.Mode == ModeDHCP {
+	if i.usesDHCP() {
 		dp := DHCPProfile{}
 		if err := txn.Find(&dp, i.DHCPProfileID).Error; err != nil {
 			return fmt.Errorf("Cannot save interface %s with DHCP profile %d",
@@ -642,6 +997,20 @@ func (i *InterfaceConfig) validateDHCPProfile(txn *gorm.DB) error {
 	return nil
 }
 
+// validateRoutes ensures that the routes via this interface remain valid (with its new address).
+func (i *InterfaceConfig) validateRoutes(txn *gorm.DB) error {
+	routes := []StaticRoute{}
+	if err := txn.Where(StaticRoute{Interface: i.Name}).Find(&routes).Error; err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := i.validateRouteGateway(net.ParseIP(route.Gateway)); err != nil {
+			return fmt.Errorf("Route to %s would become invalid: %s", route.Destination, err)
+		}
+	}
+	return nil
+}
+
 func (i *InterfaceConfig) validateIPs() error {
 	addrs := []struct {
 		ipstr string
@@ -654,7 +1023,7 @@ func (i *InterfaceConfig) validateIPs() error {
 
 	for _, addr := range addrs {
 		a := net.ParseIP(addr.ipstr)
-		if a == nil {
+		if a == nil || a.To4() == nil {
 			return fmt.Errorf("Invalid %s address", addr.name)
 		}
 	}
@@ -676,17 +1045,85 @@ func (i *InterfaceConfig) validateIPs() error {
 	return nil
 }
 
+func (i *InterfaceConfig) validateIPv6s() error {
+	addr := net.ParseIP(i.IPv6Address)
+	if addr == nil || addr.To4() != nil || !addr.IsGlobalUnicast() {
+		return fmt.Errorf("Invalid IPv6 address (%s)", i.IPv6Address)
+	}
+
+	if i.IPv6PrefixLen < MinIPv6PrefixLen || i.IPv6PrefixLen > MaxIPv6PrefixLen {
+		return fmt.Errorf("Invalid IPv6 prefix length (%d)", i.IPv6PrefixLen)
+	}
+
+	if len(i.IPv6Gateway) <= 0 {
+		return nil // router advertisements provide the default route
+	}
+
+	gw := net.ParseIP(i.IPv6Gateway)
+	if gw == nil || gw.To4() != nil || gw.Equal(addr) {
+		return fmt.Errorf("Invalid IPv6 gateway (%s)", i.IPv6Gateway)
+	}
+
+	// Routers are commonly addressed by their link local address, which is always on-link.
+	prefix := net.IPNet{IP: addr.Mask(net.CIDRMask(i.IPv6PrefixLen, 128)), Mask: net.CIDRMask(i.IPv6PrefixLen, 128)}
+	if !gw.IsLinkLocalUnicast() && !prefix.Contains(gw) {
+		return fmt.Errorf("IPv6 gateway %s is not on network %s", i.IPv6Gateway, prefix.String())
+	}
+
+	return nil
+}
+
+func (i *InterfaceConfig) validateMTU() error {
+	if i.MTU == 0 {
+		return nil
+	}
+	if i.MTU < MinMTU || i.MTU > MaxMTU {
+		return fmt.Errorf("MTU must be between %d and %d", MinMTU, MaxMTU)
+	}
+	if i.IPv6Mode != ModeNone && i.MTU < MinIPv6MTU {
+		return fmt.Errorf("MTU must be at least %d for IPv6", MinIPv6MTU)
+	}
+	return nil
+}
+
+func (i *InterfaceConfig) validateMACAddress() error {
+	if len(i.MACAddress) <= 0 {
+		return nil
+	}
+
+	mac, err := net.ParseMAC(i.MACAddress)
+	if err != nil || len(mac) != 6 {
+		return fmt.Errorf("Invalid MAC address (%s)", i.MACAddress)
+	}
+	if mac[0]&0x01 != 0 {
+		return fmt.Errorf("MAC address %s is a multicast address", i.MACAddress)
+	}
+	if mac.String() == "00:00:00:00:00:00" {
+		return fmt.Errorf("Invalid MAC address (%s)", i.MACAddress)
+	}
+
+	i.MACAddress = mac.String() // canonical form, e.g. 52-54-00-AB-CD-EF => 52:54:00:ab:cd:ef
+	return nil
+}
+
 //
 // Resources
 //
 
 type DHCPProfileResource struct {
+	ID int64 // READ ONLY
+
 	DNSMode            string // One of Mode[None|Append|Prepend|Supercede]
 	OverrideHostname   bool   // Whether to supercede the name returned by the dhcp server
 	OverrideDomainName bool   // Whether to supercede the name returned by the dhcp server
 
 	RequireOptions []string // OptionsSeparator separated string
 	RequestOptions []string // OptionsSeparator separated string
+
+	// Options (name to value) to append to, prepend to, or supersede those from the server
+	AppendOptions    map[string]string
+	PrependOptions   map[string]string
+	SupersedeOptions map[string]string
 }
 
 func (r *DHCPProfileResource) FromDHCPProfileModel(d DHCPProfile) error {
@@ -708,6 +1145,22 @@ func (r *DHCPProfileResource) FromDHCPProfileModel(d DHCPProfile) error {
 		}
 	}
 
+	for _, opts := range []struct {
+		ser string
+		ptr *map[string]string
+	}{
+		{d.AppendOptions, &r.AppendOptions},
+		{d.PrependOptions, &r.PrependOptions},
+		{d.SupersedeOptions, &r.SupersedeOptions},
+	} {
+		m, err := decodeDHCPOptionMap(opts.ser)
+		if err != nil {
+			return err
+		}
+		*opts.ptr = m
+	}
+
+	r.ID = d.ID
 	r.DNSMode = d.DNSMode
 	r.OverrideHostname = d.OverrideHostname
 	r.OverrideDomainName = d.OverrideDomainName
@@ -717,13 +1170,29 @@ func (r *DHCPProfileResource) FromDHCPProfileModel(d DHCPProfile) error {
 	return nil
 }
 
+// ToDHCPProfileModel returns the model for the resource. Options that are not specified (nil) are
+// left empty, so that the defaults apply.
 func (r DHCPProfileResource) ToDHCPProfileModel() (DHCPProfile, error) {
+	serialize := func(opts []string) (string, error) {
+		if opts == nil {
+			return "", nil
+		}
+		b, err := json.Marshal(opts)
+		return string(b), err
+	}
+	serializeMap := func(opts map[string]string) (string, error) {
+		if len(opts) <= 0 {
+			return "", nil
+		}
+		b, err := json.Marshal(opts)
+		return string(b), err
+	}
 
-	serializedRequestOpts, err := json.Marshal(r.RequestOptions)
+	serializedRequestOpts, err := serialize(r.RequestOptions)
 	if err != nil {
 		return DHCPProfile{}, err
 	}
-	serializedRequireOpts, err := json.Marshal(r.RequireOptions)
+	serializedRequireOpts, err := serialize(r.RequireOptions)
 	if err != nil {
 		return DHCPProfile{}, err
 	}
@@ -731,22 +1200,42 @@ func (r DHCPProfileResource) ToDHCPProfileModel() (DHCPProfile, error) {
 		return DHCPProfile{}, fmt.Errorf("Invalid DNSMode")
 	}
 
+	serializedOpts := make([]string, 3)
+	for i, opts := range []map[string]string{r.AppendOptions, r.PrependOptions, r.SupersedeOptions} {
+		if serializedOpts[i], err = serializeMap(opts); err != nil {
+			return DHCPProfile{}, err
+		}
+	}
+
 	return DHCPProfile{
 		DNSMode:            r.DNSMode,
 		OverrideHostname:   r.OverrideHostname,
 		OverrideDomainName: r.OverrideDomainName,
-		RequireOptions:     string(serializedRequireOpts),
-		RequestOptions:     string(serializedRequestOpts),
+		RequireOptions:     serializedRequireOpts,
+		RequestOptions:     serializedRequestOpts,
 
-		//AppendOptions:    "{}",
-		//PrependOptions:   "{}",
-		//SupercedeOptions: "{}",
+		AppendOptions:    serializedOpts[0],
+		PrependOptions:   serializedOpts[1],
+		SupersedeOptions: serializedOpts[2],
 	}, nil
 }
 
 type InterfaceConfigResource struct {
 	InterfaceConfig
-	InterfaceStatus string // READONLY contains 'ifconfig' output
+	Members         []string        // Names of the member interfaces (bonds and bridges only)
+	InterfaceStatus InterfaceStatus // READONLY state of the interface in the system
+	RevertIn        int             // READONLY seconds until an unconfirmed change is reverted (0 if none)
+}
+
+func (r *InterfaceConfigResource) FromInterfaceConfigModel(i InterfaceConfig) {
+	r.InterfaceConfig = i
+	r.Members = i.memberNames()
+}
+
+func (r InterfaceConfigResource) ToInterfaceConfigModel() InterfaceConfig {
+	iface := r.InterfaceConfig
+	iface.Members = strings.Join(r.Members, ",")
+	return iface
 }
 
 //
@@ -754,18 +1243,107 @@ type InterfaceConfigResource struct {
 //
 
 func (c *Controller) seedInterface() {
-	var (
-		profile = DHCPProfile{ID: 1}
-		iface   = InterfaceConfig{Name: "eth0", Mode: ModeDHCP, DHCPProfileID: 1}
-	)
+	profile := DHCPProfile{ID: 1, DNSMode: ModeAppend}
 
 	c.log.Infoln("Seeding interface config")
-	c.db.FirstOrCreate(&profile, profile)
-	c.db.FirstOrCreate(&iface, iface)
+	c.db.Where(DHCPProfile{ID: profile.ID}).Attrs(profile).FirstOrCreate(&profile)
+	c.seedNICs()
+}
+
+// migrateDHCPProfiles sets the DNSMode of profiles that predate it.
+func (c *Controller) migrateDHCPProfiles() {
+	err := c.db.Exec("UPDATE dhcp_profiles SET dns_mode = ? WHERE dns_mode IS NULL OR dns_mode = ''", ModeAppend).Error
+	if err != nil {
+		c.log.Errorln("Failed to migrate DNS mode for DHCP profiles:", err)
+	}
+}
+
+// migrateInterfaces enables the interfaces that predate the MTU (and, in effect, the Enabled
+// setting, which was not honored until then). The Enabled column itself is as old as the table
+// (and holds false in such rows, rather than NULL), so a NULL MTU is what identifies these rows.
+func (c *Controller) migrateInterfaces() {
+	err := c.db.Exec("UPDATE interface_configs SET enabled = ?, mtu = 0 WHERE mtu IS NULL", true).Error
+	if err != nil {
+		c.log.Errorln("Failed to migrate interfaces:", err)
+	}
+}
+
+//
+// Network config snapshot
+//
+
+// NetworkConfig holds the network related settings (interfaces, DHCP profiles, routes, resolvers)
+// so that they can be carried across a factory reset.
+type NetworkConfig struct {
+	Interfaces   []InterfaceConfig
+	DHCPProfiles []DHCPProfile
+	Routes       []StaticRoute
+	Resolvers    []ResolversConfig
+}
+
+// SnapshotNetworkConfig returns the network settings currently stored in the DB.
+func (c *Controller) SnapshotNetworkConfig() (NetworkConfig, error) {
+	snap := NetworkConfig{}
+
+	if err := c.db.Find(&snap.Interfaces).Error; err != nil {
+		return snap, err
+	}
+	if err := c.db.Find(&snap.DHCPProfiles).Error; err != nil {
+		return snap, err
+	}
+	if err := c.db.Find(&snap.Routes).Error; err != nil {
+		return snap, err
+	}
+	if err := c.db.Find(&snap.Resolvers).Error; err != nil {
+		return snap, err
+	}
+	return snap, nil
+}
+
+// RestoreNetworkConfig replaces the network settings in the DB with those in the snapshot.
+func (c *Controller) RestoreNetworkConfig(snap NetworkConfig) error {
+	txn := c.db.Begin()
+
+	// Routes and interfaces must go before the interfaces and profiles they refer to (and come back
+	// after them).
+	for _, table := range []interface{}{&StaticRoute{}, &InterfaceConfig{}, &DHCPProfile{}, &ResolversConfig{}} {
+		if err := txn.Delete(table).Error; err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+
+	for i := range snap.DHCPProfiles {
+		if err := txn.Create(&snap.DHCPProfiles[i]).Error; err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	sort.Stable(byBringUpOrder(snap.Interfaces)) // virtual interfaces after the ones they use
+	for i := range snap.Interfaces {
+		if err := txn.Create(&snap.Interfaces[i]).Error; err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	for i := range snap.Routes {
+		if err := txn.Create(&snap.Routes[i]).Error; err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	for i := range snap.Resolvers {
+		if err := txn.Create(&snap.Resolvers[i]).Error; err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+
+	return txn.Commit().Error
 }
 
 //
-// interface control - convenience struct to allow us to up/down/flap an interface.
+// interface control - convenience struct to allow us to up/down/flap an interface (and get its status).
 //
 
 type ifaceCtrl struct {
@@ -817,9 +1395,6 @@ func (i ifaceCtrl) Flap() error {
 	return nil
 }
 
-func (i ifaceCtrl) Ifconfig() (string, error) {
-	i.Log.Infoln("Running ifconfig for", i.Name)
-	out, err := exec.Command(IfconfigBinPath, i.Name).Output()
-	return string(out), err
-
+func (i ifaceCtrl) Status() (InterfaceStatus, error) {
+	return interfaceStatus(i.Name)
 }
@@ -0,0 +1,302 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Query parameter (of interface edits) specifying the seconds within which the change must be
+	// confirmed, else it is reverted.
+	ConfirmTimeoutParam = "confirm-timeout"
+
+	// Bounds on the confirmation timeout (in seconds)
+	MinConfirmTimeout = 10
+	MaxConfirmTimeout = 3600
+)
+
+// pendingChange is an interface change that is reverted unless it is confirmed in time. It is also
+// stored in the db (see PendingInterfaceChange), so that it is reverted across restarts too.
+type pendingChange struct {
+	previous InterfaceConfig // config of the interface prior to the change
+	deadline time.Time
+	timer    *time.Timer
+	noapply  bool // whether the change was (and so the revert is) applied to the db alone
+}
+
+//
+// Endpoint handlers
+//
+
+// ConfirmInterface confirms the pending change to the interface, so that it is not reverted. The
+// confirmation must come from a session that is connected over the new address of the interface,
+// which proves that the host can still be reached after the change. As commander only listens on
+// the loopback, the client (e.g. the shell) reports the address that its session is connected to.
+func (c *Controller) ConfirmInterface(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	name := ctx.URLParams["id"]
+	if c.pending == nil || c.pending.previous.Name != name {
+		c.jsonError(fmt.Errorf("No change to interface %s is pending confirmation", name), w)
+		return
+	}
+
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := InterfaceConfirmResource{}
+	if len(bodybytes) > 0 {
+		if err = json.Unmarshal(bodybytes, &resource); err != nil {
+			c.jsonError(err, w)
+			return
+		}
+	}
+
+	iface := InterfaceConfig{Name: name}
+	if err = c.db.First(&iface).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if !c.isInterfaceAddr(iface, net.ParseIP(resource.SessionAddress)) {
+		c.jsonError(fmt.Errorf("Change to interface %s must be confirmed over its new address", name), w)
+		return
+	}
+
+	if err := c.db.Delete(&PendingInterfaceChange{}).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.log.Infoln("Change to interface", name, "confirmed")
+	c.stopPendingChange()
+
+	events.Publish(events.InterfaceConfirmed, map[string]string{"Name": name})
+	c.writeInterfaceResponse(iface, w)
+}
+
+//
+// Helpers
+//
+
+// confirmTimeout returns the timeout specified (via ConfirmTimeoutParam) in the request, or 0 if the
+// change need not be confirmed.
+func confirmTimeout(r *http.Request) (time.Duration, error) {
+	str := r.URL.Query().Get(ConfirmTimeoutParam)
+	if len(str) <= 0 {
+		return 0, nil
+	}
+
+	secs, err := strconv.Atoi(str)
+	if err != nil || secs < MinConfirmTimeout || secs > MaxConfirmTimeout {
+		return 0, fmt.Errorf("Confirmation timeout must be between %d and %d seconds",
+			MinConfirmTimeout, MaxConfirmTimeout)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// checkPendingChange ensures that a change (with the specified timeout) can be made to the named
+// interface. Only one change at a time may await confirmation, and the interface it was made to
+// cannot be changed until then.
+func (c *Controller) checkPendingChange(name string, timeout time.Duration) error {
+	if c.pending == nil {
+		return nil
+	}
+	if c.pending.previous.Name == name {
+		return fmt.Errorf("A change to interface %s is pending confirmation", name)
+	}
+	if timeout > 0 {
+		return fmt.Errorf("A change to interface %s is already pending confirmation",
+			c.pending.previous.Name)
+	}
+	return nil
+}
+
+// savePendingChange stores the pending change (if any) in the db, in place of the one stored earlier.
+func savePendingChange(txn *gorm.DB, pending *pendingChange) error {
+	if pending == nil {
+		return nil
+	}
+
+	previous, err := json.Marshal(pending.previous)
+	if err != nil {
+		return err
+	}
+
+	return txn.Save(&PendingInterfaceChange{
+		ID:       1, // We always operate on the first row
+		Previous: string(previous),
+		Deadline: pending.deadline,
+		NoApply:  pending.noapply,
+	}).Error
+}
+
+// startPendingChange arranges for the interface to be reverted to its previous config, unless the
+// change is confirmed by the deadline.
+func (c *Controller) startPendingChange(pending *pendingChange) {
+	timeout := pending.deadline.Sub(time.Now())
+	c.log.Infoln("Change to interface", pending.previous.Name, "will be reverted unless confirmed within", timeout)
+
+	pending.timer = time.AfterFunc(timeout, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		// It may have been confirmed while we waited for the lock
+		if c.pending == pending {
+			c.revertPendingChange()
+		}
+	})
+	c.pending = pending
+}
+
+// revertPendingChange restores the previous config of the interface (in the db and the system).
+// The caller must hold the controller lock.
+func (c *Controller) revertPendingChange() {
+	pending := c.pending
+	c.stopPendingChange()
+
+	iface := pending.previous
+	c.log.Warningln("Change to interface", iface.Name, "was not confirmed, reverting it")
+
+	txn := c.db.Begin()
+	if err := txn.Save(&iface).Error; err != nil {
+		txn.Rollback()
+		c.log.Errorln("Failed to revert config of interface", iface.Name, ":", err)
+		return
+	}
+	if err := txn.Delete(&PendingInterfaceChange{}).Error; err != nil {
+		txn.Rollback()
+		c.log.Errorln("Failed to revert config of interface", iface.Name, ":", err)
+		return
+	}
+	if err := txn.Commit().Error; err != nil {
+		c.log.Errorln("Failed to revert config of interface", iface.Name, ":", err)
+		return
+	}
+
+	if pending.noapply {
+		c.log.Infoln("Skipping apply interface config to system (\"noapply\" present in env)")
+	} else if err := c.applyInterface(iface); err != nil {
+		c.log.Warningln("failed to apply interface settings to system:", err)
+	}
+
+	events.Publish(events.InterfaceReverted,
+		map[string]string{"Name": iface.Name, "Mode": iface.Mode, "IPv6Mode": iface.IPv6Mode})
+}
+
+// revertIn returns the seconds until the pending change to the named interface is reverted, or 0
+// if no change to it is pending.
+func (c *Controller) revertIn(name string) int {
+	if c.pending == nil || c.pending.previous.Name != name {
+		return 0
+	}
+	secs := int(c.pending.deadline.Sub(time.Now()).Seconds() + 0.5)
+	if secs < 1 {
+		secs = 1 // about to be reverted
+	}
+	return secs
+}
+
+// ResumePendingChange picks up the interface change that was pending confirmation when commander
+// last stopped (if any). It is reverted right away if its deadline has passed meanwhile.
+func (c *Controller) ResumePendingChange() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stored := PendingInterfaceChange{}
+	if c.db.First(&stored, 1).RecordNotFound() {
+		return
+	}
+
+	pending := &pendingChange{deadline: stored.Deadline, noapply: stored.NoApply}
+	if err := json.Unmarshal([]byte(stored.Previous), &pending.previous); err != nil {
+		c.log.Errorln("Failed to load the interface change pending confirmation:", err)
+		return
+	}
+
+	if time.Now().After(pending.deadline) {
+		c.pending = pending
+		c.revertPendingChange()
+		return
+	}
+	c.startPendingChange(pending)
+}
+
+// stopPendingChange stops waiting for the pending change (if any) to be confirmed, without
+// reverting it. The caller must hold the controller lock.
+func (c *Controller) stopPendingChange() {
+	if c.pending == nil {
+		return
+	}
+	if c.pending.timer != nil {
+		c.pending.timer.Stop()
+	}
+	c.pending = nil
+}
+
+// isInterfaceAddr returns whether the ip is one of the addresses of the interface, i.e. those that
+// it is configured with (statically) and those that it has on the system (e.g. via DHCP).
+func (c *Controller) isInterfaceAddr(iface InterfaceConfig, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	addrs := []string{}
+	if iface.Mode == ModeStatic {
+		addrs = append(addrs, iface.Address)
+	}
+	if iface.IPv6Mode == ModeStatic {
+		addrs = append(addrs, iface.IPv6Address)
+	}
+
+	status, err := (ifaceCtrl{Name: iface.Name, Log: c.log}).Status()
+	if err != nil {
+		c.log.Warningln("Failed to get status of", iface.Name, ":", err)
+	}
+	for _, cidr := range status.Addresses {
+		if addr, _, err := net.ParseCIDR(cidr); err == nil {
+			addrs = append(addrs, addr.String())
+		}
+	}
+
+	for _, addr := range addrs {
+		if ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// DB Models
+//
+
+// PendingInterfaceChange is the interface change that is pending confirmation (if any).
+type PendingInterfaceChange struct {
+	ID       int64
+	Previous string // JSON encoded config of the interface prior to the change
+	Deadline time.Time
+	NoApply  bool
+}
+
+//
+// Resources
+//
+
+// InterfaceConfirmResource is the confirmation of a change to an interface.
+type InterfaceConfirmResource struct {
+	// The address (of this host) that the session confirming the change is connected to, e.g. the
+	// server address in SSH_CONNECTION. It must be one of the addresses of the interface.
+	SessionAddress string
+}
@@ -3,11 +3,13 @@ package host
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
@@ -113,10 +115,46 @@ func (ts *InterfacesTestSuite) TestFailDHCPProfileDeleteIfInterfaceUsesIt(c *C)
 	c.Assert(err, Not(IsNil))
 }
 
+func (ts *InterfacesTestSuite) TestNetworkConfigSnapshotRestore(c *C) {
+	err := ts.db.Create(&InterfaceConfig{
+		Name:    "test1",
+		Mode:    ModeStatic,
+		Address: "192.168.168.8",
+		Netmask: "255.255.255.0",
+		Gateway: "192.168.168.1"}).Error
+	c.Assert(err, IsNil)
+
+	snap, err := ts.controller.SnapshotNetworkConfig()
+	c.Assert(err, IsNil)
+	c.Assert(snap.Interfaces, HasLen, 2)
+	c.Assert(snap.DHCPProfiles, HasLen, 1)
+	c.Assert(snap.Resolvers, HasLen, 1)
+
+	// Reset the tables to their seeded state, then put the snapshot back.
+	ts.controller.DropDB()
+	ts.controller.MigrateDB()
+	ts.controller.SeedDB()
+
+	c.Assert(ts.controller.RestoreNetworkConfig(snap), IsNil)
+
+	ifaces := []InterfaceConfig{}
+	c.Assert(ts.db.Find(&ifaces).Error, IsNil)
+	c.Assert(ifaces, HasLen, 2)
+
+	iface := InterfaceConfig{Name: "test1"}
+	c.Assert(ts.db.First(&iface).Error, IsNil)
+	c.Assert(iface.Address, Equals, "192.168.168.8")
+
+	profiles := []DHCPProfile{}
+	c.Assert(ts.db.Find(&profiles).Error, IsNil)
+	c.Assert(profiles, HasLen, 1)
+}
+
 func (ts *InterfacesTestSuite) TestInterfaceFileGeneration(c *C) {
 
 	err := ts.db.Create(&InterfaceConfig{
 		Name:    "test1",
+		Enabled: true,
 		Mode:    ModeStatic,
 		Address: "192.168.168.8",
 		Netmask: "255.255.255.0",
@@ -125,6 +163,7 @@ func (ts *InterfacesTestSuite) TestInterfaceFileGeneration(c *C) {
 
 	err = ts.db.Create(&InterfaceConfig{
 		Name:          "test2",
+		Enabled:       true,
 		Mode:          ModeDHCP,
 		DHCPProfileID: 1,
 	}).Error
@@ -201,6 +240,245 @@ func (ts *InterfacesTestSuite) TestDhclientConfFileGenerationWithOverrides(c *C)
 
 	// Ensure a supersede section for the default hostname.
 	c.Assert(strings.Contains(string(filecontents), "supersede host-name \"ncc1701\""), Equals, true)
+	// No domain is configured, so none is superseded
+	c.Assert(strings.Contains(string(filecontents), "supersede domain-name "), Equals, false)
+
+	// Internationalized domains are superseded in their ASCII form
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "bücher.example"}).Error, IsNil)
+	filecontents, err = ts.controller.dhclientConfFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(filecontents),
+		"supersede domain-name \"xn--bcher-kva.example\""), Equals, true)
+}
+
+func (ts *InterfacesTestSuite) TestDhclientConfFileGenerationWithDNSMode(c *C) {
+	// Seeded resolvers are 8.8.8.8 and 8.8.4.4, and the seeded profile appends them
+	for mode, clause := range map[string]string{
+		ModeAppend:   "append",
+		ModePrepend:  "prepend",
+		ModeOverride: "supersede",
+	} {
+		profile := DHCPProfile{ID: 1}
+		c.Assert(ts.db.First(&profile).Error, IsNil)
+		profile.DNSMode = mode
+		c.Assert(ts.db.Save(&profile).Error, IsNil)
+
+		filecontents, err := ts.controller.dhclientConfFileContents()
+		c.Assert(err, IsNil)
+		c.Assert(strings.Contains(string(filecontents),
+			"  "+clause+" domain-name-servers 8.8.8.8, 8.8.4.4;\n"), Equals, true, Commentf("mode: %s", mode))
+		c.Assert(strings.Count(string(filecontents), "domain-name-servers 8.8.8.8"), Equals, 1)
+	}
+
+	// Nothing to add to what the server provides, if no resolvers are configured
+	c.Assert(ts.db.Save(&ResolversConfig{ID: 1}).Error, IsNil)
+	filecontents, err := ts.controller.dhclientConfFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(filecontents), "supersede domain-name-servers"), Equals, false)
+}
+
+func (ts *InterfacesTestSuite) TestDhclientConfFileGenerationWithOptionMaps(c *C) {
+	err := ts.db.Create(&DHCPProfile{
+		DNSMode:          ModePrepend,
+		AppendOptions:    `{"domain-search": "\"corp.example.com\""}`,
+		PrependOptions:   `{"ntp-servers": "10.0.0.123"}`,
+		SupersedeOptions: `{"interface-mtu": "1400", "domain-name": "\"example.com\""}`,
+	}).Error
+	c.Assert(err, IsNil)
+
+	err = ts.db.Create(&InterfaceConfig{Name: "eth1", Mode: ModeDHCP, DHCPProfileID: 2}).Error
+	c.Assert(err, IsNil)
+
+	filecontents, err := ts.controller.dhclientConfFileContents()
+	c.Assert(err, IsNil)
+	c.Log(string(filecontents))
+
+	section := string(filecontents)[strings.Index(string(filecontents), "interface \"eth1\""):]
+	for _, line := range []string{
+		"  prepend domain-name-servers 8.8.8.8, 8.8.4.4;\n",
+		"  append domain-search \"corp.example.com\";\n",
+		"  prepend ntp-servers 10.0.0.123;\n",
+		"  supersede domain-name \"example.com\";\n  supersede interface-mtu 1400;\n",
+	} {
+		c.Assert(strings.Contains(section, line), Equals, true, Commentf("line: %s", line))
+	}
+}
+
+func (ts *InterfacesTestSuite) TestDHCPProfileValidation(c *C) {
+	for _, profile := range []DHCPProfile{
+		{DNSMode: "bogus"},
+		{RequestOptions: `["routers", "bad name"]`},
+		{RequireOptions: `["subnet-mask;"]`},
+		{AppendOptions: `{"Domain-Search": "\"example.com\""}`},
+		{AppendOptions: `{"domain-search": "\"example.com\"; } interface \"x\" {"}`},
+		{PrependOptions: `{"ntp-servers": "10.0.0.1;"}`},
+		{SupersedeOptions: `{"domain-name-servers": "10.0.0.53"}`}, // use the DNSMode
+		{AppendOptions: `{"dhcp6.name-servers": "2001:db8::53"}`},  // use the DNSMode
+		{SupersedeOptions: `{"host-name": "\"foo\""}`, OverrideHostname: true},
+		{SupersedeOptions: `not json`},
+	} {
+		c.Assert(ts.db.Create(&profile).Error, NotNil, Commentf("profile: %+v", profile))
+	}
+
+	profile := DHCPProfile{
+		RequestOptions:   `["subnet-mask", "dhcp6.name-servers"]`,
+		PrependOptions:   `{"ntp-servers": "10.0.0.1, 10.0.0.2"}`,
+		SupersedeOptions: `{"host-name": "\"foo\""}`,
+	}
+	c.Assert(ts.db.Create(&profile).Error, IsNil)
+	c.Assert(profile.DNSMode, Equals, ModeAppend)
+}
+
+func (ts *InterfacesTestSuite) TestIPv6Validation(c *C) {
+	for _, iface := range []InterfaceConfig{
+		{Name: "test", Mode: ModeNone, IPv6Mode: "bogus"},    // bad mode
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic}, // no address
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic, IPv6Address: "10.0.0.1", IPv6PrefixLen: 64},
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic, IPv6Address: "fe80::8", IPv6PrefixLen: 64},
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic, IPv6Address: "2001:db8::8"},
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic, IPv6Address: "2001:db8::8", IPv6PrefixLen: 129},
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic, IPv6Address: "2001:db8::8", IPv6PrefixLen: 64,
+			IPv6Gateway: "2001:db9::1"}, // not on network
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic, IPv6Address: "2001:db8::8", IPv6PrefixLen: 64,
+			IPv6Gateway: "10.0.0.1"},
+		{Name: "test", Mode: ModeStatic, Address: "2001:db8::8", Netmask: "255.255.255.0",
+			Gateway: "2001:db8::1", IPv6Mode: ModeNone}, // IPv6 address as the IPv4 one
+		{Name: "test", Mode: ModeNone, IPv6Mode: ModeDHCP, DHCPProfileID: 42}, // no such profile
+	} {
+		c.Assert(ts.db.Create(&iface).Error, NotNil, Commentf("iface: %+v", iface))
+	}
+
+	// Link local gateways are fine, and an IPv6 only interface can't have (IPv4) routes
+	iface := InterfaceConfig{Name: "test", Mode: ModeNone, IPv6Mode: ModeStatic,
+		IPv6Address: "2001:db8::8", IPv6PrefixLen: 64, IPv6Gateway: "fe80::1"}
+	c.Assert(ts.db.Create(&iface).Error, IsNil)
+	route := StaticRoute{Destination: "10.10.0.0/16", Gateway: "10.0.0.1", Interface: "test"}
+	c.Assert(ts.db.Create(&route).Error, NotNil)
+
+	// Interfaces without any addressing are brought up as is
+	iface = InterfaceConfig{Name: "test3", Enabled: true, Mode: ModeNone, IPv6Mode: ModeNone}
+	c.Assert(ts.db.Create(&iface).Error, IsNil)
+	c.Assert(ts.controller.interfacesConfigFileSection(iface), Equals, "auto test3\niface test3 inet manual\n")
+
+	// Address settings of other modes are dropped
+	iface = InterfaceConfig{Name: "test2", Mode: ModeDHCP, DHCPProfileID: 1,
+		IPv6Mode: ModeSLAAC, IPv6Address: "2001:db8::9", IPv6PrefixLen: 64}
+	c.Assert(ts.db.Create(&iface).Error, IsNil)
+	c.Assert(iface.IPv6Address, Equals, "")
+	c.Assert(iface.IPv6PrefixLen, Equals, 0)
+
+	// Existing interfaces have no IPv6 mode
+	eth0 := InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&eth0).Error, IsNil)
+	c.Assert(eth0.IPv6Mode, Equals, ModeNone)
+}
+
+func (ts *InterfacesTestSuite) TestIPv6InterfaceFileGeneration(c *C) {
+	c.Assert(ts.db.Save(&ResolversConfig{ID: 1, Nameservers: `["2001:db8::53"]`, Ndots: DefaultNdots}).Error, IsNil)
+
+	err := ts.db.Create(&InterfaceConfig{
+		Name:          "test1",
+		Enabled:       true,
+		Mode:          ModeNone,
+		IPv6Mode:      ModeStatic,
+		IPv6Address:   "2001:db8::8",
+		IPv6PrefixLen: 64,
+		IPv6Gateway:   "2001:db8::1"}).Error
+	c.Assert(err, IsNil)
+
+	err = ts.db.Create(&InterfaceConfig{
+		Name:          "test2",
+		Enabled:       true,
+		Mode:          ModeDHCP,
+		IPv6Mode:      ModeSLAAC,
+		DHCPProfileID: 1,
+	}).Error
+	c.Assert(err, IsNil)
+
+	err = ts.db.Create(&InterfaceConfig{
+		Name:          "test3",
+		Enabled:       true,
+		Mode:          ModeNone,
+		IPv6Mode:      ModeDHCP,
+		DHCPProfileID: 1,
+	}).Error
+	c.Assert(err, IsNil)
+
+	filecontents, err := ts.controller.interfacesConfigFileContents()
+	c.Assert(err, IsNil)
+	c.Log(string(filecontents))
+
+	for _, section := range []string{
+		"auto test1\n" +
+			"iface test1 inet6 static\n" +
+			"address 2001:db8::8\n" +
+			"netmask 64\n" +
+			"gateway 2001:db8::1\n" +
+			"dns-nameservers 2001:db8::53\n\n",
+		"auto test2\n" +
+			"iface test2 inet dhcp\n" +
+			"iface test2 inet6 auto\n" +
+			"dhcp 1\n\n",
+		"auto test3\n" +
+			"iface test3 inet6 dhcp\n\n",
+	} {
+		c.Assert(strings.Contains(string(filecontents), section), Equals, true, Commentf("section: %s", section))
+	}
+
+	// dhclient (-6) is configured for the interfaces that use it, with the IPv6 resolvers
+	filecontents, err = ts.controller.dhclientConfFileContents()
+	c.Assert(err, IsNil)
+	c.Log(string(filecontents))
+
+	c.Assert(strings.Contains(string(filecontents), "interface \"test1\" {"), Equals, false)
+	c.Assert(strings.Contains(string(filecontents), "interface \"test2\" {"), Equals, true)
+	c.Assert(strings.Contains(string(filecontents), "interface \"test3\" {"), Equals, true)
+	c.Assert(strings.Contains(string(filecontents), "  append dhcp6.name-servers 2001:db8::53;\n"), Equals, true)
+	c.Assert(strings.Contains(string(filecontents), "append domain-name-servers"), Equals, false)
+}
+
+func (ts *InterfacesTestSuite) TestLinkSettings(c *C) {
+	for _, iface := range []InterfaceConfig{
+		{Name: "test", Mode: ModeDHCP, DHCPProfileID: 1, MTU: 67},                         // too small
+		{Name: "test", Mode: ModeDHCP, DHCPProfileID: 1, MTU: 9001},                       // too big
+		{Name: "test", Mode: ModeDHCP, DHCPProfileID: 1, MTU: 1000, IPv6Mode: ModeSLAAC},  // too small for IPv6
+		{Name: "test", Mode: ModeDHCP, DHCPProfileID: 1, MACAddress: "52:54:00:12:34"},    // too short
+		{Name: "test", Mode: ModeDHCP, DHCPProfileID: 1, MACAddress: "01:00:5e:00:00:01"}, // multicast
+		{Name: "test", Mode: ModeDHCP, DHCPProfileID: 1, MACAddress: "00:00:00:00:00:00"},
+	} {
+		c.Assert(ts.db.Create(&iface).Error, NotNil, Commentf("iface: %+v", iface))
+	}
+
+	iface := InterfaceConfig{Name: "test1", Enabled: true, Mode: ModeDHCP, DHCPProfileID: 1,
+		MTU: 9000, MACAddress: "52-54-00-AB-CD-EF"}
+	c.Assert(ts.db.Create(&iface).Error, IsNil)
+	c.Assert(iface.MACAddress, Equals, "52:54:00:ab:cd:ef")
+	c.Assert(ts.controller.interfacesConfigFileSection(iface), Equals,
+		"auto test1\niface test1 inet dhcp\nmtu 9000\nhwaddress ether 52:54:00:ab:cd:ef\n")
+
+	// Disabled interfaces are not brought up at boot
+	iface = InterfaceConfig{Name: "test2", Enabled: false, Mode: ModeDHCP, DHCPProfileID: 1}
+	c.Assert(ts.db.Create(&iface).Error, IsNil)
+	c.Assert(ts.controller.interfacesConfigFileSection(iface), Equals, "iface test2 inet dhcp\n")
+}
+
+func (ts *InterfacesTestSuite) TestEnableMigration(c *C) {
+	// Interfaces that predate the MTU setting were always brought up, regardless of Enabled
+	c.Assert(ts.db.Exec("UPDATE interface_configs SET enabled = ?, mtu = NULL", false).Error, IsNil)
+	ts.controller.MigrateDB()
+
+	eth0 := InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&eth0).Error, IsNil)
+	c.Assert(eth0.Enabled, Equals, true)
+
+	// ... but those disabled since then stay disabled
+	eth0.Enabled = false
+	c.Assert(ts.db.Save(&eth0).Error, IsNil)
+	ts.controller.MigrateDB()
+
+	eth0 = InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&eth0).Error, IsNil)
+	c.Assert(eth0.Enabled, Equals, false)
 }
 
 //
@@ -309,7 +587,8 @@ func (ts *InterfacesTestSuite) TestDefaultEntries(c *C) {
 	// ensure one interface
 	c.Assert(len(ifaces), Equals, 1)
 
-	// ensure it is in dhcp mode, and uses the default profile
+	// ensure it is enabled, in dhcp mode, and uses the default profile
+	c.Assert(ifaces[0].Enabled, Equals, true)
 	c.Assert(ifaces[0].Mode, Equals, ModeDHCP)
 	c.Assert(ifaces[0].DHCPProfileID, Equals, profile.ID)
 }
@@ -370,3 +649,192 @@ func (ts *InterfacesTestSuite) TestGetDHCPProfilesHandler(c *C) {
 	ts.db.Model(&DHCPProfile{}).Count(&count)
 	c.Assert(profiles, HasLen, count)
 }
+
+func (ts *InterfacesTestSuite) TestDHCPProfileEndpointHandlers(c *C) {
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+
+	// Invalid DNS mode
+	rec := do(ts.controller.CreateDHCPProfile, nil, `{"DNSMode": "bogus"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	// Unspecified options get the defaults
+	rec = do(ts.controller.CreateDHCPProfile, nil, `{"DNSMode": "append", "OverrideHostname": true}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	profile := DHCPProfileResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &profile), IsNil)
+	c.Assert(profile.ID, Not(Equals), int64(0))
+	c.Assert(profile.OverrideHostname, Equals, true)
+	c.Assert(profile.RequireOptions, DeepEquals, []string{"subnet-mask"})
+	c.Assert(profile.RequestOptions, Not(HasLen), 0)
+
+	params := map[string]string{"id": fmt.Sprint(profile.ID)}
+	rec = do(ts.controller.UpdateDHCPProfile, params, `{"DNSMode": "prepend", "RequireOptions": [],
+		"RequestOptions": ["subnet-mask", "routers"], "SupersedeOptions": {"interface-mtu": "1400"}}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &profile), IsNil)
+	c.Assert(profile.DNSMode, Equals, ModePrepend)
+	c.Assert(profile.OverrideHostname, Equals, false)
+	c.Assert(profile.RequireOptions, HasLen, 0)
+	c.Assert(profile.RequestOptions, DeepEquals, []string{"subnet-mask", "routers"})
+	c.Assert(profile.SupersedeOptions, DeepEquals, map[string]string{"interface-mtu": "1400"})
+	c.Assert(profile.AppendOptions, HasLen, 0)
+
+	rec = do(ts.controller.UpdateDHCPProfile, params,
+		`{"DNSMode": "prepend", "AppendOptions": {"domain-name-servers": "10.0.0.53"}}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.UpdateDHCPProfile, map[string]string{"id": "42"}, `{"DNSMode": "append"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	// The profile shows up in the listing
+	rec = do(ts.controller.GetDHCPProfiles, nil, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	profiles := []DHCPProfileResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &profiles), IsNil)
+	c.Assert(profiles, HasLen, 2)
+	c.Assert(profiles[1], DeepEquals, profile)
+
+	// An interface using it renders the updated options (and no empty "require" clause)
+	err := ts.db.Create(&InterfaceConfig{Name: "eth1", Mode: ModeDHCP, DHCPProfileID: profile.ID}).Error
+	c.Assert(err, IsNil)
+
+	contents, err := ts.controller.dhclientConfFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, `(?s).*interface "eth1" \{\n[^}]*request subnet-mask, routers;\n[^}]*\}.*`)
+	c.Assert(string(contents), Not(Matches), `(?s).*require ;.*`)
+
+	// Profiles in use cannot be deleted
+	rec = do(ts.controller.DeleteDHCPProfile, params, "")
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	c.Assert(ts.db.Delete(&InterfaceConfig{Name: "eth1"}).Error, IsNil)
+	rec = do(ts.controller.DeleteDHCPProfile, params, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.First(&DHCPProfile{}, profile.ID).RecordNotFound(), Equals, true)
+}
+
+func (ts *InterfacesTestSuite) TestConfirmOrRevertHandlers(c *C) {
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	do := func(handler web.HandlerFunc, url string, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", url, bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+	defer func() {
+		if ts.controller.pending != nil {
+			ts.controller.pending.timer.Stop()
+		}
+	}()
+
+	eth0 := map[string]string{"id": "eth0"}
+	static := `{"Enabled": true, "Mode": "static", "Address": "192.168.168.8", "Netmask": "255.255.255.0",
+		"Gateway": "192.168.168.1"}`
+
+	// Bad timeouts, and nothing to confirm
+	for _, url := range []string{"/dont/care?confirm-timeout=bogus", "/dont/care?confirm-timeout=5",
+		"/dont/care?confirm-timeout=3601"} {
+		rec := do(ts.controller.EditInterface, url, eth0, static)
+		c.Assert(rec.Code, Not(Equals), http.StatusOK, Commentf("url: %s", url))
+	}
+	rec := do(ts.controller.ConfirmInterface, "/dont/care", eth0, "")
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	// A confirmed change sticks
+	rec = do(ts.controller.EditInterface, "/dont/care?confirm-timeout=600", eth0, static)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	resource := InterfaceConfigResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resource), IsNil)
+	c.Assert(resource.Mode, Equals, ModeStatic)
+	c.Assert(resource.RevertIn > 590 && resource.RevertIn <= 600, Equals, true, Commentf("%d", resource.RevertIn))
+
+	// ... and no other change to it, or timed change to another interface, is allowed meanwhile
+	rec = do(ts.controller.EditInterface, "/dont/care", eth0, `{"Enabled": true, "Mode": "dhcp", "DHCPProfileID": 1}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "eth1", Enabled: true, Mode: ModeNone}).Error, IsNil)
+	rec = do(ts.controller.EditInterface, "/dont/care?confirm-timeout=600", map[string]string{"id": "eth1"},
+		`{"Enabled": false, "Mode": "none"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.ConfirmInterface, "/dont/care", map[string]string{"id": "eth1"}, "")
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	// Confirmations must come from a session connected over the new address
+	rec = do(ts.controller.ConfirmInterface, "/dont/care", eth0, "")
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+	rec = do(ts.controller.ConfirmInterface, "/dont/care", eth0, `{"SessionAddress": "10.0.0.1"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+	c.Assert(ts.controller.pending, NotNil)
+
+	rec = do(ts.controller.ConfirmInterface, "/dont/care", eth0, `{"SessionAddress": "192.168.168.8"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.controller.pending, IsNil)
+	c.Assert(ts.db.First(&PendingInterfaceChange{}).RecordNotFound(), Equals, true)
+
+	iface := InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&iface).Error, IsNil)
+	c.Assert(iface.Mode, Equals, ModeStatic)
+
+	// An unconfirmed one is reverted
+	rec = do(ts.controller.EditInterface, "/dont/care?confirm-timeout=600", eth0,
+		`{"Enabled": true, "Mode": "static", "Address": "10.0.0.8", "Netmask": "255.255.255.0", "Gateway": "10.0.0.1"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.controller.pending, NotNil)
+
+	ts.controller.revertPendingChange()
+	c.Assert(ts.controller.pending, IsNil)
+	c.Assert(ts.db.First(&PendingInterfaceChange{}).RecordNotFound(), Equals, true)
+
+	iface = InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&iface).Error, IsNil)
+	c.Assert(iface.Address, Equals, "192.168.168.8")
+
+	rec = do(ts.controller.ConfirmInterface, "/dont/care", eth0, `{"SessionAddress": "10.0.0.8"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+}
+
+func (ts *InterfacesTestSuite) TestPendingChangeSurvivesRestart(c *C) {
+	req, err := http.NewRequest("PUT", "/dont/care?confirm-timeout=600", bytes.NewBufferString(
+		`{"Enabled": true, "Mode": "static", "Address": "10.0.0.8", "Netmask": "255.255.255.0", "Gateway": "10.0.0.1"}`))
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ctx := web.C{URLParams: map[string]string{"id": "eth0"}, Env: map[interface{}]interface{}{NoApplyEnvKey: true}}
+	ts.controller.EditInterface(ctx, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	ts.controller.Stop()
+	c.Assert(ts.controller.pending, IsNil)
+
+	// The next controller picks it up ...
+	restarted := NewController(&ts.db, ts.controller.log)
+	restarted.ResumePendingChange()
+	c.Assert(restarted.pending, NotNil)
+	c.Assert(restarted.revertIn("eth0") > 590, Equals, true)
+	restarted.Stop()
+
+	// ... and reverts it if the deadline passed meanwhile
+	err = ts.db.Model(&PendingInterfaceChange{}).Update("deadline", time.Now().Add(-time.Minute)).Error
+	c.Assert(err, IsNil)
+	restarted = NewController(&ts.db, ts.controller.log)
+	restarted.ResumePendingChange()
+	c.Assert(restarted.pending, IsNil)
+	c.Assert(ts.db.First(&PendingInterfaceChange{}).RecordNotFound(), Equals, true)
+
+	iface := InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&iface).Error, IsNil)
+	c.Assert(iface.Mode, Equals, ModeDHCP)
+}
@@ -0,0 +1,276 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	PamTally2BinPath = "/sbin/pam_tally2"
+)
+
+var (
+	ErrBadCredentials = fmt.Errorf("Incorrect username or password")
+	ErrAccountLocked  = fmt.Errorf("Account is locked due to repeated login failures")
+)
+
+//
+// Endpoint handlers
+//
+
+// Login verifies the credentials of a user, against the remote auth servers (if configured) and
+// then the local users. Repeated failures cause local accounts to be locked (as specified by the
+// password policy).
+func (c *Controller) Login(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := LoginResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// Local users are only consulted if the remote auth servers are unable to verify the credentials.
+	// The lock isn't held while talking to the remote servers (see ServeHTTPC).
+	ret, err := c.authenticateRemote(resource.Name, resource.Password)
+	if err == ErrRemoteAuthUnavailable {
+		c.lock.Lock()
+		ret, err = c.authenticateLocal(ctx, resource.Name, resource.Password)
+		c.lock.Unlock()
+	}
+	if err != nil {
+		c.authError(err, w)
+		return
+	}
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// UnlockUser unlocks a user that was locked due to repeated login failures.
+func (c *Controller) UnlockUser(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	userId := ctx.URLParams["id"]
+
+	user := User{}
+	if err := c.db.Find(&user, userId).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := c.resetFailedLogins(&user); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.log.Infoln("Unlocking user", user.Name)
+	events.Publish(events.UserUnlocked, map[string]string{"ID": fmt.Sprint(user.ID), "Name": user.Name})
+
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply unlock to system (\"noapply\" present in env)")
+	} else {
+		if err := c.RewriteShadowFile(); err != nil {
+			c.log.Warningln("failed to apply unlock to system:", err)
+		}
+		if err := exec.Command(PamTally2BinPath, "--user", user.Name, "--reset").Run(); err != nil {
+			c.log.Warningln("failed to reset pam failure count:", err)
+		}
+	}
+
+	ret := &UserResource{}
+	ret.FromUserModel(user)
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+//
+// Helpers
+//
+
+// authenticateLocal verifies the credentials against the local users, and returns the user that
+// was authenticated.
+func (c *Controller) authenticateLocal(ctx web.C, name, password string) (UserResource, error) {
+	ret := UserResource{}
+
+	user := User{}
+	if err := c.db.Where(User{Name: name}).First(&user).Error; err != nil {
+		// Don't reveal whether the user exists
+		return ret, ErrBadCredentials
+	}
+
+	_, noapply := ctx.Env[NoApplyEnvKey]
+	if err := c.authenticate(&user, password, !noapply); err != nil {
+		return ret, err
+	}
+
+	groups, err := userGroups(c.db, user.ID)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.FromUserModel(user)
+	ret.Groups = groups
+	return ret, nil
+}
+
+// authenticate verifies the password of the user, tracking failures and locking the account if
+// there are too many of them. If apply is set, the lock is also applied to the system (shadow file).
+func (c *Controller) authenticate(user *User, password string, apply bool) error {
+	var (
+		now    = time.Now()
+		policy = loadPasswordPolicy(c.db)
+		info   = map[string]string{"ID": fmt.Sprint(user.ID), "Name": user.Name}
+	)
+
+	if user.IsLocked(now) {
+		c.log.Warningf("Login attempt for locked user %s", user.Name)
+		info["Reason"] = "locked"
+		events.Publish(events.UserLoginFailed, info)
+		return ErrAccountLocked
+	}
+
+	if user.VerifyPassword(password) {
+		if user.FailedLogins > 0 || user.Locked {
+			return c.resetFailedLogins(user)
+		}
+		return nil
+	}
+
+	// An expired lock gives the user a fresh set of attempts.
+	if user.Locked {
+		user.Locked = false
+		user.FailedLogins = 0
+	}
+
+	// Failures outside the window don't count towards the lockout.
+	window := time.Duration(policy.LockoutWindowMins) * time.Minute
+	if user.FailedLogins > 0 && window > 0 && now.Sub(user.FirstFailedLoginAt) > window {
+		user.FailedLogins = 0
+	}
+	if user.FailedLogins == 0 {
+		user.FirstFailedLoginAt = now
+	}
+	user.FailedLogins++
+
+	c.log.Warningf("Failed login for user %s (%d failures)", user.Name, user.FailedLogins)
+	info["Reason"] = "credentials"
+	info["Failures"] = fmt.Sprint(user.FailedLogins)
+	events.Publish(events.UserLoginFailed, info)
+
+	lockedNow := false
+	if policy.LockoutThreshold > 0 && user.FailedLogins >= policy.LockoutThreshold {
+		lockedNow = true
+		user.Locked = true
+		user.LockedUntil = time.Time{} // till an admin unlocks it
+		if policy.LockoutDurationMins > 0 {
+			user.LockedUntil = now.Add(time.Duration(policy.LockoutDurationMins) * time.Minute)
+		}
+	}
+
+	err := c.db.Model(user).UpdateColumns(map[string]interface{}{
+		"failed_logins":         user.FailedLogins,
+		"first_failed_login_at": user.FirstFailedLoginAt,
+		"locked":                user.Locked,
+		"locked_until":          user.LockedUntil,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if lockedNow {
+		c.log.Warningf("Locking user %s (until: %s)", user.Name, user.LockedUntil)
+		events.Publish(events.UserLocked, map[string]string{"ID": fmt.Sprint(user.ID), "Name": user.Name})
+		if apply {
+			c.applyLock(*user)
+		}
+	}
+
+	return ErrBadCredentials
+}
+
+// applyLock locks the user in the shadow file, and arranges for it to be unlocked when the lock
+// expires.
+func (c *Controller) applyLock(user User) {
+	if err := c.RewriteShadowFile(); err != nil {
+		c.log.Warningln("failed to apply lock to system:", err)
+	}
+	if !user.LockedUntil.IsZero() {
+		time.AfterFunc(user.LockedUntil.Sub(time.Now()), func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			if err := c.RewriteShadowFile(); err != nil {
+				c.log.Warningln("failed to apply unlock to system:", err)
+			}
+		})
+	}
+}
+
+func (c *Controller) resetFailedLogins(user *User) error {
+	user.FailedLogins = 0
+	user.Locked = false
+	user.LockedUntil = time.Time{}
+
+	return c.db.Model(user).UpdateColumns(map[string]interface{}{
+		"failed_logins": 0,
+		"locked":        false,
+		"locked_until":  time.Time{},
+	}).Error
+}
+
+func (c *Controller) authError(err error, w http.ResponseWriter) {
+	code := http.StatusUnauthorized
+	if err == ErrAccountLocked {
+		code = http.StatusForbidden
+	} else if err != ErrBadCredentials {
+		code = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+}
+
+// IsLocked returns whether the user is locked out (at the specified time).
+func (u User) IsLocked(now time.Time) bool {
+	return u.Locked && (u.LockedUntil.IsZero() || now.Before(u.LockedUntil))
+}
+
+//
+// Resources
+//
+
+type LoginResource struct {
+	Name     string
+	Password string // WRITE ONLY
+}
@@ -0,0 +1,219 @@
+package host
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zenazn/goji/web"
+)
+
+type LockoutTestSuite struct {
+	hostTestSuite
+	user User
+}
+
+func (ts *LockoutTestSuite) SetUpTest(c *C) {
+	ts.hostTestSuite.SetUpTest(c)
+
+	policy := defaultPasswordPolicy()
+	policy.LockoutThreshold = 3
+	policy.LockoutWindowMins = 10
+	policy.LockoutDurationMins = 30
+	c.Assert(ts.db.Save(&policy).Error, IsNil)
+
+	ts.user = User{Name: "jdoe", Password: "somepass"}
+	c.Assert(ts.db.Create(&ts.user).Error, IsNil)
+}
+
+func (ts *LockoutTestSuite) login(c *C, name, password string) int {
+	jsonStr := fmt.Sprintf(`{"Name": "%s", "Password": "%s"}`, name, password)
+	req, err := http.NewRequest("POST", "/dont/care", bytes.NewBufferString(jsonStr))
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ctx := web.C{Env: map[interface{}]interface{}{NoApplyEnvKey: true}}
+	ts.controller.Login(ctx, rec, req)
+	return rec.Code
+}
+
+func (ts *LockoutTestSuite) reload(c *C) User {
+	user := User{}
+	c.Assert(ts.db.First(&user, ts.user.ID).Error, IsNil)
+	return user
+}
+
+func (ts *LockoutTestSuite) TestLogin(c *C) {
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusOK)
+	c.Assert(ts.login(c, "jdoe", "wrongpass"), Equals, http.StatusUnauthorized)
+	c.Assert(ts.login(c, "nosuchuser", "somepass"), Equals, http.StatusUnauthorized)
+
+	// A successful login clears the failures
+	c.Assert(ts.reload(c).FailedLogins, Equals, 1)
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusOK)
+	c.Assert(ts.reload(c).FailedLogins, Equals, 0)
+}
+
+func (ts *LockoutTestSuite) TestLockedAfterRepeatedFailures(c *C) {
+	for i := 0; i < 3; i++ {
+		c.Assert(ts.login(c, "jdoe", "wrongpass"), Equals, http.StatusUnauthorized)
+	}
+
+	user := ts.reload(c)
+	c.Assert(user.Locked, Equals, true)
+	c.Assert(user.IsLocked(time.Now()), Equals, true)
+
+	// Even the correct password is refused now
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusForbidden)
+
+	// The lock is applied to the shadow file too
+	tokens := strings.Split(user.ShadowFileEntry(defaultPasswordPolicy()), ShadowFileSeparator)
+	c.Assert(strings.HasPrefix(tokens[1], "!"), Equals, true)
+}
+
+func (ts *LockoutTestSuite) TestFailuresOutsideWindowNotCounted(c *C) {
+	c.Assert(ts.login(c, "jdoe", "wrongpass"), Equals, http.StatusUnauthorized)
+	c.Assert(ts.login(c, "jdoe", "wrongpass"), Equals, http.StatusUnauthorized)
+
+	// Pretend the failures happened a while ago
+	err := ts.db.Model(&ts.user).
+		UpdateColumn("first_failed_login_at", time.Now().Add(-20*time.Minute)).Error
+	c.Assert(err, IsNil)
+
+	c.Assert(ts.login(c, "jdoe", "wrongpass"), Equals, http.StatusUnauthorized)
+
+	user := ts.reload(c)
+	c.Assert(user.FailedLogins, Equals, 1)
+	c.Assert(user.Locked, Equals, false)
+}
+
+func (ts *LockoutTestSuite) TestLockExpires(c *C) {
+	for i := 0; i < 3; i++ {
+		ts.login(c, "jdoe", "wrongpass")
+	}
+
+	user := ts.reload(c)
+	c.Assert(user.IsLocked(time.Now()), Equals, true)
+	c.Assert(user.IsLocked(time.Now().Add(31*time.Minute)), Equals, false)
+
+	// Pretend the lock has expired
+	err := ts.db.Model(&ts.user).UpdateColumn("locked_until", time.Now().Add(-time.Minute)).Error
+	c.Assert(err, IsNil)
+
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusOK)
+	c.Assert(ts.reload(c).Locked, Equals, false)
+}
+
+func (ts *LockoutTestSuite) TestLockoutDisabled(c *C) {
+	policy := defaultPasswordPolicy()
+	policy.LockoutThreshold = 0
+	c.Assert(ts.db.Save(&policy).Error, IsNil)
+
+	for i := 0; i < 10; i++ {
+		ts.login(c, "jdoe", "wrongpass")
+	}
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusOK)
+}
+
+func (ts *LockoutTestSuite) TestUnlockUser(c *C) {
+	for i := 0; i < 3; i++ {
+		ts.login(c, "jdoe", "wrongpass")
+	}
+	c.Assert(ts.reload(c).Locked, Equals, true)
+
+	req, err := http.NewRequest("PUT", "/dont/care", nil)
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ctx := web.C{
+		URLParams: map[string]string{"id": fmt.Sprintf("%d", ts.user.ID)},
+		Env:       map[interface{}]interface{}{NoApplyEnvKey: true},
+	}
+	ts.controller.UnlockUser(ctx, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	user := ts.reload(c)
+	c.Assert(user.Locked, Equals, false)
+	c.Assert(user.FailedLogins, Equals, 0)
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusOK)
+}
+
+func (ts *LockoutTestSuite) TestPamFileContents(c *C) {
+	contents, err := ts.controller.pamFileContents(pamCommonAuthTemplate)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, "(?s).*pam_tally2.so onerr=fail deny=3 unlock_time=1800\n.*")
+
+	policy := defaultPasswordPolicy()
+	policy.LockoutThreshold = 0
+	c.Assert(ts.db.Save(&policy).Error, IsNil)
+
+	contents, err = ts.controller.pamFileContents(pamCommonAuthTemplate)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "pam_tally2"), Equals, false)
+}
+
+// fakeRemoteAuthenticator knows a single user, or is unreachable.
+type fakeRemoteAuthenticator struct {
+	unreachable bool
+	onAuth      func()
+}
+
+func (f *fakeRemoteAuthenticator) Authenticate(name, password string) ([]string, error) {
+	if f.onAuth != nil {
+		f.onAuth()
+	}
+	if f.unreachable {
+		return nil, ErrRemoteAuthUnavailable
+	}
+	if name == "picard" && password == "engage" {
+		return []string{SudoGroupName}, nil
+	}
+	return nil, ErrBadCredentials
+}
+
+func (f *fakeRemoteAuthenticator) PamAuthLines() ([]string, error) {
+	return []string{"auth\t[success=done default=die]\tpam_fake.so"}, nil
+}
+
+func (ts *LockoutTestSuite) TestRemoteLogin(c *C) {
+	remote := &fakeRemoteAuthenticator{}
+	ts.controller.SetRemoteAuthenticator(remote)
+
+	c.Assert(ts.login(c, "picard", "engage"), Equals, http.StatusOK)
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusUnauthorized)
+	// Remote failures don't count towards the lockout of local accounts
+	c.Assert(ts.reload(c).FailedLogins, Equals, 0)
+
+	remote.unreachable = true
+	c.Assert(ts.login(c, "picard", "engage"), Equals, http.StatusUnauthorized)
+	c.Assert(ts.login(c, "jdoe", "somepass"), Equals, http.StatusOK)
+
+	contents, err := ts.controller.pamFileContents(pamCommonAuthTemplate)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, "(?s).*pam_fake.so\n.*pam_unix.so nullok_secure try_first_pass\n.*")
+}
+
+func (ts *LockoutTestSuite) TestRemoteLoginDoesNotHoldLock(c *C) {
+	// Other requests are served while the remote servers are being waited on
+	locked := false
+	ts.controller.SetRemoteAuthenticator(&fakeRemoteAuthenticator{onAuth: func() {
+		locked = !ts.controller.lock.TryLock()
+		if !locked {
+			ts.controller.lock.Unlock()
+		}
+	}})
+
+	jsonStr := `{"Name": "picard", "Password": "engage"}`
+	req, err := http.NewRequest("POST", ELogin, bytes.NewBufferString(jsonStr))
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ts.controller.ServeHTTPC(web.C{Env: map[interface{}]interface{}{NoApplyEnvKey: true}}, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(locked, Equals, false)
+}
@@ -0,0 +1,240 @@
+package host
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"rocketship/commander/modules/events"
+)
+
+const (
+	// Name of the NIC that is seeded if none are discovered
+	DefaultNICName = "eth0"
+
+	// ARPHRD_ETHER, the type (see /sys/class/net/*/type) of ethernet NICs
+	arphrdEther = 1
+
+	// How often the links of the interfaces are checked (for events)
+	LinkPollInterval = 5 * time.Second
+)
+
+var (
+	// Directory in which the kernel exposes the network devices (and their attributes)
+	SysClassNetPath = "/sys/class/net"
+)
+
+// InterfaceStatus describes the state of an interface, as reported by the kernel.
+type InterfaceStatus struct {
+	Present   bool   // Whether the interface exists in the system
+	LinkUp    bool   // Whether the interface has a carrier
+	OperState string // e.g. "up", "down", "dormant"
+	Speed     int    // Mbps, or -1 if unknown
+	Duplex    string // "full", "half" or "unknown"
+	MAC       string
+	MTU       int
+	Addresses []string // CIDRs, e.g. 192.168.1.8/24
+
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+// discoverNICs returns the names (sorted) of the physical ethernet NICs in the system.
+func discoverNICs() ([]string, error) {
+	entries, err := ioutil.ReadDir(SysClassNetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		dir := path.Join(SysClassNetPath, entry.Name())
+
+		// Virtual devices (lo, bonds, bridges, VLANs, tunnels...) are not backed by a device
+		if _, err := os.Stat(path.Join(dir, "device")); err != nil {
+			continue
+		}
+		if t, err := readSysfsInt(path.Join(dir, "type")); err != nil || t != arphrdEther {
+			continue
+		}
+		if _, err := os.Stat(path.Join(dir, "wireless")); err == nil {
+			continue
+		}
+		if !interfaceNameRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// interfaceStatus returns the status of the named interface. Attributes that can't be read are
+// left at their zero values.
+func interfaceStatus(name string) (InterfaceStatus, error) {
+	dir := path.Join(SysClassNetPath, name)
+	status := InterfaceStatus{Speed: -1, Duplex: "unknown", Addresses: []string{}}
+
+	if _, err := os.Stat(dir); err != nil {
+		return status, fmt.Errorf("Interface %s is not present", name)
+	}
+	status.Present = true
+
+	// Reading some of these fails (EINVAL) when the link is down, which is fine.
+	status.OperState = readSysfsString(path.Join(dir, "operstate"))
+	status.MAC = readSysfsString(path.Join(dir, "address"))
+	if carrier, err := readSysfsInt(path.Join(dir, "carrier")); err == nil {
+		status.LinkUp = carrier == 1
+	}
+	if speed, err := readSysfsInt(path.Join(dir, "speed")); err == nil && speed > 0 {
+		status.Speed = speed
+	}
+	if duplex := readSysfsString(path.Join(dir, "duplex")); len(duplex) > 0 {
+		status.Duplex = duplex
+	}
+	if mtu, err := readSysfsInt(path.Join(dir, "mtu")); err == nil {
+		status.MTU = mtu
+	}
+
+	for _, counter := range []struct {
+		name string
+		ptr  *uint64
+	}{
+		{"rx_bytes", &status.RxBytes},
+		{"rx_packets", &status.RxPackets},
+		{"rx_errors", &status.RxErrors},
+		{"rx_dropped", &status.RxDropped},
+		{"tx_bytes", &status.TxBytes},
+		{"tx_packets", &status.TxPackets},
+		{"tx_errors", &status.TxErrors},
+		{"tx_dropped", &status.TxDropped},
+	} {
+		str := readSysfsString(path.Join(dir, "statistics", counter.name))
+		if v, err := strconv.ParseUint(str, 10, 64); err == nil {
+			*counter.ptr = v
+		}
+	}
+
+	// Addresses are not exposed in sysfs
+	if iface, err := net.InterfaceByName(name); err == nil {
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				status.Addresses = append(status.Addresses, addr.String())
+			}
+		}
+	}
+
+	return status, nil
+}
+
+func readSysfsString(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readSysfsInt(file string) (int, error) {
+	return strconv.Atoi(readSysfsString(file))
+}
+
+//
+// DB Seed
+//
+
+// seedNICs seeds a config for each of the discovered NICs that doesn't have one yet. On first boot
+// the first NIC is configured via DHCP (with the seeded profile), the others are brought up
+// without any addressing. If none are discovered, DefaultNICName is seeded.
+func (c *Controller) seedNICs() {
+	names, err := discoverNICs()
+	if err != nil {
+		c.log.Warningln("Failed to discover NICs:", err)
+	}
+
+	count := 0
+	c.db.Model(&InterfaceConfig{}).Count(&count)
+
+	if len(names) <= 0 {
+		if count > 0 {
+			return
+		}
+		names = []string{DefaultNICName}
+	}
+
+	for i, name := range names {
+		iface := InterfaceConfig{Name: name, Enabled: true, Type: TypeEthernet, Mode: ModeNone}
+		if count <= 0 && i == 0 {
+			iface.Mode, iface.DHCPProfileID = ModeDHCP, 1
+		}
+
+		c.log.Infoln("Seeding interface config for", name)
+		if err := c.db.Where(InterfaceConfig{Name: name}).Attrs(iface).FirstOrCreate(&iface).Error; err != nil {
+			c.log.Warningln("Failed to seed interface config for", name, ":", err)
+		}
+	}
+}
+
+// monitorLinks periodically checks the links of the interfaces (see checkLinks), until stop is
+// closed.
+func (c *Controller) monitorLinks(stop chan struct{}) {
+	ticker := time.NewTicker(LinkPollInterval)
+	defer ticker.Stop()
+
+	linkUp := map[string]bool{}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.checkLinks(linkUp)
+		}
+	}
+}
+
+// checkLinks publishes an event for each enabled interface whose link went down (or came back up)
+// since it was last checked. linkUp holds the state of the links as of the last check.
+func (c *Controller) checkLinks(linkUp map[string]bool) {
+	c.lock.Lock()
+	ifaces := []InterfaceConfig{}
+	err := c.db.Where("enabled = ?", true).Find(&ifaces).Error
+	c.lock.Unlock()
+	if err != nil {
+		c.log.Warningln("Failed to load interfaces (to check their links):", err)
+		return
+	}
+
+	for _, iface := range ifaces {
+		status, err := interfaceStatus(iface.Name)
+		if err != nil {
+			continue // not (yet) present
+		}
+
+		wasUp, seen := linkUp[iface.Name]
+		linkUp[iface.Name] = status.LinkUp
+		if !seen || wasUp == status.LinkUp {
+			continue
+		}
+
+		if status.LinkUp {
+			c.log.Infoln("Link of interface", iface.Name, "is up")
+			events.Publish(events.InterfaceLinkUp, map[string]string{"Name": iface.Name})
+		} else {
+			c.log.Warningln("Link of interface", iface.Name, "is down")
+			events.Publish(events.InterfaceLinkDown, map[string]string{"Name": iface.Name})
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package host
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"rocketship/commander/modules/events"
+
+	. "gopkg.in/check.v1"
+)
+
+type NICsTestSuite struct {
+	hostTestSuite
+	sysfsPath  string
+	savedSysfs string
+}
+
+func (ts *NICsTestSuite) SetUpTest(c *C) {
+	// A fake /sys/class/net with a couple of NICs and some devices that aren't NICs
+	ts.savedSysfs, ts.sysfsPath = SysClassNetPath, c.MkDir()
+	SysClassNetPath = ts.sysfsPath
+
+	ts.makeDevice(c, "eth0", "1", true)
+	ts.makeDevice(c, "eth1", "1", true)
+	ts.makeDevice(c, "lo", "772", false)
+	ts.makeDevice(c, "bond0", "1", false)
+	ts.makeDevice(c, "wlan0", "1", true)
+	c.Assert(os.Mkdir(path.Join(ts.sysfsPath, "wlan0", "wireless"), 0755), IsNil)
+
+	ts.openDB(c)
+}
+
+func (ts *NICsTestSuite) TearDownTest(c *C) {
+	SysClassNetPath = ts.savedSysfs
+	ts.hostTestSuite.TearDownTest(c)
+}
+
+// makeDevice creates the sysfs directory for a network device (of the given ARPHRD type).
+func (ts *NICsTestSuite) makeDevice(c *C, name, devType string, physical bool) {
+	dir := path.Join(ts.sysfsPath, name)
+	c.Assert(os.MkdirAll(path.Join(dir, "statistics"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "type"), []byte(devType+"\n"), 0644), IsNil)
+	if physical {
+		c.Assert(os.Mkdir(path.Join(dir, "device"), 0755), IsNil)
+	}
+}
+
+func (ts *NICsTestSuite) writeAttr(c *C, name, attr, value string) {
+	err := ioutil.WriteFile(path.Join(ts.sysfsPath, name, attr), []byte(value+"\n"), 0644)
+	c.Assert(err, IsNil)
+}
+
+//
+// tests
+//
+
+func (ts *NICsTestSuite) TestDiscoverNICs(c *C) {
+	names, err := discoverNICs()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"eth0", "eth1"})
+
+	SysClassNetPath = path.Join(ts.sysfsPath, "nonexistent")
+	_, err = discoverNICs()
+	c.Check(err, NotNil)
+}
+
+func (ts *NICsTestSuite) TestSeedNICs(c *C) {
+	ts.controller.SeedDB()
+
+	eth0 := InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&eth0).Error, IsNil)
+	c.Check(eth0.Mode, Equals, ModeDHCP)
+	c.Check(eth0.DHCPProfileID, Equals, int64(1))
+
+	eth1 := InterfaceConfig{Name: "eth1"}
+	c.Assert(ts.db.First(&eth1).Error, IsNil)
+	c.Check(eth1.Mode, Equals, ModeNone)
+
+	count := 0
+	c.Assert(ts.db.Model(&InterfaceConfig{}).Count(&count).Error, IsNil)
+	c.Check(count, Equals, 2)
+
+	// A NIC added later is seeded (without addressing), existing configs are left alone
+	c.Assert(ts.db.Save(&InterfaceConfig{Name: "eth1", Mode: ModeStatic,
+		Address: "192.168.168.8", Netmask: "255.255.255.0", Gateway: "192.168.168.1"}).Error, IsNil)
+	ts.makeDevice(c, "eth2", "1", true)
+	ts.controller.SeedDB()
+
+	eth1 = InterfaceConfig{Name: "eth1"}
+	c.Assert(ts.db.First(&eth1).Error, IsNil)
+	c.Check(eth1.Mode, Equals, ModeStatic)
+
+	eth2 := InterfaceConfig{Name: "eth2"}
+	c.Assert(ts.db.First(&eth2).Error, IsNil)
+	c.Check(eth2.Mode, Equals, ModeNone)
+}
+
+func (ts *NICsTestSuite) TestSeedDefaultNIC(c *C) {
+	SysClassNetPath = path.Join(ts.sysfsPath, "nonexistent")
+	ts.controller.SeedDB()
+
+	ifaces := []InterfaceConfig{}
+	c.Assert(ts.db.Find(&ifaces).Error, IsNil)
+	c.Assert(ifaces, HasLen, 1)
+	c.Check(ifaces[0].Name, Equals, DefaultNICName)
+	c.Check(ifaces[0].Mode, Equals, ModeDHCP)
+}
+
+func (ts *NICsTestSuite) TestInterfaceStatus(c *C) {
+	for attr, value := range map[string]string{
+		"operstate":             "up",
+		"carrier":               "1",
+		"speed":                 "1000",
+		"duplex":                "full",
+		"address":               "52:54:00:12:34:56",
+		"mtu":                   "9000",
+		"statistics/rx_bytes":   "123456",
+		"statistics/rx_packets": "789",
+		"statistics/rx_errors":  "1",
+		"statistics/tx_bytes":   "654321",
+		"statistics/tx_packets": "987",
+		"statistics/tx_dropped": "2",
+	} {
+		ts.writeAttr(c, "eth1", attr, value)
+	}
+
+	status, err := interfaceStatus("eth1")
+	c.Assert(err, IsNil)
+	c.Check(status.Present, Equals, true)
+	c.Check(status.LinkUp, Equals, true)
+	c.Check(status.OperState, Equals, "up")
+	c.Check(status.Speed, Equals, 1000)
+	c.Check(status.Duplex, Equals, "full")
+	c.Check(status.MAC, Equals, "52:54:00:12:34:56")
+	c.Check(status.MTU, Equals, 9000)
+	c.Check(status.RxBytes, Equals, uint64(123456))
+	c.Check(status.RxPackets, Equals, uint64(789))
+	c.Check(status.RxErrors, Equals, uint64(1))
+	c.Check(status.RxDropped, Equals, uint64(0))
+	c.Check(status.TxBytes, Equals, uint64(654321))
+	c.Check(status.TxPackets, Equals, uint64(987))
+	c.Check(status.TxDropped, Equals, uint64(2))
+
+	// The kernel reports speed -1 (and fails reads of carrier) for links that are down
+	ts.writeAttr(c, "eth1", "operstate", "down")
+	ts.writeAttr(c, "eth1", "speed", "-1")
+	c.Assert(os.Remove(path.Join(ts.sysfsPath, "eth1", "carrier")), IsNil)
+
+	status, err = interfaceStatus("eth1")
+	c.Assert(err, IsNil)
+	c.Check(status.LinkUp, Equals, false)
+	c.Check(status.OperState, Equals, "down")
+	c.Check(status.Speed, Equals, -1)
+
+	status, err = interfaceStatus("eth9")
+	c.Check(err, NotNil)
+	c.Check(status.Present, Equals, false)
+}
+
+func (ts *NICsTestSuite) TestCheckLinks(c *C) {
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "eth0", Enabled: true, Mode: ModeNone}).Error, IsNil)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "eth1", Enabled: false, Mode: ModeNone}).Error, IsNil)
+	ts.writeAttr(c, "eth0", "carrier", "1")
+	ts.writeAttr(c, "eth1", "carrier", "1")
+
+	sub := events.Subscribe(events.InterfaceLinkDown, events.InterfaceLinkUp)
+	defer events.Unsubscribe(sub)
+	published := func() []events.Event {
+		ret := []events.Event{}
+		for {
+			select {
+			case evt := <-sub.Events:
+				ret = append(ret, evt)
+			default:
+				return ret
+			}
+		}
+	}
+
+	// Nothing is published for the state of the links when first checked
+	linkUp := map[string]bool{}
+	ts.controller.checkLinks(linkUp)
+	c.Assert(published(), HasLen, 0)
+
+	// ... only when they change (for enabled interfaces)
+	ts.writeAttr(c, "eth0", "carrier", "0")
+	ts.writeAttr(c, "eth1", "carrier", "0")
+	ts.controller.checkLinks(linkUp)
+	evts := published()
+	c.Assert(evts, HasLen, 1)
+	c.Check(evts[0].Type, Equals, events.InterfaceLinkDown)
+	c.Check(evts[0].Data["Name"], Equals, "eth0")
+
+	ts.controller.checkLinks(linkUp)
+	c.Assert(published(), HasLen, 0)
+
+	ts.writeAttr(c, "eth0", "carrier", "1")
+	ts.controller.checkLinks(linkUp)
+	evts = published()
+	c.Assert(evts, HasLen, 1)
+	c.Check(evts[0].Type, Equals, events.InterfaceLinkUp)
+}
@@ -0,0 +1,100 @@
+package host
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"text/template"
+	"time"
+)
+
+var (
+	PamCommonAuthFilePath    = "/etc/pam.d/common-auth"
+	PamCommonAccountFilePath = "/etc/pam.d/common-account"
+)
+
+// RewritePamFiles rewrites the PAM config (shared by all services, e.g. ssh and login) so that the
+// lockout settings in the password policy (and remote authentication) apply to system logins too.
+func (c *Controller) RewritePamFiles() error {
+	c.log.Infoln("Rewriting PAM files")
+
+	remoteAuthLines, err := c.pamRemoteAuthLines()
+	if err != nil {
+		return err
+	}
+
+	// The remote auth lines may carry shared secrets (TACACS+), so don't let just anyone read them.
+	authFileMode := os.FileMode(0644)
+	if len(remoteAuthLines) > 0 {
+		authFileMode = 0600
+	}
+
+	for path, file := range map[string]struct {
+		tmplStr string
+		mode    os.FileMode
+	}{
+		PamCommonAuthFilePath:    {pamCommonAuthTemplate, authFileMode},
+		PamCommonAccountFilePath: {pamCommonAccountTemplate, 0644},
+	} {
+		contents, err := c.pamFileContents(file.tmplStr)
+		if err != nil {
+			return err
+		}
+
+		// WriteFile does not change the mode of existing files
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = ioutil.WriteFile(path, contents, file.mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pamRemoteAuthLines returns the PAM lines needed by the remote authenticator (if any).
+func (c *Controller) pamRemoteAuthLines() ([]string, error) {
+	if c.remoteAuth == nil {
+		return []string{}, nil
+	}
+	return c.remoteAuth.PamAuthLines()
+}
+
+func (c *Controller) pamFileContents(tmplStr string) ([]byte, error) {
+	policy := loadPasswordPolicy(c.db)
+
+	remoteAuthLines, err := c.pamRemoteAuthLines()
+	if err != nil {
+		return []byte{}, err
+	}
+
+	// NOTE: pam_tally2 has no notion of a window within which failures are counted, so that part
+	// of the policy only applies to logins verified by commander.
+	templateData := struct {
+		GenTime        string
+		LockoutEnabled bool
+		Deny           int
+		UnlockTime     int
+		RemoteAuth     []string
+	}{
+		time.Now().String(),
+		policy.LockoutThreshold > 0,
+		policy.LockoutThreshold,
+		policy.LockoutDurationMins * 60,
+		remoteAuthLines,
+	}
+
+	tmpl, err := template.New("pam").Parse(tmplStr)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	retbuf := &bytes.Buffer{}
+	if err = tmpl.Execute(retbuf, templateData); err != nil {
+		return []byte{}, err
+	}
+
+	return retbuf.Bytes(), nil
+}
@@ -0,0 +1,38 @@
+package host
+
+var (
+	pamCommonAuthTemplate = `#
+# THIS FILE IS AUTOGENERATED
+# Generated at  {{ .GenTime }} by Commander
+#
+# Authentication settings common to all services.
+#
+{{ if .LockoutEnabled }}
+# Lock accounts after repeated failures
+auth	required	pam_tally2.so onerr=fail deny={{ .Deny }}{{ if .UnlockTime }} unlock_time={{ .UnlockTime }}{{ end }}
+{{ end }}
+{{ if .RemoteAuth }}
+# Verify credentials against the remote auth servers, falling back to local users only if they
+# cannot be reached (or don't know the user)
+{{ range .RemoteAuth }}{{ . }}
+{{ end }}{{ end }}
+auth	[success=1 default=ignore]	pam_unix.so nullok_secure{{ if .RemoteAuth }} try_first_pass{{ end }}
+auth	requisite	pam_deny.so
+auth	required	pam_permit.so
+`
+
+	pamCommonAccountTemplate = `#
+# THIS FILE IS AUTOGENERATED
+# Generated at  {{ .GenTime }} by Commander
+#
+# Authorization settings common to all services.
+#
+{{ if .LockoutEnabled }}
+# Reset the failure count on successful logins
+account	required	pam_tally2.so
+{{ end }}
+account	[success=1 new_authtok_reqd=done default=ignore]	pam_unix.so
+account	requisite	pam_deny.so
+account	required	pam_permit.so
+`
+)
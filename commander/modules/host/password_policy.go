@@ -0,0 +1,247 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Value of the max age field in the shadow file indicating that passwords never expire
+	ShadowNeverExpires = 99999
+
+	// Default number of days of warning given before a password expires
+	DefaultPasswordWarnDays = 7
+
+	// Default account lockout settings
+	DefaultLockoutThreshold    = 5
+	DefaultLockoutWindowMins   = 15
+	DefaultLockoutDurationMins = 15
+)
+
+//
+// Endpoint handlers
+//
+
+func (c *Controller) GetPasswordPolicy(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	policy := PasswordPolicy{}
+	if err := c.db.First(&policy, 1).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bytes, err := json.Marshal(&policy)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) PutPasswordPolicy(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// Fields omitted from the request retain their current values
+	policy := PasswordPolicy{}
+	if err := c.db.First(&policy, 1).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := json.Unmarshal(bodybytes, &policy); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	policy.ID = 1 // We always operate on the first row
+	if err := c.db.Save(&policy).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// The aging fields in the shadow file (and the lockout settings in PAM) are rendered from the policy
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply password policy to system (\"noapply\" present in env)")
+	} else {
+		if err := c.RewriteShadowFile(); err != nil {
+			c.log.Warningln("failed to apply password policy to system:", err)
+		}
+		if err := c.RewritePamFiles(); err != nil {
+			c.log.Warningln("failed to apply lockout policy to system:", err)
+		}
+	}
+
+	bytes, err := json.Marshal(&policy)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+//
+// DB Models
+//
+
+type PasswordPolicy struct {
+	ID int64 `json:"-"`
+
+	MinLength        int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+
+	ReuseHistory int // Number of previous passwords (of a user) that cannot be reused
+
+	MinAgeDays   int // Days before a password can be changed again
+	MaxAgeDays   int // Days after which a password must be changed (0 disables expiry)
+	WarnDays     int // Days before expiry that the user is warned
+	InactiveDays int // Days after expiry that the account is disabled (0 disables this)
+
+	LockoutThreshold    int // Failed logins after which the account is locked (0 disables lockout)
+	LockoutWindowMins   int // Minutes within which failed logins are counted (0 counts all of them)
+	LockoutDurationMins int // Minutes after which a locked account is unlocked (0 needs an admin)
+}
+
+// PasswordHistory records the (hashed) passwords previously set for a user.
+type PasswordHistory struct {
+	ID             int64
+	UserID         int64
+	HashedPassword string
+	CreatedAt      time.Time
+}
+
+func (p *PasswordPolicy) BeforeSave() error {
+	if p.MinLength < 1 || p.MinLength > MaxPasswordLen {
+		return fmt.Errorf("Minimum password length must be between 1 and %d", MaxPasswordLen)
+	}
+	for _, v := range []int{p.ReuseHistory, p.MinAgeDays, p.MaxAgeDays, p.WarnDays, p.InactiveDays,
+		p.LockoutThreshold, p.LockoutWindowMins, p.LockoutDurationMins} {
+		if v < 0 {
+			return fmt.Errorf("Password policy values cannot be negative")
+		}
+	}
+	if p.MaxAgeDays > 0 && p.MinAgeDays > p.MaxAgeDays {
+		return fmt.Errorf("Minimum password age cannot exceed the maximum password age")
+	}
+	return nil
+}
+
+// Validate checks the password against the length and character class requirements of the policy.
+func (p PasswordPolicy) Validate(password string) error {
+	if len(password) < p.MinLength {
+		return fmt.Errorf("Password must be at least %d chars", p.MinLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	missing := []string{}
+	if p.RequireUppercase && !upper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if p.RequireLowercase && !lower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		missing = append(missing, "a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Password must contain %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckReuse returns an error if the password matches one of the last ReuseHistory passwords set
+// for the user.
+func (p PasswordPolicy) CheckReuse(txn *gorm.DB, userID int64, password string) error {
+	if p.ReuseHistory <= 0 {
+		return nil
+	}
+
+	history := []PasswordHistory{}
+	err := txn.Where(PasswordHistory{UserID: userID}).
+		Order("id desc").
+		Limit(p.ReuseHistory).
+		Find(&history).Error
+	if err != nil {
+		return err
+	}
+
+	for _, h := range history {
+		if verifyHash(password, h.HashedPassword) {
+			return fmt.Errorf("Password cannot be one of the last %d passwords used", p.ReuseHistory)
+		}
+	}
+	return nil
+}
+
+//
+// Helpers
+//
+
+// loadPasswordPolicy returns the configured password policy (or the default one, if none is).
+func loadPasswordPolicy(txn *gorm.DB) PasswordPolicy {
+	policy := PasswordPolicy{}
+	if err := txn.First(&policy, 1).Error; err != nil {
+		return defaultPasswordPolicy()
+	}
+	return policy
+}
+
+func defaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		ID:        1,
+		MinLength: MinPasswordLen,
+		WarnDays:  DefaultPasswordWarnDays,
+
+		LockoutThreshold:    DefaultLockoutThreshold,
+		LockoutWindowMins:   DefaultLockoutWindowMins,
+		LockoutDurationMins: DefaultLockoutDurationMins,
+	}
+}
+
+//
+// DB Seed
+//
+
+func (c *Controller) seedPasswordPolicy() {
+	c.log.Infoln("Seeding password policy")
+	c.db.Where(PasswordPolicy{ID: 1}).Attrs(defaultPasswordPolicy()).FirstOrCreate(&PasswordPolicy{})
+}
@@ -0,0 +1,126 @@
+package host
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zenazn/goji/web"
+)
+
+type PasswordPolicyTestSuite struct {
+	hostTestSuite
+}
+
+func (ts *PasswordPolicyTestSuite) TestDefaultPolicySeeded(c *C) {
+	policy := PasswordPolicy{}
+	c.Assert(ts.db.First(&policy, 1).Error, IsNil)
+	c.Assert(policy.MinLength, Equals, MinPasswordLen)
+	c.Assert(policy.WarnDays, Equals, DefaultPasswordWarnDays)
+}
+
+func (ts *PasswordPolicyTestSuite) TestPutPasswordPolicy(c *C) {
+	putPolicy := func(jsonStr string) int {
+		req, err := http.NewRequest("PUT", "/dont/care", bytes.NewBufferString(jsonStr))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		ts.controller.PutPasswordPolicy(web.C{Env: nullEnv}, rec, req)
+		return rec.Code
+	}
+
+	c.Assert(putPolicy(`{"MinLength": 0}`), Not(Equals), http.StatusOK)
+	c.Assert(putPolicy(`{"MinLength": 10, "MaxAgeDays": -1}`), Not(Equals), http.StatusOK)
+	c.Assert(putPolicy(`{"MinLength": 10, "MinAgeDays": 30, "MaxAgeDays": 10}`), Not(Equals), http.StatusOK)
+	c.Assert(putPolicy(`{"MinLength": 10, "RequireDigit": true, "MaxAgeDays": 90}`), Equals, http.StatusOK)
+
+	policy := PasswordPolicy{}
+	c.Assert(ts.db.First(&policy, 1).Error, IsNil)
+	c.Assert(policy.MinLength, Equals, 10)
+	c.Assert(policy.RequireDigit, Equals, true)
+	c.Assert(policy.MaxAgeDays, Equals, 90)
+
+	// Omitted fields are left as they were
+	c.Assert(putPolicy(`{"RequireSymbol": true}`), Equals, http.StatusOK)
+	c.Assert(ts.db.First(&policy, 1).Error, IsNil)
+	c.Assert(policy.MinLength, Equals, 10)
+	c.Assert(policy.RequireDigit, Equals, true)
+	c.Assert(policy.RequireSymbol, Equals, true)
+	c.Assert(policy.WarnDays, Equals, DefaultPasswordWarnDays)
+	c.Assert(policy.LockoutThreshold, Equals, DefaultLockoutThreshold)
+}
+
+func (ts *PasswordPolicyTestSuite) TestValidate(c *C) {
+	policy := PasswordPolicy{
+		MinLength:        8,
+		RequireUppercase: true,
+		RequireLowercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+	}
+
+	c.Assert(policy.Validate("Sh0rt!"), NotNil)
+	c.Assert(policy.Validate("alllowercase1!"), NotNil)
+	c.Assert(policy.Validate("ALLUPPERCASE1!"), NotNil)
+	c.Assert(policy.Validate("NoDigitsHere!"), NotNil)
+	c.Assert(policy.Validate("NoSymbols123"), NotNil)
+	c.Assert(policy.Validate("G00d-Enough"), IsNil)
+}
+
+func (ts *PasswordPolicyTestSuite) TestPolicyEnforcedOnUsers(c *C) {
+	policy := PasswordPolicy{ID: 1, MinLength: 12, RequireDigit: true, ReuseHistory: 2}
+	c.Assert(ts.db.Save(&policy).Error, IsNil)
+
+	c.Assert(ts.db.Create(&User{Name: "jdoe", Password: "tooshort1"}).Error, NotNil)
+	c.Assert(ts.db.Create(&User{Name: "jdoe", Password: "nodigitsatall"}).Error, NotNil)
+
+	user := User{Name: "jdoe", Password: "longenough123"}
+	c.Assert(ts.db.Create(&user).Error, IsNil)
+
+	// Reusing the current password is not allowed
+	user.Password = "longenough123"
+	c.Assert(ts.db.Save(&user).Error, NotNil)
+
+	user.Password = "differentpass456"
+	c.Assert(ts.db.Save(&user).Error, IsNil)
+
+	// Neither is reusing the previous one
+	user.Password = "longenough123"
+	c.Assert(ts.db.Save(&user).Error, NotNil)
+
+	user.Password = "yetanotherpass789"
+	c.Assert(ts.db.Save(&user).Error, IsNil)
+
+	// ... but older ones are fine
+	user.Password = "longenough123"
+	c.Assert(ts.db.Save(&user).Error, IsNil)
+}
+
+func (ts *PasswordPolicyTestSuite) TestShadowFileEntryFromPolicy(c *C) {
+	user := User{
+		Name:              "jdoe",
+		HashedPassword:    "$6$salt$hash",
+		PasswordChangedAt: time.Unix(100*24*60*60, 0),
+	}
+
+	policy := PasswordPolicy{MinAgeDays: 1, MaxAgeDays: 90, WarnDays: 14, InactiveDays: 30}
+	c.Assert(user.ShadowFileEntry(policy), Equals, "jdoe:$6$salt$hash:100:1:90:14:30::")
+
+	// No expiry, no inactivity lock
+	tokens := strings.Split(user.ShadowFileEntry(defaultPasswordPolicy()), ShadowFileSeparator)
+	c.Assert(tokens[3], Equals, "0")
+	c.Assert(tokens[4], Equals, "99999")
+	c.Assert(tokens[5], Equals, "7")
+	c.Assert(tokens[6], Equals, "")
+
+	// Per user account expiry, and forced password expiry
+	user.ExpiresAt = time.Unix(200*24*60*60, 0)
+	user.MustChangePassword = true
+	tokens = strings.Split(user.ShadowFileEntry(policy), ShadowFileSeparator)
+	c.Assert(tokens[2], Equals, "0")
+	c.Assert(tokens[7], Equals, "200")
+}
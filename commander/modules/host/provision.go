@@ -0,0 +1,151 @@
+package host
+
+import (
+	"fmt"
+
+	"rocketship/commander/modules/provision"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Provision applies the host related parts of the provisioning seed. Everything is persisted via
+// the same models (and validations) that the API uses, in a single transaction.
+func (c *Controller) Provision(seed provision.Seed) error {
+	txn := c.db.Begin()
+	if err := c.withDB(txn).provision(seed); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit().Error
+}
+
+// ValidateSeed ensures that the host related parts of the provisioning seed can be applied, by
+// applying them in a transaction that is then rolled back.
+func (c *Controller) ValidateSeed(seed provision.Seed) error {
+	txn := c.db.Begin()
+	defer txn.Rollback()
+	return c.withDB(txn).provision(seed)
+}
+
+// withDB returns a controller (for provisioning) that operates on the specified db (transaction).
+func (c *Controller) withDB(db *gorm.DB) *Controller {
+	return &Controller{db: db, log: c.log}
+}
+
+func (c *Controller) provision(seed provision.Seed) error {
+	if len(seed.Hostname) > 0 {
+		c.log.Infoln("Provisioning hostname:", seed.Hostname)
+		if err := c.db.Save(&Hostname{ID: 1, Hostname: seed.Hostname}).Error; err != nil {
+			return fmt.Errorf("invalid hostname in seed (%s)", err)
+		}
+	}
+
+	if len(seed.Domain) > 0 {
+		c.log.Infoln("Provisioning domain:", seed.Domain)
+		if err := c.db.Save(&Domain{ID: 1, Domain: seed.Domain}).Error; err != nil {
+			return fmt.Errorf("invalid domain in seed (%s)", err)
+		}
+	}
+
+	for _, ifseed := range seed.Interfaces {
+		if err := c.provisionInterface(ifseed); err != nil {
+			return fmt.Errorf("invalid config for interface %s in seed (%s)", ifseed.Name, err)
+		}
+	}
+
+	if len(seed.Resolvers) > 0 {
+		if err := c.provisionResolvers(seed.Resolvers); err != nil {
+			return fmt.Errorf("invalid resolvers in seed (%s)", err)
+		}
+	}
+
+	if len(seed.AdminPassword) > 0 {
+		c.log.Infoln("Provisioning password for", AdminUsername)
+		admin := User{}
+		if err := c.db.Where(User{Name: AdminUsername}).First(&admin).Error; err != nil {
+			return err
+		}
+		admin.Password = seed.AdminPassword
+		admin.MustChangePassword = false // operator supplied the password
+		if err := c.db.Save(&admin).Error; err != nil {
+			return fmt.Errorf("invalid admin password in seed (%s)", err)
+		}
+	}
+
+	if len(seed.SSHAuthorizedKeys) > 0 {
+		if err := c.provisionAuthorizedKeys(seed.SSHAuthorizedKeys); err != nil {
+			return fmt.Errorf("invalid ssh keys in seed (%s)", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Controller) provisionInterface(ifseed provision.InterfaceSeed) error {
+	c.log.Infoln("Provisioning interface", ifseed.Name, "in mode", ifseed.Mode)
+
+	iface := InterfaceConfig{
+		Name:    ifseed.Name,
+		Enabled: true,
+		Mode:    ifseed.Mode,
+		Address: ifseed.Address,
+		Netmask: ifseed.Netmask,
+		Gateway: ifseed.Gateway,
+
+		IPv6Mode:      ifseed.IPv6Mode,
+		IPv6Address:   ifseed.IPv6Address,
+		IPv6PrefixLen: ifseed.IPv6PrefixLen,
+		IPv6Gateway:   ifseed.IPv6Gateway,
+	}
+	if iface.usesDHCP() {
+		iface.DHCPProfileID = 1 // default (seeded) profile
+	}
+
+	existing := InterfaceConfig{}
+	if c.db.Where(InterfaceConfig{Name: iface.Name}).First(&existing).Error != nil {
+		return c.db.Create(&iface).Error
+	}
+	return c.db.Save(&iface).Error
+}
+
+func (c *Controller) provisionResolvers(servers []string) error {
+	c.log.Infoln("Provisioning resolvers:", servers)
+
+	if len(servers) > MaxResolvers {
+		return fmt.Errorf("at most %d resolvers may be specified", MaxResolvers)
+	}
+
+	// The other settings (if any) are kept, the defaults apply if there are none yet
+	rcfg, _ := c.resolversConfig()
+
+	var err error
+	if rcfg.Nameservers, err = encodeNameList(servers); err != nil {
+		return err
+	}
+
+	rcfg.ID = 1 // We always operate on the first row
+	return c.db.Save(&rcfg).Error
+}
+
+// provisionAuthorizedKeys adds the specified keys to the admin user (they are written to its
+// authorized_keys file when the files are rewritten).
+func (c *Controller) provisionAuthorizedKeys(keys []string) error {
+	c.log.Infoln("Provisioning SSH authorized keys for", AdminUsername)
+
+	admin := User{}
+	if err := c.db.Where(User{Name: AdminUsername}).First(&admin).Error; err != nil {
+		return err
+	}
+
+	for _, line := range keys {
+		key, err := parseAuthorizedKey(line)
+		if err != nil {
+			return err
+		}
+		key.UserID = admin.ID
+		if err = c.db.Create(&key).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package host
+
+import (
+	"rocketship/commander/modules/provision"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProvisionTestSuite struct {
+	hostTestSuite
+}
+
+func (ts *ProvisionTestSuite) TestProvision(c *C) {
+	err := ts.controller.Provision(provision.Seed{
+		Hostname: "enterprise",
+		Domain:   "starfleet.org",
+		Interfaces: []provision.InterfaceSeed{
+			{Name: "eth0", Mode: ModeStatic, Address: "10.0.0.5", Netmask: "255.255.255.0", Gateway: "10.0.0.1"},
+			{Name: "eth1", Mode: ModeDHCP},
+		},
+		Resolvers:     []string{"10.0.0.2", "10.0.0.3"},
+		AdminPassword: "makeitso",
+		SSHAuthorizedKeys: []string{
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHudS+B75ct45VG+YtRiwgCB0veDbuZaO+NX8d30fOJz picard@enterprise",
+		},
+	})
+	c.Assert(err, IsNil)
+
+	host := Hostname{}
+	c.Assert(ts.db.First(&host, 1).Error, IsNil)
+	c.Assert(host.Hostname, Equals, "enterprise")
+
+	dom := Domain{}
+	c.Assert(ts.db.First(&dom, 1).Error, IsNil)
+	c.Assert(dom.Domain, Equals, "starfleet.org")
+
+	eth0 := InterfaceConfig{Name: "eth0"}
+	c.Assert(ts.db.First(&eth0).Error, IsNil)
+	c.Assert(eth0.Mode, Equals, ModeStatic)
+	c.Assert(eth0.Address, Equals, "10.0.0.5")
+
+	eth1 := InterfaceConfig{Name: "eth1"}
+	c.Assert(ts.db.First(&eth1).Error, IsNil)
+	c.Assert(eth1.DHCPProfileID, Equals, int64(1))
+
+	rcfg := ResolversConfig{}
+	c.Assert(ts.db.First(&rcfg, 1).Error, IsNil)
+	c.Assert(ts.controller.resolverIPs(), DeepEquals, []string{"10.0.0.2", "10.0.0.3"})
+
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	keys := []SSHKey{}
+	c.Assert(ts.db.Where(SSHKey{UserID: admin.ID}).Find(&keys).Error, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].Comment, Equals, "picard@enterprise")
+}
+
+func (ts *ProvisionTestSuite) TestProvisionValidation(c *C) {
+	for _, seed := range []provision.Seed{
+		{Hostname: "bad.hostname"},
+		{Interfaces: []provision.InterfaceSeed{{Name: "eth0", Mode: ModeStatic, Address: "10.0.0.5"}}},
+		{Resolvers: []string{"not-an-ip"}},
+		{Resolvers: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"}},
+		{AdminPassword: "short"},
+		{SSHAuthorizedKeys: []string{"garbage"}},
+	} {
+		c.Assert(ts.controller.ValidateSeed(seed), NotNil)
+		c.Assert(ts.controller.Provision(seed), NotNil)
+	}
+}
+
+func (ts *ProvisionTestSuite) TestProvisionIsAtomic(c *C) {
+	// Validating a (valid) seed doesn't apply it
+	seed := provision.Seed{Hostname: "enterprise", Resolvers: []string{"10.0.0.2"}}
+	c.Assert(ts.controller.ValidateSeed(seed), IsNil)
+	c.Assert(ts.getHostname(c), Equals, DefaultHostname)
+
+	// Nothing is applied if any part of the seed is invalid
+	seed.AdminPassword = "short"
+	c.Assert(ts.controller.Provision(seed), NotNil)
+	c.Assert(ts.getHostname(c), Equals, DefaultHostname)
+	c.Assert(ts.controller.resolverIPs(), Not(DeepEquals), []string{"10.0.0.2"})
+}
+
+func (ts *ProvisionTestSuite) getHostname(c *C) string {
+	host := Hostname{}
+	c.Assert(ts.db.First(&host, 1).Error, IsNil)
+	return host.Hostname
+}
@@ -0,0 +1,49 @@
+package host
+
+import (
+	"fmt"
+)
+
+var (
+	ErrRemoteAuthUnavailable = fmt.Errorf("Remote authentication is unavailable")
+)
+
+// RemoteAuthenticator is implemented by whoever is able to verify credentials against remote
+// (directory) servers.
+type RemoteAuthenticator interface {
+	// Authenticate verifies the credentials against the remote servers, and returns the local
+	// groups that the user is mapped to. ErrRemoteAuthUnavailable indicates that the credentials
+	// could not be verified remotely (e.g. no servers are reachable), in which case the local users
+	// are consulted instead.
+	Authenticate(name, password string) ([]string, error)
+
+	// PamAuthLines returns the lines to be placed in the PAM auth stack (ahead of pam_unix) so
+	// that system logins are verified remotely too.
+	PamAuthLines() ([]string, error)
+}
+
+// SetRemoteAuthenticator sets the authenticator that is consulted (before the local users) when
+// users log in.
+func (c *Controller) SetRemoteAuthenticator(a RemoteAuthenticator) {
+	c.remoteAuth = a
+}
+
+// authenticateRemote verifies the credentials against the remote authenticator (if any), and
+// returns the user that was authenticated. ErrRemoteAuthUnavailable indicates that the local users
+// should be consulted instead.
+func (c *Controller) authenticateRemote(name, password string) (UserResource, error) {
+	if c.remoteAuth == nil {
+		return UserResource{}, ErrRemoteAuthUnavailable
+	}
+
+	groups, err := c.remoteAuth.Authenticate(name, password)
+	switch err {
+	case nil:
+		return UserResource{Name: name, Remote: true, Groups: groups}, nil
+	case ErrBadCredentials, ErrRemoteAuthUnavailable:
+		return UserResource{}, err
+	default:
+		c.log.Warningf("Remote authentication of %s failed (%s), falling back to local users", name, err)
+		return UserResource{}, ErrRemoteAuthUnavailable
+	}
+}
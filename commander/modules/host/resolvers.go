@@ -1,13 +1,19 @@
 package host
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"strings"
 
+	"rocketship/commander/modules/events"
+
+	"github.com/jinzhu/gorm"
 	"github.com/zenazn/goji/web"
 )
 
@@ -15,6 +21,26 @@ const (
 	etcResolvConfPath = "/etc/resolv.conf"
 
 	runResolvConfPath = "/run/resolvconf/resolv.conf"
+
+	// Contents of this file are included (by resolvconf) in resolv.conf, regardless of interfaces
+	ResolvConfBasePath = "/etc/resolvconf/resolv.conf.d/base"
+
+	ResolvconfBinPath = "/sbin/resolvconf"
+
+	// Max number of resolvers we can configure (MAXNS in resolv.h)
+	MaxResolvers = 3
+
+	// Max number of search domains (MAXDNSRCH in resolv.h), and the length of the search list
+	MaxSearchDomains   = 6
+	MaxSearchListChars = 256
+
+	// Bounds on the resolver options (see resolv.conf(5))
+	MaxResolverTimeout  = 30
+	MaxResolverAttempts = 5
+	MaxResolverNdots    = 15
+
+	// Resolver default for ndots (which, unlike the other options, has a meaningful 0)
+	DefaultNdots = 1
 )
 
 //
@@ -28,29 +54,36 @@ func (c *Controller) SetResolvers(ctx web.C, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	rcfg := ResolversConfig{}
-	if err := json.Unmarshal(bodybytes, &rcfg); err != nil {
+	resource := ResolversConfigResource{Ndots: DefaultNdots}
+	if err := json.Unmarshal(bodybytes, &resource); err != nil {
 		c.jsonError(err, w)
 		return
 	}
 
-	rcfg.ID = 1 // We always operate on the first row
-	if err := c.db.Save(&rcfg).Error; err != nil {
+	rcfg, err := resource.ToResolversConfigModel()
+	if err != nil {
 		c.jsonError(err, w)
 		return
 	}
 
-	bytes, err := json.Marshal(&rcfg)
-	if err != nil {
+	rcfg.ID = 1 // We always operate on the first row
+	if err := c.db.Save(&rcfg).Error; err != nil {
 		c.jsonError(err, w)
 		return
 	}
 
-	_, err = w.Write(bytes)
-	if err != nil {
-		c.jsonError(err, w)
-		return
+	// The resolvers are rendered into the interfaces file (for interfaces with static addresses),
+	// as well as the resolvconf base file.
+	c.rewriteNetworkFiles(ctx)
+	if _, there := ctx.Env[NoApplyEnvKey]; !there {
+		if err := c.RewriteResolvConf(); err != nil {
+			c.log.Warningln("failed to rewrite resolv.conf:", err)
+		}
 	}
+
+	events.Publish(events.ResolversChanged, nil)
+
+	c.writeResolversResponse(rcfg, w)
 }
 
 func (c *Controller) GetResolvers(ctx web.C, w http.ResponseWriter, r *http.Request) {
@@ -60,7 +93,17 @@ func (c *Controller) GetResolvers(ctx web.C, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	bytes, err := json.Marshal(&rcfg)
+	c.writeResolversResponse(rcfg, w)
+}
+
+func (c *Controller) writeResolversResponse(rcfg ResolversConfig, w http.ResponseWriter) {
+	resource := ResolversConfigResource{}
+	if err := resource.FromResolversConfigModel(rcfg); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bytes, err := json.Marshal(&resource)
 	if err != nil {
 		c.jsonError(err, w)
 		return
@@ -76,17 +119,164 @@ func (c *Controller) GetResolvers(ctx web.C, w http.ResponseWriter, r *http.Requ
 //
 // File operations
 //
+
+// RewriteResolvConf rewrites the resolvconf base file, and ensures that resolv.conf is the one
+// that resolvconf generates (which includes the base file).
 func (c *Controller) RewriteResolvConf() error {
-	// we don't actually rewrite it, just ensure it is a symlink
-	c.log.Infoln("Ensuring resolv.conf symlink")
+	c.log.Infoln("Rewriting resolvconf base file")
 
-	if err, _ := os.Stat(etcResolvConfPath); err != nil {
-		// delete it
+	contents, err := c.resolvConfBaseFileContents()
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(ResolvConfBasePath, contents, 0644); err != nil {
+		return err
+	}
+
+	c.log.Infoln("Ensuring resolv.conf symlink")
+	if target, err := os.Readlink(etcResolvConfPath); err != nil || target != runResolvConfPath {
 		os.Remove(etcResolvConfPath)
+		if err := os.Symlink(runResolvConfPath, etcResolvConfPath); err != nil {
+			return fmt.Errorf("Failed to ensure symlink: %s", err)
+		}
 	}
 
-	if err := os.Symlink(runResolvConfPath, etcResolvConfPath); err != nil {
-		return fmt.Errorf("Failed to ensure symlink: %s", err)
+	// resolvconf may not be running yet (e.g. during boot), in which case it picks this up later
+	if output, err := exec.Command(ResolvconfBinPath, "-u").CombinedOutput(); err != nil {
+		c.log.Warningln("Failed to update resolv.conf:", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// returns the contents of the resolvconf base file
+func (c *Controller) resolvConfBaseFileContents() ([]byte, error) {
+	contents := bytes.Buffer{}
+
+	rcfg, err := c.resolversConfig()
+	if err != nil {
+		return contents.Bytes(), err
+	}
+	servers, err := decodeNameList(rcfg.Nameservers)
+	if err != nil {
+		return contents.Bytes(), err
+	}
+
+	contents.WriteString("# This file is AUTOGENERATED.\n")
+	contents.WriteString("#\n\n")
+
+	for _, server := range servers {
+		contents.WriteString("nameserver " + server + "\n")
+	}
+	if search := c.searchDomains(); len(search) > 0 {
+		contents.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	if opts := rcfg.options(); len(opts) > 0 {
+		contents.WriteString("options " + strings.Join(opts, " ") + "\n")
+	}
+
+	return contents.Bytes(), nil
+}
+
+// resolverLines returns the lines (for the interfaces file) that configure the resolvers (via
+// resolvconf) when the interface comes up.
+func (c *Controller) resolverLines() []string {
+	lines := []string{}
+
+	rcfg, err := c.resolversConfig()
+	if err != nil {
+		c.log.Warningln("Failed to load resolvers config:", err)
+	}
+
+	if search := c.searchDomains(); len(search) > 0 {
+		lines = append(lines, "dns-search "+strings.Join(search, " "))
+	}
+	if resolvers := c.resolverIPs(); len(resolvers) > 0 {
+		lines = append(lines, "dns-nameservers "+strings.Join(resolvers, " "))
+	}
+	if opts := rcfg.options(); len(opts) > 0 {
+		lines = append(lines, "dns-options "+strings.Join(opts, " "))
+	}
+
+	return lines
+}
+
+// returns the (configured) resolvers config
+func (c *Controller) resolversConfig() (ResolversConfig, error) {
+	rcfg := ResolversConfig{Ndots: DefaultNdots}
+	err := c.db.First(&rcfg, 1).Error
+	return rcfg, err
+}
+
+// returns the (configured) IPs of the DNS servers, in order of preference
+func (c *Controller) resolverIPs() []string {
+	rcfg, err := c.resolversConfig()
+	if err != nil {
+		c.log.Warningln("Failed to load resolvers config:", err)
+	}
+
+	servers, err := decodeNameList(rcfg.Nameservers)
+	if err != nil {
+		c.log.Warningln("Failed to decode nameservers:", err)
+	}
+	return servers
+}
+
+// returns the IPs of the DNS servers of the specified family (IPv4 if v4 is set)
+func (c *Controller) resolverIPsOfFamily(v4 bool) []string {
+	ret := []string{}
+	for _, ip := range c.resolverIPs() {
+		if (net.ParseIP(ip).To4() != nil) == v4 {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
+// returns the domains to search (the domain of the host first), in order
+func (c *Controller) searchDomains() []string {
+	_, domain, _ := hostNames(c.db)
+
+	rcfg, err := c.resolversConfig()
+	if err != nil {
+		c.log.Warningln("Failed to load resolvers config:", err)
+	}
+	domains, err := decodeNameList(rcfg.SearchDomains)
+	if err != nil {
+		c.log.Warningln("Failed to decode search domains:", err)
+	}
+
+	// The domain of the host may have changed since the search domains were validated, in which
+	// case the ones at the end are dropped to fit the limits of the resolver.
+	ret := searchList(domain, domains)
+	for len(ret) > 0 && checkSearchList(ret) != nil {
+		c.log.Warningln("Dropping search domain", ret[len(ret)-1], "(search list is too long)")
+		ret = ret[:len(ret)-1]
+	}
+	return ret
+}
+
+// searchList returns the domain of the host followed by the search domains, without duplicates.
+func searchList(hostDomain string, domains []string) []string {
+	ret := []string{}
+	seen := map[string]bool{}
+	for _, d := range append([]string{hostDomain}, domains...) {
+		if len(d) > 0 && !seen[strings.ToLower(d)] {
+			seen[strings.ToLower(d)] = true
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// checkSearchList ensures that the search list fits within the limits of the resolver.
+func checkSearchList(list []string) error {
+	if len(list) > MaxSearchDomains {
+		return fmt.Errorf("At most %d search domains (including the domain of the host) may be configured",
+			MaxSearchDomains)
+	}
+	if len(strings.Join(list, " ")) > MaxSearchListChars {
+		return fmt.Errorf("Search domains (including the domain of the host) cannot be more than %d chars (in all)",
+			MaxSearchListChars)
 	}
 	return nil
 }
@@ -96,28 +286,218 @@ func (c *Controller) RewriteResolvConf() error {
 //
 
 type ResolversConfig struct {
-	ID           int `json:"-"`
-	DNSServerIP1 string
-	DNSServerIP2 string
-	DNSServerIP3 string
-}
-
-func (c *ResolversConfig) BeforeSave() error {
-	for _, server := range []string{c.DNSServerIP1, c.DNSServerIP2, c.DNSServerIP3} {
-		if len(server) > 0 {
-			if net.ParseIP(server) == nil {
-				return fmt.Errorf("%s is not a valid IP", server)
-			}
+	ID int `json:"-"`
+
+	Nameservers   string // Serialized json []string, in order of preference
+	SearchDomains string // Serialized json []string, searched after the domain of the host
+
+	Timeout  int  // Seconds to wait for a nameserver (0 for the resolver default)
+	Attempts int  // Times to try the nameservers (0 for the resolver default)
+	Rotate   bool // Whether to spread the queries across the nameservers
+	Ndots    int  // Dots a name needs to be looked up as is, before the search domains are tried
+
+	// Superseded by Nameservers, these are only read (and cleared) when migrating
+	DNSServerIP1 string `json:"-"`
+	DNSServerIP2 string `json:"-"`
+	DNSServerIP3 string `json:"-"`
+}
+
+func (c *ResolversConfig) BeforeSave(txn *gorm.DB) error {
+	servers, err := decodeNameList(c.Nameservers)
+	if err != nil {
+		return err
+	}
+	if len(servers) > MaxResolvers {
+		return fmt.Errorf("At most %d resolvers may be configured", MaxResolvers)
+	}
+	seen := map[string]bool{}
+	for _, server := range servers {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			return fmt.Errorf("%s is not a valid IP", server)
+		}
+		if seen[ip.String()] {
+			return fmt.Errorf("Resolver %s is specified more than once", server)
+		}
+		seen[ip.String()] = true
+	}
+
+	domains, err := decodeNameList(c.SearchDomains)
+	if err != nil {
+		return err
+	}
+	if len(domains) > MaxSearchDomains {
+		return fmt.Errorf("At most %d search domains may be configured", MaxSearchDomains)
+	}
+	for i, domain := range domains {
+		if domains[i], err = normalizeDNSName(strings.TrimSuffix(domain, ".")); err != nil {
+			return err
 		}
 	}
+	// The domain of the host is searched first, so it counts towards the limits too
+	_, hostDomain, _ := hostNames(txn)
+	if err := checkSearchList(searchList(hostDomain, domains)); err != nil {
+		return err
+	}
+	if c.SearchDomains, err = encodeNameList(domains); err != nil {
+		return err
+	}
+
+	if c.Timeout < 0 || c.Timeout > MaxResolverTimeout {
+		return fmt.Errorf("Resolver timeout must be between 0 and %d seconds", MaxResolverTimeout)
+	}
+	if c.Attempts < 0 || c.Attempts > MaxResolverAttempts {
+		return fmt.Errorf("Resolver attempts must be between 0 and %d", MaxResolverAttempts)
+	}
+	if c.Ndots < 0 || c.Ndots > MaxResolverNdots {
+		return fmt.Errorf("Resolver ndots must be between 0 and %d", MaxResolverNdots)
+	}
+
 	return nil
 }
 
+// options returns the resolver options (in resolv.conf form) that differ from the defaults.
+func (c ResolversConfig) options() []string {
+	opts := []string{}
+	if c.Timeout > 0 {
+		opts = append(opts, fmt.Sprintf("timeout:%d", c.Timeout))
+	}
+	if c.Attempts > 0 {
+		opts = append(opts, fmt.Sprintf("attempts:%d", c.Attempts))
+	}
+	if c.Rotate {
+		opts = append(opts, "rotate")
+	}
+	if c.Ndots != DefaultNdots {
+		opts = append(opts, fmt.Sprintf("ndots:%d", c.Ndots))
+	}
+	return opts
+}
+
+func decodeNameList(ser string) ([]string, error) {
+	ret := []string{}
+	if len(ser) <= 0 {
+		return ret, nil
+	}
+	if err := json.Unmarshal([]byte(ser), &ret); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+func encodeNameList(names []string) (string, error) {
+	trimmed := []string{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			trimmed = append(trimmed, name)
+		}
+	}
+	if len(trimmed) <= 0 {
+		return "", nil
+	}
+
+	bytes, err := json.Marshal(trimmed)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+//
+// Resources
+//
+
+type ResolversConfigResource struct {
+	Nameservers   []string // In order of preference
+	SearchDomains []string // Searched after the domain of the host
+
+	Timeout  int
+	Attempts int
+	Rotate   bool
+	Ndots    int
+}
+
+func (r *ResolversConfigResource) FromResolversConfigModel(m ResolversConfig) error {
+	servers, err := decodeNameList(m.Nameservers)
+	if err != nil {
+		return err
+	}
+	domains, err := decodeNameList(m.SearchDomains)
+	if err != nil {
+		return err
+	}
+
+	*r = ResolversConfigResource{
+		Nameservers:   servers,
+		SearchDomains: domains,
+		Timeout:       m.Timeout,
+		Attempts:      m.Attempts,
+		Rotate:        m.Rotate,
+		Ndots:         m.Ndots,
+	}
+	return nil
+}
+
+func (r ResolversConfigResource) ToResolversConfigModel() (ResolversConfig, error) {
+	servers, err := encodeNameList(r.Nameservers)
+	if err != nil {
+		return ResolversConfig{}, err
+	}
+	domains, err := encodeNameList(r.SearchDomains)
+	if err != nil {
+		return ResolversConfig{}, err
+	}
+
+	return ResolversConfig{
+		Nameservers:   servers,
+		SearchDomains: domains,
+		Timeout:       r.Timeout,
+		Attempts:      r.Attempts,
+		Rotate:        r.Rotate,
+		Ndots:         r.Ndots,
+	}, nil
+}
+
+//
+// DB Seed
+//
+
 func (c *Controller) seedResolvers() {
 	c.log.Infoln("Seeding resolvers")
 	c.db.FirstOrCreate(&ResolversConfig{
-		DNSServerIP1: "8.8.8.8",
-		DNSServerIP2: "8.8.4.4",
-		DNSServerIP3: "",
+		Nameservers: `["8.8.8.8","8.8.4.4"]`,
+		Ndots:       DefaultNdots,
 	})
 }
+
+// migrateResolvers moves the resolvers of configs that predate the list of them (off the
+// DNSServerIPn columns), and sets the defaults for the resolver options.
+func (c *Controller) migrateResolvers() {
+	// Rows predating the columns have NULLs in them (which cannot be loaded into the model), so
+	// this is done in SQL.
+	err := c.db.Exec("UPDATE resolvers_configs SET nameservers = '', search_domains = '', timeout = 0, "+
+		"attempts = 0, rotate = ?, ndots = ? WHERE nameservers IS NULL", false, DefaultNdots).Error
+	if err != nil {
+		c.log.Errorln("Failed to migrate resolvers:", err)
+		return
+	}
+
+	rcfgs := []ResolversConfig{}
+	if err = c.db.Where("nameservers = ''").Find(&rcfgs).Error; err != nil {
+		c.log.Errorln("Failed to migrate resolvers:", err)
+		return
+	}
+
+	for _, rcfg := range rcfgs {
+		servers := []string{rcfg.DNSServerIP1, rcfg.DNSServerIP2, rcfg.DNSServerIP3}
+		if rcfg.Nameservers, err = encodeNameList(servers); err != nil {
+			c.log.Errorln("Failed to migrate resolvers:", err)
+			continue
+		}
+		rcfg.DNSServerIP1, rcfg.DNSServerIP2, rcfg.DNSServerIP3 = "", "", ""
+
+		if err = c.db.Save(&rcfg).Error; err != nil {
+			c.log.Errorln("Failed to migrate resolvers:", err)
+		}
+	}
+}
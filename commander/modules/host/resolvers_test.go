@@ -1,11 +1,17 @@
 package host
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
 
 	_ "github.com/mattn/go-sqlite3"
 	. "gopkg.in/check.v1"
@@ -40,6 +46,134 @@ func (ts *ResolversTestSuite) TearDownTest(c *C) {
 func (ts *ResolversTestSuite) TestSeeds(c *C) {
 	r := ResolversConfig{}
 	c.Assert(ts.db.First(&r, 1).Error, IsNil)
-	c.Assert(r.DNSServerIP1, Not(HasLen), 0)
-	c.Assert(r.DNSServerIP2, Not(HasLen), 0)
+	c.Assert(r.Ndots, Equals, DefaultNdots)
+	c.Assert(ts.controller.resolverIPs(), HasLen, 2)
+}
+
+func (ts *ResolversTestSuite) TestResolversEndpointHandlers(c *C) {
+	do := func(handler web.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{Env: map[interface{}]interface{}{NoApplyEnvKey: true}}, rec, req)
+		return rec
+	}
+
+	for _, body := range []string{
+		`{"Nameservers": ["10.0.0.53", "not.an.ip"]}`,
+		`{"Nameservers": ["10.0.0.53", "10.0.1.53", "10.0.2.53", "10.0.3.53"]}`, // too many
+		`{"Nameservers": ["10.0.0.53", "10.0.0.53"]}`,                           // twice
+		`{"SearchDomains": ["example.com", "-bogus.com"]}`,
+		`{"SearchDomains": ["a.com", "b.com", "c.com", "d.com", "e.com", "f.com", "g.com"]}`, // too many
+		`{"Timeout": 31}`,
+		`{"Attempts": -1}`,
+		`{"Ndots": 16}`,
+	} {
+		rec := do(ts.controller.SetResolvers, body)
+		c.Assert(rec.Code, Not(Equals), http.StatusOK, Commentf("body: %s", body))
+	}
+
+	rec := do(ts.controller.SetResolvers, `{"Nameservers": ["10.0.0.53", " 10.0.1.53 "], "SearchDomains":
+		["corp.example.com", "example.com"], "Timeout": 2, "Attempts": 3, "Rotate": true}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.GetResolvers, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	r := ResolversConfigResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &r), IsNil)
+	c.Assert(r, DeepEquals, ResolversConfigResource{
+		Nameservers:   []string{"10.0.0.53", "10.0.1.53"},
+		SearchDomains: []string{"corp.example.com", "example.com"},
+		Timeout:       2,
+		Attempts:      3,
+		Rotate:        true,
+		Ndots:         DefaultNdots, // unspecified
+	})
+
+	// Interfaces with static addresses use them
+	err := ts.db.Create(&InterfaceConfig{
+		Name:    "eth1",
+		Mode:    ModeStatic,
+		Address: "192.168.168.8",
+		Netmask: "255.255.255.0",
+		Gateway: "192.168.168.1"}).Error
+	c.Assert(err, IsNil)
+
+	contents, err := ts.controller.interfacesConfigFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "dns-search corp.example.com example.com\n"+
+		"dns-nameservers 10.0.0.53 10.0.1.53\ndns-options timeout:2 attempts:3 rotate\n"), Equals, true)
+
+	// ... as does the resolvconf base file, with the domain of the host searched first
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "example.com"}).Error, IsNil)
+	contents, err = ts.controller.resolvConfBaseFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasSuffix(string(contents), "nameserver 10.0.0.53\nnameserver 10.0.1.53\n"+
+		"search example.com corp.example.com\noptions timeout:2 attempts:3 rotate\n"), Equals, true,
+		Commentf("contents: %s", contents))
+
+	// Clearing them all leaves the defaults
+	rec = do(ts.controller.SetResolvers, `{"Ndots": 0}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: ""}).Error, IsNil)
+
+	contents, err = ts.controller.resolvConfBaseFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Equals, "# This file is AUTOGENERATED.\n#\n\noptions ndots:0\n")
+}
+
+func (ts *ResolversTestSuite) TestResolversMigration(c *C) {
+	// Configs predating the list of resolvers have them in the DNSServerIPn columns
+	c.Assert(ts.db.Exec("UPDATE resolvers_configs SET dns_server_ip1 = ?, dns_server_ip3 = ?, "+
+		"nameservers = NULL, search_domains = NULL, timeout = NULL, attempts = NULL, rotate = NULL, "+
+		"ndots = NULL", "10.0.0.53", "2001:db8::53").Error, IsNil)
+	ts.controller.MigrateDB()
+
+	r := ResolversConfig{}
+	c.Assert(ts.db.First(&r, 1).Error, IsNil)
+	c.Assert(r.DNSServerIP1, Equals, "")
+	c.Assert(r.DNSServerIP3, Equals, "")
+	c.Assert(r.Ndots, Equals, DefaultNdots)
+	c.Assert(ts.controller.resolverIPs(), DeepEquals, []string{"10.0.0.53", "2001:db8::53"})
+}
+
+func (ts *ResolversTestSuite) TestIPv6Resolvers(c *C) {
+	r := ResolversConfig{ID: 1, Nameservers: `["2001:4860:4860::8888", "8.8.8.8"]`, Ndots: DefaultNdots}
+	c.Assert(ts.db.Save(&r).Error, IsNil)
+
+	r.Nameservers = `["2001:4860:4860::8888", "8.8.8.8", "2001:4860:4860::88888"]`
+	c.Assert(ts.db.Save(&r).Error, NotNil)
+
+	c.Assert(ts.controller.resolverIPsOfFamily(true), DeepEquals, []string{"8.8.8.8"})
+	c.Assert(ts.controller.resolverIPsOfFamily(false), DeepEquals, []string{"2001:4860:4860::8888"})
+}
+
+func (ts *ResolversTestSuite) TestSearchListLimits(c *C) {
+	six := `["a.com", "b.com", "c.com", "d.com", "e.com", "f.com"]`
+	r := ResolversConfig{ID: 1, SearchDomains: six, Ndots: DefaultNdots}
+	c.Assert(ts.db.Save(&r).Error, IsNil)
+
+	// The domain of the host counts towards the limits (unless it is one of the search domains)
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "example.com"}).Error, IsNil)
+	r.SearchDomains = six
+	c.Assert(ts.db.Save(&r).Error, NotNil)
+	r.SearchDomains = `["a.com", "b.com", "c.com", "d.com", "e.com", "example.com"]`
+	c.Assert(ts.db.Save(&r).Error, IsNil)
+
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: ""}).Error, IsNil)
+	long := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".com"
+	r.SearchDomains = `["` + long + `", "x` + long + `"]`
+	c.Assert(ts.db.Save(&r).Error, IsNil)
+	c.Assert(ts.db.Save(&Domain{ID: 1, Domain: "z" + long}).Error, IsNil)
+	r.SearchDomains = `["` + long + `", "x` + long + `"]`
+	c.Assert(ts.db.Save(&r).Error, NotNil)
+
+	// Domains that no longer fit (as the domain of the host changed) are not searched
+	c.Assert(ts.controller.searchDomains(), DeepEquals, []string{"z" + long, long})
+
+	c.Assert(ts.db.Exec("UPDATE resolvers_configs SET search_domains = ?", six).Error, IsNil)
+	c.Assert(ts.controller.searchDomains(), DeepEquals,
+		[]string{"z" + long, "a.com", "b.com", "c.com", "d.com", "e.com"})
 }
@@ -0,0 +1,293 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/amoghe/distillog"
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	IpBinPath = "/sbin/ip"
+
+	// Upper bound on route metrics (metrics are u32 in the kernel, we keep it sane)
+	MaxRouteMetric = 65535
+)
+
+//
+// Endpoint handlers
+//
+
+func (c *Controller) GetRoutes(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	routes := []StaticRoute{}
+	if err := c.db.Find(&routes).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bytes, err := json.Marshal(routes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) CreateRoute(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	route := StaticRoute{}
+	if err = json.Unmarshal(bodybytes, &route); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	route.ID = 0
+
+	c.log.Infoln("Creating route to", route.Destination)
+	if err = c.db.Create(&route).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.applyRoutes(ctx, nil, &route)
+	c.writeRouteResponse(route, w)
+}
+
+func (c *Controller) UpdateRoute(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	route := StaticRoute{}
+	if err = json.Unmarshal(bodybytes, &route); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	existing := StaticRoute{}
+	if err = c.db.Find(&existing, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	route.ID = existing.ID
+
+	c.log.Infoln("Updating route to", route.Destination)
+	if err = c.db.Save(&route).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.applyRoutes(ctx, &existing, &route)
+	c.writeRouteResponse(route, w)
+}
+
+func (c *Controller) DeleteRoute(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	route := StaticRoute{}
+	if err := c.db.Find(&route, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.log.Infoln("Deleting route to", route.Destination)
+	if err := c.db.Delete(&route).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.applyRoutes(ctx, &route, nil)
+	c.writeRouteResponse(route, w)
+}
+
+//
+// Helpers
+//
+
+func (c *Controller) writeRouteResponse(route StaticRoute, w http.ResponseWriter) {
+	bytes, err := json.Marshal(route)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// applyRoutes rewrites the interfaces file (so that the routes persist), and replaces the removed
+// route with the added one in the kernel routing table. Either of them may be nil.
+func (c *Controller) applyRoutes(ctx web.C, removed, added *StaticRoute) {
+	data := map[string]string{}
+	for _, rt := range []*StaticRoute{removed, added} {
+		if rt != nil {
+			data["ID"] = fmt.Sprint(rt.ID)
+			data["Destination"] = rt.Destination
+		}
+	}
+	defer events.Publish(events.RoutesChanged, data)
+
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply of routes to system (\"noapply\" present in env)")
+		return
+	}
+
+	if err := c.RewriteInterfacesFile(); err != nil {
+		c.log.Warningln("failed to rewrite interfaces file:", err)
+	}
+
+	ctrl := routeCtrl{Log: c.log}
+	if removed != nil {
+		if err := ctrl.Delete(*removed); err != nil {
+			c.log.Warningln(err)
+		}
+	}
+	if added != nil {
+		if err := ctrl.Replace(*added); err != nil {
+			c.log.Warningln(err)
+		}
+	}
+}
+
+// routesForInterface returns the routes that go out the named interface.
+func (c *Controller) routesForInterface(name string) ([]StaticRoute, error) {
+	routes := []StaticRoute{}
+	err := c.db.Where(StaticRoute{Interface: name}).Order("metric, id").Find(&routes).Error
+	return routes, err
+}
+
+//
+// DB Models
+//
+
+// StaticRoute is a route (to the destination network, via the gateway) in addition to the default
+// route of the interface.
+type StaticRoute struct {
+	ID          int64
+	Destination string // CIDR, e.g. 10.10.0.0/16
+	Gateway     string
+	Interface   string
+	Metric      int
+}
+
+func (s *StaticRoute) BeforeSave(txn *gorm.DB) error {
+	_, dest, err := net.ParseCIDR(s.Destination)
+	if err != nil || dest.IP.To4() == nil {
+		return fmt.Errorf("Invalid destination network (%s)", s.Destination)
+	}
+	if ones, _ := dest.Mask.Size(); ones == 0 {
+		return fmt.Errorf("Default route is configured by the gateway of the interface")
+	}
+	s.Destination = dest.String() // canonical form, e.g. 10.10.1.1/16 => 10.10.0.0/16
+
+	gw := net.ParseIP(s.Gateway)
+	if gw == nil || gw.To4() == nil {
+		return fmt.Errorf("Invalid gateway (%s)", s.Gateway)
+	}
+
+	if s.Metric < 0 || s.Metric > MaxRouteMetric {
+		return fmt.Errorf("Route metric must be between 0 and %d", MaxRouteMetric)
+	}
+
+	iface := InterfaceConfig{Name: s.Interface}
+	if len(s.Interface) <= 0 || txn.First(&iface).Error != nil {
+		return fmt.Errorf("Unknown interface: %s", s.Interface)
+	}
+	if err = iface.validateRouteGateway(gw); err != nil {
+		return err
+	}
+
+	others := []StaticRoute{}
+	if err = txn.Where("destination = ? AND metric = ? AND id <> ?", s.Destination, s.Metric, s.ID).
+		Find(&others).Error; err != nil {
+		return err
+	}
+	if len(others) > 0 {
+		return fmt.Errorf("A route to %s (with metric %d) already exists", s.Destination, s.Metric)
+	}
+
+	return nil
+}
+
+// validateRouteGateway ensures that the gateway is directly reachable via the interface. The
+// subnet of interfaces in DHCP mode is not known upfront, so any gateway goes for those.
+func (i InterfaceConfig) validateRouteGateway(gw net.IP) error {
+	if i.Mode == ModeNone {
+		return fmt.Errorf("Interface %s has no IPv4 configuration", i.Name)
+	}
+	if i.Mode != ModeStatic {
+		return nil
+	}
+
+	subnet := net.IPNet{
+		IP:   net.ParseIP(i.Address).Mask(net.IPMask(net.ParseIP(i.Netmask).To4())),
+		Mask: net.IPMask(net.ParseIP(i.Netmask).To4()),
+	}
+	if !subnet.Contains(gw) {
+		return fmt.Errorf("Gateway %s is not on the network of %s (%s)", gw, i.Name, subnet.String())
+	}
+	if gw.Equal(net.ParseIP(i.Address)) {
+		return fmt.Errorf("Gateway %s is the address of %s", gw, i.Name)
+	}
+	return nil
+}
+
+// upDownLines returns the lines (for the interfaces file) that add and remove the route when the
+// interface goes up and down.
+func (s StaticRoute) upDownLines() []string {
+	spec := strings.Join(s.ipRouteArgs(), " ")
+	return []string{
+		"up " + IpBinPath + " route add " + spec,
+		"down " + IpBinPath + " route del " + spec,
+	}
+}
+
+func (s StaticRoute) ipRouteArgs() []string {
+	return []string{s.Destination, "via", s.Gateway, "dev", s.Interface, "metric", fmt.Sprint(s.Metric)}
+}
+
+//
+// route control - convenience struct to allow us to add/remove routes to/from the kernel.
+//
+
+type routeCtrl struct {
+	Log distillog.Logger
+}
+
+func (r routeCtrl) Replace(route StaticRoute) error {
+	return r.ip(append([]string{"route", "replace"}, route.ipRouteArgs()...))
+}
+
+func (r routeCtrl) Delete(route StaticRoute) error {
+	return r.ip(append([]string{"route", "del"}, route.ipRouteArgs()...))
+}
+
+func (r routeCtrl) ip(args []string) error {
+	r.Log.Infoln("Running ip", strings.Join(args, " "))
+	if output, err := exec.Command(IpBinPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to run ip %s: %s (%s)", strings.Join(args, " "), err,
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
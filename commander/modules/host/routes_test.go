@@ -0,0 +1,138 @@
+package host
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+
+	. "gopkg.in/check.v1"
+)
+
+type RoutesTestSuite struct {
+	hostTestSuite
+}
+
+func (ts *RoutesTestSuite) SetUpTest(c *C) {
+	ts.hostTestSuite.SetUpTest(c)
+
+	// A data network, in addition to the (DHCP) management network on eth0
+	err := ts.db.Create(&InterfaceConfig{
+		Name:    "eth1",
+		Mode:    ModeStatic,
+		Address: "192.168.168.8",
+		Netmask: "255.255.255.0",
+		Gateway: "192.168.168.1"}).Error
+	c.Assert(err, IsNil)
+}
+
+//
+// tests
+//
+
+func (ts *RoutesTestSuite) TestRouteValidation(c *C) {
+	for _, route := range []StaticRoute{
+		{Destination: "10.10.0.0", Gateway: "192.168.168.254", Interface: "eth1"},                // not a CIDR
+		{Destination: "0.0.0.0/0", Gateway: "192.168.168.254", Interface: "eth1"},                // default route
+		{Destination: "10.10.0.0/16", Gateway: "bogus", Interface: "eth1"},                       // bad gateway
+		{Destination: "10.10.0.0/16", Gateway: "192.168.168.254", Interface: "eth9"},             // no such iface
+		{Destination: "10.10.0.0/16", Gateway: "192.168.168.254"},                                // no iface
+		{Destination: "10.10.0.0/16", Gateway: "10.0.0.1", Interface: "eth1"},                    // not on subnet
+		{Destination: "10.10.0.0/16", Gateway: "192.168.168.8", Interface: "eth1"},               // own address
+		{Destination: "10.10.0.0/16", Gateway: "192.168.168.254", Interface: "eth1", Metric: -1}, // bad metric
+	} {
+		c.Assert(ts.db.Create(&route).Error, NotNil, Commentf("route: %+v", route))
+	}
+
+	route := StaticRoute{Destination: "10.10.1.1/16", Gateway: "192.168.168.254", Interface: "eth1"}
+	c.Assert(ts.db.Create(&route).Error, IsNil)
+	c.Assert(route.Destination, Equals, "10.10.0.0/16")
+
+	// Same destination (and metric) again, even via another interface
+	dup := StaticRoute{Destination: "10.10.0.0/16", Gateway: "172.16.0.1", Interface: "eth0"}
+	c.Assert(ts.db.Create(&dup).Error, NotNil)
+	dup.Metric = 10
+	c.Assert(ts.db.Create(&dup).Error, IsNil)
+
+	// Routes via interfaces in DHCP mode aren't checked against a subnet
+	c.Assert(ts.db.Create(&StaticRoute{Destination: "172.20.0.0/16", Gateway: "172.16.0.1", Interface: "eth0"}).Error, IsNil)
+
+	// The interface cannot move to another network while it has routes
+	iface := InterfaceConfig{Name: "eth1"}
+	c.Assert(ts.db.First(&iface).Error, IsNil)
+	iface.Address, iface.Gateway = "10.1.1.8", "10.1.1.1"
+	c.Assert(ts.db.Save(&iface).Error, NotNil)
+}
+
+func (ts *RoutesTestSuite) TestRoutesRendered(c *C) {
+	c.Assert(ts.db.Create(&StaticRoute{Destination: "10.10.0.0/16", Gateway: "192.168.168.254",
+		Interface: "eth1", Metric: 5}).Error, IsNil)
+	c.Assert(ts.db.Create(&StaticRoute{Destination: "10.20.0.0/16", Gateway: "192.168.168.253",
+		Interface: "eth1"}).Error, IsNil)
+
+	contents, err := ts.controller.interfacesConfigFileContents()
+	c.Assert(err, IsNil)
+	c.Log(string(contents))
+
+	c.Assert(strings.Contains(string(contents), strings.Join([]string{
+		"iface eth1 inet static",
+		"address 192.168.168.8",
+		"netmask 255.255.255.0",
+		"gateway 192.168.168.1",
+		"dns-nameservers 8.8.8.8 8.8.4.4",
+		"up /sbin/ip route add 10.20.0.0/16 via 192.168.168.253 dev eth1 metric 0",
+		"down /sbin/ip route del 10.20.0.0/16 via 192.168.168.253 dev eth1 metric 0",
+		"up /sbin/ip route add 10.10.0.0/16 via 192.168.168.254 dev eth1 metric 5",
+		"down /sbin/ip route del 10.10.0.0/16 via 192.168.168.254 dev eth1 metric 5",
+	}, "\n")), Equals, true)
+
+	// Nothing for eth0
+	c.Assert(strings.Contains(string(contents), "iface eth0 inet dhcp\n\n"), Equals, true)
+}
+
+func (ts *RoutesTestSuite) TestRouteEndpointHandlers(c *C) {
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+
+	rec := do(ts.controller.CreateRoute, nil, `{"Destination": "10.10.0.0/16", "Gateway": "10.0.0.1", "Interface": "eth1"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.CreateRoute, nil,
+		`{"Destination": "10.10.0.0/16", "Gateway": "192.168.168.254", "Interface": "eth1", "Metric": 5}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	route := StaticRoute{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &route), IsNil)
+	c.Assert(route.ID, Not(Equals), int64(0))
+
+	params := map[string]string{"id": fmt.Sprint(route.ID)}
+	rec = do(ts.controller.UpdateRoute, params,
+		`{"Destination": "10.20.0.0/16", "Gateway": "192.168.168.254", "Interface": "eth1"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.GetRoutes, nil, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	routes := []StaticRoute{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &routes), IsNil)
+	c.Assert(routes, DeepEquals, []StaticRoute{
+		{ID: route.ID, Destination: "10.20.0.0/16", Gateway: "192.168.168.254", Interface: "eth1"},
+	})
+
+	rec = do(ts.controller.DeleteRoute, params, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.DeleteRoute, params, "")
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+}
@@ -0,0 +1,85 @@
+package host
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+const (
+	// Login shells that may be configured for users
+	ShellCLI     = "cli"     // The rocketship restricted CLI
+	ShellBash    = "bash"    // For support engineers
+	ShellNologin = "nologin" // For API only accounts
+
+	// Login shell assigned to users unless specified otherwise
+	DefaultShell = ShellCLI
+
+	ShellsFilePath = "/etc/shells"
+)
+
+var (
+	// Paths to the binaries for each of the login shells
+	loginShells = map[string]string{
+		ShellCLI:     "/bin/shell",
+		ShellBash:    "/bin/bash",
+		ShellNologin: "/usr/sbin/nologin",
+	}
+
+	// Shells listed in the /etc/shells shipped by the distro, which are kept in the rewritten file
+	distroShells = []string{"/bin/sh", "/bin/dash", "/bin/bash", "/bin/rbash"}
+)
+
+// RewriteShellsFile rewrites /etc/shells, which lists the shells that users may log in with.
+func (c *Controller) RewriteShellsFile() error {
+	c.log.Infoln("Rewriting shells file")
+
+	err := ioutil.WriteFile(ShellsFilePath, shellsFileContents(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func shellsFileContents() []byte {
+	contents := bytes.Buffer{}
+	contents.WriteString("#\n")
+	contents.WriteString("# THIS FILE IS AUTOGENERATED\n")
+	contents.WriteString(fmt.Sprintf("# Generated at  %s by Commander\n", time.Now()))
+	contents.WriteString("#\n")
+
+	// nologin is deliberately absent (it is not a valid shell for logging in)
+	listed := map[string]bool{}
+	for _, path := range distroShells {
+		listed[path] = true
+	}
+	for name, path := range loginShells {
+		if name != ShellNologin {
+			listed[path] = true
+		}
+	}
+
+	paths := []string{}
+	for path := range listed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		contents.WriteString(path)
+		contents.WriteString("\n")
+	}
+	return contents.Bytes()
+}
+
+// validateShell returns an error if the named shell is not one that users may be configured with.
+func validateShell(name string) error {
+	if _, ok := loginShells[name]; !ok {
+		return fmt.Errorf("Invalid shell (%s), must be one of: %s, %s, %s",
+			name, ShellCLI, ShellBash, ShellNologin)
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+package host
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Max number of keys that a user may have
+	MaxSSHKeysPerUser = 32
+)
+
+//
+// Endpoint handlers
+//
+
+func (c *Controller) GetUserKeys(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	if err := c.db.Find(&user, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	keys := []SSHKey{}
+	if err := c.db.Where(SSHKey{UserID: user.ID}).Find(&keys).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resources := []SSHKeyResource{}
+	for _, key := range keys {
+		res := SSHKeyResource{}
+		res.FromSSHKeyModel(key)
+		resources = append(resources, res)
+	}
+
+	bytes, err := json.Marshal(resources)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) CreateUserKey(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	if err := c.db.Find(&user, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := SSHKeyResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	key, err := resource.ToSSHKeyModel()
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	key.UserID = user.ID
+
+	if err = c.db.Create(&key).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.UserKeyAdded, map[string]string{
+		"ID":          fmt.Sprint(user.ID),
+		"Name":        user.Name,
+		"Fingerprint": key.Fingerprint,
+	})
+	c.applyAuthorizedKeys(ctx, user)
+
+	ret := SSHKeyResource{}
+	ret.FromSSHKeyModel(key)
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// UpdateUserKey updates the comment on a key. The key itself cannot be changed (it must be deleted
+// and a new one added instead).
+func (c *Controller) UpdateUserKey(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	user, key, err := c.findUserKey(ctx)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := SSHKeyResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	key.Comment = resource.Comment
+	if err = c.db.Save(&key).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.applyAuthorizedKeys(ctx, user)
+
+	ret := SSHKeyResource{}
+	ret.FromSSHKeyModel(key)
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) DeleteUserKey(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	user, key, err := c.findUserKey(ctx)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err = c.db.Delete(&key).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.UserKeyRemoved, map[string]string{
+		"ID":          fmt.Sprint(user.ID),
+		"Name":        user.Name,
+		"Fingerprint": key.Fingerprint,
+	})
+	c.applyAuthorizedKeys(ctx, user)
+
+	ret := SSHKeyResource{}
+	ret.FromSSHKeyModel(key)
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+//
+// Helpers
+//
+
+// findUserKey returns the user and key identified by the URL params.
+func (c *Controller) findUserKey(ctx web.C) (User, SSHKey, error) {
+	user := User{}
+	if err := c.db.Find(&user, ctx.URLParams["id"]).Error; err != nil {
+		return User{}, SSHKey{}, err
+	}
+
+	key := SSHKey{}
+	err := c.db.Where(SSHKey{UserID: user.ID}).Find(&key, ctx.URLParams["keyid"]).Error
+	if err != nil {
+		return User{}, SSHKey{}, err
+	}
+	return user, key, nil
+}
+
+func (c *Controller) applyAuthorizedKeys(ctx web.C, user User) {
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply authorized keys to system (\"noapply\" present in env)")
+		return
+	}
+	if err := c.writeAuthorizedKeysFile(user); err != nil {
+		c.log.Warningln("failed to apply authorized keys to system:", err)
+	}
+}
+
+// RewriteAuthorizedKeysFiles renders the authorized_keys file for every user. This must run after
+// the homedirs have been created.
+func (c *Controller) RewriteAuthorizedKeysFiles() error {
+	c.log.Infoln("Rewriting authorized keys files")
+
+	users := []User{}
+	if err := c.db.Find(&users).Error; err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := c.writeAuthorizedKeysFile(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAuthorizedKeysFile renders the ~/.ssh/authorized_keys file of the user (removing it if the
+// user has no keys).
+func (c *Controller) writeAuthorizedKeysFile(user User) error {
+	var (
+		sshDir   = fmt.Sprintf("/home/%s/.ssh", user.Name)
+		keysFile = sshDir + "/authorized_keys"
+	)
+
+	contents, err := c.authorizedKeysFileContents(user)
+	if err != nil {
+		return err
+	}
+
+	// The homedir is writable by the user, so don't follow links they may have planted there.
+	if info, err := os.Lstat(sshDir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to write keys for %s, %s is a symlink", user.Name, sshDir)
+	}
+	if err := os.Remove(keysFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) <= 0 {
+		return nil
+	}
+
+	if err := os.Mkdir(sshDir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(keysFile, contents, 0600); err != nil {
+		return err
+	}
+
+	for _, p := range []string{sshDir, keysFile} {
+		if err := os.Lchown(p, user.Uid(), user.Gid()); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(sshDir, 0700)
+}
+
+func (c *Controller) authorizedKeysFileContents(user User) ([]byte, error) {
+	keys := []SSHKey{}
+	if err := c.db.Where(SSHKey{UserID: user.ID}).Order("id").Find(&keys).Error; err != nil {
+		return []byte{}, err
+	}
+
+	contents := bytes.Buffer{}
+	for _, key := range keys {
+		contents.WriteString(key.AuthorizedKeysEntry())
+		contents.WriteString("\n")
+	}
+	return contents.Bytes(), nil
+}
+
+// parseAuthorizedKey parses a single public key in authorized_keys format (as found in the *.pub
+// files generated by ssh-keygen).
+func parseAuthorizedKey(line string) (SSHKey, error) {
+	pubkey, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return SSHKey{}, fmt.Errorf("malformed key: %.20s...", line)
+	}
+	if len(options) > 0 {
+		return SSHKey{}, fmt.Errorf("key options are not supported")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return SSHKey{}, fmt.Errorf("only one key may be specified")
+	}
+
+	return SSHKey{
+		Type:        pubkey.Type(),
+		Key:         base64.StdEncoding.EncodeToString(pubkey.Marshal()),
+		Comment:     comment,
+		Fingerprint: fingerprint(pubkey),
+	}, nil
+}
+
+// fingerprint returns the fingerprint of the key (in the same format as "ssh-keygen -l").
+func fingerprint(pubkey ssh.PublicKey) string {
+	sum := sha256.Sum256(pubkey.Marshal())
+	return "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+}
+
+//
+// DB Models
+//
+
+// SSHKey is a public key that may be used to log in as the user that it belongs to.
+type SSHKey struct {
+	ID          int64
+	UserID      int64
+	Type        string
+	Key         string // base64 encoded (as it appears in authorized_keys)
+	Comment     string
+	Fingerprint string
+	CreatedAt   time.Time
+}
+
+func (k *SSHKey) BeforeSave() error {
+	parsed, err := parseAuthorizedKey(k.Type + " " + k.Key)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(k.Comment, "\r\n") {
+		return fmt.Errorf("Key comment cannot span multiple lines")
+	}
+	k.Fingerprint = parsed.Fingerprint
+	return nil
+}
+
+func (k *SSHKey) BeforeCreate(txn *gorm.DB) error {
+	keys := []SSHKey{}
+	if err := txn.Where(SSHKey{UserID: k.UserID}).Find(&keys).Error; err != nil {
+		return err
+	}
+	if len(keys) >= MaxSSHKeysPerUser {
+		return fmt.Errorf("A user may have at most %d keys", MaxSSHKeysPerUser)
+	}
+	for _, key := range keys {
+		if key.Fingerprint == k.Fingerprint {
+			return fmt.Errorf("Key %s has already been added", k.Fingerprint)
+		}
+	}
+	return nil
+}
+
+func (k SSHKey) AuthorizedKeysEntry() string {
+	return strings.TrimSpace(strings.Join([]string{k.Type, k.Key, k.Comment}, " "))
+}
+
+//
+// Resources
+//
+
+type SSHKeyResource struct {
+	ID          int64
+	Key         string // In authorized_keys format (cannot be changed once added)
+	Comment     string // Defaults to the comment in the key
+	Fingerprint string // READ ONLY
+	CreatedAt   time.Time
+}
+
+func (k SSHKeyResource) ToSSHKeyModel() (SSHKey, error) {
+	key, err := parseAuthorizedKey(k.Key)
+	if err != nil {
+		return SSHKey{}, err
+	}
+	if len(k.Comment) > 0 {
+		key.Comment = k.Comment
+	}
+	return key, nil
+}
+
+func (k *SSHKeyResource) FromSSHKeyModel(m SSHKey) {
+	k.ID = m.ID
+	k.Key = m.AuthorizedKeysEntry()
+	k.Comment = m.Comment
+	k.Fingerprint = m.Fingerprint
+	k.CreatedAt = m.CreatedAt
+}
@@ -0,0 +1,172 @@
+package host
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	testEd25519Key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHudS+B75ct45VG+YtRiwgCB0veDbuZaO+NX8d30fOJz picard@enterprise"
+	testEcdsaKey   = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBLbCaPyej6u7mCgAPNrlwKQVVHKifPogqpsTFZt7tT/vBjLQaKsWfczLTb7CLPtU5ObQgo6o1/XXTpAwCYy2utY= riker@enterprise"
+)
+
+type SSHKeysTestSuite struct {
+	hostTestSuite
+	user User
+}
+
+func (ts *SSHKeysTestSuite) SetUpTest(c *C) {
+	ts.hostTestSuite.SetUpTest(c)
+
+	ts.user = User{Name: "jdoe", Password: "somepass"}
+	c.Assert(ts.db.Create(&ts.user).Error, IsNil)
+}
+
+func (ts *SSHKeysTestSuite) TestParseAuthorizedKey(c *C) {
+	key, err := parseAuthorizedKey(testEd25519Key)
+	c.Assert(err, IsNil)
+	c.Assert(key.Type, Equals, "ssh-ed25519")
+	c.Assert(key.Comment, Equals, "picard@enterprise")
+	// As reported by ssh-keygen -l
+	c.Assert(key.Fingerprint, Equals, "SHA256:yFf9oj7txBB4G+FX3Gd+y9z/EUpVl0nblK1RW3r06TE")
+	c.Assert(key.AuthorizedKeysEntry(), Equals, testEd25519Key)
+
+	key, err = parseAuthorizedKey(testEcdsaKey)
+	c.Assert(err, IsNil)
+	c.Assert(key.Fingerprint, Equals, "SHA256:gMNB0yCK3HVZr9BU6Wf35eF9bDqO42kbXKxTNl9o58w")
+
+	for _, line := range []string{
+		"",
+		"ssh-rsa",
+		"garbage",
+		"pgp-key AAAAB3NzaC1yc2E=",
+		"ssh-rsa !!notbase64!!",
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 truncated",
+		`command="/bin/sh" ` + testEd25519Key,
+		testEd25519Key + "\n" + testEcdsaKey,
+	} {
+		_, err = parseAuthorizedKey(line)
+		c.Assert(err, NotNil, Commentf("line: %s", line))
+	}
+}
+
+func (ts *SSHKeysTestSuite) TestCreateDeleteKeys(c *C) {
+	ctx := web.C{
+		URLParams: map[string]string{"id": fmt.Sprintf("%d", ts.user.ID)},
+		Env:       map[interface{}]interface{}{NoApplyEnvKey: true},
+	}
+
+	createKey := func(jsonStr string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/dont/care", bytes.NewBufferString(jsonStr))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		ts.controller.CreateUserKey(ctx, rec, req)
+		return rec
+	}
+
+	c.Assert(createKey(`{"Key": "garbage"}`).Code, Not(Equals), http.StatusOK)
+
+	rec := createKey(fmt.Sprintf(`{"Key": "%s", "Comment": "bridge"}`, testEd25519Key))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	created := SSHKeyResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &created), IsNil)
+	c.Assert(created.Comment, Equals, "bridge")
+	c.Assert(created.Fingerprint, Equals, "SHA256:yFf9oj7txBB4G+FX3Gd+y9z/EUpVl0nblK1RW3r06TE")
+
+	// The same key cannot be added twice
+	c.Assert(createKey(fmt.Sprintf(`{"Key": "%s"}`, testEd25519Key)).Code, Not(Equals), http.StatusOK)
+	c.Assert(createKey(fmt.Sprintf(`{"Key": "%s"}`, testEcdsaKey)).Code, Equals, http.StatusOK)
+
+	// List
+	req, err := http.NewRequest("GET", "/dont/care", nil)
+	c.Assert(err, IsNil)
+	rec = httptest.NewRecorder()
+	ts.controller.GetUserKeys(ctx, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	keys := []SSHKeyResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &keys), IsNil)
+	c.Assert(keys, HasLen, 2)
+
+	// Update the comment
+	keyCtx := web.C{
+		URLParams: map[string]string{"id": fmt.Sprintf("%d", ts.user.ID), "keyid": fmt.Sprintf("%d", created.ID)},
+		Env:       ctx.Env,
+	}
+	req, err = http.NewRequest("PUT", "/dont/care", bytes.NewBufferString(`{"Comment": "ready room"}`))
+	c.Assert(err, IsNil)
+	rec = httptest.NewRecorder()
+	ts.controller.UpdateUserKey(keyCtx, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	key := SSHKey{}
+	c.Assert(ts.db.First(&key, created.ID).Error, IsNil)
+	c.Assert(key.Comment, Equals, "ready room")
+
+	// Delete
+	req, err = http.NewRequest("DELETE", "/dont/care", nil)
+	c.Assert(err, IsNil)
+	rec = httptest.NewRecorder()
+	ts.controller.DeleteUserKey(keyCtx, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	c.Assert(ts.db.First(&SSHKey{}, created.ID).Error, NotNil)
+}
+
+func (ts *SSHKeysTestSuite) TestKeysOfOtherUsersNotAccessible(c *C) {
+	key, err := parseAuthorizedKey(testEd25519Key)
+	c.Assert(err, IsNil)
+	key.UserID = ts.user.ID
+	c.Assert(ts.db.Create(&key).Error, IsNil)
+
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+
+	ctx := web.C{
+		URLParams: map[string]string{"id": fmt.Sprintf("%d", admin.ID), "keyid": fmt.Sprintf("%d", key.ID)},
+		Env:       map[interface{}]interface{}{NoApplyEnvKey: true},
+	}
+	req, err := http.NewRequest("DELETE", "/dont/care", nil)
+	c.Assert(err, IsNil)
+	rec := httptest.NewRecorder()
+	ts.controller.DeleteUserKey(ctx, rec, req)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	c.Assert(ts.db.First(&SSHKey{}, key.ID).Error, IsNil)
+}
+
+func (ts *SSHKeysTestSuite) TestAuthorizedKeysFileContents(c *C) {
+	contents, err := ts.controller.authorizedKeysFileContents(ts.user)
+	c.Assert(err, IsNil)
+	c.Assert(contents, HasLen, 0)
+
+	for _, line := range []string{testEd25519Key, testEcdsaKey} {
+		key, err := parseAuthorizedKey(line)
+		c.Assert(err, IsNil)
+		key.UserID = ts.user.ID
+		c.Assert(ts.db.Create(&key).Error, IsNil)
+	}
+
+	contents, err = ts.controller.authorizedKeysFileContents(ts.user)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Equals, testEd25519Key+"\n"+testEcdsaKey+"\n")
+}
+
+func (ts *SSHKeysTestSuite) TestKeysDeletedWithUser(c *C) {
+	key, err := parseAuthorizedKey(testEd25519Key)
+	c.Assert(err, IsNil)
+	key.UserID = ts.user.ID
+	c.Assert(ts.db.Create(&key).Error, IsNil)
+
+	c.Assert(ts.db.Delete(&ts.user).Error, IsNil)
+	c.Assert(ts.db.First(&SSHKey{}, key.ID).Error, NotNil)
+}
@@ -2,15 +2,244 @@ package host
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
 	"text/template"
 	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// User that commands in sudo rules run as, unless specified otherwise
+	DefaultSudoRunAs = "root"
 )
 
 var (
 	SudoersFilePath = "/etc/sudoers"
+
+	// Commands in sudo rules are restricted to these chars so that they never need escaping in the
+	// sudoers file (and cannot be used to sneak in additional rules).
+	sudoCommandRegexp = regexp.MustCompile(`^/[A-Za-z0-9/._+@*-]*( [A-Za-z0-9/._+@*-]+)*$`)
+	sudoRunAsRegexp   = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+	// Regexps for the lines that we (might) render in the sudoers file, see sudoers(5).
+	sudoersDefaultsRegexp = regexp.MustCompile(`^Defaults([:@!>]\S+)?\s+\S.*$`)
+	sudoersAliasRegexp    = regexp.MustCompile(`^(User|Runas|Host|Cmnd)_Alias\s+[A-Z][A-Z0-9_]*\s*=\s*\S.*$`)
+	sudoersIncludeRegexp  = regexp.MustCompile(`^#include(dir)?\s+\S+$`)
+	sudoersUserSpecRegexp = regexp.MustCompile(`^(%?[A-Za-z0-9_][A-Za-z0-9_.-]*|ALL)\s+` + // who
+		`(ALL|[A-Za-z0-9_.-]+)\s*=\s*` + // on which hosts
+		`(\(\s*([A-Za-z0-9_%.-]+)?\s*(:\s*[A-Za-z0-9_%.-]+\s*)?\)\s*)?` + // as whom
+		`(((NO)?(PASSWD|SETENV|EXEC)):\s*)*` + // tags
+		`(\S.*)$`) // what
 )
 
+//
+// Endpoint handlers
+//
+
+func (c *Controller) GetSudoRules(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	rules := []SudoRule{}
+	if err := c.db.Find(&rules).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	ret := make([]SudoRuleResource, len(rules))
+	for i := range rules {
+		if err := c.sudoRuleResource(rules[i], &ret[i]); err != nil {
+			c.jsonError(err, w)
+			return
+		}
+	}
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) CreateSudoRule(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := SudoRuleResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	rule, err := c.sudoRuleModel(resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err = c.db.Create(&rule).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.SudoRulesChanged, map[string]string{"ID": fmt.Sprint(rule.ID), "Group": resource.Group})
+	c.writeSudoRuleResponse(ctx, rule, w)
+}
+
+func (c *Controller) UpdateSudoRule(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := SudoRuleResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	existing := SudoRule{}
+	if err = c.db.Find(&existing, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	rule, err := c.sudoRuleModel(resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	rule.ID = existing.ID
+
+	if err = c.db.Save(&rule).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.SudoRulesChanged, map[string]string{"ID": fmt.Sprint(rule.ID), "Group": resource.Group})
+	c.writeSudoRuleResponse(ctx, rule, w)
+}
+
+func (c *Controller) DeleteSudoRule(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	rule := SudoRule{}
+	if err := c.db.Find(&rule, ctx.URLParams["id"]).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := SudoRuleResource{}
+	if err := c.sudoRuleResource(rule, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := c.db.Delete(&rule).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.SudoRulesChanged, map[string]string{"ID": fmt.Sprint(rule.ID), "Group": resource.Group})
+	c.applySudoers(ctx)
+
+	bytes, err := json.Marshal(resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+//
+// Helpers
+//
+
+func (c *Controller) writeSudoRuleResponse(ctx web.C, rule SudoRule, w http.ResponseWriter) {
+	c.applySudoers(ctx)
+
+	ret := SudoRuleResource{}
+	if err := c.sudoRuleResource(rule, &ret); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) applySudoers(ctx web.C) {
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply sudoers to system (\"noapply\" present in env)")
+		return
+	}
+	if err := c.RewriteSudoersFile(); err != nil {
+		c.log.Warningln("failed to apply sudoers to system:", err)
+	}
+}
+
+// sudoRuleModel converts the resource into a model, resolving the group (name) that it refers to.
+func (c *Controller) sudoRuleModel(res SudoRuleResource) (SudoRule, error) {
+	group := Group{}
+	if err := c.db.Where(Group{Name: res.Group}).First(&group).Error; err != nil {
+		return SudoRule{}, fmt.Errorf("No such group: %s", res.Group)
+	}
+
+	return SudoRule{
+		GroupID:  group.ID,
+		RunAs:    res.RunAs,
+		NoPasswd: res.NoPasswd,
+		Commands: strings.Join(res.Commands, "\n"),
+		Comment:  res.Comment,
+	}, nil
+}
+
+func (c *Controller) sudoRuleResource(rule SudoRule, res *SudoRuleResource) error {
+	group := Group{}
+	if err := c.db.Find(&group, rule.GroupID).Error; err != nil {
+		return err
+	}
+
+	res.ID = rule.ID
+	res.Group = group.Name
+	res.RunAs = rule.RunAs
+	res.NoPasswd = rule.NoPasswd
+	res.Commands = rule.CommandList()
+	res.Comment = rule.Comment
+	return nil
+}
+
+// RewriteSudoersFile renders and checks the sudoers file. It is only written if the check passes,
+// since a broken sudoers file locks everyone out of sudo.
 func (c *Controller) RewriteSudoersFile() error {
 	c.log.Infoln("Rewriting sudoers file")
 
@@ -19,21 +248,60 @@ func (c *Controller) RewriteSudoersFile() error {
 		return err
 	}
 
-	err = ioutil.WriteFile(SudoersFilePath, contents, 0440)
-	if err != nil {
+	if err = checkSudoers(contents); err != nil {
+		return err
+	}
+
+	// Write it alongside and move it into place, so that sudo never sees a partial file.
+	tmpPath := SudoersFilePath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, contents, 0440); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, SudoersFilePath); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
 	return nil
 }
 
+// sudoersFileContents renders the sudoers file, granting admin rights to the members of the groups
+// that have the sudo flag set, followed by the sudo rules configured for groups.
 func (c *Controller) sudoersFileContents() ([]byte, error) {
+	groups := []Group{}
+	if err := c.db.Order("name").Find(&groups).Error; err != nil {
+		return []byte{}, err
+	}
+
+	rules := []SudoRule{}
+	if err := c.db.Order("id").Find(&rules).Error; err != nil {
+		return []byte{}, err
+	}
+
+	names := map[int64]string{}
+	sudoGroups := []string{}
+	for _, group := range groups {
+		names[group.ID] = group.Name
+		if group.Sudo {
+			sudoGroups = append(sudoGroups, group.Name)
+		}
+	}
+
+	sudoRules := []string{}
+	for _, rule := range rules {
+		if name, ok := names[rule.GroupID]; ok {
+			sudoRules = append(sudoRules, rule.SudoersEntry(name))
+		}
+	}
+
 	templateData := struct {
-		GenTime string
-		Sudoers []string
+		GenTime    string
+		SudoGroups []string
+		SudoRules  []string
 	}{
 		time.Now().String(),
-		[]string{"admin"},
+		sudoGroups,
+		sudoRules,
 	}
 
 	tmpl, err := template.New("sudoers.conf").Parse(sudoersTemplate)
@@ -48,3 +316,133 @@ func (c *Controller) sudoersFileContents() ([]byte, error) {
 
 	return retbuf.Bytes(), nil
 }
+
+// checkSudoers checks the syntax of the sudoers file (the subset of it that we render) in the same
+// spirit as "visudo -c".
+func checkSudoers(contents []byte) error {
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case len(line) <= 0:
+			continue
+		case strings.HasPrefix(line, "#include"):
+			if !sudoersIncludeRegexp.MatchString(line) {
+				return fmt.Errorf("sudoers line %d: malformed include", i+1)
+			}
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasSuffix(line, "\\"):
+			return fmt.Errorf("sudoers line %d: unexpected line continuation", i+1)
+		case strings.HasPrefix(line, "Defaults"):
+			if !sudoersDefaultsRegexp.MatchString(line) {
+				return fmt.Errorf("sudoers line %d: malformed defaults", i+1)
+			}
+			continue
+		case strings.Contains(line, "_Alias"):
+			if !sudoersAliasRegexp.MatchString(line) {
+				return fmt.Errorf("sudoers line %d: malformed alias", i+1)
+			}
+			continue
+		}
+
+		if err := checkSudoersUserSpec(line); err != nil {
+			return fmt.Errorf("sudoers line %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func checkSudoersUserSpec(line string) error {
+	matches := sudoersUserSpecRegexp.FindStringSubmatch(line)
+	if matches == nil {
+		return fmt.Errorf("malformed user specification")
+	}
+
+	cmnds := matches[len(matches)-1]
+	for _, cmnd := range strings.Split(cmnds, ",") {
+		cmnd = strings.TrimSpace(cmnd)
+		if cmnd == "ALL" {
+			continue
+		}
+		if !strings.HasPrefix(cmnd, "/") {
+			return fmt.Errorf("command must be ALL or a fully qualified path: %s", cmnd)
+		}
+		if strings.ContainsAny(cmnd, ":=()") {
+			return fmt.Errorf("command contains unescaped special chars: %s", cmnd)
+		}
+	}
+	return nil
+}
+
+//
+// DB Models
+//
+
+// SudoRule allows the members of a group to run specific commands (e.g. rocketship shell commands,
+// or restarting specific upstart jobs) via sudo.
+type SudoRule struct {
+	ID       int64
+	GroupID  int64
+	RunAs    string // User that the commands run as
+	NoPasswd bool   // Whether members are prompted for their password
+	Commands string // Newline separated list of commands (with optional args)
+	Comment  string
+}
+
+func (s *SudoRule) BeforeSave(txn *gorm.DB) error {
+	if len(s.RunAs) <= 0 {
+		s.RunAs = DefaultSudoRunAs
+	}
+	if s.RunAs != "ALL" && !sudoRunAsRegexp.MatchString(s.RunAs) {
+		return fmt.Errorf("Invalid user (%s) to run commands as", s.RunAs)
+	}
+
+	commands := s.CommandList()
+	if len(commands) <= 0 {
+		return fmt.Errorf("Sudo rule must specify at least one command")
+	}
+	for _, cmd := range commands {
+		if cmd != "ALL" && !sudoCommandRegexp.MatchString(cmd) {
+			return fmt.Errorf("Invalid command (%s), must be ALL or a fully qualified path "+
+				"(and args) using only letters, digits, spaces and /._+@*-", cmd)
+		}
+	}
+
+	// Belt and braces, the rule must render to valid sudoers syntax
+	return checkSudoersUserSpec(s.SudoersEntry("group"))
+}
+
+// CommandList returns the commands that the rule allows.
+func (s SudoRule) CommandList() []string {
+	commands := []string{}
+	for _, cmd := range strings.Split(s.Commands, "\n") {
+		if cmd = strings.TrimSpace(cmd); len(cmd) > 0 {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+// SudoersEntry returns the sudoers line for the rule, which applies to the named group.
+func (s SudoRule) SudoersEntry(group string) string {
+	tags := ""
+	if s.NoPasswd {
+		tags = "NOPASSWD: "
+	}
+	return fmt.Sprintf("%%%s ALL=(%s) %s%s", group, s.RunAs, tags, strings.Join(s.CommandList(), ", "))
+}
+
+//
+// Resources
+//
+
+type SudoRuleResource struct {
+	ID       int64
+	Group    string   // Name of the group whose members the rule applies to
+	RunAs    string   // Defaults to DefaultSudoRunAs
+	NoPasswd bool     // Set to not prompt for the password
+	Commands []string // e.g. "/opt/shellcommands/interfaces" or "/sbin/restart radio"
+	Comment  string
+}
@@ -20,12 +20,17 @@ Defaults	secure_path="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/b
 # Cmnd alias specification
 
 # User privilege specification
-{{ range .Sudoers }}
-{{ . }} ALL=(ALL:ALL) ALL
-{{ end }}
+root ALL=(ALL:ALL) ALL
 
 # Group privilege specification
-# %groupname ALL=(ALL:ALL) ALL
+{{ range .SudoGroups }}
+%{{ . }} ALL=(ALL:ALL) ALL
+{{ end }}
+
+# Group sudo rules
+{{ range .SudoRules }}
+{{ . }}
+{{ end }}
 
 # See sudoers(5) for more information on "#include" directives:
 
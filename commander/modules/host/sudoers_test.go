@@ -1,16 +1,25 @@
 package host
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
 
 	_ "github.com/mattn/go-sqlite3"
 	. "gopkg.in/check.v1"
 )
 
 type SudoersTestSuite struct {
+	db         gorm.DB
 	controller *Controller
 }
 
@@ -18,11 +27,162 @@ func (ts *SudoersTestSuite) SetUpTest(c *C) {
 	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
 	c.Assert(err, IsNil)
 
-	ts.controller = NewController(&db, distillog.NewNullLogger(""))
+	// Comment this to enable db logs during tests
+	db.SetLogger(log.New(ioutil.Discard, "", 0))
+	ts.db = db
+
+	ts.controller = NewController(&ts.db, distillog.NewNullLogger(""))
+	ts.controller.MigrateDB()
+	ts.controller.SeedDB()
+}
+
+func (ts *SudoersTestSuite) TearDownTest(c *C) {
+	ts.db.Close()
 }
 
 func (ts *SudoersTestSuite) TestSudoersFileContents(c *C) {
 	contents, err := ts.controller.sudoersFileContents()
 	c.Assert(err, IsNil)
-	c.Assert(strings.Contains(string(contents), "admin ALL=(ALL:ALL) ALL"), Equals, true)
+	c.Assert(strings.Contains(string(contents), "%sudo ALL=(ALL:ALL) ALL"), Equals, true)
+
+	// The admin gets its rights by being a member of the sudo group
+	groups, err := ts.controller.groupsFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(string(groups), Matches, "(?ms).*^sudo:x:27:admin$.*")
+}
+
+func (ts *SudoersTestSuite) TestSudoFlagOnGroups(c *C) {
+	group := Group{Name: "operators", Sudo: true}
+	c.Assert(ts.db.Create(&group).Error, IsNil)
+
+	contents, err := ts.controller.sudoersFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "%operators ALL=(ALL:ALL) ALL"), Equals, true)
+
+	group.Sudo = false
+	c.Assert(ts.db.Save(&group).Error, IsNil)
+
+	contents, err = ts.controller.sudoersFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "%operators"), Equals, false)
+}
+
+func (ts *SudoersTestSuite) TestCheckSudoers(c *C) {
+	contents, err := ts.controller.sudoersFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(checkSudoers(contents), IsNil)
+
+	for _, line := range []string{
+		"Defaults	env_reset",
+		"Cmnd_Alias RESTART = /sbin/restart radio, /sbin/restart crashcorder",
+		"#includedir /etc/sudoers.d",
+		"%ops ALL=(root) NOPASSWD: /sbin/restart radio, /opt/shellcommands/interfaces",
+		"jdoe ALL = (ALL) ALL",
+		"%ops ALL=/usr/bin/uptime",
+	} {
+		c.Assert(checkSudoers([]byte(line)), IsNil, Commentf("line: %s", line))
+	}
+
+	for _, line := range []string{
+		"Defaults",
+		"Cmnd_Alias restart = /sbin/restart",
+		"#include",
+		"%ops ALL",
+		"%ops ALL=(root) restart radio",
+		"%ops ALL=(root) NOPASSWD: /sbin/restart radio, ",
+		"%ops ALL=(root /sbin/restart",
+		"%ops ALL=(root) /bin/echo a=b",
+		"%ops ALL=(root) /sbin/restart \\",
+		"some garbage",
+	} {
+		c.Assert(checkSudoers([]byte(line)), NotNil, Commentf("line: %s", line))
+	}
+}
+
+func (ts *SudoersTestSuite) TestSudoRuleValidation(c *C) {
+	ops := Group{Name: "ops"}
+	c.Assert(ts.db.Create(&ops).Error, IsNil)
+
+	for _, rule := range []SudoRule{
+		{GroupID: ops.ID}, // no commands
+		{GroupID: ops.ID, Commands: "restart radio"},                 // not fully qualified
+		{GroupID: ops.ID, Commands: "/sbin/restart radio, ALL"},      // sneaking in another command
+		{GroupID: ops.ID, Commands: "/bin/sh -c id;reboot"},          // special chars
+		{GroupID: ops.ID, Commands: "/bin/echo\nALL=(ALL) ALL"},      // not a command
+		{GroupID: ops.ID, Commands: "/sbin/reboot", RunAs: "a:b"},    // bad runas
+		{GroupID: ops.ID, Commands: "/sbin/reboot", RunAs: "(root)"}, // bad runas
+	} {
+		c.Assert(ts.db.Create(&rule).Error, NotNil, Commentf("rule: %+v", rule))
+	}
+
+	rule := SudoRule{GroupID: ops.ID, Commands: "/sbin/restart radio\n/opt/shellcommands/interfaces"}
+	c.Assert(ts.db.Create(&rule).Error, IsNil)
+	c.Assert(rule.RunAs, Equals, DefaultSudoRunAs)
+}
+
+func (ts *SudoersTestSuite) TestSudoRulesRendered(c *C) {
+	ops := Group{Name: "ops"}
+	c.Assert(ts.db.Create(&ops).Error, IsNil)
+
+	rule := SudoRule{
+		GroupID:  ops.ID,
+		NoPasswd: true,
+		Commands: "/sbin/restart radio\n/opt/shellcommands/interfaces",
+	}
+	c.Assert(ts.db.Create(&rule).Error, IsNil)
+
+	contents, err := ts.controller.sudoersFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(checkSudoers(contents), IsNil)
+	c.Assert(strings.Contains(string(contents),
+		"%ops ALL=(root) NOPASSWD: /sbin/restart radio, /opt/shellcommands/interfaces\n"), Equals, true)
+
+	// Rules go away with the group
+	c.Assert(ts.db.Delete(&ops).Error, IsNil)
+	contents, err = ts.controller.sudoersFileContents()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(contents), "%ops"), Equals, false)
+}
+
+func (ts *SudoersTestSuite) TestSudoRuleEndpointHandlers(c *C) {
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+
+	rec := do(ts.controller.CreateSudoRule, nil, `{"Group": "nosuchgroup", "Commands": ["/sbin/reboot"]}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.CreateSudoRule, nil, `{"Group": "adm", "Commands": ["/sbin/restart radio"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rule := SudoRuleResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &rule), IsNil)
+	c.Assert(rule.Group, Equals, "adm")
+	c.Assert(rule.RunAs, Equals, DefaultSudoRunAs)
+	c.Assert(rule.Commands, DeepEquals, []string{"/sbin/restart radio"})
+
+	params := map[string]string{"id": fmt.Sprintf("%d", rule.ID)}
+	rec = do(ts.controller.UpdateSudoRule, params, `{"Group": "adm", "Commands": ["restart radio"]}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+	rec = do(ts.controller.UpdateSudoRule, params,
+		`{"Group": "adm", "NoPasswd": true, "Commands": ["/sbin/restart radio", "/sbin/restart crashcorder"]}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.GetSudoRules, nil, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	rules := []SudoRuleResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &rules), IsNil)
+	c.Assert(rules, HasLen, 1)
+	c.Assert(rules[0].NoPasswd, Equals, true)
+	c.Assert(rules[0].Commands, HasLen, 2)
+
+	rec = do(ts.controller.DeleteSudoRule, params, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.First(&SudoRule{}, rule.ID).RecordNotFound(), Equals, true)
 }
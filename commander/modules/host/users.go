@@ -3,6 +3,7 @@ package host
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -12,16 +13,25 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"rocketship/commander/modules/events"
+
 	"github.com/amoghe/go-crypt"
 	"github.com/jinzhu/gorm"
 	"github.com/zenazn/goji/web"
 )
 
 const (
-	// Datum from which we start computing uid's for configured users.
+	// Datum from which we start allocating uid's for configured users.
 	UIDDatum = 2000
+	// Upper bound (inclusive) of the uid's and gid's allocated for configured users.
+	MaxUID = 59999
+
+	// Name of the (seeded) default admin user, and its (well known) default password
+	AdminUsername        = "admin"
+	DefaultAdminPassword = "password"
 
 	ValidUsernameChars    = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz123456789-_"
 	MaxUsernameLen        = 12
@@ -212,6 +222,8 @@ func (c *Controller) CreateUser(ctx web.C, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	events.Publish(events.UserCreated, map[string]string{"ID": fmt.Sprint(user.ID), "Name": user.Name})
+
 	applicator := func() error {
 		if err := c.RewriteShadowFile(); err != nil {
 			c.log.Errorf("Failed to regenerate shadow file: %s", err.Error())
@@ -221,6 +233,14 @@ func (c *Controller) CreateUser(ctx web.C, w http.ResponseWriter, r *http.Reques
 			c.log.Errorf("Failed to regenerate passwd file: %s", err.Error())
 			return err
 		}
+		if err := c.RewriteGroupsFile(); err != nil {
+			c.log.Errorf("Failed to regenerate groups file: %s", err.Error())
+			return err
+		}
+		if err := c.RewriteGShadowFile(); err != nil {
+			c.log.Errorf("Failed to regenerate gshadow file: %s", err.Error())
+			return err
+		}
 		return nil
 	}
 
@@ -248,6 +268,167 @@ func (c *Controller) CreateUser(ctx web.C, w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// UpdateUser updates the comment, login flag, expiry and (optionally) shell and password of a user. Users
+// cannot be renamed. Unlike ChangePassword, this does not require the current password. Fields that
+// are omitted from the request retain their values.
+func (c *Controller) UpdateUser(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	userId := ctx.URLParams["id"]
+
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	user := User{}
+	if err = c.db.Find(&user, userId).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// The request is applied over the existing settings
+	resource := UserResource{}
+	resource.FromUserModel(user)
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if len(resource.Name) > 0 && resource.Name != user.Name {
+		c.jsonError(fmt.Errorf("Users cannot be renamed"), w)
+		return
+	}
+
+	user.Comment = resource.Comment
+	user.Login = resource.Login
+	user.MustChangePassword = resource.MustChangePassword
+	user.ExpiresAt = resource.ExpiresAt
+	if len(resource.Shell) > 0 {
+		user.Shell = resource.Shell
+	}
+	if len(resource.Password) > 0 {
+		user.Password = resource.Password
+	}
+
+	if err = c.db.Save(&user).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.UserUpdated, map[string]string{"ID": fmt.Sprint(user.ID), "Name": user.Name})
+
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply user config to system (\"noapply\" present in env)")
+	} else {
+		if err := c.RewriteShadowFile(); err != nil {
+			c.log.Warningln("failed to apply user settings to system:", err)
+		}
+		if err := c.RewritePasswdFile(); err != nil {
+			c.log.Warningln("failed to apply user settings to system:", err)
+		}
+	}
+
+	ret := &UserResource{}
+	ret.FromUserModel(user)
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// ChangePassword sets a new password for the user, provided the current password is supplied. This
+// also clears the flag that forces the user to change their password.
+func (c *Controller) ChangePassword(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	userId := ctx.URLParams["id"]
+
+	bodybytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := PasswordChangeResource{}
+	if err = json.Unmarshal(bodybytes, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	user := User{}
+	if err = c.db.Find(&user, userId).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, noapply := ctx.Env[NoApplyEnvKey]
+	if err = c.authenticate(&user, resource.OldPassword, !noapply); err != nil {
+		if err != ErrBadCredentials && err != ErrAccountLocked {
+			c.jsonError(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+		return
+	}
+
+	switch resource.NewPassword {
+	case "":
+		err = fmt.Errorf("New password must not be empty")
+	case resource.OldPassword:
+		err = fmt.Errorf("New password must differ from the current password")
+	case DefaultAdminPassword:
+		err = fmt.Errorf("New password must not be the default password")
+	default:
+		if err = validatePassword(resource.NewPassword); err == nil {
+			err = loadPasswordPolicy(c.db).Validate(resource.NewPassword)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+		return
+	}
+
+	user.Password = resource.NewPassword
+	user.MustChangePassword = false
+	if err = c.db.Save(&user).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	events.Publish(events.UserPasswordChanged, map[string]string{"ID": fmt.Sprint(user.ID), "Name": user.Name})
+
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply shadow file to system (\"noapply\" present in env)")
+	} else {
+		if err := c.RewriteShadowFile(); err != nil {
+			c.log.Warningln("failed to apply password to system:", err)
+		}
+	}
+
+	ret := &UserResource{}
+	ret.FromUserModel(user)
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
 func (c *Controller) DeleteUser(ctx web.C, w http.ResponseWriter, r *http.Request) {
 	userId := ctx.URLParams["id"]
 
@@ -264,6 +445,8 @@ func (c *Controller) DeleteUser(ctx web.C, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	events.Publish(events.UserDeleted, map[string]string{"ID": fmt.Sprint(user.ID), "Name": user.Name})
+
 	resource := &UserResource{}
 	resource.FromUserModel(user)
 
@@ -332,7 +515,7 @@ func (c *Controller) EnsureHomedirs() error {
 
 		c.log.Debugln("Ensuring homedir for ", user.Name, " at ", dirname)
 		err = os.Mkdir(dirname, 0777)
-		if err != nil {
+		if err != nil && !os.IsExist(err) {
 			failed[user.Name] = true
 			continue
 		}
@@ -345,28 +528,52 @@ func (c *Controller) EnsureHomedirs() error {
 		ioutil.WriteFile(dirname+"/.cache/motd.legal-displayed", []byte{}, 0644)
 		// This err is non-fatal
 
-		c.log.Debugf("Ensuring %s has homedir owned by %d:%d", user.Name, user.Uid(), user.Gid())
-		err = os.Chown(dirname, user.Uid(), user.Gid())
-		if err != nil {
-			failed[user.Name] = true
+		// These may have just been (re)created above
+		os.Lchown(dirname+"/.cache", user.Uid(), user.Gid())
+		os.Lchown(dirname+"/.cache/motd.legal-displayed", user.Uid(), user.Gid())
+
+		// If the homedir is already owned by the user, we assume its contents are too. Otherwise
+		// (e.g. the ids changed due to a restore) re-own everything in it.
+		if isOwnedBy(dirname, user.Uid(), user.Gid()) {
 			continue
 		}
 
 		c.log.Debugln("Ensuring all files in homdir are owned by", user.Name)
 		filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
-			err = os.Chown(dirname, user.Uid(), user.Gid())
 			if err != nil {
 				failed[user.Name] = true
-				return err
+				return nil
+			}
+			if err = os.Lchown(path, user.Uid(), user.Gid()); err != nil {
+				failed[user.Name] = true
 			}
 			return nil
 		})
 	}
 
-	// TODO:  If there were errors creating any of the homedirs, return them
+	if len(failed) > 0 {
+		names := []string{}
+		for name := range failed {
+			names = append(names, name)
+		}
+		return fmt.Errorf("Failed to ensure homedirs for: %s", strings.Join(names, ", "))
+	}
 	return nil
 }
 
+// isOwnedBy returns whether the file at path is owned by the specified uid and gid.
+func isOwnedBy(path string, uid, gid int) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return int(stat.Uid) == uid && int(stat.Gid) == gid
+}
+
 func (c *Controller) passwdFileContents() ([]byte, error) {
 	var (
 		contents = bytes.Buffer{}
@@ -384,6 +591,9 @@ func (c *Controller) passwdFileContents() ([]byte, error) {
 	}
 
 	for _, user := range users {
+		if err := user.checkIds(); err != nil {
+			return []byte{}, err
+		}
 		contents.WriteString(user.PasswdFileEntry())
 		contents.WriteString("\n")
 	}
@@ -407,8 +617,9 @@ func (c *Controller) shadowFileContents() ([]byte, error) {
 		contents.WriteString("\n")
 	}
 
+	policy := loadPasswordPolicy(c.db)
 	for _, user := range users {
-		contents.WriteString(user.ShadowFileEntry())
+		contents.WriteString(user.ShadowFileEntry(policy))
 		contents.WriteString("\n")
 	}
 
@@ -425,9 +636,27 @@ type User struct {
 	Comment        string
 	Homedir        string
 	Login          bool
+	Shell          string // One of Shell[CLI|Bash|Nologin]
 	Password       string `sql:"-"`
 	HashedPassword string
 
+	// Unix uid and gid, allocated when the user is created (and never changed thereafter)
+	UID int
+	GID int
+
+	// Whether the user must change their password before doing anything else
+	MustChangePassword bool
+	// When the password was last changed
+	PasswordChangedAt time.Time
+	// When the account expires (zero value means never)
+	ExpiresAt time.Time
+
+	// Failed login tracking (see authenticate)
+	FailedLogins       int
+	FirstFailedLoginAt time.Time
+	Locked             bool
+	LockedUntil        time.Time // zero value means until unlocked by an admin
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -443,7 +672,19 @@ func (u *User) BeforeSave() error {
 		return []byte(base64.StdEncoding.EncodeToString(buf))[:SaltSize], nil
 	}
 
+	if len(u.Shell) <= 0 {
+		u.Shell = DefaultShell
+	}
+	if err := validateShell(u.Shell); err != nil {
+		return err
+	}
+
+	// An empty password leaves the existing (hashed) password untouched.
 	if len(u.Password) > 0 {
+		if err := validatePassword(u.Password); err != nil {
+			return err
+		}
+
 		salt, err := makeSalt()
 		if err != nil {
 			return err
@@ -453,23 +694,23 @@ func (u *User) BeforeSave() error {
 		if err != nil {
 			return err
 		}
-	} else {
-		u.HashedPassword = ""
+		u.PasswordChangedAt = time.Now()
 	}
 
 	return nil
 }
 
-func (u *User) BeforeCreate() error {
+func (u *User) BeforeCreate(txn *gorm.DB) error {
 	EBadUsernameChar := fmt.Errorf("Username can only contain upper/lower case alphabets " +
 		"and numbers.")
 	EBadUsernameLen := fmt.Errorf("Username must be between %d and %d chars",
 		MinUsernameLen, MaxUsernameLen)
-	EBadPasswordLen := fmt.Errorf("Password must be between %d and %d chars",
-		MinPasswordLen, MaxPasswordLen)
 
-	if len(u.Password) < MinPasswordLen || len(u.Password) > MaxPasswordLen {
-		return EBadPasswordLen
+	if err := validatePassword(u.Password); err != nil {
+		return err
+	}
+	if err := loadPasswordPolicy(txn).Validate(u.Password); err != nil {
+		return err
 	}
 	if len(u.Name) < MinUsernameLen || len(u.Name) > MaxUsernameLen {
 		return EBadUsernameLen
@@ -479,7 +720,34 @@ func (u *User) BeforeCreate() error {
 			return EBadUsernameChar
 		}
 	}
-	return nil
+
+	// The personal group of the user must not clash with an existing group
+	if _, reserved := defaultGroups[u.Name]; reserved {
+		return fmt.Errorf("Username %s is reserved for the system", u.Name)
+	}
+	if !txn.Where(Group{Name: u.Name}).First(&Group{}).RecordNotFound() {
+		return fmt.Errorf("Username %s conflicts with an existing group", u.Name)
+	}
+	return u.allocateIds(txn)
+}
+
+func (u *User) BeforeUpdate(txn *gorm.DB) error {
+	if len(u.Password) <= 0 {
+		return nil
+	}
+
+	policy := loadPasswordPolicy(txn)
+	if err := policy.Validate(u.Password); err != nil {
+		return err
+	}
+	return policy.CheckReuse(txn, u.ID, u.Password)
+}
+
+func (u *User) AfterSave(txn *gorm.DB) error {
+	if len(u.Password) <= 0 {
+		return nil
+	}
+	return txn.Create(&PasswordHistory{UserID: u.ID, HashedPassword: u.HashedPassword}).Error
 }
 
 func (u *User) AfterDelete(txn *gorm.DB) error {
@@ -492,25 +760,190 @@ func (u *User) AfterDelete(txn *gorm.DB) error {
 	if nusers <= 0 {
 		return fmt.Errorf("Cannot delete last remaining user from DB")
 	}
-	return nil
+	if err := txn.Where(SSHKey{UserID: u.ID}).Delete(SSHKey{}).Error; err != nil {
+		return err
+	}
+	if err := txn.Where(GroupMember{UserID: u.ID}).Delete(GroupMember{}).Error; err != nil {
+		return err
+	}
+	return txn.Where(PasswordHistory{UserID: u.ID}).Delete(PasswordHistory{}).Error
 }
 
 //
 // Helpers
 //
 
+// validatePassword checks the bounds on passwords that hold regardless of the password policy.
+func validatePassword(password string) error {
+	if len(password) <= 0 || len(password) > MaxPasswordLen {
+		return fmt.Errorf("Password must be between 1 and %d chars", MaxPasswordLen)
+	}
+	return nil
+}
+
+// verifyHash returns whether the password matches the (crypt) hash.
+func verifyHash(password, hash string) bool {
+	if len(hash) <= 0 {
+		return false
+	}
+
+	// The hash contains the algorithm and salt used to generate it.
+	hashed, err := crypt.Crypt(password, hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashed), []byte(hash)) == 1
+}
+
+// AdminPasswordChangeRequired returns whether the default admin still needs to change the (well
+// known) password it was seeded with.
+func (c *Controller) AdminPasswordChangeRequired() bool {
+	admin := User{}
+	if err := c.db.Where(User{Name: AdminUsername}).First(&admin).Error; err != nil {
+		return false
+	}
+	return admin.MustChangePassword
+}
+
+// VerifyPassword returns whether the specified password matches the (hashed) password of the user.
+func (u User) VerifyPassword(password string) bool {
+	return verifyHash(password, u.HashedPassword)
+}
+
+// allocateIds assigns the uid and gid for a user that is being created. If they have been explicitly
+// specified, they are instead checked for collisions with the default and configured users.
+func (u *User) allocateIds(txn *gorm.DB) error {
+	users := []User{}
+	if err := txn.Find(&users).Error; err != nil {
+		return err
+	}
+
+	usedUids := map[int]bool{}
+	usedGids := map[int]bool{}
+	for _, d := range defaultUsers {
+		usedUids[d.Uid] = true
+	}
+	for _, gid := range defaultGroups {
+		usedGids[gid] = true
+	}
+	for _, other := range users {
+		usedUids[other.UID] = true
+		usedGids[other.GID] = true
+	}
+
+	// The personal group of the user shares the gid space with the configured groups.
+	groups := []Group{}
+	if err := txn.Find(&groups).Error; err != nil {
+		return err
+	}
+	for _, group := range groups {
+		usedGids[group.GID] = true
+	}
+
+	uid, err := pickId("uid", u.UID, UIDDatum, usedUids)
+	if err != nil {
+		return err
+	}
+
+	// Prefer a gid that matches the uid, if it is available.
+	gid := u.GID
+	if gid == 0 && uid >= GIDDatum && !usedGids[uid] {
+		gid = uid
+	}
+	gid, err = pickId("gid", gid, GIDDatum, usedGids)
+	if err != nil {
+		return err
+	}
+
+	u.UID, u.GID = uid, gid
+	return nil
+}
+
+// pickId returns the specified id if it is in the allowed range and unused, or allocates the
+// first unused one (if no id is specified).
+func pickId(kind string, id, datum int, used map[int]bool) (int, error) {
+	if id != 0 {
+		if id < datum || id > MaxUID {
+			return 0, fmt.Errorf("%s %d is outside the allowed range (%d-%d)", kind, id, datum, MaxUID)
+		}
+		if used[id] {
+			return 0, fmt.Errorf("%s %d is already in use", kind, id)
+		}
+		return id, nil
+	}
+	for id = datum; id <= MaxUID; id++ {
+		if !used[id] {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("No free %s available", kind)
+}
+
+// migrateUserIds assigns uid's and gid's to users that were created before they were persisted.
+// These are the ids that were (previously) derived from the row ID, so file ownership is retained.
+func (c *Controller) migrateUserIds() {
+	// Rows predating the columns have NULLs in them (which cannot be loaded into the model), so
+	// this is done in SQL. Note that gorm names the GID column g_id (unlike UID, it isn't one of
+	// its known initialisms).
+	err := c.db.Exec("UPDATE users SET uid = id + ?, g_id = id + ? WHERE uid IS NULL OR uid = 0",
+		UIDDatum, GIDDatum).Error
+	if err != nil {
+		c.log.Errorln("Failed to migrate uid/gid for users:", err)
+	}
+}
+
+// migrateUserShells sets the shell for users created before it was configurable to bash (which is
+// what they have always had).
+func (c *Controller) migrateUserShells() {
+	err := c.db.Exec("UPDATE users SET shell = ? WHERE shell IS NULL OR shell = ''", ShellBash).Error
+	if err != nil {
+		c.log.Errorln("Failed to migrate shell for users:", err)
+	}
+}
+
+// migrateDefaultAdminPassword forces the admin to change its password if it is still the default.
+// An admin seeded before the password had to be changed may well have kept it.
+func (c *Controller) migrateDefaultAdminPassword() {
+	var hash string
+	row := c.db.Raw("SELECT hashed_password FROM users WHERE name = ?", AdminUsername).Row()
+	if err := row.Scan(&hash); err != nil {
+		return // not seeded yet
+	}
+	if !verifyHash(DefaultAdminPassword, hash) {
+		return
+	}
+
+	c.log.Warningln("Password for", AdminUsername, "is the default, it must be changed")
+	err := c.db.Exec("UPDATE users SET must_change_password = ? WHERE name = ?", true, AdminUsername).Error
+	if err != nil {
+		c.log.Errorln("Failed to migrate default password for", AdminUsername, ":", err)
+	}
+}
+
+// checkIds ensures that the user has been allocated (non root) ids, so that a user whose ids are
+// missing (e.g. due to a failed migration) is never rendered as root.
+func (u User) checkIds() error {
+	if u.UID <= 0 || u.GID <= 0 {
+		return fmt.Errorf("User %s has no uid/gid allocated (%d/%d), refusing to render it", u.Name, u.UID, u.GID)
+	}
+	return nil
+}
+
 // Uid returns the Uid for this user.
 func (u User) Uid() int {
-	return int(UIDDatum + u.ID)
+	return u.UID
 }
 
 // Gid returns the Gid for this user.
 func (u User) Gid() int {
-	return int(GIDDatum + u.ID)
+	return u.GID
 }
 
 func (u User) PasswdFileEntry() string {
-	shell := "/bin/bash" // TODO: changeme
+	shell, ok := loginShells[u.Shell]
+	if !ok {
+		shell = loginShells[ShellNologin]
+	}
 	return strings.Join([]string{
 		u.Name,
 		"x",
@@ -522,18 +955,53 @@ func (u User) PasswdFileEntry() string {
 	}, PasswordFileSeparator)
 }
 
-func (u User) ShadowFileEntry() string {
-	lastUpdateDays := (u.UpdatedAt.Unix()) / (60 * 60 * 24) // seconds/(secPerMin * minPerHour * hourPerDay) = days
+// ShadowFileEntry returns the shadow file line for the user, with the password aging fields
+// rendered from the specified policy.
+func (u User) ShadowFileEntry(policy PasswordPolicy) string {
+	toDays := func(t time.Time) int64 {
+		return t.Unix() / (60 * 60 * 24) // seconds/(secPerMin * minPerHour * hourPerDay) = days
+	}
+
+	changedAt := u.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = u.UpdatedAt // users created before we tracked this
+	}
+
+	lastUpdateDays := toDays(changedAt)
+	if u.MustChangePassword {
+		lastUpdateDays = 0 // forces PAM to demand a password change at login
+	}
+
+	maxAge := ShadowNeverExpires
+	if policy.MaxAgeDays > 0 {
+		maxAge = policy.MaxAgeDays
+	}
+
+	inactive := ""
+	if policy.InactiveDays > 0 {
+		inactive = strconv.Itoa(policy.InactiveDays)
+	}
+
+	expire := ""
+	if !u.ExpiresAt.IsZero() {
+		expire = fmt.Sprintf("%d", toDays(u.ExpiresAt))
+	}
+
+	hashedPassword := u.HashedPassword
+	if u.IsLocked(time.Now()) {
+		hashedPassword = "!" + hashedPassword // locked, see passwd(1)
+	}
+
 	return strings.Join([]string{
 		u.Name,
-		u.HashedPassword,
-		fmt.Sprintf("%d", int(lastUpdateDays)),
-		"0",     // TODO: ???
-		"99999", // TODO: ()
-		"7",     // TODO: (warn)
-		"",      // TODO: (inactive)
-		"",      // TODO: (expire)
-		"",      // NYI   (reserved, future)
+		hashedPassword,
+		fmt.Sprintf("%d", lastUpdateDays),
+		strconv.Itoa(policy.MinAgeDays),
+		strconv.Itoa(maxAge),
+		strconv.Itoa(policy.WarnDays),
+		inactive,
+		expire,
+		"", // NYI   (reserved, future)
 	}, ShadowFileSeparator)
 }
 
@@ -581,6 +1049,25 @@ type UserResource struct {
 	Name     string
 	Password string // WRITE ONLY
 	Comment  string
+	Login    bool
+	Shell    string // One of Shell[CLI|Bash|Nologin], defaults to DefaultShell
+
+	UID int // Allocated if unspecified, cannot be changed once created
+	GID int // Allocated if unspecified, cannot be changed once created
+
+	MustChangePassword bool      // Set to force the user to change their password at next login
+	ExpiresAt          time.Time // When the account expires (zero value means never)
+
+	Locked      bool      // READ ONLY
+	LockedUntil time.Time // READ ONLY
+
+	Remote bool     // READ ONLY, set (on login) for users verified by a remote auth server
+	Groups []string // READ ONLY, the (local) groups the user belongs to (reported on login)
+}
+
+type PasswordChangeResource struct {
+	OldPassword string // WRITE ONLY
+	NewPassword string // WRITE ONLY
 }
 
 func (u UserResource) ToUserModel() User {
@@ -588,7 +1075,14 @@ func (u UserResource) ToUserModel() User {
 		ID:       u.ID,
 		Name:     u.Name,
 		Comment:  u.Comment,
+		Login:    u.Login,
+		Shell:    u.Shell,
 		Password: u.Password,
+		UID:      u.UID,
+		GID:      u.GID,
+
+		MustChangePassword: u.MustChangePassword,
+		ExpiresAt:          u.ExpiresAt,
 	}
 }
 
@@ -596,6 +1090,14 @@ func (u *UserResource) FromUserModel(m User) {
 	u.ID = m.ID
 	u.Name = m.Name
 	u.Comment = m.Comment
+	u.Login = m.Login
+	u.Shell = m.Shell
+	u.UID = m.UID
+	u.GID = m.GID
+	u.MustChangePassword = m.MustChangePassword
+	u.ExpiresAt = m.ExpiresAt
+	u.Locked = m.IsLocked(time.Now())
+	u.LockedUntil = m.LockedUntil
 
 	// NEVER return the password
 	// u.Password = m.Password
@@ -607,5 +1109,8 @@ func (u *UserResource) FromUserModel(m User) {
 
 func (c *Controller) seedUsers() {
 	c.log.Infoln("Seeding users")
-	c.db.FirstOrCreate(&User{Name: "admin", Password: "password"})
+	// The default password is well known, so it must be changed before the system is used.
+	c.db.Where(User{Name: AdminUsername}).
+		Attrs(User{Password: DefaultAdminPassword, MustChangePassword: true}).
+		FirstOrCreate(&User{})
 }
@@ -9,6 +9,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
+
+	"rocketship/commander/modules/events"
 
 	_ "github.com/mattn/go-sqlite3"
 	. "gopkg.in/check.v1"
@@ -275,3 +278,299 @@ func (ts *UsersTestSuite) TestShadowFileContents(c *C) {
 		}
 	}
 }
+
+//
+// Forced password change tests
+//
+
+func (ts *UsersTestSuite) TestSeededAdminMustChangePassword(c *C) {
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	c.Assert(admin.MustChangePassword, Equals, true)
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, true)
+
+	// PAM should demand a password change at login
+	tokens := strings.Split(admin.ShadowFileEntry(defaultPasswordPolicy()), ShadowFileSeparator)
+	c.Assert(tokens[2], Equals, "0")
+}
+
+func (ts *UsersTestSuite) TestChangePassword(c *C) {
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	oldHash := admin.HashedPassword
+
+	changePassword := func(oldPass, newPass string) *httptest.ResponseRecorder {
+		jsonStr := fmt.Sprintf(`{"OldPassword": "%s", "NewPassword": "%s"}`, oldPass, newPass)
+		req, err := http.NewRequest("PUT", "/dont/care", bytes.NewBufferString(jsonStr))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		ctx := web.C{
+			URLParams: map[string]string{"id": fmt.Sprintf("%d", admin.ID)},
+			Env:       map[interface{}]interface{}{NoApplyEnvKey: true},
+		}
+		ts.controller.ChangePassword(ctx, rec, req)
+		return rec
+	}
+
+	sub := events.Subscribe(events.UserPasswordChanged)
+	defer events.Unsubscribe(sub)
+	published := func() int {
+		for n := 0; ; n++ {
+			select {
+			case <-sub.Events:
+			default:
+				return n
+			}
+		}
+	}
+
+	// too short
+	c.Assert(changePassword("password", "x").Code, Equals, http.StatusBadRequest)
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, true)
+
+	// wrong current password
+	c.Assert(changePassword("wrongpassword", "n3wpassw0rd").Code, Equals, http.StatusForbidden)
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, true)
+
+	// empty new password
+	c.Assert(changePassword("password", "").Code, Equals, http.StatusBadRequest)
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, true)
+
+	// new password same as the current (default) one
+	c.Assert(changePassword("password", "password").Code, Equals, http.StatusBadRequest)
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, true)
+	c.Assert(published(), Equals, 0)
+
+	rec := changePassword("password", "n3wpassw0rd")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(published(), Equals, 1)
+
+	res := UserResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &res), IsNil)
+	c.Assert(res.MustChangePassword, Equals, false)
+
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	c.Assert(admin.MustChangePassword, Equals, false)
+	c.Assert(admin.HashedPassword, Not(Equals), oldHash)
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, false)
+	newHash := admin.HashedPassword
+
+	// new password same as the current one
+	c.Assert(changePassword("n3wpassw0rd", "n3wpassw0rd").Code, Equals, http.StatusBadRequest)
+
+	// back to the default password
+	c.Assert(changePassword("n3wpassw0rd", DefaultAdminPassword).Code, Equals, http.StatusBadRequest)
+
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	c.Assert(admin.HashedPassword, Equals, newHash)
+}
+
+func (ts *UsersTestSuite) TestVerifyPassword(c *C) {
+	u := User{Name: "jdoe", Password: "somepass"}
+	c.Assert(u.BeforeSave(), IsNil)
+
+	c.Assert(u.VerifyPassword("somepass"), Equals, true)
+	c.Assert(u.VerifyPassword("otherpass"), Equals, false)
+	c.Assert(u.VerifyPassword(""), Equals, false)
+}
+
+func (ts *UsersTestSuite) TestUpdateUser(c *C) {
+	user := User{Name: "jdoe", Password: "somepass", Comment: "before"}
+	c.Assert(ts.db.Create(&user).Error, IsNil)
+
+	updateUser := func(jsonStr string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/dont/care", bytes.NewBufferString(jsonStr))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		ctx := web.C{
+			URLParams: map[string]string{"id": fmt.Sprintf("%d", user.ID)},
+			Env:       map[interface{}]interface{}{NoApplyEnvKey: true},
+		}
+		ts.controller.UpdateUser(ctx, rec, req)
+		return rec
+	}
+
+	// Updating without a password retains the existing one
+	rec := updateUser(`{"Comment": "after", "Login": true}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	updated := User{}
+	c.Assert(ts.db.Find(&updated, user.ID).Error, IsNil)
+	c.Assert(updated.Comment, Equals, "after")
+	c.Assert(updated.Login, Equals, true)
+	c.Assert(updated.HashedPassword, Equals, user.HashedPassword)
+	c.Assert(updated.VerifyPassword("somepass"), Equals, true)
+
+	// Password can be reset
+	rec = updateUser(`{"Password": "newpass123"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.Find(&updated, user.ID).Error, IsNil)
+	c.Assert(updated.VerifyPassword("newpass123"), Equals, true)
+
+	// Omitted fields retain their values
+	expiry := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	updated.MustChangePassword = true
+	updated.ExpiresAt = expiry
+	c.Assert(ts.db.Save(&updated).Error, IsNil)
+
+	rec = updateUser(`{"Shell": "bash"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.Find(&updated, user.ID).Error, IsNil)
+	c.Assert(updated.Shell, Equals, ShellBash)
+	c.Assert(updated.Comment, Equals, "after")
+	c.Assert(updated.Login, Equals, true)
+	c.Assert(updated.MustChangePassword, Equals, true)
+	c.Assert(updated.ExpiresAt.Equal(expiry), Equals, true)
+
+	// Unless explicitly cleared
+	rec = updateUser(`{"Login": false, "MustChangePassword": false, "ExpiresAt": "0001-01-01T00:00:00Z"}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.Find(&updated, user.ID).Error, IsNil)
+	c.Assert(updated.Login, Equals, false)
+	c.Assert(updated.MustChangePassword, Equals, false)
+	c.Assert(updated.ExpiresAt.IsZero(), Equals, true)
+
+	// Cannot rename
+	rec = updateUser(`{"Name": "jsmith"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+}
+
+//
+// uid/gid allocation tests
+//
+
+func (ts *UsersTestSuite) TestUidGidAllocation(c *C) {
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	c.Assert(admin.Uid(), Equals, UIDDatum)
+	c.Assert(admin.Gid(), Equals, GIDDatum)
+
+	u1 := User{Name: "jdoe", Password: "somepass"}
+	c.Assert(ts.db.Create(&u1).Error, IsNil)
+	c.Assert(u1.Uid(), Equals, UIDDatum+1)
+	c.Assert(u1.Gid(), Equals, GIDDatum+1)
+
+	// explicitly specified ids
+	u2 := User{Name: "jsmith", Password: "somepass", UID: 3000, GID: 3500}
+	c.Assert(ts.db.Create(&u2).Error, IsNil)
+	c.Assert(u2.Uid(), Equals, 3000)
+	c.Assert(u2.Gid(), Equals, 3500)
+
+	// collisions and out of range ids
+	for _, u := range []User{
+		{Name: "clash1", Password: "somepass", UID: u1.Uid()},
+		{Name: "clash2", Password: "somepass", GID: u2.Gid()},
+		{Name: "system", Password: "somepass", UID: 105},
+		{Name: "toobig", Password: "somepass", UID: MaxUID + 1},
+	} {
+		c.Assert(ts.db.Create(&u).Error, NotNil)
+	}
+
+	// Deleting and recreating a user does not disturb the ids of others
+	c.Assert(ts.db.Delete(&u1).Error, IsNil)
+	u3 := User{Name: "jdoe", Password: "somepass"}
+	c.Assert(ts.db.Create(&u3).Error, IsNil)
+	c.Assert(u3.Uid(), Equals, UIDDatum+1)
+
+	c.Assert(ts.db.Find(&u2, u2.ID).Error, IsNil)
+	c.Assert(u2.Uid(), Equals, 3000)
+}
+
+func (ts *UsersTestSuite) TestMigrateUserIds(c *C) {
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+
+	// Simulate a row that was created before the ids were persisted
+	c.Assert(ts.db.Exec("UPDATE users SET uid = NULL, g_id = NULL").Error, IsNil)
+
+	ts.controller.migrateUserIds()
+
+	c.Assert(ts.db.Find(&admin, admin.ID).Error, IsNil)
+	c.Assert(admin.Uid(), Equals, int(UIDDatum+admin.ID))
+	c.Assert(admin.Gid(), Equals, int(GIDDatum+admin.ID))
+}
+
+func (ts *UsersTestSuite) TestUsersWithoutIdsAreNotRendered(c *C) {
+	_, err := ts.controller.passwdFileContents()
+	c.Assert(err, IsNil)
+	_, err = ts.controller.groupsFileContents()
+	c.Assert(err, IsNil)
+
+	// Users must never end up as root
+	c.Assert(ts.db.Exec("UPDATE users SET uid = 0, g_id = 0").Error, IsNil)
+	_, err = ts.controller.passwdFileContents()
+	c.Assert(err, NotNil)
+	_, err = ts.controller.groupsFileContents()
+	c.Assert(err, NotNil)
+}
+
+//
+// Login shell tests
+//
+
+func (ts *UsersTestSuite) TestUserShell(c *C) {
+	u1 := User{Name: "jdoe", Password: "somepass"}
+	c.Assert(ts.db.Create(&u1).Error, IsNil)
+	c.Assert(u1.Shell, Equals, DefaultShell)
+	c.Assert(strings.HasSuffix(u1.PasswdFileEntry(), ":/bin/shell"), Equals, true)
+
+	u2 := User{Name: "support", Password: "somepass", Shell: ShellBash}
+	c.Assert(ts.db.Create(&u2).Error, IsNil)
+	c.Assert(strings.HasSuffix(u2.PasswdFileEntry(), ":/bin/bash"), Equals, true)
+
+	u3 := User{Name: "apionly", Password: "somepass", Shell: ShellNologin}
+	c.Assert(ts.db.Create(&u3).Error, IsNil)
+	c.Assert(strings.HasSuffix(u3.PasswdFileEntry(), ":/usr/sbin/nologin"), Equals, true)
+
+	c.Assert(ts.db.Create(&User{Name: "hacker", Password: "somepass", Shell: "/bin/sh"}).Error, NotNil)
+
+	u1.Shell = "zsh"
+	c.Assert(ts.db.Save(&u1).Error, NotNil)
+}
+
+func (ts *UsersTestSuite) TestMigrateUserShells(c *C) {
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	c.Assert(admin.Shell, Equals, ShellCLI)
+
+	// Simulate a row that was created before the shell was configurable
+	c.Assert(ts.db.Exec("UPDATE users SET shell = NULL").Error, IsNil)
+
+	ts.controller.migrateUserShells()
+
+	c.Assert(ts.db.Find(&admin, admin.ID).Error, IsNil)
+	c.Assert(admin.Shell, Equals, ShellBash)
+}
+
+func (ts *UsersTestSuite) TestMigrateDefaultAdminPassword(c *C) {
+	// Simulate an admin that was seeded before it had to change its password
+	c.Assert(ts.db.Exec("UPDATE users SET must_change_password = ?", false).Error, IsNil)
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, false)
+
+	ts.controller.migrateDefaultAdminPassword()
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, true)
+
+	// Not if the password was changed
+	admin := User{}
+	c.Assert(ts.db.Where(User{Name: AdminUsername}).First(&admin).Error, IsNil)
+	admin.Password = "makeitso1701"
+	admin.MustChangePassword = false
+	c.Assert(ts.db.Save(&admin).Error, IsNil)
+
+	ts.controller.migrateDefaultAdminPassword()
+	c.Assert(ts.controller.AdminPasswordChangeRequired(), Equals, false)
+}
+
+func (ts *UsersTestSuite) TestShellsFileContents(c *C) {
+	lines := strings.Split(string(shellsFileContents()), "\n")
+
+	shells := []string{}
+	for _, line := range lines {
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			shells = append(shells, line)
+		}
+	}
+	c.Assert(shells, DeepEquals, []string{"/bin/bash", "/bin/dash", "/bin/rbash", "/bin/sh", "/bin/shell"})
+}
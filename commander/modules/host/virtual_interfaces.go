@@ -0,0 +1,440 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// Types of interfaces
+	TypeEthernet = "ethernet" // physical NIC
+	TypeVLAN     = "vlan"     // 802.1Q sub-interface of a NIC (or bond)
+	TypeBond     = "bond"     // bond over several NICs
+	TypeBridge   = "bridge"   // bridge over zero or more interfaces (e.g. for nested VMs)
+
+	// Supported bonding modes
+	BondModeActiveBackup = "active-backup"
+	BondModeLACP         = "802.3ad"
+
+	// Bounds on 802.1Q VLAN IDs (0 and 4095 are reserved)
+	MinVLANID = 1
+	MaxVLANID = 4094
+
+	// Link monitoring interval (in ms) for bonds
+	bondMIIMonInterval = 100
+)
+
+var (
+	// Interface names are limited to IFNAMSIZ-1 chars
+	interfaceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,14}$`)
+
+	// Interfaces are brought up in this order, so that the interfaces an interface builds on come
+	// up before it does.
+	interfaceTypeRank = map[string]int{TypeEthernet: 0, TypeBond: 1, TypeVLAN: 2, TypeBridge: 3}
+)
+
+//
+// Endpoint handlers
+//
+
+// CreateInterface creates a virtual (VLAN, bond or bridge) interface. Physical interfaces exist
+// by virtue of the NICs in the system, and cannot be created.
+func (c *Controller) CreateInterface(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	reqbody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := InterfaceConfigResource{}
+	if err = json.Unmarshal(reqbody, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	iface := resource.ToInterfaceConfigModel()
+	if interfaceType(iface.Type) == TypeEthernet {
+		c.jsonError(fmt.Errorf("Physical interfaces cannot be created"), w)
+		return
+	}
+	if len(iface.Name) > 0 && !c.db.First(&InterfaceConfig{Name: iface.Name}).RecordNotFound() {
+		c.jsonError(fmt.Errorf("Interface %s already exists", iface.Name), w)
+		return
+	}
+
+	c.log.Infoln("Creating", iface.Type, "interface", iface.Name)
+	if err = c.db.Create(&iface).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if _, there := ctx.Env[NoApplyEnvKey]; there {
+		c.log.Infoln("Skipping apply interface config to system (\"noapply\" present in env)")
+	} else {
+		c.rewriteNetworkFiles(ctx)
+
+		// Members come up (and are enslaved) before the interface itself
+		names := iface.memberNames()
+		if iface.Enabled {
+			names = append(names, iface.Name)
+		}
+		for _, name := range names {
+			if err := (ifaceCtrl{Name: name, Log: c.log}).Up(false); err != nil {
+				c.log.Warningln(err)
+			}
+		}
+	}
+
+	events.Publish(events.InterfaceCreated, map[string]string{"Name": iface.Name, "Type": iface.Type})
+	c.writeInterfaceResponse(iface, w)
+}
+
+// DeleteInterface deletes a virtual interface, provided no other interface (or route) uses it.
+func (c *Controller) DeleteInterface(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	iface := InterfaceConfig{Name: ctx.URLParams["id"]}
+	if err := c.db.First(&iface).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if interfaceType(iface.Type) == TypeEthernet {
+		c.jsonError(fmt.Errorf("Physical interfaces cannot be deleted"), w)
+		return
+	}
+	if err := iface.validateUnused(c.db); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	if err := c.checkPendingChange(iface.Name, 0); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	// It is taken down while its configuration is still around
+	_, noapply := ctx.Env[NoApplyEnvKey]
+	if !noapply {
+		if err := (ifaceCtrl{Name: iface.Name, Log: c.log}).Down(); err != nil {
+			c.log.Warningln(err)
+		}
+	}
+
+	c.log.Infoln("Deleting interface", iface.Name)
+	if err := c.db.Delete(&iface).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.rewriteNetworkFiles(ctx)
+
+	events.Publish(events.InterfaceDeleted, map[string]string{"Name": iface.Name, "Type": iface.Type})
+	c.writeInterfaceResponse(iface, w)
+}
+
+//
+// Helpers
+//
+
+func (c *Controller) writeInterfaceResponse(iface InterfaceConfig, w http.ResponseWriter) {
+	resource := InterfaceConfigResource{}
+	resource.FromInterfaceConfigModel(iface)
+
+	status, err := (ifaceCtrl{Name: iface.Name, Log: c.log}).Status()
+	if err != nil {
+		c.log.Warningln("Failed to get status of", iface.Name, ":", err)
+	}
+	resource.InterfaceStatus = status
+
+	bytes, err := json.Marshal(resource)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	_, err = w.Write(bytes)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// linkOptionLines returns the lines (for the interfaces file) that set up the link of the
+// interface, i.e. that make it a VLAN, bond or bridge (or enslave it to a bond), and set its MTU
+// and MAC address.
+func (c *Controller) linkOptionLines(iface InterfaceConfig) []string {
+	lines := []string{}
+
+	switch iface.Type {
+	case TypeVLAN:
+		lines = append(lines, "vlan-raw-device "+iface.VLANParent)
+	case TypeBond:
+		// The members enslave themselves (see below) as they come up
+		lines = append(lines,
+			"bond-slaves none",
+			"bond-mode "+iface.BondMode,
+			fmt.Sprintf("bond-miimon %d", bondMIIMonInterval))
+		if members := iface.memberNames(); iface.BondMode == BondModeActiveBackup && len(members) > 0 {
+			lines = append(lines, "bond-primary "+members[0])
+		}
+		if iface.BondMode == BondModeLACP {
+			lines = append(lines, "bond-lacp-rate fast")
+		}
+	case TypeBridge:
+		ports := "none"
+		if members := iface.memberNames(); len(members) > 0 {
+			ports = strings.Join(members, " ")
+		}
+		lines = append(lines, "bridge_ports "+ports, "bridge_stp off", "bridge_fd 0")
+	}
+
+	if iface.MTU > 0 {
+		lines = append(lines, fmt.Sprintf("mtu %d", iface.MTU))
+	}
+	if len(iface.MACAddress) > 0 {
+		lines = append(lines, "hwaddress ether "+iface.MACAddress)
+	}
+
+	masters, err := interfaceMasters(c.db, iface.Name)
+	if err != nil {
+		c.log.Warningln("Failed to find the interfaces that", iface.Name, "is a member of:", err)
+	}
+	for _, master := range masters {
+		if master.Type == TypeBond {
+			lines = append(lines, "bond-master "+master.Name)
+		}
+	}
+
+	return lines
+}
+
+// interfaceMasters returns the bonds and bridges that the named interface is a member of.
+func interfaceMasters(txn *gorm.DB, name string) ([]InterfaceConfig, error) {
+	ifaces := []InterfaceConfig{}
+	if err := txn.Find(&ifaces).Error; err != nil {
+		return nil, err
+	}
+
+	masters := []InterfaceConfig{}
+	for _, iface := range ifaces {
+		if iface.Type != TypeBond && iface.Type != TypeBridge {
+			continue
+		}
+		for _, member := range iface.memberNames() {
+			if member == name {
+				masters = append(masters, iface)
+			}
+		}
+	}
+	return masters, nil
+}
+
+// interfaceType returns the type of the interface (interfaces that predate types are NICs).
+func interfaceType(t string) string {
+	if len(t) <= 0 {
+		return TypeEthernet
+	}
+	return t
+}
+
+// byBringUpOrder sorts interfaces in the order in which they should be brought up.
+type byBringUpOrder []InterfaceConfig
+
+func (b byBringUpOrder) Len() int      { return len(b) }
+func (b byBringUpOrder) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byBringUpOrder) Less(i, j int) bool {
+	return interfaceTypeRank[interfaceType(b[i].Type)] < interfaceTypeRank[interfaceType(b[j].Type)]
+}
+
+//
+// Validations (of the InterfaceConfig model)
+//
+
+// memberNames returns the names of the members of the bond or bridge.
+func (i InterfaceConfig) memberNames() []string {
+	names := []string{}
+	for _, name := range strings.Split(i.Members, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validateLink validates the settings that pertain to the type of the interface (and clears
+// those that don't).
+func (i *InterfaceConfig) validateLink(txn *gorm.DB) error {
+	if !interfaceNameRegexp.MatchString(i.Name) {
+		return fmt.Errorf("Invalid interface name (%s)", i.Name)
+	}
+
+	i.Type = interfaceType(i.Type)
+	switch i.Type {
+	case TypeEthernet:
+		i.VLANParent, i.VLANID, i.BondMode, i.Members = "", 0, "", ""
+		return nil
+	case TypeVLAN:
+		i.BondMode, i.Members = "", ""
+		return i.validateVLAN(txn)
+	case TypeBond:
+		i.VLANParent, i.VLANID = "", 0
+		if i.BondMode != BondModeActiveBackup && i.BondMode != BondModeLACP {
+			return fmt.Errorf("Invalid bond mode (%s) for %s", i.BondMode, i.Name)
+		}
+		if len(i.memberNames()) <= 0 {
+			return fmt.Errorf("Bond %s must have at least one member", i.Name)
+		}
+		return i.validateMembers(txn, TypeEthernet)
+	case TypeBridge:
+		i.VLANParent, i.VLANID, i.BondMode = "", 0, ""
+		return i.validateMembers(txn, TypeEthernet, TypeBond, TypeVLAN)
+	default:
+		return fmt.Errorf("Invalid type (%s) for interface %s", i.Type, i.Name)
+	}
+}
+
+func (i *InterfaceConfig) validateVLAN(txn *gorm.DB) error {
+	if i.VLANID < MinVLANID || i.VLANID > MaxVLANID {
+		return fmt.Errorf("Invalid VLAN ID (%d), must be between %d and %d", i.VLANID, MinVLANID, MaxVLANID)
+	}
+
+	// The VLAN tooling (vlan-raw-device) relies on the naming convention
+	if expected := fmt.Sprintf("%s.%d", i.VLANParent, i.VLANID); i.Name != expected {
+		return fmt.Errorf("VLAN interface %s must be named %s", i.Name, expected)
+	}
+
+	parent := InterfaceConfig{Name: i.VLANParent}
+	if len(i.VLANParent) <= 0 || txn.First(&parent).Error != nil {
+		return fmt.Errorf("Unknown parent interface (%s) for VLAN %s", i.VLANParent, i.Name)
+	}
+	if t := interfaceType(parent.Type); t != TypeEthernet && t != TypeBond {
+		return fmt.Errorf("VLAN %s cannot be on %s interface %s", i.Name, t, parent.Name)
+	}
+
+	masters, err := interfaceMasters(txn, parent.Name)
+	if err != nil {
+		return err
+	}
+	for _, master := range masters {
+		if master.Type == TypeBond {
+			return fmt.Errorf("VLAN %s cannot be on %s, it is a member of bond %s", i.Name, parent.Name, master.Name)
+		}
+	}
+	return nil
+}
+
+// validateMembers ensures that the members exist (and are of the allowed types), have no
+// addressing of their own, and are not already members of another bond or bridge.
+func (i *InterfaceConfig) validateMembers(txn *gorm.DB, allowedTypes ...string) error {
+	members := i.memberNames()
+	seen := map[string]bool{}
+
+	for _, name := range members {
+		if seen[name] || name == i.Name {
+			return fmt.Errorf("Invalid member %s for %s", name, i.Name)
+		}
+		seen[name] = true
+
+		member := InterfaceConfig{Name: name}
+		if txn.First(&member).Error != nil {
+			return fmt.Errorf("Unknown member interface (%s) for %s", name, i.Name)
+		}
+
+		allowed := false
+		for _, t := range allowedTypes {
+			allowed = allowed || interfaceType(member.Type) == t
+		}
+		if !allowed {
+			return fmt.Errorf("%s interface %s cannot be a member of %s %s", interfaceType(member.Type), name, i.Type, i.Name)
+		}
+
+		if member.hasAddressing() {
+			return fmt.Errorf("Interface %s has addressing of its own (its modes must be %s)", name, ModeNone)
+		}
+
+		masters, err := interfaceMasters(txn, name)
+		if err != nil {
+			return err
+		}
+		for _, master := range masters {
+			if master.Name != i.Name {
+				return fmt.Errorf("Interface %s is already a member of %s", name, master.Name)
+			}
+		}
+
+		if i.Type == TypeBond {
+			vlans := []InterfaceConfig{}
+			if err = txn.Where(InterfaceConfig{VLANParent: name}).Find(&vlans).Error; err != nil {
+				return err
+			}
+			if len(vlans) > 0 {
+				return fmt.Errorf("Interface %s has VLANs (%s) on it, it cannot be a member of bond %s", name, vlans[0].Name, i.Name)
+			}
+		}
+	}
+
+	i.Members = strings.Join(members, ",") // canonical form
+	return nil
+}
+
+// validateEnslaved ensures that the interface has no addressing of its own if it is a member of
+// a bond or bridge.
+func (i *InterfaceConfig) validateEnslaved(txn *gorm.DB) error {
+	if !i.hasAddressing() {
+		return nil
+	}
+
+	masters, err := interfaceMasters(txn, i.Name)
+	if err != nil {
+		return err
+	}
+	if len(masters) > 0 {
+		return fmt.Errorf("Interface %s is a member of %s, it cannot have addressing of its own", i.Name, masters[0].Name)
+	}
+	return nil
+}
+
+// validateUnused ensures that no other interface (or route) uses the interface.
+func (i InterfaceConfig) validateUnused(txn *gorm.DB) error {
+	if len(i.Name) <= 0 {
+		return nil // the whole table is being deleted
+	}
+
+	masters, err := interfaceMasters(txn, i.Name)
+	if err != nil {
+		return err
+	}
+	if len(masters) > 0 {
+		return fmt.Errorf("Interface %s is a member of %s", i.Name, masters[0].Name)
+	}
+
+	vlans := []InterfaceConfig{}
+	if err = txn.Where(InterfaceConfig{VLANParent: i.Name}).Find(&vlans).Error; err != nil {
+		return err
+	}
+	if len(vlans) > 0 {
+		return fmt.Errorf("Interface %s has VLANs (%s) on it", i.Name, vlans[0].Name)
+	}
+
+	routes := []StaticRoute{}
+	if err = txn.Where(StaticRoute{Interface: i.Name}).Find(&routes).Error; err != nil {
+		return err
+	}
+	if len(routes) > 0 {
+		return fmt.Errorf("Interface %s has routes (to %s) via it", i.Name, routes[0].Destination)
+	}
+
+	return nil
+}
+
+// hasAddressing returns whether IPv4 or IPv6 addressing is configured on the interface.
+func (i InterfaceConfig) hasAddressing() bool {
+	return i.Mode != ModeNone || (len(i.IPv6Mode) > 0 && i.IPv6Mode != ModeNone)
+}
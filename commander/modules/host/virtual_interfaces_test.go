@@ -0,0 +1,198 @@
+package host
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+
+	. "gopkg.in/check.v1"
+)
+
+type VirtualInterfacesTestSuite struct {
+	hostTestSuite
+}
+
+func (ts *VirtualInterfacesTestSuite) SetUpTest(c *C) {
+	ts.hostTestSuite.SetUpTest(c)
+
+	// NICs (besides eth0) without any addressing, so that they can be enslaved
+	for _, name := range []string{"eth1", "eth2", "eth3"} {
+		c.Assert(ts.db.Create(&InterfaceConfig{Name: name, Enabled: true, Mode: ModeNone}).Error, IsNil)
+	}
+}
+
+//
+// tests
+//
+
+func (ts *VirtualInterfacesTestSuite) TestVLANValidation(c *C) {
+	for _, iface := range []InterfaceConfig{
+		{Name: "eth0.100", Type: TypeVLAN, VLANParent: "eth0", Mode: ModeDHCP, DHCPProfileID: 1},                // no id
+		{Name: "eth0.4095", Type: TypeVLAN, VLANParent: "eth0", VLANID: 4095, Mode: ModeDHCP, DHCPProfileID: 1}, // bad id
+		{Name: "vlan100", Type: TypeVLAN, VLANParent: "eth0", VLANID: 100, Mode: ModeDHCP, DHCPProfileID: 1},    // bad name
+		{Name: "eth9.100", Type: TypeVLAN, VLANParent: "eth9", VLANID: 100, Mode: ModeDHCP, DHCPProfileID: 1},   // no parent
+		{Name: "eth0.100", Type: "tunnel", VLANParent: "eth0", VLANID: 100, Mode: ModeDHCP, DHCPProfileID: 1},   // bad type
+		{Name: "a-very-long-name.100", Type: TypeVLAN, VLANParent: "a-very-long-name", VLANID: 100, Mode: ModeNone},
+	} {
+		c.Assert(ts.db.Create(&iface).Error, NotNil, Commentf("iface: %+v", iface))
+	}
+
+	vlan := InterfaceConfig{Name: "eth0.100", Type: TypeVLAN, VLANParent: "eth0", VLANID: 100,
+		Mode: ModeDHCP, DHCPProfileID: 1, BondMode: BondModeLACP}
+	c.Assert(ts.db.Create(&vlan).Error, IsNil)
+	c.Assert(vlan.BondMode, Equals, "")
+
+	// No VLANs on VLANs
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "eth0.100.5", Type: TypeVLAN, VLANParent: "eth0.100",
+		VLANID: 5, Mode: ModeDHCP, DHCPProfileID: 1}).Error, NotNil)
+
+	// The type of an interface is fixed
+	vlan.Type = TypeEthernet
+	c.Assert(ts.db.Save(&vlan).Error, NotNil)
+
+	// NICs with VLANs on them cannot be enslaved to a bond (the VLANs go on the bond instead)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "eth1.200", Type: TypeVLAN, VLANParent: "eth1",
+		VLANID: 200, Mode: ModeDHCP, DHCPProfileID: 1}).Error, IsNil)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "bond0", Type: TypeBond, BondMode: BondModeLACP,
+		Members: "eth1,eth2", Mode: ModeDHCP, DHCPProfileID: 1}).Error, NotNil)
+}
+
+func (ts *VirtualInterfacesTestSuite) TestBondAndBridgeValidation(c *C) {
+	for _, iface := range []InterfaceConfig{
+		{Name: "bond0", Type: TypeBond, Members: "eth1,eth2", Mode: ModeDHCP, DHCPProfileID: 1},                     // no mode
+		{Name: "bond0", Type: TypeBond, BondMode: "round-robin", Members: "eth1", Mode: ModeDHCP, DHCPProfileID: 1}, // bad mode
+		{Name: "bond0", Type: TypeBond, BondMode: BondModeLACP, Mode: ModeDHCP, DHCPProfileID: 1},                   // no members
+		{Name: "bond0", Type: TypeBond, BondMode: BondModeLACP, Members: "eth1,eth9", Mode: ModeNone},               // no such member
+		{Name: "bond0", Type: TypeBond, BondMode: BondModeLACP, Members: "eth1,eth1", Mode: ModeNone},               // member twice
+		{Name: "bond0", Type: TypeBond, BondMode: BondModeLACP, Members: "eth0,eth1", Mode: ModeNone},               // eth0 has an address
+		{Name: "br0", Type: TypeBridge, Members: "br0", Mode: ModeNone},                                             // itself
+	} {
+		c.Assert(ts.db.Create(&iface).Error, NotNil, Commentf("iface: %+v", iface))
+	}
+
+	bond := InterfaceConfig{Name: "bond0", Type: TypeBond, BondMode: BondModeActiveBackup,
+		Members: " eth1, eth2 ", Mode: ModeDHCP, DHCPProfileID: 1}
+	c.Assert(ts.db.Create(&bond).Error, IsNil)
+	c.Assert(bond.Members, Equals, "eth1,eth2")
+
+	// A NIC can't be used twice
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "bond1", Type: TypeBond, BondMode: BondModeLACP,
+		Members: "eth2,eth3", Mode: ModeNone}).Error, NotNil)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "br0", Type: TypeBridge,
+		Members: "eth1", Mode: ModeNone}).Error, NotNil)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "eth1.200", Type: TypeVLAN, VLANParent: "eth1",
+		VLANID: 200, Mode: ModeNone}).Error, NotNil)
+
+	// ... nor can members get addresses of their own
+	eth1 := InterfaceConfig{Name: "eth1"}
+	c.Assert(ts.db.First(&eth1).Error, IsNil)
+	eth1.Mode, eth1.DHCPProfileID = ModeDHCP, 1
+	c.Assert(ts.db.Save(&eth1).Error, NotNil)
+
+	// Bridges go over bonds and VLANs (on bonds), and may have no members at all
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "bond0.10", Type: TypeVLAN, VLANParent: "bond0",
+		VLANID: 10, Mode: ModeNone}).Error, IsNil)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "br0", Type: TypeBridge,
+		Members: "eth3,bond0.10", Mode: ModeNone, IPv6Mode: ModeSLAAC, DHCPProfileID: 1}).Error, IsNil)
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "br1", Type: TypeBridge, Mode: ModeNone,
+		IPv6Mode: ModeSLAAC, DHCPProfileID: 1}).Error, IsNil)
+
+	// Interfaces in use cannot be deleted
+	c.Assert(ts.db.Delete(&InterfaceConfig{Name: "bond0.10"}).Error, NotNil)
+	c.Assert(ts.db.Delete(&InterfaceConfig{Name: "br0"}).Error, IsNil)
+	c.Assert(ts.db.Delete(&InterfaceConfig{Name: "bond0"}).Error, NotNil)
+	c.Assert(ts.db.Delete(&InterfaceConfig{Name: "bond0.10"}).Error, IsNil)
+	c.Assert(ts.db.Delete(&InterfaceConfig{Name: "bond0"}).Error, IsNil)
+
+	// eth1 is free again
+	c.Assert(ts.db.Save(&eth1).Error, IsNil)
+}
+
+func (ts *VirtualInterfacesTestSuite) TestVirtualInterfacesFileGeneration(c *C) {
+	// Created in an order that differs from the one in which they are brought up
+	for _, iface := range []InterfaceConfig{
+		{Name: "bond0", Enabled: true, Type: TypeBond, BondMode: BondModeActiveBackup, Members: "eth1,eth2", Mode: ModeNone},
+		{Name: "bond0.10", Enabled: true, Type: TypeVLAN, VLANParent: "bond0", VLANID: 10, Mode: ModeStatic,
+			Address: "192.168.10.8", Netmask: "255.255.255.0", Gateway: "192.168.10.1"},
+		{Name: "br0", Enabled: true, Type: TypeBridge, Members: "eth3", Mode: ModeDHCP, DHCPProfileID: 1},
+	} {
+		c.Assert(ts.db.Create(&iface).Error, IsNil, Commentf("iface: %+v", iface))
+	}
+	c.Assert(ts.db.Create(&InterfaceConfig{Name: "eth4", Enabled: true, Mode: ModeDHCP, DHCPProfileID: 1}).Error, IsNil)
+
+	filecontents, err := ts.controller.interfacesConfigFileContents()
+	c.Assert(err, IsNil)
+	c.Log(string(filecontents))
+
+	sections := []string{
+		"auto eth0\niface eth0 inet dhcp\n\n",
+		"auto eth1\niface eth1 inet manual\nbond-master bond0\n\n",
+		"auto eth2\niface eth2 inet manual\nbond-master bond0\n\n",
+		"auto eth3\niface eth3 inet manual\n\n",
+		"auto eth4\niface eth4 inet dhcp\n\n",
+		"auto bond0\niface bond0 inet manual\nbond-slaves none\nbond-mode active-backup\nbond-miimon 100\n" +
+			"bond-primary eth1\n\n",
+		"auto bond0.10\niface bond0.10 inet static\nvlan-raw-device bond0\naddress 192.168.10.8\n" +
+			"netmask 255.255.255.0\ngateway 192.168.10.1\n",
+		"auto br0\niface br0 inet dhcp\nbridge_ports eth3\nbridge_stp off\nbridge_fd 0\n\n",
+	}
+
+	// in that order
+	offset := 0
+	for _, section := range sections {
+		i := strings.Index(string(filecontents[offset:]), section)
+		c.Assert(i >= 0, Equals, true, Commentf("section: %s", section))
+		offset += i + len(section)
+	}
+}
+
+func (ts *VirtualInterfacesTestSuite) TestVirtualInterfaceEndpointHandlers(c *C) {
+	env := map[interface{}]interface{}{NoApplyEnvKey: true}
+	do := func(handler web.HandlerFunc, params map[string]string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DONTCARE", "/dont/care", bytes.NewBufferString(body))
+		c.Assert(err, IsNil)
+
+		rec := httptest.NewRecorder()
+		handler(web.C{URLParams: params, Env: env}, rec, req)
+		return rec
+	}
+
+	// NICs can't be created (or deleted)
+	rec := do(ts.controller.CreateInterface, nil, `{"Name": "eth5", "Mode": "dhcp", "DHCPProfileID": 1}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+	rec = do(ts.controller.DeleteInterface, map[string]string{"id": "eth1"}, "")
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	rec = do(ts.controller.CreateInterface, nil,
+		`{"Name": "bond0", "Type": "bond", "BondMode": "802.3ad", "Members": ["eth1", "eth2"], "Mode": "dhcp", "DHCPProfileID": 1}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	bond := InterfaceConfigResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &bond), IsNil)
+	c.Assert(bond.Members, DeepEquals, []string{"eth1", "eth2"})
+
+	// Already exists
+	rec = do(ts.controller.CreateInterface, nil,
+		`{"Name": "bond0", "Type": "bond", "BondMode": "802.3ad", "Members": ["eth3"], "Mode": "none"}`)
+	c.Assert(rec.Code, Not(Equals), http.StatusOK)
+
+	// Members can be changed
+	params := map[string]string{"id": "bond0"}
+	rec = do(ts.controller.EditInterface, params,
+		`{"Type": "bond", "BondMode": "802.3ad", "Members": ["eth1", "eth2", "eth3"], "Mode": "dhcp", "DHCPProfileID": 1}`)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	rec = do(ts.controller.GetInterface, params, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &bond), IsNil)
+	c.Assert(bond.Members, DeepEquals, []string{"eth1", "eth2", "eth3"})
+	c.Assert(bond.Type, Equals, TypeBond)
+
+	rec = do(ts.controller.DeleteInterface, params, "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.db.First(&InterfaceConfig{Name: "bond0"}).RecordNotFound(), Equals, true)
+}
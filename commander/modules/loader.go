@@ -3,14 +3,18 @@ package modules
 import (
 	"net/http"
 
+	"rocketship/commander/modules/auth"
 	"rocketship/commander/modules/bootbank"
 	"rocketship/commander/modules/crashcorder"
+	"rocketship/commander/modules/events"
 	"rocketship/commander/modules/host"
 	"rocketship/commander/modules/powerstate"
+	"rocketship/commander/modules/provision"
 	"rocketship/commander/modules/radio"
 	"rocketship/commander/modules/ssh"
 	"rocketship/commander/modules/stats"
 	"rocketship/commander/modules/syslog"
+	"rocketship/commander/modules/webhooks"
 
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
@@ -23,17 +27,40 @@ type Controller interface {
 	RewriteFiles() error // RewriteFiles causes the controller to rewrite config files it is responsible for.
 	MigrateDB()          // MigrateDB tells the controller to make its required changes to the DB.
 	SeedDB()             // SeedDB tells the controller to seed the db with any state that is essential to it.
+	DropDB()             // DropDB tells the controller to drop the tables it owns (used for factory reset).
+	WipeFiles() error    // WipeFiles tells the controller to delete any user data files it is responsible for.
+}
+
+// Provisioner is implemented by controllers that consume (parts of) the first boot provisioning seed.
+type Provisioner interface {
+	ValidateSeed(seed provision.Seed) error // ValidateSeed ensures the seed can be applied (without applying it).
+	Provision(seed provision.Seed) error    // Provision applies the seed.
+}
+
+// Starter is implemented by controllers that do work in the background (e.g. monitoring the
+// system), which is started once commander is up and serving.
+type Starter interface {
+	Start()
+}
+
+// Stopper is implemented by controllers that run in the background (e.g. dispatching events), and
+// so must be stopped before they are discarded.
+type Stopper interface {
+	Stop()
 }
 
 func LoadAll(db *gorm.DB, log distillog.Logger) []Controller {
 	return []Controller{
 		crashcorder.NewController(db, log),
 		host.NewController(db, log),
+		auth.NewController(db, log), // after host (group mappings refer to host groups)
 		radio.NewController(db, log),
 		ssh.NewController(db, log),
 		syslog.NewController(db, log),
 		bootbank.NewController(db, log),
 		stats.NewController(db, log),
 		powerstate.NewController(db, log),
+		events.NewController(db, log),
+		webhooks.NewController(db, log),
 	}
 }
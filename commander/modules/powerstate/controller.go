@@ -1,10 +1,18 @@
 package powerstate
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os/exec"
+	"strconv"
 	"sync"
+	"time"
+
+	"rocketship/commander/modules/events"
 
 	"github.com/amoghe/distillog"
 	"github.com/jinzhu/gorm"
@@ -12,15 +20,35 @@ import (
 )
 
 const (
+	// Indicates that we should'nt apply changes to the system (no reboot)
+	NoApplyEnvKey = "noapply"
+
 	URLPrefix = "/powerstate"
 	EReboot   = URLPrefix + "/reboot"
 	EShutdown = URLPrefix + "/shutdown"
+
+	// EFactoryReset is the endpoint at which a factory reset is requested, EFactoryResetToken
+	// is where the confirmation token that must accompany the request is obtained.
+	EFactoryReset      = URLPrefix + "/factory-reset"
+	EFactoryResetToken = EFactoryReset + "/token"
+
+	// How long a factory reset confirmation token remains valid
+	FactoryResetTokenTTL = 5 * time.Minute
 )
 
+// FactoryResetter is implemented by whoever is able to reset all the modules to factory state.
+type FactoryResetter interface {
+	FactoryReset(preserveNetwork bool) error
+}
+
 type Controller struct {
 	mux  *web.Mux
 	log  distillog.Logger
 	lock sync.Mutex
+
+	resetter    FactoryResetter
+	resetToken  string
+	resetExpiry time.Time
 }
 
 func NewController(db *gorm.DB, logger distillog.Logger) *Controller {
@@ -28,6 +56,8 @@ func NewController(db *gorm.DB, logger distillog.Logger) *Controller {
 
 	ctrl.mux.Put(EReboot, ctrl.DoReboot)
 	ctrl.mux.Put(EShutdown, ctrl.DoShutdown)
+	ctrl.mux.Post(EFactoryResetToken, ctrl.CreateFactoryResetToken)
+	ctrl.mux.Put(EFactoryReset, ctrl.DoFactoryReset)
 
 	return ctrl
 }
@@ -45,16 +75,25 @@ func (c *Controller) RoutePrefix() string {
 	return URLPrefix
 }
 
+// SetFactoryResetter sets the resetter that is invoked when a factory reset is requested.
+func (c *Controller) SetFactoryResetter(r FactoryResetter) {
+	c.resetter = r
+}
+
 // These satisfy the controller interface.
 func (c *Controller) SeedDB()             {}
 func (c *Controller) MigrateDB()          {}
+func (c *Controller) DropDB()             {}
 func (c *Controller) RewriteFiles() error { return nil }
+func (c *Controller) WipeFiles() error    { return nil }
 
 //
 // Handlers
 //
 
 func (c *Controller) DoReboot(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	events.Publish(events.RebootRequested, nil)
+
 	cmd := exec.Command("shutdown", "-r", "now", "user initiated reboot")
 	if err := cmd.Start(); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -65,6 +104,8 @@ func (c *Controller) DoReboot(ctx web.C, w http.ResponseWriter, r *http.Request)
 }
 
 func (c *Controller) DoShutdown(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	events.Publish(events.ShutdownRequested, nil)
+
 	cmd := exec.Command("shutdown", "-h", "now", "user initiated shutdown (halt)")
 	if err := cmd.Start(); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -73,3 +114,96 @@ func (c *Controller) DoShutdown(ctx web.C, w http.ResponseWriter, r *http.Reques
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// CreateFactoryResetToken issues a (short lived) token that must be presented to confirm a
+// factory reset. Issuing a new token invalidates any previously issued one.
+func (c *Controller) CreateFactoryResetToken(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.resetToken = hex.EncodeToString(buf)
+	c.resetExpiry = time.Now().Add(FactoryResetTokenTTL)
+
+	bytes, err := json.Marshal(FactoryResetTokenResource{
+		Token:     c.resetToken,
+		ExpiresAt: c.resetExpiry,
+	})
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// DoFactoryReset resets all modules to their factory state (optionally preserving the network
+// settings) and then reboots the system.
+func (c *Controller) DoFactoryReset(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	req := FactoryResetResource{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	valid := subtle.ConstantTimeCompare([]byte(req.Token), []byte(c.resetToken)) == 1
+	if len(c.resetToken) <= 0 || !valid || time.Now().After(c.resetExpiry) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid or expired confirmation token"))
+		return
+	}
+
+	// Tokens are single use
+	c.resetToken = ""
+
+	if c.resetter == nil {
+		c.jsonError(fmt.Errorf("factory reset is not available"), w)
+		return
+	}
+
+	c.log.Warningf("Factory reset requested (preserve network: %t)", req.PreserveNetwork)
+	events.Publish(events.FactoryResetRequested, map[string]string{
+		"PreserveNetwork": strconv.FormatBool(req.PreserveNetwork),
+	})
+
+	if err := c.resetter.FactoryReset(req.PreserveNetwork); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if _, there := ctx.Env[NoApplyEnvKey]; !there {
+		cmd := exec.Command("shutdown", "-r", "now", "factory reset")
+		if err := cmd.Start(); err != nil {
+			c.jsonError(err, w)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+//
+// Resources
+//
+
+type FactoryResetTokenResource struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+type FactoryResetResource struct {
+	Token           string
+	PreserveNetwork bool
+}
+
+//
+// Helpers
+//
+
+func (c *Controller) jsonError(err error, w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+}
@@ -0,0 +1,146 @@
+package powerstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/amoghe/distillog"
+	"github.com/zenazn/goji/web"
+
+	. "gopkg.in/check.v1"
+)
+
+var (
+	noApplyEnv = map[interface{}]interface{}{NoApplyEnvKey: nil}
+)
+
+//
+// Test Suite
+//
+
+type PowerstateTestSuite struct {
+	controller *Controller
+	resetter   *fakeResetter
+}
+
+// Register the test suite with gocheck.
+func init() {
+	Suite(&PowerstateTestSuite{})
+}
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (ts *PowerstateTestSuite) SetUpTest(c *C) {
+	ts.resetter = &fakeResetter{}
+	ts.controller = NewController(nil, distillog.NewNullLogger(""))
+	ts.controller.SetFactoryResetter(ts.resetter)
+}
+
+//
+// Tests
+//
+
+func (ts *PowerstateTestSuite) TestFactoryResetRequiresToken(c *C) {
+	rec := httptest.NewRecorder()
+	req := newJsonRequest(FactoryResetResource{Token: "bogus"}, c)
+	ts.controller.DoFactoryReset(web.C{Env: noApplyEnv}, rec, req)
+
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(ts.resetter.calls, Equals, 0)
+}
+
+func (ts *PowerstateTestSuite) TestFactoryReset(c *C) {
+	sub := events.Subscribe(events.FactoryResetRequested)
+	defer events.Unsubscribe(sub)
+
+	token := ts.getToken(c)
+
+	rec := httptest.NewRecorder()
+	req := newJsonRequest(FactoryResetResource{Token: token, PreserveNetwork: true}, c)
+	ts.controller.DoFactoryReset(web.C{Env: noApplyEnv}, rec, req)
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(ts.resetter.calls, Equals, 1)
+	c.Assert(ts.resetter.preserveNetwork, Equals, true)
+	c.Assert(sub.Events, HasLen, 1)
+	c.Assert((<-sub.Events).Data, DeepEquals, map[string]string{"PreserveNetwork": "true"})
+
+	// Tokens cannot be reused
+	rec = httptest.NewRecorder()
+	req = newJsonRequest(FactoryResetResource{Token: token}, c)
+	ts.controller.DoFactoryReset(web.C{Env: noApplyEnv}, rec, req)
+
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(ts.resetter.calls, Equals, 1)
+}
+
+func (ts *PowerstateTestSuite) TestFactoryResetExpiredToken(c *C) {
+	token := ts.getToken(c)
+	ts.controller.resetExpiry = time.Now().Add(-time.Second)
+
+	rec := httptest.NewRecorder()
+	req := newJsonRequest(FactoryResetResource{Token: token}, c)
+	ts.controller.DoFactoryReset(web.C{Env: noApplyEnv}, rec, req)
+
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(ts.resetter.calls, Equals, 0)
+}
+
+func (ts *PowerstateTestSuite) TestFactoryResetFailure(c *C) {
+	ts.resetter.err = fmt.Errorf("disk on fire")
+	token := ts.getToken(c)
+
+	rec := httptest.NewRecorder()
+	req := newJsonRequest(FactoryResetResource{Token: token}, c)
+	ts.controller.DoFactoryReset(web.C{Env: noApplyEnv}, rec, req)
+
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+	c.Assert(ts.resetter.calls, Equals, 1)
+}
+
+//
+// Helpers
+//
+
+type fakeResetter struct {
+	calls           int
+	preserveNetwork bool
+	err             error
+}
+
+func (f *fakeResetter) FactoryReset(preserveNetwork bool) error {
+	f.calls++
+	f.preserveNetwork = preserveNetwork
+	return f.err
+}
+
+func (ts *PowerstateTestSuite) getToken(c *C) string {
+	rec := httptest.NewRecorder()
+	ts.controller.CreateFactoryResetToken(web.C{}, rec, &http.Request{})
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	res := FactoryResetTokenResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &res), IsNil)
+	c.Assert(res.Token, Not(Equals), "")
+	return res.Token
+}
+
+func newJsonRequest(s interface{}, c *C) *http.Request {
+	jsonBytes, err := json.Marshal(s)
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("PUT", "", bytes.NewBuffer(jsonBytes))
+	c.Assert(err, IsNil)
+
+	return req
+}
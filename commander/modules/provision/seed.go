@@ -0,0 +1,194 @@
+package provision
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/amoghe/distillog"
+)
+
+const (
+	// Kernel cmdline param whose value is the (base64 encoded) seed, e.g. rocketship.seed=eyJI...
+	// The cmdline is readable by all users (and persists across boots), so seeds passed this way
+	// cannot carry secrets (see checkNoSecrets).
+	KernelCmdlineParam = "rocketship.seed"
+	// File from which the kernel cmdline is read
+	KernelCmdlineFile = "/proc/cmdline"
+
+	// Name of the seed file on a config drive (or seed partition)
+	SeedFileName = "rocketship-seed.json"
+
+	// Marker file indicating that the system has been provisioned (and the seed should not be
+	// applied on subsequent boots)
+	ProvisionedMarkerFilePath = "/etc/.commander_provisioned"
+)
+
+var (
+	// Labels of partitions (or attached config drives) that are searched for a seed file.
+	SeedPartitionLabels = []string{"RSSEED", "cidata", "config-2"}
+	// Filesystems we try when mounting a seed partition.
+	SeedPartitionFsTypes = []string{"iso9660", "vfat", "ext4"}
+)
+
+// Seed describes the configuration that is applied to the system when it boots for the first time.
+// All fields are optional, unset fields retain their seeded (factory) values.
+type Seed struct {
+	Hostname string
+	Domain   string
+
+	Interfaces []InterfaceSeed
+	Resolvers  []string
+
+	AdminPassword     string
+	SSHAuthorizedKeys []string
+
+	SMTP *SMTPSeed
+}
+
+type InterfaceSeed struct {
+	Name    string
+	Mode    string // "static", "dhcp" or "none"
+	Address string
+	Netmask string
+	Gateway string
+
+	IPv6Mode      string // "static", "dhcp", "auto" or "none" (default)
+	IPv6Address   string
+	IPv6PrefixLen int
+	IPv6Gateway   string
+}
+
+type SMTPSeed struct {
+	From          string
+	ServerAddress string
+	ServerPort    uint16
+	AuthHost      string
+	AuthUsername  string
+	AuthPassword  string
+}
+
+// Parse parses the (json) contents of a seed file.
+func Parse(contents []byte) (Seed, error) {
+	seed := Seed{}
+	if err := json.Unmarshal(contents, &seed); err != nil {
+		return seed, fmt.Errorf("invalid seed: %s", err)
+	}
+	return seed, nil
+}
+
+// Find looks for a provisioning seed, first on the kernel cmdline and then on any labelled
+// partitions (config drives). It returns nil (and no error) if no seed is found.
+func Find(log distillog.Logger) (*Seed, error) {
+	if seed, err := findInCmdline(KernelCmdlineFile); seed != nil || err != nil {
+		return seed, err
+	}
+
+	for _, label := range SeedPartitionLabels {
+		partitionPath := "/dev/disk/by-label/" + label
+		if _, err := os.Stat(partitionPath); err != nil {
+			continue
+		}
+
+		log.Infoln("Looking for seed on partition", partitionPath)
+		contents, err := readFromPartition(partitionPath, SeedFileName, log)
+		if err != nil {
+			log.Warningf("Unable to read seed from %s: %s", partitionPath, err)
+			continue
+		}
+
+		seed, err := Parse(contents)
+		if err != nil {
+			return nil, err
+		}
+		return &seed, nil
+	}
+
+	return nil, nil
+}
+
+// IsProvisioned returns whether a seed has previously been applied to this system.
+func IsProvisioned() bool {
+	_, err := os.Stat(ProvisionedMarkerFilePath)
+	return err == nil
+}
+
+// MarkProvisioned records that a seed has been applied to this system.
+func MarkProvisioned() error {
+	return ioutil.WriteFile(ProvisionedMarkerFilePath, []byte{}, 0644)
+}
+
+//
+// Helpers
+//
+
+func findInCmdline(cmdlineFile string) (*Seed, error) {
+	b, err := ioutil.ReadFile(cmdlineFile)
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, token := range strings.Fields(string(b)) {
+		if !strings.HasPrefix(token, KernelCmdlineParam+"=") {
+			continue
+		}
+
+		contents, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, KernelCmdlineParam+"="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed on kernel cmdline: %s", err)
+		}
+
+		seed, err := Parse(contents)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkNoSecrets(seed); err != nil {
+			return nil, err
+		}
+		return &seed, nil
+	}
+
+	return nil, nil
+}
+
+// checkNoSecrets ensures that the seed carries no secrets (passwords), e.g. since it was read from
+// where others can read it too.
+func checkNoSecrets(seed Seed) error {
+	secrets := []string{}
+	if len(seed.AdminPassword) > 0 {
+		secrets = append(secrets, "AdminPassword")
+	}
+	if seed.SMTP != nil && len(seed.SMTP.AuthPassword) > 0 {
+		secrets = append(secrets, "SMTP.AuthPassword")
+	}
+	if len(secrets) > 0 {
+		return fmt.Errorf("seed on kernel cmdline cannot carry secrets (%s), use a seed partition instead",
+			strings.Join(secrets, ", "))
+	}
+	return nil
+}
+
+func readFromPartition(partitionPath, filename string, log distillog.Logger) ([]byte, error) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "seedPartition")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, fstype := range SeedPartitionFsTypes {
+		log.Debugf("Mounting %s (%s) on %s", partitionPath, fstype, tempDir)
+		if err := syscall.Mount(partitionPath, tempDir, fstype, syscall.MS_RDONLY, ""); err != nil {
+			continue
+		}
+		defer syscall.Unmount(tempDir, 0)
+
+		return ioutil.ReadFile(path.Join(tempDir, filename))
+	}
+
+	return nil, fmt.Errorf("unable to mount %s", partitionPath)
+}
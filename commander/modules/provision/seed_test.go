@@ -0,0 +1,108 @@
+package provision
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+//
+// Test Suite
+//
+
+type ProvisionTestSuite struct{}
+
+// Register the test suite with gocheck.
+func init() {
+	Suite(&ProvisionTestSuite{})
+}
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+//
+// Vars
+//
+
+var (
+	testSeed = `{
+		"Hostname": "enterprise",
+		"Domain": "starfleet.org",
+		"Interfaces": [{"Name": "eth0", "Mode": "static", "Address": "10.0.0.5", "Netmask": "255.255.255.0", "Gateway": "10.0.0.1"}],
+		"Resolvers": ["10.0.0.2"],
+		"AdminPassword": "makeitso",
+		"SSHAuthorizedKeys": ["ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIB0b7I6jBGu3N9Xs6pGdZgD3D4e6zJfWnS1aNfqf4tVJ picard"],
+		"SMTP": {"From": "ship@starfleet.org", "ServerAddress": "10.0.0.25", "ServerPort": 25}
+	}`
+
+	// A seed that may be passed on the kernel cmdline (i.e. without secrets)
+	testCmdlineSeed = `{
+		"Domain": "starfleet.org",
+		"SMTP": {"From": "ship@starfleet.org", "ServerAddress": "10.0.0.25", "ServerPort": 25}
+	}`
+)
+
+//
+// Tests
+//
+
+func (ts *ProvisionTestSuite) TestParse(c *C) {
+	seed, err := Parse([]byte(testSeed))
+	c.Assert(err, IsNil)
+	c.Assert(seed.Hostname, Equals, "enterprise")
+	c.Assert(seed.Interfaces, HasLen, 1)
+	c.Assert(seed.Interfaces[0].Mode, Equals, "static")
+	c.Assert(seed.Resolvers, DeepEquals, []string{"10.0.0.2"})
+	c.Assert(seed.SMTP, NotNil)
+	c.Assert(seed.SMTP.ServerPort, Equals, uint16(25))
+
+	_, err = Parse([]byte("{not json"))
+	c.Assert(err, NotNil)
+}
+
+func (ts *ProvisionTestSuite) TestFindInCmdline(c *C) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(testCmdlineSeed))
+
+	seed, err := findInCmdline(writeTempFile("root=LABEL=BOOTBANK1 "+KernelCmdlineParam+"="+encoded+" quiet\n", c))
+	c.Assert(err, IsNil)
+	c.Assert(seed, NotNil)
+	c.Assert(seed.Domain, Equals, "starfleet.org")
+
+	// No seed param
+	seed, err = findInCmdline(writeTempFile("root=LABEL=BOOTBANK1 quiet\n", c))
+	c.Assert(err, IsNil)
+	c.Assert(seed, IsNil)
+
+	// Garbage in the seed param
+	seed, err = findInCmdline(writeTempFile(KernelCmdlineParam+"=!!!\n", c))
+	c.Assert(err, NotNil)
+
+	// Secrets are refused, everyone can read the cmdline
+	for _, secretSeed := range []string{
+		testSeed,
+		`{"SMTP": {"ServerAddress": "10.0.0.25", "AuthUsername": "ship", "AuthPassword": "engage"}}`,
+	} {
+		encoded = base64.StdEncoding.EncodeToString([]byte(secretSeed))
+		seed, err = findInCmdline(writeTempFile(KernelCmdlineParam+"="+encoded+"\n", c))
+		c.Assert(err, NotNil)
+		c.Assert(seed, IsNil)
+	}
+}
+
+//
+// Helpers
+//
+
+func writeTempFile(contents string, c *C) string {
+	f, err := ioutil.TempFile(c.MkDir(), "cmdline")
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	_, err = f.WriteString(contents)
+	c.Assert(err, IsNil)
+	return f.Name()
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/zenazn/goji/web"
 
 	"rocketship/commander/modules/host"
+	"rocketship/commander/modules/provision"
 	"rocketship/radio"
 )
 
@@ -71,6 +72,16 @@ func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Reques
 	return
 }
 
+// Lock holds off the requests to the controller until Unlock is called.
+func (c *Controller) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock undoes Lock.
+func (c *Controller) Unlock() {
+	c.lock.Unlock()
+}
+
 // RoutePrefix returns the prefix under which this router handles endpoints
 func (c *Controller) RoutePrefix() string {
 	return URLPrefix
@@ -324,6 +335,14 @@ func (c *Controller) RewriteFiles() error {
 	return nil
 }
 
+// WipeFiles deletes the radio config file (it contains credentials).
+func (c *Controller) WipeFiles() error {
+	if err := os.Remove(RadioConfFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (c *Controller) radioConfFileContents() ([]byte, error) {
 	radioCfg := RadioConfig{}
 	if err := c.db.First(&radioCfg).Error; err != nil {
@@ -456,6 +475,43 @@ func (e *ErrorRecipient) BeforeSave(txn *gorm.DB) error {
 // Resource is the exact same as what we store in the DB. No massaging needed here.
 type RadioConfigResource RadioConfig
 
+//
+// Provisioning
+//
+
+// ValidateSeed ensures that the SMTP settings (if any) in the provisioning seed can be applied.
+func (c *Controller) ValidateSeed(seed provision.Seed) error {
+	if seed.SMTP == nil {
+		return nil
+	}
+
+	if _, err := mail.ParseAddress(seed.SMTP.From); err != nil {
+		return fmt.Errorf("invalid SMTP from address in seed (%s)", err)
+	}
+	if len(seed.SMTP.ServerAddress) <= 0 || seed.SMTP.ServerPort == 0 {
+		return fmt.Errorf("SMTP server address and port must be specified in seed")
+	}
+	return nil
+}
+
+// Provision applies the SMTP settings (if any) from the provisioning seed.
+func (c *Controller) Provision(seed provision.Seed) error {
+	if err := c.ValidateSeed(seed); err != nil || seed.SMTP == nil {
+		return err
+	}
+
+	c.log.Infoln("Provisioning SMTP server:", seed.SMTP.ServerAddress)
+
+	// The config table holds a single (seeded) row, update it in place.
+	return c.db.Model(&RadioConfig{}).Updates(map[string]interface{}{
+		"server_address": seed.SMTP.ServerAddress,
+		"server_port":    seed.SMTP.ServerPort,
+		"auth_host":      seed.SMTP.AuthHost,
+		"auth_username":  seed.SMTP.AuthUsername,
+		"auth_password":  seed.SMTP.AuthPassword,
+	}).Error
+}
+
 //
 // Seeds
 //
@@ -472,6 +528,18 @@ func (c *Controller) MigrateDB() {
 	}
 }
 
+func (c *Controller) DropDB() {
+	c.log.Infoln("Dropping radio configuration tables")
+	for _, table := range []interface{}{
+		&RadioConfig{},
+		&InfoRecipient{},
+		&WarnRecipient{},
+		&ErrorRecipient{},
+	} {
+		c.db.DropTable(table)
+	}
+}
+
 func (c *Controller) SeedDB() {
 	c.log.Infoln("Seeding radio configuration")
 	// always create one row in the radio config table (singleton row)
@@ -10,6 +10,8 @@ import (
 	"net/mail"
 	"testing"
 
+	"rocketship/commander/modules/provision"
+
 	"github.com/amoghe/distillog"
 
 	"github.com/jinzhu/gorm"
@@ -226,6 +228,39 @@ func (ts *RadioTestSuite) TestConfigFileContents(c *C) {
 	// TODO parse string and test for presence of known substrings?
 }
 
+func (ts *RadioTestSuite) TestProvision(c *C) {
+	for _, seed := range []provision.Seed{
+		{SMTP: &provision.SMTPSeed{From: "not an address", ServerAddress: "smtp.example.com", ServerPort: 25}},
+		{SMTP: &provision.SMTPSeed{From: "ops@example.com", ServerPort: 25}},
+	} {
+		c.Assert(ts.controller.ValidateSeed(seed), NotNil)
+		c.Assert(ts.controller.Provision(seed), NotNil)
+	}
+
+	seed := provision.Seed{SMTP: &provision.SMTPSeed{
+		From:          "ops@example.com",
+		ServerAddress: "smtp.example.com",
+		ServerPort:    587,
+		AuthUsername:  "ops",
+	}}
+	c.Assert(ts.controller.ValidateSeed(seed), IsNil)
+	c.Assert(ts.controller.Provision(seed), IsNil)
+
+	// The (singleton) row is updated in place
+	count := 0
+	c.Assert(ts.db.Model(&RadioConfig{}).Count(&count).Error, IsNil)
+	c.Assert(count, Equals, 1)
+	var rowid int
+	c.Assert(ts.db.Raw("SELECT rowid FROM radio_configs").Row().Scan(&rowid), IsNil)
+	c.Assert(rowid, Equals, 1)
+
+	rcfg := RadioConfig{}
+	c.Assert(ts.db.First(&rcfg).Error, IsNil)
+	c.Assert(rcfg.ServerAddress, Equals, "smtp.example.com")
+	c.Assert(rcfg.ServerPort, Equals, uint16(587))
+	c.Assert(rcfg.AuthUsername, Equals, "ops")
+}
+
 //
 // Helpers
 //
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
 	"text/template"
 	"time"
@@ -26,6 +27,7 @@ const (
 
 	SshConfigFileName         = "ssh_config"
 	SshKeyRegenMarkerFileName = ".commander_regenerated_keys"
+	SshHostKeyFilesPattern    = "ssh_host_*_key*"
 
 	// Path to files of interest in the ssh dir
 	SshConfigFilePath         = SshConfigDirPath + "/" + SshConfigFileName
@@ -65,6 +67,16 @@ func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Reques
 	c.lock.Unlock()
 }
 
+// Lock holds off the requests to the controller until Unlock is called.
+func (c *Controller) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock undoes Lock.
+func (c *Controller) Unlock() {
+	c.lock.Unlock()
+}
+
 // RoutePrefix returns the prefix under which this router handles endpoints
 func (c *Controller) RoutePrefix() string {
 	return URLPrefix
@@ -196,6 +208,24 @@ func (c *Controller) RewriteFiles() error {
 	return nil
 }
 
+// WipeFiles deletes the host SSH keys (and the marker indicating they were regenerated) so that
+// a fresh set of keys is generated the next time the files are rewritten.
+func (c *Controller) WipeFiles() error {
+	c.log.Infoln("Wiping host SSH keys")
+
+	keyFiles, err := filepath.Glob(SshConfigDirPath + "/" + SshHostKeyFilesPattern)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range append(keyFiles, SshKeyRegenMarkerFilePath) {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Controller) sshConfigFileContents() ([]byte, error) {
 	type templateData struct {
 		GenTime           string
@@ -255,6 +285,11 @@ func (c *Controller) SeedDB() {
 	c.db.FirstOrCreate(&SshConfig{ID: 1, AllowPasswordAuth: true})
 }
 
+func (c *Controller) DropDB() {
+	c.log.Infoln("Dropping SSH tables")
+	c.db.DropTable(&SshConfig{})
+}
+
 //
 // Resources
 //
@@ -52,6 +52,16 @@ func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Reques
 	return
 }
 
+// Lock holds off the requests to the controller until Unlock is called.
+func (c *Controller) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock undoes Lock.
+func (c *Controller) Unlock() {
+	c.lock.Unlock()
+}
+
 // RoutePrefix returns the URL prefix under which this controller serves its routes
 func (c *Controller) RoutePrefix() string {
 	return URLPrefix
@@ -115,6 +125,16 @@ func (c *Controller) MigrateDB() {
 	return
 }
 
+func (c *Controller) DropDB() {
+	return
+}
+
+// WipeFiles deletes all the collected statistics.
+func (c *Controller) WipeFiles() error {
+	c.log.Infoln("Wiping prometheus data dir")
+	return os.RemoveAll(PrometheusDataDir)
+}
+
 //
 // Handlers
 //
@@ -94,3 +94,7 @@ func (c *Controller) syslogConfFileContents() ([]byte, error) {
 
 func (c *Controller) MigrateDB() {}
 func (c *Controller) SeedDB()    {}
+func (c *Controller) DropDB()    {}
+
+// WipeFiles is a no-op, logs are not considered user data.
+func (c *Controller) WipeFiles() error { return nil }
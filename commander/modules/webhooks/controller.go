@@ -0,0 +1,441 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/amoghe/distillog"
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	URLPrefix = "/webhooks"
+
+	EHooks           = URLPrefix + "/hooks"
+	EHooksID         = EHooks + "/:id"
+	EHookDeliveries  = EHooksID + "/deliveries"
+	EHookTestTrigger = EHooksID + "/test"
+
+	// Max number of delivery log entries retained per webhook
+	MaxDeliveryLogLen = 100
+)
+
+type Controller struct {
+	db   *gorm.DB
+	mux  *web.Mux
+	log  distillog.Logger
+	lock sync.Mutex
+	sub  *events.Subscription // events that the dispatcher delivers to the webhooks
+}
+
+func NewController(db *gorm.DB, logger distillog.Logger) *Controller {
+	ctrl := &Controller{db: db, mux: web.New(), log: logger}
+
+	ctrl.mux.Get(EHooks, ctrl.GetWebhooks)
+	ctrl.mux.Post(EHooks, ctrl.CreateWebhook)
+	ctrl.mux.Get(EHooksID, ctrl.GetWebhook)
+	ctrl.mux.Put(EHooksID, ctrl.UpdateWebhook)
+	ctrl.mux.Delete(EHooksID, ctrl.DeleteWebhook)
+	ctrl.mux.Get(EHookDeliveries, ctrl.GetDeliveries)
+	ctrl.mux.Post(EHookTestTrigger, ctrl.TestWebhook)
+
+	ctrl.sub = events.Subscribe()
+	go ctrl.dispatchEvents(ctrl.sub)
+
+	return ctrl
+}
+
+// Stop stops the dispatch of events to the webhooks (deliveries in flight are not interrupted).
+// The controller must not be used after it is stopped.
+func (c *Controller) Stop() {
+	events.Unsubscribe(c.sub)
+}
+
+// ServeHTTP satisfies the http.Handler interface (net/http as well as goji)
+func (c *Controller) ServeHTTPC(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	c.mux.ServeHTTPC(ctx, w, r)
+	c.lock.Unlock()
+	return
+}
+
+// Lock holds off the requests to the controller until Unlock is called.
+func (c *Controller) Lock() {
+	c.lock.Lock()
+}
+
+// Unlock undoes Lock.
+func (c *Controller) Unlock() {
+	c.lock.Unlock()
+}
+
+// RoutePrefix returns the URL prefix under which this controller serves its routes
+func (c *Controller) RoutePrefix() string {
+	return URLPrefix
+}
+
+// Webhooks have no config files.
+func (c *Controller) RewriteFiles() error { return nil }
+func (c *Controller) WipeFiles() error    { return nil }
+
+//
+// HTTP Handlers
+//
+
+func (c *Controller) GetWebhooks(_ web.C, w http.ResponseWriter, r *http.Request) {
+	hooks := []Webhook{}
+	if err := c.db.Find(&hooks).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resources := make([]WebhookResource, len(hooks))
+	for i := 0; i < len(hooks); i++ {
+		if err := resources[i].FromWebhookModel(hooks[i]); err != nil {
+			c.jsonError(err, w)
+			return
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(resources); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) GetWebhook(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	hook, err := c.webhookFromPath(ctx)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.writeWebhookResource(hook, w)
+}
+
+func (c *Controller) CreateWebhook(_ web.C, w http.ResponseWriter, r *http.Request) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := WebhookResource{}
+	if err = json.Unmarshal(reqBody, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	hook, err := resource.ToWebhookModel()
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	hook.ID = 0
+
+	if err = c.db.Create(&hook).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.writeWebhookResource(hook, w)
+}
+
+func (c *Controller) UpdateWebhook(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	existing, err := c.webhookFromPath(ctx)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	resource := WebhookResource{}
+	if err = json.Unmarshal(reqBody, &resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	hook, err := resource.ToWebhookModel()
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	hook.ID = existing.ID
+	if len(hook.Secret) <= 0 {
+		hook.Secret = existing.Secret // secret is only updated when specified
+	}
+
+	if err = c.db.Save(&hook).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	c.writeWebhookResource(hook, w)
+}
+
+func (c *Controller) DeleteWebhook(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	hook, err := c.webhookFromPath(ctx)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err = c.db.Delete(&hook).Error; err != nil {
+		c.jsonError(err, w)
+		return
+	}
+	if err = c.db.Where(WebhookDelivery{WebhookID: hook.ID}).Delete(WebhookDelivery{}).Error; err != nil {
+		c.log.Warningln("Failed to delete delivery log for webhook", hook.ID, ":", err)
+	}
+
+	c.writeWebhookResource(hook, w)
+}
+
+func (c *Controller) GetDeliveries(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	hook, err := c.webhookFromPath(ctx)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	deliveries := []WebhookDelivery{}
+	err = c.db.Where(WebhookDelivery{WebhookID: hook.ID}).Order("id desc").Find(&deliveries).Error
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+// TestWebhook delivers a test event to the webhook (once, without retries) and responds with the
+// result of the delivery attempt.
+func (c *Controller) TestWebhook(ctx web.C, w http.ResponseWriter, r *http.Request) {
+	hook, err := c.webhookFromPath(ctx)
+	if err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	evt := events.Event{
+		Type: TestEventType,
+		Time: time.Now().UTC(),
+		Data: map[string]string{"Message": "This is a test event"},
+	}
+
+	delivery := c.attemptDelivery(hook, evt, 1)
+
+	if err := json.NewEncoder(w).Encode(delivery); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+//
+// Helpers
+//
+
+func (c *Controller) webhookFromPath(ctx web.C) (Webhook, error) {
+	hook := Webhook{}
+
+	idStr, there := ctx.URLParams["id"]
+	if !there {
+		return hook, fmt.Errorf("missing id")
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return hook, fmt.Errorf("invalid id specified")
+	}
+
+	if err := c.db.First(&hook, id).Error; err != nil {
+		return hook, err
+	}
+
+	return hook, nil
+}
+
+func (c *Controller) writeWebhookResource(hook Webhook, w http.ResponseWriter) {
+	resource := WebhookResource{}
+	if err := resource.FromWebhookModel(hook); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		c.jsonError(err, w)
+		return
+	}
+}
+
+func (c *Controller) jsonError(err error, w http.ResponseWriter) {
+	// TODO: switch on err type
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err.Error())))
+}
+
+//
+// DB Models
+//
+
+type Webhook struct {
+	ID         int64
+	URL        string
+	Secret     string // Key used to sign (HMAC) the payloads we deliver
+	EventTypes string // Serialized json []string. Empty list means all events.
+	Enabled    bool
+}
+
+func (h *Webhook) BeforeSave(txn *gorm.DB) error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid URL: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("URL scheme must be http or https")
+	}
+	if len(u.Host) <= 0 {
+		return fmt.Errorf("URL must specify a host")
+	}
+	if len(h.Secret) < MinSecretLen {
+		return fmt.Errorf("Secret must be at least %d chars", MinSecretLen)
+	}
+
+	// A misspelt type would silently never match any event
+	types := []string{}
+	if len(h.EventTypes) > 0 {
+		if err := json.Unmarshal([]byte(h.EventTypes), &types); err != nil {
+			return fmt.Errorf("Invalid event types: %s", err)
+		}
+	}
+	for _, t := range types {
+		if !events.IsKnownType(t) {
+			return fmt.Errorf("Unknown event type (%s)", t)
+		}
+	}
+	return nil
+}
+
+// WantsEvent returns whether the webhook should be notified of the specified type of event.
+func (h Webhook) WantsEvent(eventType string) bool {
+	if !h.Enabled {
+		return false
+	}
+
+	types := []string{}
+	if len(h.EventTypes) > 0 {
+		if err := json.Unmarshal([]byte(h.EventTypes), &types); err != nil {
+			return false
+		}
+	}
+	if len(types) <= 0 {
+		return true
+	}
+
+	for _, t := range types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery records a single attempt at delivering an event to a webhook.
+type WebhookDelivery struct {
+	ID         int64
+	WebhookID  int64
+	EventID    uint64
+	EventType  string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Success    bool
+	CreatedAt  time.Time
+}
+
+//
+// Resources
+//
+
+type WebhookResource struct {
+	ID         int64
+	URL        string
+	Secret     string // WRITE ONLY
+	EventTypes []string
+	Enabled    bool
+}
+
+func (r WebhookResource) ToWebhookModel() (Webhook, error) {
+	types := r.EventTypes
+	if types == nil {
+		types = []string{}
+	}
+
+	serializedTypes, err := json.Marshal(types)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return Webhook{
+		ID:         r.ID,
+		URL:        r.URL,
+		Secret:     r.Secret,
+		EventTypes: string(serializedTypes),
+		Enabled:    r.Enabled,
+	}, nil
+}
+
+func (r *WebhookResource) FromWebhookModel(m Webhook) error {
+	types := []string{}
+	if len(m.EventTypes) > 0 {
+		if err := json.Unmarshal([]byte(m.EventTypes), &types); err != nil {
+			return err
+		}
+	}
+
+	r.ID = m.ID
+	r.URL = m.URL
+	r.EventTypes = types
+	r.Enabled = m.Enabled
+
+	// NEVER return the secret
+	// r.Secret = m.Secret
+
+	return nil
+}
+
+//
+// DB
+//
+
+func (c *Controller) MigrateDB() {
+	c.log.Infoln("Migrating webhooks tables")
+	c.db.AutoMigrate(&Webhook{})
+	c.db.AutoMigrate(&WebhookDelivery{})
+}
+
+func (c *Controller) DropDB() {
+	c.log.Infoln("Dropping webhooks tables")
+	c.db.DropTable(&Webhook{})
+	c.db.DropTable(&WebhookDelivery{})
+}
+
+func (c *Controller) SeedDB() {}
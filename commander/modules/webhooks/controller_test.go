@@ -0,0 +1,281 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rocketship/commander/modules/events"
+
+	"github.com/amoghe/distillog"
+	"github.com/jinzhu/gorm"
+	"github.com/zenazn/goji/web"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testSecret = "0123456789abcdef"
+)
+
+type WebhooksTestSuite struct {
+	db         gorm.DB
+	controller *Controller
+}
+
+// Register the test suite with gocheck.
+func init() {
+	Suite(&WebhooksTestSuite{})
+}
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+func (ts *WebhooksTestSuite) SetUpTest(c *C) {
+	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
+	c.Assert(err, IsNil)
+
+	// Comment this for db logs during tests
+	db.SetLogger(log.New(ioutil.Discard, "", 0))
+
+	ts.db = db
+	ts.controller = NewController(&ts.db, distillog.NewNullLogger(""))
+	ts.controller.MigrateDB()
+	ts.controller.SeedDB()
+
+	RetryBackoff = time.Millisecond
+}
+
+func (ts *WebhooksTestSuite) TearDownTest(c *C) {
+	ts.controller.Stop()
+	ts.db.Close()
+}
+
+//
+// Tests
+//
+
+func (ts *WebhooksTestSuite) TestCreateAndGetWebhooks(c *C) {
+	created := ts.createWebhook(c, "http://example.com/hook", []string{events.UserCreated})
+	c.Assert(created.ID, Not(Equals), int64(0))
+	c.Assert(created.Secret, Equals, "") // never returned
+	c.Assert(created.EventTypes, DeepEquals, []string{events.UserCreated})
+
+	req, err := http.NewRequest("GET", "/dont/care", &bytes.Buffer{})
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ts.controller.GetWebhooks(web.C{}, rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	hooks := []WebhookResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &hooks), IsNil)
+	c.Assert(hooks, HasLen, 1)
+	c.Assert(hooks[0], DeepEquals, created)
+}
+
+func (ts *WebhooksTestSuite) TestUpdateWebhookRetainsSecret(c *C) {
+	created := ts.createWebhook(c, "http://example.com/hook", nil)
+
+	body := `{"URL": "https://example.com/other", "Enabled": false}`
+	req, err := http.NewRequest("PUT", "/dont/care", bytes.NewBufferString(body))
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ts.controller.UpdateWebhook(ts.ctxForID(created.ID), rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	hook := Webhook{}
+	c.Assert(ts.db.First(&hook, created.ID).Error, IsNil)
+	c.Assert(hook.URL, Equals, "https://example.com/other")
+	c.Assert(hook.Enabled, Equals, false)
+	c.Assert(hook.Secret, Equals, testSecret)
+}
+
+func (ts *WebhooksTestSuite) TestWebhookValidation(c *C) {
+	for _, hook := range []Webhook{
+		{URL: "ftp://example.com", Secret: testSecret},     // bad scheme
+		{URL: "http://", Secret: testSecret},               // no host
+		{URL: "http://example.com", Secret: "short"},       // short secret
+		{URL: "://example.com", Secret: testSecret},        // unparseable
+		{URL: "example.com/no/scheme", Secret: testSecret}, // no scheme
+	} {
+		c.Assert(ts.db.Create(&hook).Error, Not(IsNil))
+	}
+
+	// Misspelt event types are caught
+	hook := Webhook{URL: "http://example.com", Secret: testSecret, EventTypes: `["host.user.craeted"]`}
+	c.Assert(ts.db.Create(&hook).Error, Not(IsNil))
+}
+
+func (ts *WebhooksTestSuite) TestWantsEvent(c *C) {
+	all := Webhook{Enabled: true, EventTypes: "[]"}
+	some := Webhook{Enabled: true, EventTypes: `["host.user.created"]`}
+	disabled := Webhook{Enabled: false, EventTypes: "[]"}
+
+	c.Assert(all.WantsEvent(events.RebootRequested), Equals, true)
+	c.Assert(some.WantsEvent(events.UserCreated), Equals, true)
+	c.Assert(some.WantsEvent(events.RebootRequested), Equals, false)
+	c.Assert(disabled.WantsEvent(events.RebootRequested), Equals, false)
+}
+
+func (ts *WebhooksTestSuite) TestTestWebhookSignsPayload(c *C) {
+	var (
+		reqHeaders http.Header
+		reqBody    []byte
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqHeaders = r.Header
+		reqBody, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	created := ts.createWebhook(c, server.URL, nil)
+
+	req, err := http.NewRequest("POST", "/dont/care", &bytes.Buffer{})
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ts.controller.TestWebhook(ts.ctxForID(created.ID), rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	delivery := WebhookDelivery{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &delivery), IsNil)
+	c.Assert(delivery.Success, Equals, true)
+	c.Assert(delivery.StatusCode, Equals, http.StatusOK)
+
+	c.Assert(reqHeaders.Get(EventHeader), Equals, TestEventType)
+	c.Assert(reqHeaders.Get(SignatureHeader), Equals, Sign(testSecret, reqBody))
+
+	evt := events.Event{}
+	c.Assert(json.Unmarshal(reqBody, &evt), IsNil)
+	c.Assert(evt.Type, Equals, TestEventType)
+
+	c.Assert(ts.getDeliveries(c, created.ID), HasLen, 1)
+}
+
+func (ts *WebhooksTestSuite) TestDeliveryRetries(c *C) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	created := ts.createWebhook(c, server.URL, nil)
+	hook := Webhook{}
+	c.Assert(ts.db.First(&hook, created.ID).Error, IsNil)
+
+	ts.controller.deliver(hook, events.Event{ID: 42, Type: events.RebootRequested})
+	c.Assert(attempts, Equals, 3)
+
+	deliveries := ts.getDeliveries(c, created.ID)
+	c.Assert(deliveries, HasLen, 3)
+	c.Assert(deliveries[0].Success, Equals, true) // latest first
+	c.Assert(deliveries[0].Attempt, Equals, 3)
+	c.Assert(deliveries[1].Success, Equals, false)
+	c.Assert(deliveries[1].StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (ts *WebhooksTestSuite) TestDeliveryGivesUp(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	created := ts.createWebhook(c, server.URL, nil)
+	hook := Webhook{}
+	c.Assert(ts.db.First(&hook, created.ID).Error, IsNil)
+
+	ts.controller.deliver(hook, events.Event{ID: 42, Type: events.RebootRequested})
+	c.Assert(ts.getDeliveries(c, created.ID), HasLen, MaxDeliveryAttempts)
+}
+
+func (ts *WebhooksTestSuite) TestDispatchEvents(c *C) {
+	received := make(chan string, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(EventHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ts.createWebhook(c, server.URL, []string{events.UserCreated})
+
+	// Only this controller delivers (those of the earlier tests were stopped), and only the events
+	// that the webhook wants.
+	events.Publish(events.UserDeleted, map[string]string{"Name": "foo"})
+	events.Publish(events.UserCreated, map[string]string{"Name": "foo"})
+	select {
+	case evtType := <-received:
+		c.Assert(evtType, Equals, events.UserCreated)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Event was not delivered")
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(received, HasLen, 0)
+
+	// Nothing is delivered once stopped
+	ts.controller.Stop()
+	events.Publish(events.UserCreated, map[string]string{"Name": "bar"})
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(received, HasLen, 0)
+}
+
+//
+// Helpers
+//
+
+func (ts *WebhooksTestSuite) ctxForID(id int64) web.C {
+	return web.C{URLParams: map[string]string{"id": fmt.Sprint(id)}}
+}
+
+func (ts *WebhooksTestSuite) createWebhook(c *C, url string, types []string) WebhookResource {
+	body, err := json.Marshal(WebhookResource{
+		URL:        url,
+		Secret:     testSecret,
+		EventTypes: types,
+		Enabled:    true,
+	})
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("POST", "/dont/care", bytes.NewBuffer(body))
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ts.controller.CreateWebhook(web.C{}, rec, req)
+	if rec.Code != http.StatusOK {
+		c.Fatal("Failed to create webhook: ", rec.Body.String())
+	}
+
+	resource := WebhookResource{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resource), IsNil)
+	return resource
+}
+
+func (ts *WebhooksTestSuite) getDeliveries(c *C, id int64) []WebhookDelivery {
+	req, err := http.NewRequest("GET", "/dont/care", &bytes.Buffer{})
+	c.Assert(err, IsNil)
+
+	rec := httptest.NewRecorder()
+	ts.controller.GetDeliveries(ts.ctxForID(id), rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	deliveries := []WebhookDelivery{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &deliveries), IsNil)
+	return deliveries
+}
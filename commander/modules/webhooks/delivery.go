@@ -0,0 +1,153 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"rocketship/commander/modules/events"
+)
+
+const (
+	// Type of the event sent when a webhook is test-fired
+	TestEventType = "webhooks.test"
+
+	// Minimum length of the secret used to sign payloads
+	MinSecretLen = 16
+
+	// Headers set on every delivery
+	SignatureHeader = "X-Rocketship-Signature" // "sha256=" + hex(HMAC-SHA256(secret, body))
+	EventHeader     = "X-Rocketship-Event"
+	DeliveryHeader  = "X-Rocketship-Delivery"
+
+	// Number of times we try to deliver an event before giving up
+	MaxDeliveryAttempts = 5
+)
+
+var (
+	// Wait before the first retry. Doubled for every subsequent retry.
+	RetryBackoff = 2 * time.Second
+
+	// Client used to deliver payloads
+	deliveryClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Sign returns the signature of the payload, as sent in the SignatureHeader.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// dispatchEvents delivers every event received on the subscription to the webhooks interested in it.
+func (c *Controller) dispatchEvents(sub *events.Subscription) {
+	for evt := range sub.Events {
+		hooks := []Webhook{}
+		if err := c.db.Where("enabled = ?", true).Find(&hooks).Error; err != nil {
+			c.log.Warningln("Failed to fetch webhooks from db:", err)
+			continue
+		}
+
+		for _, hook := range hooks {
+			if hook.WantsEvent(evt.Type) {
+				go c.deliver(hook, evt)
+			}
+		}
+	}
+}
+
+// deliver delivers the event to the webhook, retrying (with exponential backoff) on failure.
+func (c *Controller) deliver(hook Webhook, evt events.Event) {
+	backoff := RetryBackoff
+	for attempt := 1; attempt <= MaxDeliveryAttempts; attempt++ {
+		if c.attemptDelivery(hook, evt, attempt).Success {
+			return
+		}
+		if attempt < MaxDeliveryAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	c.log.Warningf("Giving up delivering event %d to webhook %d after %d attempts",
+		evt.ID, hook.ID, MaxDeliveryAttempts)
+}
+
+// attemptDelivery makes a single attempt to deliver the event to the webhook, records the
+// attempt in the delivery log and returns it.
+func (c *Controller) attemptDelivery(hook Webhook, evt events.Event, attempt int) WebhookDelivery {
+	delivery := WebhookDelivery{
+		WebhookID: hook.ID,
+		EventID:   evt.ID,
+		EventType: evt.Type,
+		Attempt:   attempt,
+	}
+
+	post := func() error {
+		payload, err := json.Marshal(evt)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest("POST", hook.URL, bytes.NewBuffer(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(SignatureHeader, Sign(hook.Secret, payload))
+		req.Header.Set(EventHeader, evt.Type)
+		req.Header.Set(DeliveryHeader, fmt.Sprintf("%d-%d", evt.ID, attempt))
+
+		resp, err := deliveryClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		delivery.StatusCode = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("Unexpected response status: %s", resp.Status)
+		}
+		return nil
+	}
+
+	if err := post(); err != nil {
+		c.log.Infof("Failed to deliver event %d to webhook %d (attempt %d): %s",
+			evt.ID, hook.ID, attempt, err)
+		delivery.Error = err.Error()
+	} else {
+		delivery.Success = true
+	}
+
+	if err := c.db.Create(&delivery).Error; err != nil {
+		c.log.Warningln("Failed to record webhook delivery:", err)
+	}
+	c.trimDeliveryLog(hook.ID)
+
+	return delivery
+}
+
+// trimDeliveryLog drops all but the latest MaxDeliveryLogLen entries of the webhook delivery log.
+func (c *Controller) trimDeliveryLog(hookID int64) {
+	deliveries := []WebhookDelivery{}
+	err := c.db.
+		Where(WebhookDelivery{WebhookID: hookID}).
+		Order("id desc").
+		Offset(MaxDeliveryLogLen).
+		Limit(1).
+		Find(&deliveries).Error
+	if err != nil || len(deliveries) <= 0 {
+		return
+	}
+
+	err = c.db.
+		Where("webhook_id = ? AND id <= ?", hookID, deliveries[0].ID).
+		Delete(WebhookDelivery{}).Error
+	if err != nil {
+		c.log.Warningln("Failed to trim webhook delivery log:", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 
+	"rocketship/commander/modules/events/eventtypes"
 	"rocketship/radio"
 
 	"github.com/amoghe/distillog"
@@ -36,9 +37,10 @@ var (
 
 // Config holds the configuration for the crashcorder
 type Config struct {
-	CorePatternTokens []string
-	CoresDirectory    string
-	RadioConnectAddr  net.TCPAddr
+	CorePatternTokens    []string
+	CoresDirectory       string
+	RadioConnectAddr     net.TCPAddr
+	CommanderConnectAddr net.TCPAddr // Zero value disables publishing crash events to commander
 }
 
 // Crashcorder holds all the state for an instance of the crash detector.
@@ -171,6 +173,11 @@ func (c *Crashcorder) handleCoreFile(name string) error {
 		return err
 	}
 
+	err = c.sendCommanderEvent(coreinfo)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -213,7 +220,42 @@ func (c *Crashcorder) sendRadioMessage(subj string, body string) error {
 	if err != nil {
 		return err
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Commander refused crash event (status %d)", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *Crashcorder) sendCommanderEvent(coreinfo map[string]string) error {
+	if c.Config.CommanderConnectAddr.Port == 0 {
+		return nil
+	}
+
+	evt := eventtypes.EventResource{
+		Type: eventtypes.CrashDetected,
+		Data: coreinfo,
+	}
+
+	evtjson, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(
+		"http://"+c.Config.CommanderConnectAddr.String()+eventtypes.PublishPath,
+		"application/json",
+		bytes.NewBuffer(evtjson))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Commander refused crash event (status %d)", resp.StatusCode)
+	}
 
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"rocketship/commander/modules/events/eventtypes"
 	"rocketship/radio"
 
 	"github.com/amoghe/distillog"
@@ -44,7 +45,7 @@ func (s *TestSuite) TestHandleCoreFile(c *C) {
 	testAddr := testServer.Listener.Addr()
 	radioAddr, err := net.ResolveTCPAddr(testAddr.Network(), testAddr.String())
 
-	cc := New(Config{[]string{"%e", "%p", "%s", "%t"}, "/tmp", *radioAddr}, distillog.NewNullLogger(""))
+	cc := New(Config{[]string{"%e", "%p", "%s", "%t"}, "/tmp", *radioAddr, net.TCPAddr{}}, distillog.NewNullLogger(""))
 	err = cc.handleCoreFile("foo_bar_baz_quz")
 	c.Assert(err, IsNil)
 
@@ -54,3 +55,59 @@ func (s *TestSuite) TestHandleCoreFile(c *C) {
 
 	c.Assert(rmsg.Subject, Equals, NotificationSubject)
 }
+
+func (s *TestSuite) TestHandleCoreFilePublishesEvent(c *C) {
+	var (
+		paths   = []string{}
+		reqBody []byte
+		err     error
+	)
+
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == eventtypes.PublishPath {
+			reqBody, err = ioutil.ReadAll(r.Body)
+			c.Assert(err, IsNil)
+		}
+		w.WriteHeader(200)
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer testServer.Close()
+
+	testAddr := testServer.Listener.Addr()
+	serverAddr, err := net.ResolveTCPAddr(testAddr.Network(), testAddr.String())
+
+	cc := New(Config{[]string{"%e", "%p", "%s", "%t"}, "/tmp", *serverAddr, *serverAddr}, distillog.NewNullLogger(""))
+	err = cc.handleCoreFile("foo_bar_baz_quz")
+	c.Assert(err, IsNil)
+
+	c.Assert(paths, DeepEquals, []string{radio.EmailEndpoint, eventtypes.PublishPath})
+
+	var evt eventtypes.EventResource
+	err = json.Unmarshal(reqBody, &evt)
+	c.Assert(err, IsNil)
+
+	c.Assert(evt.Type, Equals, eventtypes.CrashDetected)
+	c.Assert(evt.Data["Executable"], Equals, "foo")
+}
+
+func (s *TestSuite) TestHandleCoreFileEventRefused(c *C) {
+	testHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == eventtypes.PublishPath {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(200)
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer testServer.Close()
+
+	testAddr := testServer.Listener.Addr()
+	serverAddr, err := net.ResolveTCPAddr(testAddr.Network(), testAddr.String())
+	c.Assert(err, IsNil)
+
+	cc := New(Config{[]string{"%e", "%p", "%s", "%t"}, "/tmp", *serverAddr, *serverAddr}, distillog.NewNullLogger(""))
+	c.Assert(cc.handleCoreFile("foo_bar_baz_quz"), NotNil)
+}